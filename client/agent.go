@@ -0,0 +1,207 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// commentTimeFormat is the layout produced by time.Time.String(), which is
+// used when formatting the expiry in a key comment.
+const commentTimeFormat = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+var commentRE = regexp.MustCompile(`^\[id=(.*) expiry=(.*) issuer=(.*?)(?: profile=(.*))?\]$`)
+
+// parseComment parses a key comment created by InstallCert.
+// It returns false if the comment was not created by cashier.
+func parseComment(s string) (comment, bool) {
+	m := commentRE.FindStringSubmatch(s)
+	if m == nil {
+		return comment{}, false
+	}
+	expiry, err := time.Parse(commentTimeFormat, m[2])
+	if err != nil {
+		return comment{}, false
+	}
+	return comment{keyID: m[1], expiry: expiry, ca: m[3], profile: m[4]}, true
+}
+
+// keyIDOwner returns the username part of a key ID issued by cashier, which
+// is followed by the time of issue.
+func keyIDOwner(keyID string) string {
+	if i := strings.LastIndex(keyID, "_"); i >= 0 {
+		return keyID[:i]
+	}
+	return keyID
+}
+
+// AgentKey is a cashier-issued key held by an ssh agent.
+type AgentKey struct {
+	KeyID      string
+	Principals []string
+	Expiry     time.Time
+	Issuer     string
+	// Profile is empty for keys installed without a profile.
+	Profile string
+	// Certificate is nil for the plain private key installed alongside the
+	// certificate.
+	Certificate *ssh.Certificate
+	key         *agent.Key
+}
+
+// belongsTo reports whether the key was installed for profile. Keys installed
+// without a profile belong to it if they were issued to the owner of keyID.
+func (k *AgentKey) belongsTo(profile, keyID string) bool {
+	if k.Profile != "" {
+		return k.Profile == profile
+	}
+	return keyIDOwner(k.KeyID) == keyIDOwner(keyID)
+}
+
+// Expired reports whether the key has passed its expiry time.
+func (k *AgentKey) Expired() bool {
+	return time.Now().After(k.Expiry)
+}
+
+// ListKeys returns the keys in the agent that were installed by cashier.
+// If issuer is not empty only keys from that issuer are returned.
+func ListKeys(a agent.Agent, issuer string) ([]*AgentKey, error) {
+	keys, err := a.List()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list keys in ssh agent: %w", err)
+	}
+	var found []*AgentKey
+	for _, k := range keys {
+		c, ok := parseComment(k.Comment)
+		if !ok || (issuer != "" && c.ca != issuer) {
+			continue
+		}
+		ak := &AgentKey{
+			KeyID:   c.keyID,
+			Expiry:  c.expiry,
+			Issuer:  c.ca,
+			Profile: c.profile,
+			key:     k,
+		}
+		if pub, err := ssh.ParsePublicKey(k.Blob); err == nil {
+			if cert, ok := pub.(*ssh.Certificate); ok {
+				ak.Certificate = cert
+				ak.Principals = cert.ValidPrincipals
+			}
+		}
+		found = append(found, ak)
+	}
+	return found, nil
+}
+
+// RemoveKeys removes the keys installed by cashier from the agent.
+// If issuer is not empty only keys from that issuer are removed.
+// The number of keys removed is returned.
+func RemoveKeys(a agent.Agent, issuer string) (int, error) {
+	keys, err := ListKeys(a, issuer)
+	if err != nil {
+		return 0, err
+	}
+	for i, k := range keys {
+		if err := a.Remove(k.key); err != nil {
+			return i, fmt.Errorf("unable to remove key %s from ssh agent: %w", k.KeyID, err)
+		}
+	}
+	return len(keys), nil
+}
+
+// removeProfileKeys removes the keys from issuer that belong to profile,
+// except those of the certificate just installed.
+func removeProfileKeys(a agent.Agent, issuer, profile string, installed *ssh.Certificate) error {
+	keys, err := ListKeys(a, issuer)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if !k.belongsTo(profile, installed.KeyId) {
+			continue
+		}
+		if bytes.Equal(k.key.Blob, installed.Marshal()) || bytes.Equal(k.key.Blob, installed.Key.Marshal()) {
+			continue
+		}
+		if err := a.Remove(k.key); err != nil {
+			return fmt.Errorf("unable to remove key %s from ssh agent: %w", k.KeyID, err)
+		}
+	}
+	return nil
+}
+
+// EphemeralAgent is an in-process ssh agent listening on a temporary unix
+// socket. Keys added to it are discarded when it is closed.
+type EphemeralAgent struct {
+	agent.Agent
+	dir      string
+	listener net.Listener
+	done     chan struct{}
+}
+
+// NewEphemeralAgent starts an in-memory agent on a new socket in a private
+// temporary directory.
+func NewEphemeralAgent() (*EphemeralAgent, error) {
+	dir, err := os.MkdirTemp("", "cashier-agent-")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create agent directory: %w", err)
+	}
+	if err := os.Chmod(dir, 0o700); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	l, err := net.Listen("unix", filepath.Join(dir, "agent.sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("unable to create agent socket: %w", err)
+	}
+	a := &EphemeralAgent{
+		Agent:    agent.NewKeyring(),
+		dir:      dir,
+		listener: l,
+		done:     make(chan struct{}),
+	}
+	go a.serve()
+	return a, nil
+}
+
+func (a *EphemeralAgent) serve() {
+	defer close(a.done)
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			agent.ServeAgent(a.Agent, conn)
+		}()
+	}
+}
+
+// SocketPath returns the path of the agent's socket, suitable for use as
+// SSH_AUTH_SOCK.
+func (a *EphemeralAgent) SocketPath() string {
+	return a.listener.Addr().String()
+}
+
+// Close removes all keys from the agent, stops listening and deletes the
+// socket.
+func (a *EphemeralAgent) Close() error {
+	err := a.Agent.RemoveAll()
+	a.listener.Close()
+	<-a.done
+	if rmErr := os.RemoveAll(a.dir); err == nil {
+		err = rmErr
+	}
+	return err
+}
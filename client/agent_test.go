@@ -0,0 +1,180 @@
+package client
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func signedCert(t *testing.T, keyID string, principals []string) (*ssh.Certificate, Key) {
+	t.Helper()
+	key, pub, err := GenerateKey(KeyType("ed25519"))
+	require.NoError(t, err)
+	c := &ssh.Certificate{
+		KeyId:           keyID,
+		Key:             pub,
+		CertType:        ssh.UserCert,
+		ValidPrincipals: principals,
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	require.NoError(t, c.SignCert(rand.Reader, signer))
+	return c, key
+}
+
+func TestParseComment(t *testing.T) {
+	exp := time.Unix(1500000000, 0)
+	for _, want := range []comment{
+		{"user_1500000000", exp, "https://sshca.example.com", ""},
+		{"user_1500000000", exp, "https://sshca.example.com", "work"},
+	} {
+		got, ok := parseComment(want.String())
+		require.True(t, ok)
+		assert.Equal(t, want.keyID, got.keyID)
+		assert.Equal(t, want.ca, got.ca)
+		assert.Equal(t, want.profile, got.profile)
+		assert.True(t, want.expiry.Equal(got.expiry))
+	}
+
+	_, ok := parseComment("user@host")
+	assert.False(t, ok)
+}
+
+func TestListKeys(t *testing.T) {
+	a := agent.NewKeyring()
+	key, _, err := GenerateKey(KeyType("ed25519"))
+	require.NoError(t, err)
+	require.NoError(t, a.Add(agent.AddedKey{PrivateKey: key, Comment: "user@host"}))
+
+	cert, priv := signedCert(t, "key_1", []string{"user", "deploy"})
+	require.NoError(t, InstallCert(a, cert, priv, "https://ca1.example.com"))
+	other, otherPriv := signedCert(t, "key_2", []string{"user"})
+	require.NoError(t, InstallCert(a, other, otherPriv, "https://ca2.example.com"))
+
+	keys, err := ListKeys(a, "")
+	require.NoError(t, err)
+	assert.Len(t, keys, 4)
+
+	keys, err = ListKeys(a, "https://ca1.example.com")
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	for _, k := range keys {
+		assert.Equal(t, "key_1", k.KeyID)
+		assert.False(t, k.Expired())
+		if k.Certificate != nil {
+			assert.Equal(t, []string{"user", "deploy"}, k.Principals)
+		}
+	}
+}
+
+func TestRemoveKeys(t *testing.T) {
+	a := agent.NewKeyring()
+	cert, priv := signedCert(t, "key_1", []string{"user"})
+	require.NoError(t, InstallCert(a, cert, priv, "https://ca1.example.com"))
+	other, otherPriv := signedCert(t, "key_2", []string{"user"})
+	require.NoError(t, InstallCert(a, other, otherPriv, "https://ca2.example.com"))
+
+	n, err := RemoveKeys(a, "https://ca1.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	keys, err := a.List()
+	require.NoError(t, err)
+	assert.Len(t, keys, 2)
+
+	n, err = RemoveKeys(a, "")
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	keys, err = a.List()
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestInstallCertReplaces(t *testing.T) {
+	a := agent.NewKeyring()
+	for _, id := range []string{"key_1", "key_2"} {
+		cert, priv := signedCert(t, id, []string{"user"})
+		require.NoError(t, InstallCert(a, cert, priv, "https://ca1.example.com"))
+	}
+	keys, err := ListKeys(a, "")
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	for _, k := range keys {
+		assert.Equal(t, "key_2", k.KeyID)
+	}
+}
+
+// failingAgent fails to add keys.
+type failingAgent struct {
+	agent.Agent
+}
+
+func (failingAgent) Add(agent.AddedKey) error {
+	return errors.New("refused")
+}
+
+func TestInstallCertFailureKeepsKeys(t *testing.T) {
+	a := agent.NewKeyring()
+	cert, priv := signedCert(t, "key_1", []string{"user"})
+	require.NoError(t, InstallCertWithConstraints(a, cert, priv, "https://ca1.example.com", "work", AgentConstraints{}))
+	cert, priv = signedCert(t, "key_2", []string{"user"})
+	require.Error(t, InstallCertWithConstraints(failingAgent{a}, cert, priv, "https://ca1.example.com", "work", AgentConstraints{}))
+
+	keys, err := ListKeys(a, "")
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	for _, k := range keys {
+		assert.Equal(t, "key_1", k.KeyID)
+	}
+}
+
+func TestInstallCertKeepsOtherProfiles(t *testing.T) {
+	a := agent.NewKeyring()
+	install := func(keyID, profile string) {
+		t.Helper()
+		cert, priv := signedCert(t, keyID, []string{"user"})
+		require.NoError(t, InstallCertWithConstraints(a, cert, priv, "https://ca1.example.com", profile, AgentConstraints{}))
+	}
+	install("alice_1", "")
+	install("deploy_1", "")
+	install("alice_2", "personal")
+	install("alice_3", "work")
+	install("alice_4", "personal")
+
+	keys, err := ListKeys(a, "")
+	require.NoError(t, err)
+	got := map[string]string{}
+	for _, k := range keys {
+		got[k.KeyID] = k.Profile
+	}
+	assert.Equal(t, map[string]string{"deploy_1": "", "alice_3": "work", "alice_4": "personal"}, got)
+}
+
+func TestEphemeralAgent(t *testing.T) {
+	a, err := NewEphemeralAgent()
+	require.NoError(t, err)
+	cert, priv := signedCert(t, "key_1", []string{"user"})
+	require.NoError(t, InstallCert(a, cert, priv, "https://ca1.example.com"))
+
+	conn, err := net.Dial("unix", a.SocketPath())
+	require.NoError(t, err)
+	keys, err := ListKeys(agent.NewClient(conn), "")
+	conn.Close()
+	require.NoError(t, err)
+	assert.Len(t, keys, 2)
+
+	require.NoError(t, a.Close())
+	_, err = os.Stat(a.SocketPath())
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	keys, err = ListKeys(a, "")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
@@ -1,9 +1,8 @@
 package client
 
 import (
-	"bufio"
 	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
@@ -23,7 +22,24 @@ import (
 	"github.com/cashier-go/cashier/lib"
 )
 
-var errNeedsReason = errors.New("reason required")
+// KeyFiles holds the paths of the files written for a certificate.
+type KeyFiles struct {
+	PrivateKey  string
+	PublicKey   string
+	Certificate string
+}
+
+// KeyFilePaths returns the paths of the files written for the named key.
+// The files follow the ssh-keygen naming convention so that ssh finds the
+// public key and certificate next to the private key.
+func KeyFilePaths(prefix, name string) KeyFiles {
+	base := path.Join(prefix, "id_"+name)
+	return KeyFiles{
+		PrivateKey:  base,
+		PublicKey:   base + ".pub",
+		Certificate: base + "-cert.pub",
+	}
+}
 
 // SavePublicFiles installs the public part of the cert and key.
 func SavePublicFiles(prefix string, cert *ssh.Certificate, pub ssh.PublicKey) error {
@@ -34,54 +50,84 @@ func SavePublicFiles(prefix string, cert *ssh.Certificate, pub ssh.PublicKey) er
 	pubTxt := ssh.MarshalAuthorizedKey(pub)
 	certPubTxt := []byte(cert.Type() + " " + base64.StdEncoding.EncodeToString(cert.Marshal()))
 
-	prefix = fmt.Sprintf("%s/id_%s", prefix, cert.KeyId)
-	pubkeyFile := fmt.Sprint(prefix, ".pub")
-	pubcertFile := fmt.Sprint(prefix, "-cert.pub")
-
+	files := KeyFilePaths(prefix, cert.KeyId)
 	errs = multierror.Append(errs,
-		os.WriteFile(pubkeyFile, pubTxt, 0o644),
-		os.WriteFile(pubcertFile, certPubTxt, 0o644))
+		os.WriteFile(files.PublicKey, pubTxt, 0o644),
+		os.WriteFile(files.Certificate, certPubTxt, 0o644))
 	return errs.ErrorOrNil()
 }
 
-// SavePrivateFiles installs the private part of the key.
+// SavePrivateFiles installs the private part of the key in the OpenSSH private
+// key format.
 func SavePrivateFiles(prefix string, cert *ssh.Certificate, key Key) error {
+	return SavePrivateFilesWithPassphrase(prefix, cert, key, nil)
+}
+
+// SavePrivateFilesWithPassphrase installs the private part of the key in the
+// OpenSSH private key format, encrypted with the given passphrase.
+func SavePrivateFilesWithPassphrase(prefix string, cert *ssh.Certificate, key Key, passphrase []byte) error {
 	if prefix == "" {
 		return nil
 	}
-	prefix = fmt.Sprintf("%s/id_%s", prefix, cert.KeyId)
-	pemBlock, err := pemBlockForKey(key)
+	pemBlock, err := marshalPrivateKey(key, cert.KeyId, passphrase)
 	if err != nil {
 		return err
 	}
-	err = os.WriteFile(prefix, pem.EncodeToMemory(pemBlock), 0o600)
-	return err
+	return os.WriteFile(KeyFilePaths(prefix, cert.KeyId).PrivateKey, pem.EncodeToMemory(pemBlock), 0o600)
 }
 
 type comment struct {
-	keyID  string
-	expiry time.Time
-	ca     string
+	keyID   string
+	expiry  time.Time
+	ca      string
+	profile string
 }
 
 func (c comment) String() string {
-	return fmt.Sprintf("[id=%s expiry=%s issuer=%s]", c.keyID, c.expiry, c.ca)
+	if c.profile == "" {
+		return fmt.Sprintf("[id=%s expiry=%s issuer=%s]", c.keyID, c.expiry, c.ca)
+	}
+	return fmt.Sprintf("[id=%s expiry=%s issuer=%s profile=%s]", c.keyID, c.expiry, c.ca, c.profile)
 }
 
 // InstallCert adds the private key and signed certificate to the ssh agent.
+// Keys previously installed from the same issuer for the same user are
+// replaced.
 func InstallCert(a agent.Agent, cert *ssh.Certificate, key Key, issuer string) error {
+	return InstallCertWithConstraints(a, cert, key, issuer, "", AgentConstraints{})
+}
+
+// InstallCertWithConstraints adds the private key and signed certificate to
+// the ssh agent for a profile, restricting their use with the given
+// constraints. Keys previously installed from the same issuer for the profile
+// are removed once the new ones have been added; other profiles' keys are
+// kept.
+// Destination constraints are only supported by agents created with
+// NewAgentClient.
+func InstallCertWithConstraints(a agent.Agent, cert *ssh.Certificate, key Key, issuer, profile string, constraints AgentConstraints) error {
+	var extensions []agent.ConstraintExtension
+	if len(constraints.Destinations) > 0 {
+		if _, ok := a.(*agentClient); !ok {
+			return errConstraintsUnsupported
+		}
+		extensions = append(extensions, destinationExtension(constraints.Destinations))
+	}
 	t := time.Unix(int64(cert.ValidBefore), 0)
 	lifetime := time.Until(t).Seconds()
 	keycomment := comment{
 		cert.KeyId,
 		t,
 		issuer,
+		profile,
 	}
 	pubcert := agent.AddedKey{
 		PrivateKey:   key,
 		Certificate:  cert,
 		Comment:      keycomment.String(),
 		LifetimeSecs: uint32(lifetime),
+
+		ConfirmBeforeUse:     constraints.ConfirmBeforeUse,
+		ConstraintExtensions: extensions,
 	}
 	if err := a.Add(pubcert); err != nil {
 		return fmt.Errorf("unable to add cert to ssh agent: %w", err)
@@ -90,96 +136,220 @@ func InstallCert(a agent.Agent, cert *ssh.Certificate, key Key, issuer string) e
 		PrivateKey:   key,
 		Comment:      keycomment.String(),
 		LifetimeSecs: uint32(lifetime),
+
+		ConfirmBeforeUse:     constraints.ConfirmBeforeUse,
+		ConstraintExtensions: extensions,
 	}
 	if err := a.Add(privkey); err != nil {
+		a.Remove(cert)
 		return fmt.Errorf("unable to add private key to ssh agent: %w", err)
 	}
-	return nil
+	return removeProfileKeys(a, issuer, profile, cert)
+}
+
+// Errors wrapped by a SignError, one for each lib.ErrorCode.
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrNeedsReason  = errors.New("reason required")
+	ErrKeyRejected  = errors.New("key rejected")
+	ErrPolicyDenied = errors.New("policy denied")
+	ErrRateLimited  = errors.New("rate limited")
+	ErrServer       = errors.New("server error")
+)
+
+var errorCodes = map[lib.ErrorCode]error{
+	lib.ErrorUnauthorized: ErrUnauthorized,
+	lib.ErrorNeedsReason:  ErrNeedsReason,
+	lib.ErrorKeyRejected:  ErrKeyRejected,
+	lib.ErrorPolicyDenied: ErrPolicyDenied,
+	lib.ErrorRateLimited:  ErrRateLimited,
+	lib.ErrorInternal:     ErrServer,
+}
+
+// errorHints explain what the user can do about an error.
+var errorHints = map[error]string{
+	ErrUnauthorized: "the CA did not accept the access token, please log in again",
+	ErrNeedsReason:  "the CA requires a reason for this request",
+	ErrKeyRejected:  "the CA rejected the key or request",
+	ErrPolicyDenied: "the request is not permitted by the CA",
+	ErrRateLimited:  "too many requests, please try again later",
+	ErrServer:       "the CA failed to sign the key",
+}
+
+// SignError describes a signing request rejected by the CA.
+// It wraps the error for its Code, e.g. ErrNeedsReason.
+type SignError struct {
+	StatusCode int
+	Code       lib.ErrorCode
+	Message    string
+	Err        error
+}
+
+// newSignError creates an error from the response. Servers which predate
+// error codes are identified by the status code.
+func newSignError(resp *http.Response, sr *lib.SignResponse) *SignError {
+	e := &SignError{StatusCode: resp.StatusCode, Code: sr.Error, Message: sr.Response}
+	if err, ok := errorCodes[sr.Error]; ok {
+		e.Err = err
+		return e
+	}
+	switch {
+	case resp.StatusCode == http.StatusForbidden && strings.HasPrefix(resp.Header.Get("X-Need-Reason"), "required"):
+		e.Err = ErrNeedsReason
+	case resp.StatusCode == http.StatusUnauthorized:
+		e.Err = ErrUnauthorized
+	case resp.StatusCode == http.StatusTooManyRequests:
+		e.Err = ErrRateLimited
+	default:
+		e.Err = ErrServer
+	}
+	if e.Message == "" {
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+	return e
+}
+
+func (e *SignError) Error() string {
+	hint := errorHints[e.Err]
+	if hint == "" {
+		hint = e.Err.Error()
+	}
+	if e.Message == "" {
+		return fmt.Sprintf("%s (%d)", hint, e.StatusCode)
+	}
+	return fmt.Sprintf("%s (%d): %s", hint, e.StatusCode, e.Message)
+}
+
+func (e *SignError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports whether the request may succeed if retried.
+func (e *SignError) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
 }
 
 // send the signing request to the CA.
-func send(sr *lib.SignRequest, token, ca string, ValidateTLSCertificate bool) (*lib.SignResponse, error) {
+func send(ctx context.Context, sr *lib.SignRequest, token string, conf *Config) (*lib.SignResponse, error) {
 	s, err := json.Marshal(sr)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create sign request: %w", err)
 	}
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: !ValidateTLSCertificate},
-		},
-		Timeout: 30 * time.Second,
+	client, err := newHTTPClient(conf)
+	if err != nil {
+		return nil, err
 	}
-	u, err := url.Parse(ca)
+	u, err := url.Parse(conf.CA)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse CA url: %w", err)
 	}
 	u.Path = path.Join(u.Path, "/sign")
-	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(s))
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(s))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Add("Accept", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	if token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 	signResponse := &lib.SignResponse{}
-	if resp.StatusCode == http.StatusForbidden && strings.HasPrefix(resp.Header.Get("X-Need-Reason"), "required") {
-		return nil, errNeedsReason
-	}
-	if err := json.NewDecoder(resp.Body).Decode(signResponse); err != nil {
-		return nil, fmt.Errorf("unable to decode server response: %w", err)
+	decodeErr := json.NewDecoder(resp.Body).Decode(signResponse)
+	switch {
+	case decodeErr != nil && resp.StatusCode == http.StatusOK:
+		return nil, fmt.Errorf("unable to decode server response: %w", decodeErr)
+	case resp.StatusCode != http.StatusOK || signResponse.Status != "ok":
+		return nil, newSignError(resp, signResponse)
 	}
 	return signResponse, nil
 }
 
-func promptForReason() (message string) {
-	fmt.Print("Enter message: ")
-	scanner := bufio.NewScanner(os.Stdin)
-	if scanner.Scan() {
-		message = scanner.Text()
-	}
-	return message
-}
-
 // Sign sends the public key to the CA to be signed.
 func Sign(pub ssh.PublicKey, token string, conf *Config) (*ssh.Certificate, error) {
-	var err error
-	var resp *lib.SignResponse
+	return SignContext(context.Background(), pub, token, conf, "")
+}
+
+// SignContext sends the public key to the CA to be signed, along with the
+// reason for the request. Errors returned by the CA are a *SignError.
+func SignContext(ctx context.Context, pub ssh.PublicKey, token string, conf *Config, reason string) (*ssh.Certificate, error) {
+	cert, _, err := signCert(ctx, pub, token, conf, reason, nil)
+	return cert, err
+}
+
+// signCert signs the public key, returning the certificate and the
+// description of it sent by the CA.
+func signCert(ctx context.Context, pub ssh.PublicKey, token string, conf *Config, reason string, proof *keyProof) (*ssh.Certificate, *lib.CertificateInfo, error) {
 	validity, err := time.ParseDuration(conf.Validity)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	s := &lib.SignRequest{
 		Key:        string(lib.GetPublicKey(pub)),
 		ValidUntil: time.Now().Add(validity),
+		Message:    reason,
 		Version:    lib.Version,
+
+		Principals:    conf.Principals,
+		Extensions:    conf.Extensions,
+		SourceAddress: conf.SourceAddress,
 	}
-	for {
-		resp, err = send(s, token, conf.CA, conf.ValidateTLSCertificate)
-		if err == nil {
-			break
+	if conf.AttestationFile != "" {
+		if s.Attestation, err = os.ReadFile(conf.AttestationFile); err != nil {
+			return nil, nil, fmt.Errorf("unable to read attestation: %w", err)
+		}
+		if s.AttestationChallenge, err = os.ReadFile(conf.AttestationChallengeFile); err != nil {
+			return nil, nil, fmt.Errorf("unable to read attestation challenge: %w", err)
 		}
-		if err != nil && errors.Is(err, errNeedsReason) {
-			s.Message = promptForReason()
-			continue
-		} else if err != nil {
-			return nil, fmt.Errorf("error sending request to CA: %w", err)
+	}
+	if proof != nil {
+		if err := proof.prove(ctx, conf, token, s); err != nil {
+			return nil, nil, err
 		}
 	}
-	if resp.Status != "ok" {
-		return nil, fmt.Errorf("bad response from CA: %s", resp.Response)
+	resp, err := send(ctx, s, token, conf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error sending request to CA: %w", err)
 	}
 	k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(resp.Response))
 	if err != nil {
-		return nil, fmt.Errorf("unable to parse response: %w", err)
+		return nil, nil, fmt.Errorf("unable to parse response: %w", err)
 	}
 	cert, ok := k.(*ssh.Certificate)
 	if !ok {
-		return nil, fmt.Errorf("did not receive a valid certificate from server")
+		return nil, nil, fmt.Errorf("did not receive a valid certificate from server")
+	}
+	info := resp.Certificate
+	if info == nil {
+		// Older servers don't describe the certificate.
+		info = lib.NewCertificateInfo(cert)
+		info.Reason = reason
+	}
+	if info.KRLURL != "" {
+		if u, err := resolveURL(conf.CA, info.KRLURL); err == nil {
+			info.KRLURL = u
+		}
+	}
+	return cert, info, nil
+}
+
+// resolveURL resolves a URL relative to the CA's address.
+func resolveURL(ca, ref string) (string, error) {
+	base, err := url.Parse(strings.TrimSuffix(ca, "/") + "/")
+	if err != nil {
+		return "", err
+	}
+	r, err := url.Parse(strings.TrimPrefix(ref, "/"))
+	if err != nil {
+		return "", err
 	}
-	return cert, nil
+	return base.ResolveReference(r).String(), nil
 }
@@ -2,9 +2,12 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -48,6 +51,27 @@ func (s *ClientSuite) TestSavePrivateFiles_InvalidKey() {
 	s.Error(SavePrivateFiles("test", &ssh.Certificate{KeyId: "key"}, nil))
 }
 
+func (s *ClientSuite) TestSavePrivateFiles_Encrypted() {
+	dir := s.T().TempDir()
+	key, pub, err := GenerateKey(KeyType("ed25519"))
+	s.Require().NoError(err)
+	cert := &ssh.Certificate{KeyId: "key"}
+	s.Require().NoError(SavePrivateFilesWithPassphrase(dir, cert, key, []byte("passphrase")))
+	b, err := os.ReadFile(KeyFilePaths(dir, "key").PrivateKey)
+	s.Require().NoError(err)
+	signer, err := ssh.ParsePrivateKeyWithPassphrase(b, []byte("passphrase"))
+	s.Require().NoError(err)
+	s.Equal(pub.Marshal(), signer.PublicKey().Marshal())
+}
+
+func (s *ClientSuite) TestKeyFilePaths() {
+	s.Equal(KeyFiles{
+		PrivateKey:  "/home/user/.ssh/id_key",
+		PublicKey:   "/home/user/.ssh/id_key.pub",
+		Certificate: "/home/user/.ssh/id_key-cert.pub",
+	}, KeyFilePaths("/home/user/.ssh", "key"))
+}
+
 func TestLoadCert(t *testing.T) {
 	priv, _ := ssh.ParseRawPrivateKey(testdata.Priv)
 	key := priv.(*rsa.PrivateKey)
@@ -80,7 +104,7 @@ func TestLoadCert(t *testing.T) {
 	}
 	for _, k := range listedKeys {
 		exp := time.Unix(int64(c.ValidBefore), 0)
-		want := comment{c.KeyId, exp, "sshca.example.com"}
+		want := comment{c.KeyId, exp, "sshca.example.com", ""}
 		if k.Comment != want.String() {
 			t.Errorf("key comment:\nwanted:%s\ngot: %s", want, k.Comment)
 		}
@@ -97,7 +121,7 @@ func TestSignGood(t *testing.T) {
 		fmt.Fprintln(w, string(j))
 	}))
 	defer ts.Close()
-	_, err := send(&lib.SignRequest{}, "token", ts.URL, true)
+	_, err := send(context.Background(), &lib.SignRequest{}, "token", &Config{CA: ts.URL, ValidateTLSCertificate: true})
 	if err != nil {
 		t.Error(err)
 	}
@@ -125,9 +149,9 @@ func TestSignBad(t *testing.T) {
 		fmt.Fprintln(w, string(j))
 	}))
 	defer ts.Close()
-	_, err := send(&lib.SignRequest{}, "token", ts.URL, true)
-	if err != nil {
-		t.Error(err)
+	_, err := send(context.Background(), &lib.SignRequest{}, "token", &Config{CA: ts.URL, ValidateTLSCertificate: true})
+	if !errors.Is(err, ErrServer) {
+		t.Errorf("want ErrServer, got %v", err)
 	}
 	k, _, _, _, err := ssh.ParseAuthorizedKey(testdata.Pub)
 	if err != nil {
@@ -138,7 +162,108 @@ func TestSignBad(t *testing.T) {
 		Validity: "24h",
 	}
 	cert, err := Sign(k, "token", c)
-	if cert != nil && err == nil {
-		t.Error(err)
+	if cert != nil || err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestSignErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		header    string
+		code      lib.ErrorCode
+		want      error
+		temporary bool
+	}{
+		{"needs reason", http.StatusForbidden, "required", "", ErrNeedsReason, false},
+		{"unauthorized", http.StatusUnauthorized, "", "", ErrUnauthorized, false},
+		{"server error", http.StatusInternalServerError, "", "", ErrServer, false},
+		{"bad gateway", http.StatusBadGateway, "", "", ErrServer, true},
+		{"code needs reason", http.StatusForbidden, "", lib.ErrorNeedsReason, ErrNeedsReason, false},
+		{"code key rejected", http.StatusBadRequest, "", lib.ErrorKeyRejected, ErrKeyRejected, false},
+		{"code policy denied", http.StatusForbidden, "", lib.ErrorPolicyDenied, ErrPolicyDenied, false},
+		{"code rate limited", http.StatusTooManyRequests, "", lib.ErrorRateLimited, ErrRateLimited, false},
+		{"code internal", http.StatusInternalServerError, "", lib.ErrorInternal, ErrServer, false},
+	}
+	k, _, _, _, _ := ssh.ParseAuthorizedKey(testdata.Pub)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.header != "" {
+					w.Header().Set("X-Need-Reason", tt.header)
+				}
+				w.WriteHeader(tt.status)
+				json.NewEncoder(w).Encode(&lib.SignResponse{Status: "error", Response: "failed", Error: tt.code})
+			}))
+			defer ts.Close()
+			_, err := Sign(k, "token", &Config{CA: ts.URL, Validity: "24h"})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("want %v, got %v", tt.want, err)
+			}
+			var signErr *SignError
+			if !errors.As(err, &signErr) || signErr.StatusCode != tt.status {
+				t.Fatalf("want SignError with status %d, got %v", tt.status, err)
+			}
+			if signErr.Temporary() != tt.temporary {
+				t.Errorf("want temporary %t, got %t", tt.temporary, signErr.Temporary())
+			}
+		})
+	}
+}
+
+func TestResolveURL(t *testing.T) {
+	tests := []struct {
+		ca, ref, want string
+	}{
+		{"https://ca.example.com", "/revoked", "https://ca.example.com/revoked"},
+		{"https://ca.example.com/cashier/", "/revoked", "https://ca.example.com/cashier/revoked"},
+		{"https://ca.example.com", "https://krl.example.com/krl", "https://krl.example.com/krl"},
+	}
+	for _, tt := range tests {
+		got, err := resolveURL(tt.ca, tt.ref)
+		if err != nil || got != tt.want {
+			t.Errorf("resolveURL(%q, %q) = %q, %v, want %q", tt.ca, tt.ref, got, err, tt.want)
+		}
+	}
+}
+
+func TestRenew(t *testing.T) {
+	signer, _ := ssh.ParsePrivateKey(testdata.Priv)
+	c, _, _, _, _ := ssh.ParseAuthorizedKey(testdata.Cert)
+	cert := c.(*ssh.Certificate)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rr := &lib.RenewRequest{}
+		json.NewDecoder(r.Body).Decode(rr)
+		if rr.Cert != string(lib.GetPublicKey(cert)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/renew/challenge":
+			json.NewEncoder(w).Encode(&lib.ChallengeResponse{Challenge: "challenge", Namespace: lib.RenewNamespace})
+		case "/renew":
+			if err := lib.VerifySSHSig(signer.PublicKey(), lib.RenewNamespace, []byte(rr.Challenge), rr.Signature); err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(&lib.SignResponse{Status: "error", Error: lib.ErrorUnauthorized})
+				return
+			}
+			json.NewEncoder(w).Encode(&lib.SignResponse{Status: "ok", Response: string(testdata.Cert)})
+		}
+	}))
+	defer ts.Close()
+	conf := &Config{CA: ts.URL, Validity: "24h"}
+	renewed, err := Renew(context.Background(), cert, signer, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.KeyId != cert.KeyId {
+		t.Errorf("Unexpected certificate %s", renewed.KeyId)
+	}
+
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	other, _ := ssh.NewSignerFromKey(priv)
+	if _, err := Renew(context.Background(), cert, other, conf); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("want ErrUnauthorized, got %v", err)
 	}
 }
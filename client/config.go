@@ -1,50 +1,211 @@
 package client
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
 
+	"github.com/hashicorp/hcl"
 	"github.com/mitchellh/go-homedir"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
-// Config holds the client configuration.
+const (
+	// DefaultProfile is the name of the profile made up of the top-level
+	// settings in the configuration file.
+	DefaultProfile = "default"
+	// AllProfiles selects every profile in the configuration file.
+	AllProfiles = "all"
+)
+
+// Config holds the client configuration for a single CA profile.
 type Config struct {
+	Profile                string `mapstructure:"-"`
 	CA                     string `mapstructure:"ca"`
 	Keytype                string `mapstructure:"key_type"`
 	Keysize                int    `mapstructure:"key_size"`
 	Validity               string `mapstructure:"validity"`
 	ValidateTLSCertificate bool   `mapstructure:"validate_tls_certificate"`
 	PublicFilePrefix       string `mapstructure:"key_file_prefix"`
+	EncryptPrivateKey      bool   `mapstructure:"encrypt_private_key"`
+
+	// PublicKeyFile is an existing public key, such as a FIDO security key,
+	// to sign instead of generating a new key pair.
+	PublicKeyFile string `mapstructure:"public_key"`
+	// AttestationFile and AttestationChallengeFile are the FIDO attestation
+	// for a security key public_key, written by `ssh-keygen -O
+	// write-attestation=<file> -O challenge=<file>`.
+	AttestationFile          string `mapstructure:"attestation_file"`
+	AttestationChallengeFile string `mapstructure:"attestation_challenge_file"`
+
+	// Principals, Extensions and SourceAddress request a certificate
+	// narrower than the CA would otherwise issue.
+	Principals    []string `mapstructure:"principals"`
+	Extensions    []string `mapstructure:"extensions"`
+	SourceAddress string   `mapstructure:"source_address"`
+
+	// SSHConfigFile is a managed ssh config file, suitable for use with
+	// `Include`, referencing the saved key files for each profile.
+	SSHConfigFile string   `mapstructure:"ssh_config_file"`
+	SSHHosts      []string `mapstructure:"ssh_hosts"`
+
+	// Constraints applied to keys added to the ssh agent.
+	AgentConfirm      bool     `mapstructure:"agent_confirm"`
+	AgentDestinations []string `mapstructure:"agent_destinations"`
+	KnownHostsFiles   []string `mapstructure:"known_hosts_files"`
+
+	// TLS settings for connections to the CA.
+	TLSCAFile      string   `mapstructure:"tls_ca_file"`
+	TLSClientCert  string   `mapstructure:"tls_client_cert"`
+	TLSClientKey   string   `mapstructure:"tls_client_key"`
+	TLSPinnedCerts []string `mapstructure:"tls_pinned_certs"`
+	Proxy          string   `mapstructure:"proxy"`
+
+	// IDTokenFile holds an OIDC ID token, such as one issued to a CI job,
+	// presented to the CA instead of logging in.
+	IDTokenFile string `mapstructure:"id_token_file"`
+	// APIKeyFile holds a service account's API key, presented to the CA
+	// instead of logging in.
+	APIKeyFile string `mapstructure:"api_key_file"`
 }
 
-func setDefaults() {
-	viper.BindPFlag("ca", pflag.Lookup("ca"))
-	viper.BindPFlag("key_type", pflag.Lookup("key_type"))
-	viper.BindPFlag("key_size", pflag.Lookup("key_size"))
-	viper.BindPFlag("validity", pflag.Lookup("validity"))
-	viper.BindPFlag("key_file_prefix", pflag.Lookup("key_file_prefix"))
-	viper.SetDefault("validateTLSCertificate", true)
+// configFile is the parsed contents of a configuration file.
+// Top-level settings are shared by every profile and may be overridden by a
+// `profile "name" { ... }` block.
+type configFile struct {
+	settings map[string]interface{}
+	profiles map[string]map[string]interface{}
+	names    []string
 }
 
-// ReadConfig reads the client configuration from a file into a Config struct.
-func ReadConfig(path string) (*Config, error) {
-	setDefaults()
-	if _, err := os.Stat(path); err == nil {
-		viper.SetConfigFile(path)
-		viper.SetConfigType("hcl")
-		if err := viper.ReadInConfig(); err != nil {
-			return nil, err
+func readConfigFile(path string) (*configFile, error) {
+	f := &configFile{
+		settings: make(map[string]interface{}),
+		profiles: make(map[string]map[string]interface{}),
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := hcl.Unmarshal(b, &f.settings); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+	blocks, _ := f.settings["profile"].([]map[string]interface{})
+	delete(f.settings, "profile")
+	for _, block := range blocks {
+		for name, v := range block {
+			items, _ := v.([]map[string]interface{})
+			p := make(map[string]interface{})
+			for _, item := range items {
+				for k, v := range item {
+					p[k] = v
+				}
+			}
+			if _, ok := f.profiles[name]; !ok {
+				f.names = append(f.names, name)
+			}
+			f.profiles[name] = p
 		}
 	}
+	return f, nil
+}
+
+func bindFlags(v *viper.Viper) {
+	v.BindPFlag("ca", pflag.Lookup("ca"))
+	v.BindPFlag("key_type", pflag.Lookup("key_type"))
+	v.BindPFlag("key_size", pflag.Lookup("key_size"))
+	v.BindPFlag("validity", pflag.Lookup("validity"))
+	v.BindPFlag("key_file_prefix", pflag.Lookup("key_file_prefix"))
+	v.BindPFlag("principals", pflag.Lookup("principal"))
+	v.BindPFlag("public_key", pflag.Lookup("public_key"))
+	v.SetDefault("validate_tls_certificate", true)
+}
+
+// profile builds the configuration for the named profile.
+// Command-line flags take precedence over the profile, which takes precedence
+// over the top-level settings.
+func (f *configFile) profile(name string) (*Config, error) {
+	p, ok := f.profiles[name]
+	if !ok && name != DefaultProfile {
+		return nil, fmt.Errorf("unknown profile %q", name)
+	}
+	v := viper.New()
+	bindFlags(v)
+	if err := v.MergeConfigMap(f.settings); err != nil {
+		return nil, err
+	}
+	if err := v.MergeConfigMap(p); err != nil {
+		return nil, err
+	}
 	c := &Config{}
-	if err := viper.Unmarshal(c); err != nil {
+	if err := v.Unmarshal(c); err != nil {
 		return nil, err
 	}
-	p, err := homedir.Expand(c.PublicFilePrefix)
+	c.Profile = name
+	for _, p := range []*string{&c.PublicFilePrefix, &c.PublicKeyFile, &c.AttestationFile, &c.AttestationChallengeFile, &c.SSHConfigFile, &c.TLSCAFile, &c.TLSClientCert, &c.TLSClientKey, &c.IDTokenFile, &c.APIKeyFile} {
+		expanded, err := homedir.Expand(*p)
+		if err != nil {
+			return nil, err
+		}
+		*p = expanded
+	}
+	return c, nil
+}
+
+// ReadConfig reads the default profile from a configuration file into a Config
+// struct.
+func ReadConfig(path string) (*Config, error) {
+	profiles, err := ReadProfiles(path, nil)
 	if err != nil {
 		return nil, err
 	}
-	c.PublicFilePrefix = p
-	return c, nil
+	return profiles[0], nil
+}
+
+// ReadProfiles reads the named profiles from a configuration file.
+// If no names are given, the profile named by the `default_profile` setting
+// is used, falling back to the top-level settings.
+// The name "all" selects every profile defined in the file.
+func ReadProfiles(path string, names []string) ([]*Config, error) {
+	f, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		name, _ := f.settings["default_profile"].(string)
+		if name == "" {
+			name = DefaultProfile
+		}
+		names = []string{name}
+	}
+	var selected []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		expanded := []string{name}
+		if name == AllProfiles && len(f.names) > 0 {
+			expanded = f.names
+		} else if name == AllProfiles {
+			expanded = []string{DefaultProfile}
+		}
+		for _, n := range expanded {
+			if !seen[n] {
+				seen[n] = true
+				selected = append(selected, n)
+			}
+		}
+	}
+	var configs []*Config
+	for _, name := range selected {
+		c, err := f.profile(name)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, c)
+	}
+	return configs, nil
 }
@@ -0,0 +1,108 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testConfig = `
+ca = "https://sshca.example.com"
+key_type = "ed25519"
+validity = "12h"
+default_profile = "prod"
+
+profile "prod" {
+  ca = "https://prod.example.com"
+}
+
+profile "staging" {
+  ca = "https://staging.example.com"
+  key_type = "ecdsa"
+  key_size = 384
+  validate_tls_certificate = false
+  key_file_prefix = "/tmp/staging"
+}
+`
+
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	f := filepath.Join(t.TempDir(), "cashier.conf")
+	require.NoError(t, os.WriteFile(f, []byte(contents), 0o600))
+	return f
+}
+
+func TestReadConfigDefaultProfile(t *testing.T) {
+	c, err := ReadConfig(writeConfig(t, testConfig))
+	require.NoError(t, err)
+	assert.Equal(t, &Config{
+		Profile:                "prod",
+		CA:                     "https://prod.example.com",
+		Keytype:                "ed25519",
+		Validity:               "12h",
+		ValidateTLSCertificate: true,
+	}, c)
+}
+
+func TestReadConfigNoProfiles(t *testing.T) {
+	c, err := ReadConfig(writeConfig(t, `ca = "https://sshca.example.com"`))
+	require.NoError(t, err)
+	assert.Equal(t, DefaultProfile, c.Profile)
+	assert.Equal(t, "https://sshca.example.com", c.CA)
+	assert.True(t, c.ValidateTLSCertificate)
+}
+
+func TestReadConfigRequest(t *testing.T) {
+	c, err := ReadConfig(writeConfig(t, `
+principals = ["deploy"]
+extensions = ["permit-pty"]
+source_address = "10.0.0.0/8"
+id_token_file = "/run/ci/id_token"
+api_key_file = "/etc/cashier/api_key"
+`))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"deploy"}, c.Principals)
+	assert.Equal(t, []string{"permit-pty"}, c.Extensions)
+	assert.Equal(t, "10.0.0.0/8", c.SourceAddress)
+	assert.Equal(t, "/run/ci/id_token", c.IDTokenFile)
+	assert.Equal(t, "/etc/cashier/api_key", c.APIKeyFile)
+}
+
+func TestReadConfigMissingFile(t *testing.T) {
+	c, err := ReadConfig(filepath.Join(t.TempDir(), "missing.conf"))
+	require.NoError(t, err)
+	assert.Equal(t, DefaultProfile, c.Profile)
+}
+
+func TestReadProfiles(t *testing.T) {
+	f := writeConfig(t, testConfig)
+
+	configs, err := ReadProfiles(f, []string{"staging"})
+	require.NoError(t, err)
+	require.Len(t, configs, 1)
+	assert.Equal(t, &Config{
+		Profile:                "staging",
+		CA:                     "https://staging.example.com",
+		Keytype:                "ecdsa",
+		Keysize:                384,
+		Validity:               "12h",
+		ValidateTLSCertificate: false,
+		PublicFilePrefix:       "/tmp/staging",
+	}, configs[0])
+
+	configs, err = ReadProfiles(f, []string{AllProfiles, "prod"})
+	require.NoError(t, err)
+	require.Len(t, configs, 2)
+	assert.Equal(t, "prod", configs[0].Profile)
+	assert.Equal(t, "staging", configs[1].Profile)
+
+	configs, err = ReadProfiles(f, []string{DefaultProfile})
+	require.NoError(t, err)
+	assert.Equal(t, "https://sshca.example.com", configs[0].CA)
+
+	_, err = ReadProfiles(f, []string{"missing"})
+	assert.ErrorContains(t, err, `unknown profile "missing"`)
+}
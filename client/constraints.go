@@ -0,0 +1,444 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// See [PROTOCOL.agent], section 3 and the OpenSSH restrict-destination
+// extension.
+const (
+	agentSuccess             = 6
+	agentAddIDConstrained    = 25
+	agentConstrainLifetime   = 1
+	agentConstrainConfirm    = 2
+	agentConstrainExtension  = 255
+	restrictDestinationExtID = "restrict-destination-v00@openssh.com"
+)
+
+// defaultKnownHostsFiles are used to look up host keys if no known hosts
+// files are configured.
+var defaultKnownHostsFiles = []string{"~/.ssh/known_hosts", "/etc/ssh/ssh_known_hosts"}
+
+var errConstraintsUnsupported = errors.New("ssh agent does not support destination constraints")
+
+// Hop is one end of a destination constraint.
+type Hop struct {
+	User     string
+	Host     string
+	HostKeys []ssh.PublicKey
+}
+
+// DestinationConstraint permits a key to be used to authenticate from one
+// host to another. An empty From host is the local host.
+type DestinationConstraint struct {
+	From Hop
+	To   Hop
+}
+
+// AgentConstraints are restrictions applied to keys added to the ssh agent.
+type AgentConstraints struct {
+	ConfirmBeforeUse bool
+	Destinations     []DestinationConstraint
+}
+
+func appendString(b, s []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func (h Hop) marshal() []byte {
+	var b []byte
+	b = appendString(b, []byte(h.User))
+	b = appendString(b, []byte(h.Host))
+	b = appendString(b, nil) // reserved
+	for _, k := range h.HostKeys {
+		b = appendString(b, k.Marshal())
+		b = append(b, 0) // is_ca
+	}
+	return b
+}
+
+// destinationExtension encodes the destination constraints as an agent constraint
+// extension.
+func destinationExtension(dcs []DestinationConstraint) agent.ConstraintExtension {
+	var details []byte
+	for _, dc := range dcs {
+		var b []byte
+		b = appendString(b, dc.From.marshal())
+		b = appendString(b, dc.To.marshal())
+		b = appendString(b, nil) // reserved
+		details = appendString(details, b)
+	}
+	return agent.ConstraintExtension{
+		ExtensionName:    restrictDestinationExtID,
+		ExtensionDetails: details,
+	}
+}
+
+// splitHostPort splits a destination host, "host", "host:port" or
+// "[host]:port", into its host and port. The port defaults to 22.
+func splitHostPort(dest string) (string, int, error) {
+	host, port, err := net.SplitHostPort(dest)
+	if err != nil {
+		// There's no port, or dest is a bare IPv6 address.
+		return strings.TrimSuffix(strings.TrimPrefix(dest, "["), "]"), 22, nil
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 || host == "" {
+		return "", 0, fmt.Errorf("invalid destination %q", dest)
+	}
+	return host, int(p), nil
+}
+
+// lookupHostKeys returns the keys for a host found in the known hosts files.
+// Hosts on a port other than 22 are looked up as "[host]:port".
+func lookupHostKeys(hostKeyCallback ssh.HostKeyCallback, host string, port int) ([]ssh.PublicKey, error) {
+	// Checking a key which can't be known yields the known keys for the host.
+	_, probe, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(probe)
+	if err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	err = hostKeyCallback(addr, &net.TCPAddr{IP: net.IPv4zero, Port: port}, signer.PublicKey())
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) || len(keyErr.Want) == 0 {
+		return nil, fmt.Errorf("no host keys found for %s in known hosts", knownhosts.Normalize(addr))
+	}
+	var keys []ssh.PublicKey
+	for _, k := range keyErr.Want {
+		keys = append(keys, k.Key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Type() < keys[j].Type() })
+	return keys, nil
+}
+
+func parseHop(hostKeyCallback ssh.HostKeyCallback, spec string) (Hop, error) {
+	h := Hop{Host: spec}
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		h.User, h.Host = spec[:i], spec[i+1:]
+	}
+	if h.Host == "" {
+		return Hop{}, fmt.Errorf("invalid destination %q", spec)
+	}
+	host, port, err := splitHostPort(h.Host)
+	if err != nil {
+		return Hop{}, err
+	}
+	h.Host = host
+	keys, err := lookupHostKeys(hostKeyCallback, host, port)
+	if err != nil {
+		return Hop{}, err
+	}
+	h.HostKeys = keys
+	return h, nil
+}
+
+// ParseDestinationConstraints parses destination constraints in the format
+// accepted by `ssh-add -h`: "[user@]host" permits use of the key from the
+// local host to host, "host1>[user@]host2" permits use of the key forwarded
+// to host1 to authenticate to host2. Hosts may be given as "host:port" or
+// "[host]:port". Host keys are read from the known hosts files; files which
+// don't exist are ignored.
+func ParseDestinationConstraints(specs []string, knownHostsFiles []string) ([]DestinationConstraint, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	if len(knownHostsFiles) == 0 {
+		knownHostsFiles = defaultKnownHostsFiles
+	}
+	var files []string
+	for _, f := range knownHostsFiles {
+		f, err := homedir.Expand(f)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(f); err == nil {
+			files = append(files, f)
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("destination constraints require a known hosts file")
+	}
+	hostKeyCallback, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read known hosts: %w", err)
+	}
+	var dcs []DestinationConstraint
+	for _, spec := range specs {
+		var dc DestinationConstraint
+		to := spec
+		if from, rest, ok := strings.Cut(spec, ">"); ok {
+			if strings.Contains(from, "@") {
+				return nil, fmt.Errorf("invalid destination %q: user not permitted in first hop", spec)
+			}
+			if dc.From, err = parseHop(hostKeyCallback, from); err != nil {
+				return nil, err
+			}
+			to = rest
+		}
+		if dc.To, err = parseHop(hostKeyCallback, to); err != nil {
+			return nil, err
+		}
+		dcs = append(dcs, dc)
+	}
+	return dcs, nil
+}
+
+// agentClient is an ssh agent client which, unlike the client returned by
+// agent.NewClient, sends constraint extensions when adding keys. Every request
+// holds mu, so that constrained adds, which are written to the connection
+// directly, don't interleave with other requests.
+type agentClient struct {
+	mu     sync.Mutex
+	client agent.ExtendedAgent
+	conn   io.ReadWriter
+}
+
+// NewAgentClient returns an ssh agent client for the connection.
+func NewAgentClient(conn io.ReadWriter) agent.ExtendedAgent {
+	return &agentClient{
+		client: agent.NewClient(conn),
+		conn:   conn,
+	}
+}
+
+// Add adds a key to the agent.
+func (c *agentClient) Add(key agent.AddedKey) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(key.ConstraintExtensions) == 0 {
+		return c.client.Add(key)
+	}
+	req, err := marshalAddKey(key)
+	if err != nil {
+		return err
+	}
+	if _, err := c.conn.Write(appendString(nil, req)); err != nil {
+		return err
+	}
+	var length [4]byte
+	if _, err := io.ReadFull(c.conn, length[:]); err != nil {
+		return err
+	}
+	resp := make([]byte, binary.BigEndian.Uint32(length[:]))
+	if _, err := io.ReadFull(c.conn, resp); err != nil {
+		return err
+	}
+	if len(resp) == 0 || resp[0] != agentSuccess {
+		return errors.New("agent: failure")
+	}
+	return nil
+}
+
+// List returns the identities known to the agent.
+func (c *agentClient) List() ([]*agent.Key, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client.List()
+}
+
+// Sign has the agent sign the data using a protocol 2 key.
+func (c *agentClient) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client.Sign(key, data)
+}
+
+// SignWithFlags signs like Sign, but allows for additional flags.
+func (c *agentClient) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client.SignWithFlags(key, data, flags)
+}
+
+// Remove removes all identities with the given public key.
+func (c *agentClient) Remove(key ssh.PublicKey) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client.Remove(key)
+}
+
+// RemoveAll removes all identities.
+func (c *agentClient) RemoveAll() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client.RemoveAll()
+}
+
+// Lock locks the agent.
+func (c *agentClient) Lock(passphrase []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client.Lock(passphrase)
+}
+
+// Unlock undoes the effect of Lock.
+func (c *agentClient) Unlock(passphrase []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client.Unlock(passphrase)
+}
+
+// Signers returns signers for all the known keys. The signers make their own
+// requests, which also hold mu.
+func (c *agentClient) Signers() ([]ssh.Signer, error) {
+	keys, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	signers := make([]ssh.Signer, len(keys))
+	for i, k := range keys {
+		signers[i] = &agentSigner{c: c, pub: k}
+	}
+	return signers, nil
+}
+
+// Extension processes a custom extension request.
+func (c *agentClient) Extension(extensionType string, contents []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client.Extension(extensionType, contents)
+}
+
+// agentSigner signs with a key held by the agent.
+type agentSigner struct {
+	c   *agentClient
+	pub ssh.PublicKey
+}
+
+func (s *agentSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.c.Sign(s.pub, data)
+}
+
+// SignWithAlgorithm supports the SHA-2 signature algorithms of RSA keys, as
+// the signers returned by agent.NewClient do.
+func (s *agentSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	var flags agent.SignatureFlags
+	switch algorithm {
+	case "", s.pub.Type():
+	case ssh.KeyAlgoRSASHA256, ssh.CertAlgoRSASHA256v01:
+		flags = agent.SignatureFlagRsaSha256
+	case ssh.KeyAlgoRSASHA512, ssh.CertAlgoRSASHA512v01:
+		flags = agent.SignatureFlagRsaSha512
+	default:
+		return nil, fmt.Errorf("agent: unsupported algorithm %q", algorithm)
+	}
+	return s.c.SignWithFlags(s.pub, data, flags)
+}
+
+func marshalConstraints(key agent.AddedKey) []byte {
+	var b []byte
+	if key.LifetimeSecs != 0 {
+		b = append(b, agentConstrainLifetime)
+		b = binary.BigEndian.AppendUint32(b, key.LifetimeSecs)
+	}
+	if key.ConfirmBeforeUse {
+		b = append(b, agentConstrainConfirm)
+	}
+	for _, ext := range key.ConstraintExtensions {
+		b = append(b, agentConstrainExtension)
+		b = appendString(b, []byte(ext.ExtensionName))
+		b = appendString(b, ext.ExtensionDetails)
+	}
+	return b
+}
+
+func appendMPInt(b []byte, n *big.Int) []byte {
+	return append(b, ssh.Marshal(struct{ N *big.Int }{n})...)
+}
+
+// marshalAddKey encodes an SSH_AGENTC_ADD_ID_CONSTRAINED request.
+func marshalAddKey(key agent.AddedKey) ([]byte, error) {
+	b := []byte{agentAddIDConstrained}
+	if key.Certificate != nil {
+		b = appendString(b, []byte(key.Certificate.Type()))
+		b = appendString(b, key.Certificate.Marshal())
+	}
+	switch k := key.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		if len(k.Primes) != 2 {
+			return nil, fmt.Errorf("agent: unsupported RSA key with %d primes", len(k.Primes))
+		}
+		k.Precompute()
+		if key.Certificate == nil {
+			b = appendString(b, []byte(ssh.KeyAlgoRSA))
+			b = appendMPInt(b, k.N)
+			b = appendMPInt(b, big.NewInt(int64(k.E)))
+		}
+		b = appendMPInt(b, k.D)
+		b = appendMPInt(b, k.Precomputed.Qinv)
+		b = appendMPInt(b, k.Primes[0])
+		b = appendMPInt(b, k.Primes[1])
+	case *ecdsa.PrivateKey:
+		if key.Certificate == nil {
+			pub, err := ssh.NewPublicKey(&k.PublicKey)
+			if err != nil {
+				return nil, err
+			}
+			ecdh, err := k.PublicKey.ECDH()
+			if err != nil {
+				return nil, err
+			}
+			b = appendString(b, []byte(pub.Type()))
+			b = appendString(b, []byte(strings.TrimPrefix(pub.Type(), "ecdsa-sha2-")))
+			b = appendString(b, ecdh.Bytes())
+		}
+		b = appendMPInt(b, k.D)
+	case *ed25519.PrivateKey:
+		if key.Certificate == nil {
+			b = appendString(b, []byte(ssh.KeyAlgoED25519))
+		}
+		b = appendString(b, k.Public().(ed25519.PublicKey))
+		b = appendString(b, *k)
+	case ed25519.PrivateKey:
+		if key.Certificate == nil {
+			b = appendString(b, []byte(ssh.KeyAlgoED25519))
+		}
+		b = appendString(b, k.Public().(ed25519.PublicKey))
+		b = appendString(b, k)
+	default:
+		return nil, fmt.Errorf("agent: unsupported key type %T", k)
+	}
+	b = appendString(b, []byte(key.Comment))
+	return append(b, marshalConstraints(key)...), nil
+}
+
+// AgentConstraints returns the constraints to apply to keys added to the
+// agent.
+func (c *Config) AgentConstraints() (AgentConstraints, error) {
+	dcs, err := ParseDestinationConstraints(c.AgentDestinations, c.KnownHostsFiles)
+	if err != nil {
+		return AgentConstraints{}, err
+	}
+	return AgentConstraints{
+		ConfirmBeforeUse: c.AgentConfirm,
+		Destinations:     dcs,
+	}, nil
+}
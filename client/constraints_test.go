@@ -0,0 +1,224 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// recordingAgent records the keys added to it.
+type recordingAgent struct {
+	agent.Agent
+	added []agent.AddedKey
+}
+
+func (r *recordingAgent) Add(key agent.AddedKey) error {
+	r.added = append(r.added, key)
+	return r.Agent.Add(key)
+}
+
+func readString(t *testing.T, b []byte) ([]byte, []byte) {
+	t.Helper()
+	require.GreaterOrEqual(t, len(b), 4)
+	n := binary.BigEndian.Uint32(b)
+	require.GreaterOrEqual(t, len(b), int(4+n))
+	return b[4 : 4+n], b[4+n:]
+}
+
+func writeKnownHosts(t *testing.T, hosts map[string]ssh.PublicKey) string {
+	t.Helper()
+	var b []byte
+	for host, key := range hosts {
+		b = append(b, host+" "+string(ssh.MarshalAuthorizedKey(key))...)
+	}
+	f := filepath.Join(t.TempDir(), "known_hosts")
+	require.NoError(t, os.WriteFile(f, b, 0o600))
+	return f
+}
+
+func TestParseDestinationConstraints(t *testing.T) {
+	_, bastionKey, err := GenerateKey(KeyType("ed25519"))
+	require.NoError(t, err)
+	_, internalKey, err := GenerateKey(KeyType("ecdsa"))
+	require.NoError(t, err)
+	knownHosts := writeKnownHosts(t, map[string]ssh.PublicKey{
+		"bastion.example.com":  bastionKey,
+		"internal.example.com": internalKey,
+	})
+
+	dcs, err := ParseDestinationConstraints([]string{
+		"bastion.example.com",
+		"bastion.example.com>deploy@internal.example.com",
+	}, []string{"/nonexistent", knownHosts})
+	require.NoError(t, err)
+	require.Len(t, dcs, 2)
+
+	assert.Equal(t, Hop{}, dcs[0].From)
+	assert.Equal(t, "bastion.example.com", dcs[0].To.Host)
+	require.Len(t, dcs[0].To.HostKeys, 1)
+	assert.Equal(t, bastionKey.Marshal(), dcs[0].To.HostKeys[0].Marshal())
+
+	assert.Equal(t, "bastion.example.com", dcs[1].From.Host)
+	assert.Equal(t, "deploy", dcs[1].To.User)
+	assert.Equal(t, "internal.example.com", dcs[1].To.Host)
+	require.Len(t, dcs[1].To.HostKeys, 1)
+	assert.Equal(t, internalKey.Marshal(), dcs[1].To.HostKeys[0].Marshal())
+
+	_, err = ParseDestinationConstraints([]string{"unknown.example.com"}, []string{knownHosts})
+	assert.ErrorContains(t, err, "no host keys found for unknown.example.com")
+	_, err = ParseDestinationConstraints([]string{"bastion.example.com:2222"}, []string{knownHosts})
+	assert.ErrorContains(t, err, "no host keys found for [bastion.example.com]:2222")
+	_, err = ParseDestinationConstraints([]string{"bastion.example.com:ssh"}, []string{knownHosts})
+	assert.ErrorContains(t, err, "invalid destination")
+	_, err = ParseDestinationConstraints([]string{"user@bastion.example.com>internal.example.com"}, []string{knownHosts})
+	assert.Error(t, err)
+	_, err = ParseDestinationConstraints([]string{"bastion.example.com"}, []string{"/nonexistent"})
+	assert.Error(t, err)
+}
+
+func TestParseDestinationConstraintsPort(t *testing.T) {
+	_, defaultKey, err := GenerateKey(KeyType("ed25519"))
+	require.NoError(t, err)
+	_, portKey, err := GenerateKey(KeyType("ed25519"))
+	require.NoError(t, err)
+	knownHosts := writeKnownHosts(t, map[string]ssh.PublicKey{
+		"git.example.com":        defaultKey,
+		"[git.example.com]:2222": portKey,
+		"[::1]:2222":             portKey,
+	})
+
+	for spec, want := range map[string]ssh.PublicKey{
+		"git.example.com":            defaultKey,
+		"git.example.com:22":         defaultKey,
+		"[git.example.com]":          defaultKey,
+		"git@git.example.com:2222":   portKey,
+		"git@[git.example.com]:2222": portKey,
+		"[::1]:2222":                 portKey,
+	} {
+		dcs, err := ParseDestinationConstraints([]string{spec}, []string{knownHosts})
+		require.NoError(t, err, spec)
+		require.Len(t, dcs[0].To.HostKeys, 1, spec)
+		assert.Equal(t, want.Marshal(), dcs[0].To.HostKeys[0].Marshal(), spec)
+		assert.NotContains(t, dcs[0].To.Host, ":2222", spec)
+	}
+}
+
+func TestDestinationExtension(t *testing.T) {
+	_, hostKey, err := GenerateKey(KeyType("ed25519"))
+	require.NoError(t, err)
+	ext := destinationExtension([]DestinationConstraint{
+		{To: Hop{User: "deploy", Host: "bastion", HostKeys: []ssh.PublicKey{hostKey}}},
+	})
+	assert.Equal(t, restrictDestinationExtID, ext.ExtensionName)
+
+	dc, rest := readString(t, ext.ExtensionDetails)
+	assert.Empty(t, rest)
+	from, dc := readString(t, dc)
+	to, dc := readString(t, dc)
+	reserved, dc := readString(t, dc)
+	assert.Empty(t, reserved)
+	assert.Empty(t, dc)
+
+	// The origin hop has an empty user, host and reserved field and no keys.
+	assert.Equal(t, make([]byte, 12), from)
+
+	user, to := readString(t, to)
+	host, to := readString(t, to)
+	reserved, to = readString(t, to)
+	key, to := readString(t, to)
+	assert.Equal(t, "deploy", string(user))
+	assert.Equal(t, "bastion", string(host))
+	assert.Empty(t, reserved)
+	assert.Equal(t, hostKey.Marshal(), key)
+	assert.Equal(t, []byte{0}, to)
+}
+
+func TestInstallCertWithConstraints(t *testing.T) {
+	dcs := []DestinationConstraint{{To: Hop{Host: "bastion"}}}
+	for _, keytype := range []string{"rsa", "ecdsa", "ed25519"} {
+		t.Run(keytype, func(t *testing.T) {
+			key, pub, err := GenerateKey(KeyType(keytype))
+			require.NoError(t, err)
+			cert, _ := signedCert(t, "key_1", []string{"user"})
+			cert.Key = pub
+			signer, err := ssh.NewSignerFromKey(key)
+			require.NoError(t, err)
+			require.NoError(t, cert.SignCert(rand.Reader, signer))
+
+			server := &recordingAgent{Agent: agent.NewKeyring()}
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			go agent.ServeAgent(server, c2)
+
+			a := NewAgentClient(c1)
+			constraints := AgentConstraints{ConfirmBeforeUse: true, Destinations: dcs}
+			require.NoError(t, InstallCertWithConstraints(a, cert, key, "https://ca.example.com", "default", constraints))
+
+			require.Len(t, server.added, 2)
+			for _, k := range server.added {
+				assert.True(t, k.ConfirmBeforeUse)
+				assert.NotZero(t, k.LifetimeSecs)
+				assert.Equal(t, []agent.ConstraintExtension{destinationExtension(dcs)}, k.ConstraintExtensions)
+			}
+			require.NotNil(t, server.added[0].Certificate)
+			assert.Equal(t, cert.Marshal(), server.added[0].Certificate.Marshal())
+			assert.Nil(t, server.added[1].Certificate)
+
+			keys, err := ListKeys(a, "https://ca.example.com")
+			require.NoError(t, err)
+			assert.Len(t, keys, 2)
+		})
+	}
+}
+
+func TestAgentClientConcurrent(t *testing.T) {
+	// Unlike net.Pipe, a socket lets requests be written before the previous
+	// response has been read.
+	server, err := NewEphemeralAgent()
+	require.NoError(t, err)
+	defer server.Close()
+	conn, err := net.Dial("unix", server.SocketPath())
+	require.NoError(t, err)
+	defer conn.Close()
+	a := NewAgentClient(conn)
+	_, hostKey, err := GenerateKey(KeyType("ed25519"))
+	require.NoError(t, err)
+	constraints := AgentConstraints{Destinations: []DestinationConstraint{{To: Hop{Host: "bastion", HostKeys: []ssh.PublicKey{hostKey}}}}}
+
+	// Constrained adds and other requests share the connection.
+	cert, key := signedCert(t, "key_1", []string{"user"})
+	errs := make(chan error, 2)
+	go func() {
+		var err error
+		for i := 0; i < 100 && err == nil; i++ {
+			err = InstallCertWithConstraints(a, cert, key, "https://ca.example.com", "", constraints)
+		}
+		errs <- err
+	}()
+	go func() {
+		var err error
+		for i := 0; i < 100 && err == nil; i++ {
+			_, err = a.List()
+		}
+		errs <- err
+	}()
+	for i := 0; i < 2; i++ {
+		require.NoError(t, <-errs)
+	}
+}
+
+func TestInstallCertWithConstraintsUnsupported(t *testing.T) {
+	cert, key := signedCert(t, "key_1", []string{"user"})
+	err := InstallCertWithConstraints(agent.NewKeyring(), cert, key, "https://ca.example.com", "default", AgentConstraints{
+		Destinations: []DestinationConstraint{{To: Hop{Host: "bastion"}}},
+	})
+	assert.ErrorIs(t, err, errConstraintsUnsupported)
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cashier-go/cashier/lib"
+)
+
+// ErrIncompatibleVersion is returned when the CA doesn't support this version
+// of the client.
+var ErrIncompatibleVersion = errors.New("incompatible client version")
+
+var errDiscoveryUnsupported = errors.New("CA does not publish a discovery document")
+
+// Discover fetches the CA's discovery document.
+func Discover(ctx context.Context, conf *Config) (*lib.Discovery, error) {
+	client, err := newHTTPClient(conf)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(conf.CA)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse CA url: %w", err)
+	}
+	u.Path = path.Join(u.Path, lib.DiscoveryPath)
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, errDiscoveryUnsupported
+	default:
+		return nil, fmt.Errorf("unable to fetch discovery document: %s", resp.Status)
+	}
+	d := &lib.Discovery{}
+	if err := json.NewDecoder(resp.Body).Decode(d); err != nil {
+		return nil, fmt.Errorf("unable to decode discovery document: %w", err)
+	}
+	return d, nil
+}
+
+// ApplyDiscovery checks that the client is compatible with the CA and picks
+// defaults for settings which weren't configured. It returns warnings for the
+// user.
+func (c *Config) ApplyDiscovery(d *lib.Discovery) ([]string, error) {
+	var warnings []string
+	if cmp, ok := lib.CompareVersions(lib.Version, d.MinClientVersion); ok && cmp < 0 {
+		return nil, fmt.Errorf("%w: client version %s is older than %s, the minimum supported by the CA. Please upgrade", ErrIncompatibleVersion, lib.Version, d.MinClientVersion)
+	}
+	if cmp, ok := lib.CompareVersions(lib.Version, d.Version); ok && cmp > 0 {
+		warnings = append(warnings, fmt.Sprintf("CA version %s is older than client version %s, newer options may be ignored", d.Version, lib.Version))
+	}
+
+	// Keys signed from a public_key file aren't generated, so the CA checks
+	// their type.
+	if len(d.KeyTypes) > 0 && c.PublicKeyFile == "" {
+		var generated []string
+		for _, t := range d.KeyTypes {
+			if slices.Contains(generatedKeyTypes, t) {
+				generated = append(generated, t)
+			}
+		}
+		switch {
+		case len(generated) == 0:
+			return nil, fmt.Errorf("the CA only signs %s keys, set public_key to an existing key", strings.Join(d.KeyTypes, ", "))
+		case c.Keytype == "" && !slices.Contains(generated, defaultOptions.keytype):
+			c.Keytype = generated[0]
+			c.Keysize = 0
+		case c.Keytype != "" && !slices.Contains(generated, c.Keytype):
+			return nil, fmt.Errorf("key type %s is not allowed by the CA, use one of: %s", c.Keytype, strings.Join(generated, ", "))
+		}
+	}
+
+	if maxValidity, err := time.ParseDuration(d.MaxValidity); err == nil {
+		if validity, err := time.ParseDuration(c.Validity); err != nil || validity > maxValidity {
+			c.Validity = maxValidity.String()
+		}
+	}
+	return warnings, nil
+}
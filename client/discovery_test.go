@@ -0,0 +1,82 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cashier-go/cashier/lib"
+)
+
+func TestDiscover(t *testing.T) {
+	want := &lib.Discovery{
+		Version:       "v1.2.0",
+		AuthFlows:     []string{lib.AuthFlowBrowser},
+		KeyTypes:      []string{"ed25519"},
+		MaxValidity:   "4h0m0s",
+		RequireReason: true,
+		RevocationURL: "/revoked",
+		CAKeyURL:      "/ca.pub",
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(lib.DiscoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(want)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	d, err := Discover(context.Background(), &Config{CA: ts.URL})
+	require.NoError(t, err)
+	assert.Equal(t, want, d)
+
+	_, err = Discover(context.Background(), &Config{CA: ts.URL + "/missing"})
+	assert.ErrorIs(t, err, errDiscoveryUnsupported)
+}
+
+func TestApplyDiscovery(t *testing.T) {
+	defer func(v string) { lib.Version = v }(lib.Version)
+	lib.Version = "v1.5.0"
+
+	c := &Config{Validity: "24h", Keysize: 4096}
+	warnings, err := c.ApplyDiscovery(&lib.Discovery{
+		Version:     "v1.4.0",
+		KeyTypes:    []string{"ed25519", "ecdsa"},
+		MaxValidity: "4h0m0s",
+	})
+	require.NoError(t, err)
+	assert.Len(t, warnings, 1)
+	assert.Equal(t, &Config{Keytype: "ed25519", Validity: "4h0m0s"}, c)
+
+	c = &Config{Keytype: "ecdsa", Validity: "1h"}
+	warnings, err = c.ApplyDiscovery(&lib.Discovery{Version: "v1.5.0", KeyTypes: []string{"ed25519", "ecdsa"}, MaxValidity: "4h0m0s"})
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+	assert.Equal(t, &Config{Keytype: "ecdsa", Validity: "1h"}, c)
+
+	c = &Config{Keytype: "rsa"}
+	_, err = c.ApplyDiscovery(&lib.Discovery{KeyTypes: []string{"ed25519"}})
+	assert.ErrorContains(t, err, "key type rsa is not allowed")
+
+	// Security keys can't be generated, but an existing key may be signed.
+	c = &Config{}
+	_, err = c.ApplyDiscovery(&lib.Discovery{KeyTypes: []string{"sk-ed25519", "ed25519"}})
+	require.NoError(t, err)
+	assert.Equal(t, "ed25519", c.Keytype)
+	_, err = (&Config{}).ApplyDiscovery(&lib.Discovery{KeyTypes: []string{"sk-ed25519"}})
+	assert.ErrorContains(t, err, "set public_key")
+	_, err = (&Config{PublicKeyFile: "id_ed25519_sk.pub"}).ApplyDiscovery(&lib.Discovery{KeyTypes: []string{"sk-ed25519"}})
+	assert.NoError(t, err)
+
+	_, err = (&Config{}).ApplyDiscovery(&lib.Discovery{MinClientVersion: "v2.0.0"})
+	assert.ErrorIs(t, err, ErrIncompatibleVersion)
+
+	// Development builds are assumed to be compatible.
+	lib.Version = "unknown"
+	_, err = (&Config{}).ApplyDiscovery(&lib.Discovery{MinClientVersion: "v2.0.0"})
+	assert.NoError(t, err)
+}
@@ -6,15 +6,12 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/x509"
 	"encoding/pem"
 	"errors"
 	"fmt"
 
 	"golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/ssh"
-
-	"github.com/mikesmitty/edkey"
 )
 
 // Key is a private key.
@@ -35,24 +32,27 @@ var defaultOptions = options{
 // A KeyOption is used to generate keys of different types and sizes.
 type KeyOption func(*options)
 
-func pemBlockForKey(priv interface{}) (*pem.Block, error) {
-	switch k := priv.(type) {
-	case *rsa.PrivateKey:
-		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}, nil
-	case *ecdsa.PrivateKey:
-		b, err := x509.MarshalECPrivateKey(k)
-		if err != nil {
-			return nil, err
-		}
-		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}, nil
+// marshalPrivateKey encodes the key in the OpenSSH private key format. If a
+// passphrase is given the key is encrypted with it.
+func marshalPrivateKey(key Key, comment string, passphrase []byte) (*pem.Block, error) {
+	var k crypto.PrivateKey
+	switch key := key.(type) {
 	case *ed25519.PrivateKey:
-		b := edkey.MarshalED25519PrivateKey(*k)
-		return &pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: b}, nil
-	default:
+		k = *key
+	case nil:
 		return nil, errors.New("unable to create PEM block from key")
+	default:
+		k = key
+	}
+	if len(passphrase) > 0 {
+		return ssh.MarshalPrivateKeyWithPassphrase(k, comment, passphrase)
 	}
+	return ssh.MarshalPrivateKey(k, comment)
 }
 
+// generatedKeyTypes are the key types GenerateKey can create.
+var generatedKeyTypes = []string{"rsa", "ecdsa", "ed25519"}
+
 // KeyType sets the type of key to generate.
 // Valid types are: "rsa", "ecdsa", "ed25519".
 // Default is "rsa"
@@ -1,11 +1,14 @@
 package client
 
 import (
+	"bytes"
 	"crypto/rsa"
+	"encoding/pem"
 	"reflect"
 	"testing"
 
 	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
 )
 
 func TestGenerateKeys(t *testing.T) {
@@ -66,3 +69,43 @@ func TestGenerateKeySize(t *testing.T) {
 		t.Errorf("Unexpected key type %T, wanted *rsa.PrivateKey", k)
 	}
 }
+
+func TestMarshalPrivateKey(t *testing.T) {
+	for _, keytype := range []string{"rsa", "ecdsa", "ed25519"} {
+		t.Run(keytype, func(t *testing.T) {
+			k, pub, err := GenerateKey(KeyType(keytype))
+			if err != nil {
+				t.Fatal(err)
+			}
+			block, err := marshalPrivateKey(k, "comment", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if block.Type != "OPENSSH PRIVATE KEY" {
+				t.Errorf("Unexpected PEM block type %q", block.Type)
+			}
+			signer, err := ssh.ParsePrivateKey(pem.EncodeToMemory(block))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(signer.PublicKey().Marshal(), pub.Marshal()) {
+				t.Error("Public keys don't match")
+			}
+
+			block, err = marshalPrivateKey(k, "comment", []byte("passphrase"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ssh.ParsePrivateKey(pem.EncodeToMemory(block)); err == nil {
+				t.Error("Expected encrypted key to require a passphrase")
+			}
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(pem.EncodeToMemory(block), []byte("passphrase"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(signer.PublicKey().Marshal(), pub.Marshal()) {
+				t.Error("Public keys don't match")
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	srvOK    = "ok"
+	srvError = "error"
+)
+
+// localserver receives the token from the browser once the user has
+// authenticated with the CA. In the loopback flow the browser is instead
+// redirected to it with an authorization code.
+type localserver struct {
+	token, code, response chan string
+	ip                    net.IP
+	port                  int
+	path                  string
+	state                 string
+	ca                    string
+	httpserver            *http.Server
+}
+
+func startServer(ca string) (*localserver, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, fmt.Errorf("error starting local server: %w", err)
+	}
+	mux := http.NewServeMux()
+	ls := &localserver{
+		token:    make(chan string, 1),
+		code:     make(chan string, 1),
+		response: make(chan string, 1),
+		ip:       l.Addr().(*net.TCPAddr).IP,
+		port:     l.Addr().(*net.TCPAddr).Port,
+		path:     "/" + uuid.NewString(),
+		state:    uuid.NewString(),
+		httpserver: &http.Server{
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: 30 * time.Second,
+			Handler:      mux,
+		},
+		ca: ca,
+	}
+	mux.HandleFunc(ls.path, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", strings.TrimSuffix(ls.ca, "/"))
+		token := r.FormValue("token")
+		if code := r.FormValue("code"); code != "" {
+			if r.FormValue("state") != ls.state {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			select {
+			case ls.code <- code:
+			default:
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+		} else if token != "" {
+			select {
+			case ls.token <- token:
+			default:
+				// a token has already been received
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+		} else {
+			// no token, no service
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// block here until we get something to send back
+		resp := <-ls.response
+		if resp != srvOK {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		if r.FormValue("code") != "" {
+			// The browser was redirected here, so the response is seen by
+			// the user.
+			if resp == srvOK {
+				resp = "Authentication complete - you can close this window"
+			} else {
+				resp = "Authentication failed - see your terminal for details"
+			}
+		}
+		w.Write([]byte(resp))
+	})
+	go ls.httpserver.Serve(l)
+	return ls, nil
+}
+
+func (l *localserver) stop(ctx context.Context) {
+	l.httpserver.Shutdown(ctx)
+}
+
+func (l *localserver) url() string {
+	return fmt.Sprintf("%d%s", l.port, l.path)
+}
+
+// redirectURL is where the browser is sent with an authorization code.
+func (l *localserver) redirectURL() string {
+	return (&url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(l.ip.String(), strconv.Itoa(l.port)),
+		Path:   l.path,
+	}).String()
+}
+
+func (l *localserver) respond(val string) {
+	l.response <- val
+}
@@ -0,0 +1,302 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/cashier-go/cashier/lib"
+)
+
+const (
+	defaultMaxAttempts = 3
+	defaultBackoff     = time.Second
+)
+
+// LoginOptions configures Login.
+type LoginOptions struct {
+	Config *Config
+	// Token obtains the access token presented to the CA.
+	Token TokenSource
+	// Message is the reason for the request sent to the CA.
+	Message string
+	// Reason is called when the CA requires a reason for the request and no
+	// Message was given. If nil Login fails with ErrNeedsReason.
+	Reason func(ctx context.Context) (string, error)
+	// Agent, if set, receives the key and certificate, restricted by
+	// Constraints.
+	Agent       agent.Agent
+	Constraints AgentConstraints
+	// SaveFiles writes the key and certificate under the configured
+	// key_file_prefix, and updates the stable links and managed ssh config.
+	SaveFiles bool
+	// Passphrase encrypts the saved private key.
+	Passphrase []byte
+	// MaxAttempts is the number of times a request which fails with a
+	// temporary error is sent. Defaults to 3.
+	MaxAttempts int
+	// Backoff is the delay before the first retry, which doubles with each
+	// further attempt. Defaults to 1s.
+	Backoff time.Duration
+	// SkipDiscovery disables reading the CA's discovery document, which is
+	// otherwise used to check compatibility and pick defaults.
+	SkipDiscovery bool
+	// Logf receives progress messages.
+	Logf func(format string, v ...interface{})
+}
+
+func (o *LoginOptions) logf(format string, v ...interface{}) {
+	if o.Logf != nil {
+		o.Logf(format, v...)
+	}
+}
+
+// LoginResult is a key pair and the certificate issued for it.
+type LoginResult struct {
+	Certificate *ssh.Certificate
+	// Info is the CA's description of the certificate.
+	Info      *lib.CertificateInfo
+	PublicKey ssh.PublicKey
+	// PrivateKey is nil if an existing public key was signed.
+	PrivateKey Key
+	// Installed is set if the key was added to the agent.
+	Installed bool
+	// Files are the stable paths of the saved key files, if any.
+	Files KeyFiles
+}
+
+// Login generates a new key pair, has it signed by the CA using a token from
+// the token source and installs the result in the agent and on disk.
+// If the config names a public_key file, that key is signed instead and the
+// certificate is saved next to it.
+func Login(ctx context.Context, opts LoginOptions) (res *LoginResult, err error) {
+	if opts.Config == nil || opts.Token == nil {
+		return nil, errors.New("login requires a config and token source")
+	}
+	// Discovery may change the config, which belongs to the caller.
+	conf := *opts.Config
+	c := &conf
+	opts.Config = c
+	if opts.Agent == nil && (!opts.SaveFiles || c.PublicFilePrefix == "") && c.PublicKeyFile == "" {
+		return nil, errors.New("login requires an agent, key_file_prefix or public_key")
+	}
+
+	var d *lib.Discovery
+	if !opts.SkipDiscovery {
+		if d, err = discover(ctx, &opts); err != nil {
+			return nil, err
+		}
+	}
+
+	var priv Key
+	var pub ssh.PublicKey
+	if c.PublicKeyFile != "" {
+		if pub, err = readPublicKey(c.PublicKeyFile); err != nil {
+			return nil, err
+		}
+	} else {
+		opts.logf("Generating new key pair")
+		if priv, pub, err = GenerateKey(KeyType(c.Keytype), KeySize(c.Keysize)); err != nil {
+			return nil, fmt.Errorf("error generating key pair: %w", err)
+		}
+	}
+
+	// Possession of generated keys is proved whenever the CA supports it.
+	// Existing keys are only proved if required, as security keys need to
+	// be touched again.
+	var proof *keyProof
+	switch {
+	case d == nil || d.ChallengeURL == "":
+	case priv != nil:
+		if proof, err = signerProof(d.ChallengeURL, priv); err != nil {
+			return nil, err
+		}
+	case d.RequireKeyProof:
+		proof = keygenProof(d.ChallengeURL, c.PublicKeyFile)
+	}
+
+	if u, ok := opts.Token.(discoveryUser); ok && d != nil {
+		u.useDiscovery(c, d)
+	}
+	if f, ok := opts.Token.(TokenFinisher); ok {
+		defer func() { f.Finish(err) }()
+	}
+	token, err := opts.Token.Token(ctx, c.CA)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.logf("Sending keys for signing...")
+	cert, info, err := signWithRetry(ctx, pub, token, proof, &opts)
+	if err != nil {
+		return nil, err
+	}
+	res = &LoginResult{Certificate: cert, Info: info, PublicKey: pub, PrivateKey: priv}
+
+	if priv == nil {
+		// The private key isn't available, so the certificate can only be
+		// saved next to the public key for ssh to find.
+		if res.Files, err = saveCertificate(c.PublicKeyFile, cert); err != nil {
+			return nil, err
+		}
+		opts.logf("Certificate saved to %s", res.Files.Certificate)
+		return res, nil
+	}
+
+	canSave := opts.SaveFiles && c.PublicFilePrefix != ""
+	if opts.Agent != nil {
+		if err := InstallCertWithConstraints(opts.Agent, cert, priv, c.CA, c.Profile, opts.Constraints); err != nil {
+			if !canSave {
+				return nil, err
+			}
+			opts.logf("%v", err)
+		} else {
+			res.Installed = true
+			opts.logf("Credentials added to agent.")
+		}
+	}
+	if canSave {
+		if res.Files, err = saveFiles(c, cert, pub, priv, opts.Passphrase); err != nil {
+			return nil, err
+		}
+		opts.logf("Private key saved to %s", res.Files.PrivateKey)
+		if c.SSHConfigFile != "" {
+			opts.logf("Updated ssh config %s", c.SSHConfigFile)
+		}
+	}
+	return res, nil
+}
+
+// discover applies the CA's discovery document to the config, and asks for a
+// reason up front if the CA requires one. CAs which don't publish a discovery
+// document are assumed to be compatible, and nil is returned.
+func discover(ctx context.Context, opts *LoginOptions) (*lib.Discovery, error) {
+	d, err := Discover(ctx, opts.Config)
+	if err != nil {
+		opts.logf("Unable to read CA discovery document: %v", err)
+		return nil, nil
+	}
+	warnings, err := opts.Config.ApplyDiscovery(d)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range warnings {
+		opts.logf("Warning: %s", w)
+	}
+	if d.RequireReason && opts.Message == "" && opts.Reason != nil {
+		if opts.Message, err = opts.Reason(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// signWithRetry signs the key, asking for a reason if the CA requires one and
+// retrying temporary failures.
+func signWithRetry(ctx context.Context, pub ssh.PublicKey, token string, proof *keyProof, opts *LoginOptions) (*ssh.Certificate, *lib.CertificateInfo, error) {
+	attempts := opts.MaxAttempts
+	if attempts <= 0 {
+		attempts = defaultMaxAttempts
+	}
+	backoff := opts.Backoff
+	if backoff <= 0 {
+		backoff = defaultBackoff
+	}
+	reason := opts.Message
+	for attempt := 1; ; attempt++ {
+		cert, info, err := signCert(ctx, pub, token, opts.Config, reason, proof)
+		if err == nil {
+			return cert, info, nil
+		}
+		if errors.Is(err, ErrNeedsReason) && reason == "" && opts.Reason != nil {
+			if reason, err = opts.Reason(ctx); err != nil {
+				return nil, nil, err
+			}
+			if reason == "" {
+				return nil, nil, ErrNeedsReason
+			}
+			attempt--
+			continue
+		}
+		if !temporary(err) || attempt >= attempts {
+			return nil, nil, err
+		}
+		opts.logf("%v, retrying in %s", err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// temporary reports whether a signing request may succeed if retried.
+// Sign tokens are single use, so only requests which can't have been
+// processed by the CA are retried: errors from the CA whose status code
+// indicates the request didn't reach it, and failures to connect.
+func temporary(err error) bool {
+	var signErr *SignError
+	if errors.As(err, &signErr) {
+		return signErr.Temporary()
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// saveFiles writes the key and certificate under the key_file_prefix, and
+// updates the stable links and managed ssh config. It returns the stable
+// paths of the files.
+func saveFiles(c *Config, cert *ssh.Certificate, pub ssh.PublicKey, priv Key, passphrase []byte) (KeyFiles, error) {
+	if err := SavePublicFiles(c.PublicFilePrefix, cert, pub); err != nil {
+		return KeyFiles{}, err
+	}
+	if err := SavePrivateFilesWithPassphrase(c.PublicFilePrefix, cert, priv, passphrase); err != nil {
+		return KeyFiles{}, err
+	}
+	files, err := LinkKeyFiles(c.PublicFilePrefix, c.Profile, cert.KeyId)
+	if err != nil {
+		return KeyFiles{}, err
+	}
+	if c.SSHConfigFile != "" {
+		if err := WriteSSHConfig(c.SSHConfigFile, c.Profile, c.SSHHosts, files); err != nil {
+			return KeyFiles{}, err
+		}
+	}
+	return files, nil
+}
+
+// readPublicKey reads an authorized_keys style public key from a file.
+func readPublicKey(file string) (ssh.PublicKey, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read public key: %w", err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse public key %s: %w", file, err)
+	}
+	return pub, nil
+}
+
+// saveCertificate writes the certificate for an existing public key, following
+// the ssh-keygen naming convention so that ssh finds it next to the key.
+func saveCertificate(pubFile string, cert *ssh.Certificate) (KeyFiles, error) {
+	base := strings.TrimSuffix(pubFile, ".pub")
+	files := KeyFiles{
+		PrivateKey:  base,
+		PublicKey:   pubFile,
+		Certificate: base + "-cert.pub",
+	}
+	if err := os.WriteFile(files.Certificate, ssh.MarshalAuthorizedKey(cert), 0o644); err != nil {
+		return KeyFiles{}, fmt.Errorf("unable to save certificate: %w", err)
+	}
+	return files, nil
+}
@@ -0,0 +1,501 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/oauth2"
+
+	"github.com/cashier-go/cashier/lib"
+	"github.com/cashier-go/cashier/testdata"
+)
+
+// testCA signs keys sent to it. Requests are passed to fail first, which may
+// write an error response instead.
+func testCA(t *testing.T, fail func(w http.ResponseWriter, req *lib.SignRequest) bool) *httptest.Server {
+	t.Helper()
+	caKey, _, err := GenerateKey(KeyType("ed25519"))
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(caKey)
+	require.NoError(t, err)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		req := &lib.SignRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if fail != nil && fail(w, req) {
+			return
+		}
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.Key))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		cert := &ssh.Certificate{
+			KeyId:           "key_1",
+			Key:             pub,
+			CertType:        ssh.UserCert,
+			ValidPrincipals: []string{"user"},
+			ValidBefore:     uint64(req.ValidUntil.Unix()),
+		}
+		if err := cert.SignCert(rand.Reader, signer); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		info := lib.NewCertificateInfo(cert)
+		info.KRLURL = "/revoked"
+		info.Reason = req.Message
+		json.NewEncoder(w).Encode(&lib.SignResponse{
+			Status:      "ok",
+			Response:    string(lib.GetPublicKey(cert)),
+			Certificate: info,
+		})
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+type recordingFinisher struct {
+	TokenSource
+	err      error
+	finished bool
+}
+
+func (f *recordingFinisher) Finish(err error) {
+	f.finished = true
+	f.err = err
+}
+
+func TestLogin(t *testing.T) {
+	ts := testCA(t, nil)
+	a := agent.NewKeyring()
+	token := &recordingFinisher{TokenSource: StaticToken("token")}
+	res, err := Login(context.Background(), LoginOptions{
+		Config: &Config{CA: ts.URL, Keytype: "ed25519", Validity: "1h"},
+		Token:  token,
+		Agent:  a,
+	})
+	require.NoError(t, err)
+	assert.True(t, res.Installed)
+	assert.Equal(t, res.PublicKey.Marshal(), res.Certificate.Key.Marshal())
+	assert.True(t, token.finished)
+	assert.NoError(t, token.err)
+	assert.Equal(t, "key_1", res.Info.KeyID)
+	assert.Equal(t, []string{"user"}, res.Info.Principals)
+	assert.Equal(t, ts.URL+"/revoked", res.Info.KRLURL)
+
+	keys, err := ListKeys(a, ts.URL)
+	require.NoError(t, err)
+	assert.Len(t, keys, 2)
+}
+
+func TestLoginSaveFiles(t *testing.T) {
+	ts := testCA(t, nil)
+	dir := t.TempDir()
+	res, err := Login(context.Background(), LoginOptions{
+		Config:    &Config{CA: ts.URL, Keytype: "ed25519", Validity: "1h", PublicFilePrefix: dir, Profile: "default"},
+		Token:     StaticToken("token"),
+		SaveFiles: true,
+	})
+	require.NoError(t, err)
+	assert.False(t, res.Installed)
+	assert.Equal(t, StableKeyFilePaths(dir, "default"), res.Files)
+
+	_, err = Login(context.Background(), LoginOptions{
+		Config: &Config{CA: ts.URL, Keytype: "ed25519", Validity: "1h"},
+		Token:  StaticToken("token"),
+	})
+	assert.Error(t, err)
+}
+
+func TestLoginPublicKey(t *testing.T) {
+	var signed *lib.SignRequest
+	ts := testCA(t, func(w http.ResponseWriter, req *lib.SignRequest) bool {
+		signed = req
+		return false
+	})
+	dir := t.TempDir()
+	pubFile := filepath.Join(dir, "id_ed25519_sk.pub")
+	require.NoError(t, os.WriteFile(pubFile, testdata.SKPub, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "attestation"), []byte("attestation"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "challenge"), []byte("challenge"), 0o644))
+	res, err := Login(context.Background(), LoginOptions{
+		Config: &Config{
+			CA:                       ts.URL,
+			Validity:                 "1h",
+			PublicKeyFile:            pubFile,
+			AttestationFile:          filepath.Join(dir, "attestation"),
+			AttestationChallengeFile: filepath.Join(dir, "challenge"),
+		},
+		Token: StaticToken("token"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("attestation"), signed.Attestation)
+	assert.Equal(t, []byte("challenge"), signed.AttestationChallenge)
+	assert.Nil(t, res.PrivateKey)
+	assert.False(t, res.Installed)
+	assert.Equal(t, filepath.Join(dir, "id_ed25519_sk-cert.pub"), res.Files.Certificate)
+
+	b, err := os.ReadFile(res.Files.Certificate)
+	require.NoError(t, err)
+	k, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	require.NoError(t, err)
+	cert, ok := k.(*ssh.Certificate)
+	require.True(t, ok)
+	assert.Equal(t, ssh.KeyAlgoSKED25519, cert.Key.Type())
+}
+
+// proofCA wraps a test CA which requires signing requests to prove
+// possession of the key.
+func proofCA(t *testing.T) *httptest.Server {
+	t.Helper()
+	const challenge = "nonce"
+	ca := testCA(t, func(w http.ResponseWriter, req *lib.SignRequest) bool {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.Key))
+		if err != nil || req.Challenge != challenge || lib.VerifySSHSig(pub, lib.SignNamespace, []byte(challenge), req.Signature) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&lib.SignResponse{Status: "error", Error: lib.ErrorKeyRejected})
+			return true
+		}
+		return false
+	})
+	target, _ := url.Parse(ca.URL)
+	mux := http.NewServeMux()
+	mux.Handle("/", httputil.NewSingleHostReverseProxy(target))
+	mux.HandleFunc(lib.DiscoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&lib.Discovery{ChallengeURL: "/sign/challenge", RequireKeyProof: true})
+	})
+	mux.HandleFunc("/sign/challenge", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(&lib.ChallengeResponse{Challenge: challenge, Namespace: lib.SignNamespace})
+	})
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestLoginKeyProof(t *testing.T) {
+	ts := proofCA(t)
+	_, err := Login(context.Background(), LoginOptions{
+		Config: &Config{CA: ts.URL, Keytype: "ed25519", Validity: "1h"},
+		Token:  StaticToken("token"),
+		Agent:  agent.NewKeyring(),
+	})
+	require.NoError(t, err)
+
+	_, err = Login(context.Background(), LoginOptions{
+		Config:        &Config{CA: ts.URL, Keytype: "ed25519", Validity: "1h"},
+		Token:         StaticToken("token"),
+		Agent:         agent.NewKeyring(),
+		SkipDiscovery: true,
+	})
+	assert.ErrorIs(t, err, ErrKeyRejected)
+}
+
+func TestLoginKeyProofPublicKey(t *testing.T) {
+	if _, err := exec.LookPath(sshKeygen); err != nil {
+		t.Skip("ssh-keygen not found")
+	}
+	ts := proofCA(t)
+	key := filepath.Join(t.TempDir(), "id_ed25519")
+	out, err := exec.Command(sshKeygen, "-q", "-t", "ed25519", "-N", "", "-f", key).CombinedOutput()
+	require.NoError(t, err, string(out))
+	res, err := Login(context.Background(), LoginOptions{
+		Config: &Config{CA: ts.URL, Validity: "1h", PublicKeyFile: key + ".pub"},
+		Token:  StaticToken("token"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, key+"-cert.pub", res.Files.Certificate)
+}
+
+func TestLoginReason(t *testing.T) {
+	var message string
+	ts := testCA(t, func(w http.ResponseWriter, req *lib.SignRequest) bool {
+		if req.Message == "" {
+			w.Header().Set("X-Need-Reason", "required")
+			w.WriteHeader(http.StatusForbidden)
+			return true
+		}
+		message = req.Message
+		return false
+	})
+	conf := &Config{CA: ts.URL, Keytype: "ed25519", Validity: "1h"}
+
+	token := &recordingFinisher{TokenSource: StaticToken("token")}
+	_, err := Login(context.Background(), LoginOptions{
+		Config: conf,
+		Token:  token,
+		Agent:  agent.NewKeyring(),
+	})
+	assert.ErrorIs(t, err, ErrNeedsReason)
+	assert.ErrorIs(t, token.err, ErrNeedsReason)
+
+	_, err = Login(context.Background(), LoginOptions{
+		Config: conf,
+		Token:  StaticToken("token"),
+		Agent:  agent.NewKeyring(),
+		Reason: func(context.Context) (string, error) { return "deploy", nil },
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "deploy", message)
+
+	_, err = Login(context.Background(), LoginOptions{
+		Config:  conf,
+		Token:   StaticToken("token"),
+		Agent:   agent.NewKeyring(),
+		Message: "incident",
+		Reason: func(context.Context) (string, error) {
+			return "", errors.New("unexpected prompt")
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "incident", message)
+}
+
+func TestLoginRetry(t *testing.T) {
+	var requests atomic.Int32
+	ts := testCA(t, func(w http.ResponseWriter, req *lib.SignRequest) bool {
+		if requests.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return true
+		}
+		return false
+	})
+	_, err := Login(context.Background(), LoginOptions{
+		Config:  &Config{CA: ts.URL, Keytype: "ed25519", Validity: "1h"},
+		Token:   StaticToken("token"),
+		Agent:   agent.NewKeyring(),
+		Backoff: time.Millisecond,
+	})
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, requests.Load())
+
+	requests.Store(0)
+	_, err = Login(context.Background(), LoginOptions{
+		Config:      &Config{CA: ts.URL, Keytype: "ed25519", Validity: "1h"},
+		Token:       StaticToken("token"),
+		Agent:       agent.NewKeyring(),
+		MaxAttempts: 2,
+		Backoff:     time.Millisecond,
+	})
+	assert.ErrorIs(t, err, ErrServer)
+	assert.EqualValues(t, 2, requests.Load())
+}
+
+func TestLoginNoRetryAfterSend(t *testing.T) {
+	var requests atomic.Int32
+	ts := testCA(t, func(w http.ResponseWriter, req *lib.SignRequest) bool {
+		requests.Add(1)
+		// The request reached the CA, which may have used the token.
+		conn, _, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		conn.Close()
+		return true
+	})
+	_, err := Login(context.Background(), LoginOptions{
+		Config:  &Config{CA: ts.URL, Keytype: "ed25519", Validity: "1h"},
+		Token:   StaticToken("token"),
+		Agent:   agent.NewKeyring(),
+		Backoff: time.Millisecond,
+	})
+	assert.Error(t, err)
+	assert.EqualValues(t, 1, requests.Load())
+}
+
+func TestTemporary(t *testing.T) {
+	assert.True(t, temporary(&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}))
+	assert.True(t, temporary(&SignError{StatusCode: http.StatusBadGateway}))
+	assert.False(t, temporary(&net.OpError{Op: "read", Err: syscall.ECONNRESET}))
+	assert.False(t, temporary(io.EOF))
+	assert.False(t, temporary(io.ErrUnexpectedEOF))
+	assert.False(t, temporary(&SignError{StatusCode: http.StatusUnauthorized}))
+}
+
+func TestLoginUnauthorized(t *testing.T) {
+	var requests atomic.Int32
+	ts := testCA(t, func(w http.ResponseWriter, req *lib.SignRequest) bool {
+		requests.Add(1)
+		return false
+	})
+	_, err := Login(context.Background(), LoginOptions{
+		Config:  &Config{CA: ts.URL, Keytype: "ed25519", Validity: "1h"},
+		Token:   StaticToken("wrong"),
+		Agent:   agent.NewKeyring(),
+		Backoff: time.Millisecond,
+	})
+	assert.ErrorIs(t, err, ErrUnauthorized)
+	assert.Zero(t, requests.Load())
+}
+
+func TestBrowserTokenSource(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte("token"))
+	response := make(chan string, 1)
+	s := &BrowserTokenSource{
+		OpenBrowser: func(u string) error {
+			parsed, err := url.Parse(u)
+			if err != nil {
+				return err
+			}
+			go func() {
+				resp, err := http.PostForm("http://localhost:"+parsed.Query().Get("localserver"), url.Values{"token": {encoded}})
+				if err != nil {
+					response <- err.Error()
+					return
+				}
+				defer resp.Body.Close()
+				b, _ := io.ReadAll(resp.Body)
+				response <- string(b)
+			}()
+			return nil
+		},
+	}
+	token, err := s.Token(context.Background(), "https://ca.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "token", token)
+	s.Finish(nil)
+	assert.Equal(t, srvOK, <-response)
+}
+
+func TestBrowserTokenSourceLoopback(t *testing.T) {
+	var challenge string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "code" || oauth2.S256ChallengeFromVerifier(r.FormValue("code_verifier")) != challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(&lib.TokenResponse{AccessToken: "token", TokenType: "Bearer"})
+	})
+	ca := httptest.NewServer(mux)
+	defer ca.Close()
+
+	response := make(chan string, 1)
+	s := &BrowserTokenSource{
+		OpenBrowser: func(u string) error {
+			parsed, err := url.Parse(u)
+			if err != nil {
+				return err
+			}
+			q := parsed.Query()
+			if parsed.Path != "/auth/authorize" || q.Get("code_challenge_method") != "S256" {
+				return fmt.Errorf("unexpected url %s", u)
+			}
+			challenge = q.Get("code_challenge")
+			redirect := q.Get("redirect_uri")
+			go func() {
+				// A redirect with the wrong state is ignored.
+				resp, err := http.Get(redirect + "?code=forged&state=wrong")
+				if err != nil || resp.StatusCode != http.StatusBadRequest {
+					response <- "forged code accepted"
+					return
+				}
+				resp, err = http.Get(redirect + "?" + url.Values{"code": {"code"}, "state": {q.Get("state")}}.Encode())
+				if err != nil {
+					response <- err.Error()
+					return
+				}
+				defer resp.Body.Close()
+				b, _ := io.ReadAll(resp.Body)
+				response <- string(b)
+			}()
+			return nil
+		},
+	}
+	s.useDiscovery(&Config{CA: ca.URL}, &lib.Discovery{
+		AuthFlows:    []string{lib.AuthFlowBrowser, lib.AuthFlowLoopback},
+		AuthorizeURL: "/auth/authorize",
+		TokenURL:     "/auth/token",
+	})
+	token, err := s.Token(context.Background(), ca.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "token", token)
+	s.Finish(nil)
+	assert.Contains(t, <-response, "Authentication complete")
+}
+
+func TestBrowserTokenSourceClientCert(t *testing.T) {
+	s := &BrowserTokenSource{
+		OpenBrowser: func(string) error { return errors.New("unexpected browser") },
+	}
+	s.useDiscovery(&Config{TLSClientCert: "client.pem"}, &lib.Discovery{
+		AuthFlows: []string{lib.AuthFlowBrowser, lib.AuthFlowClientCert},
+	})
+	token, err := s.Token(context.Background(), "https://ca.example.com")
+	require.NoError(t, err)
+	assert.Empty(t, token)
+	s.Finish(nil)
+}
+
+func TestIDTokenFile(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "id_token")
+	require.NoError(t, os.WriteFile(f, []byte("header.payload.signature\n"), 0o600))
+	token, err := IDTokenFile(f).Token(context.Background(), "https://ca.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "header.payload.signature", token)
+
+	require.NoError(t, os.WriteFile(f, nil, 0o600))
+	_, err = IDTokenFile(f).Token(context.Background(), "https://ca.example.com")
+	assert.ErrorIs(t, err, errNoToken)
+
+	require.NoError(t, os.WriteFile(f, []byte("cashier_sa_key\n"), 0o600))
+	token, err = APIKeyFile(f).Token(context.Background(), "https://ca.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "cashier_sa_key", token)
+}
+
+func TestBrowserTokenSourcePaste(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte("token"))
+	lines := make(chan string, 3)
+	lines <- encoded[:4]
+	lines <- encoded[4:]
+	lines <- "."
+	s := &BrowserTokenSource{
+		Input:       func() <-chan string { return lines },
+		OpenBrowser: func(string) error { return errors.New("no browser") },
+	}
+	token, err := s.Token(context.Background(), "https://ca.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "token", token)
+	s.Finish(nil)
+
+	close(lines)
+	_, err = s.Token(context.Background(), "https://ca.example.com")
+	assert.ErrorIs(t, err, errNoToken)
+	s.Finish(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.FallbackOnly = true
+	_, err = s.Token(ctx, "https://ca.example.com")
+	assert.ErrorIs(t, err, context.Canceled)
+	s.Finish(err)
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/term"
+)
+
+var errPassphraseMismatch = errors.New("passphrases do not match")
+
+// ReadPassphrase reads a passphrase from r, up to the first newline.
+func ReadPassphrase(r io.Reader) ([]byte, error) {
+	line, err := bufio.NewReader(r).ReadBytes('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("unable to read passphrase: %w", err)
+	}
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	return line, nil
+}
+
+// ReadPassphraseFD reads a passphrase from an open file descriptor.
+func ReadPassphraseFD(fd int) ([]byte, error) {
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd))
+	if f == nil {
+		return nil, fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	defer f.Close()
+	return ReadPassphrase(f)
+}
+
+// PromptPassphrase asks for a new passphrase on the terminal, twice.
+func PromptPassphrase() ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, errors.New("unable to prompt for passphrase: stdin is not a terminal")
+	}
+	fmt.Fprint(os.Stderr, "Enter passphrase for private key: ")
+	p1, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprint(os.Stderr, "Enter same passphrase again: ")
+	p2, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(p1, p2) {
+		return nil, errPassphraseMismatch
+	}
+	if len(p1) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	return p1, nil
+}
@@ -0,0 +1,35 @@
+package client
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadPassphrase(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{input: "secret\n", want: "secret"},
+		{input: "secret\r\nignored\n", want: "secret"},
+		{input: "secret", want: "secret"},
+		{input: "\n", wantErr: true},
+		{input: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ReadPassphrase(strings.NewReader(tt.input))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ReadPassphrase(%q): expected error", tt.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ReadPassphrase(%q): %v", tt.input, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("ReadPassphrase(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/cashier-go/cashier/lib"
+)
+
+// sshKeygen is the ssh-keygen binary used to sign challenges with keys the
+// client doesn't hold, such as security keys.
+var sshKeygen = "ssh-keygen"
+
+// keyProof proves possession of the private key being signed by signing a
+// challenge fetched from the CA.
+type keyProof struct {
+	url  string
+	sign func(ctx context.Context, challenge string) ([]byte, error)
+}
+
+// signerProof signs challenges with a private key.
+func signerProof(url string, priv Key) (*keyProof, error) {
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	return &keyProof{url: url, sign: func(_ context.Context, challenge string) ([]byte, error) {
+		return lib.SignSSHSig(signer, lib.SignNamespace, []byte(challenge))
+	}}, nil
+}
+
+// keygenProof signs challenges with `ssh-keygen -Y sign`, using the private
+// key next to the public key file. This works for security keys, which may
+// ask to be touched.
+func keygenProof(url, pubFile string) *keyProof {
+	return &keyProof{url: url, sign: func(ctx context.Context, challenge string) ([]byte, error) {
+		cmd := exec.CommandContext(ctx, sshKeygen, "-q", "-Y", "sign", "-f", strings.TrimSuffix(pubFile, ".pub"), "-n", lib.SignNamespace)
+		cmd.Stdin = strings.NewReader(challenge)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("unable to sign challenge with ssh-keygen: %w", err)
+		}
+		return lib.ParseArmoredSSHSig(out)
+	}}
+}
+
+// fetchChallenge asks the CA for a challenge to sign.
+func fetchChallenge(ctx context.Context, conf *Config, token, ref string) (*lib.ChallengeResponse, error) {
+	client, err := newHTTPClient(conf)
+	if err != nil {
+		return nil, err
+	}
+	u, err := resolveURL(conf.CA, ref)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse challenge url: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newSignError(resp, &lib.SignResponse{})
+	}
+	c := &lib.ChallengeResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(c); err != nil {
+		return nil, fmt.Errorf("unable to decode challenge: %w", err)
+	}
+	return c, nil
+}
+
+// prove fills in the challenge and signature of the signing request.
+func (p *keyProof) prove(ctx context.Context, conf *Config, token string, req *lib.SignRequest) error {
+	c, err := fetchChallenge(ctx, conf, token, p.url)
+	if err != nil {
+		return fmt.Errorf("unable to fetch challenge: %w", err)
+	}
+	if c.Namespace != lib.SignNamespace {
+		return fmt.Errorf("unexpected challenge namespace %q", c.Namespace)
+	}
+	req.Challenge = c.Challenge
+	req.Signature, err = p.sign(ctx, c.Challenge)
+	return err
+}
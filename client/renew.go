@@ -0,0 +1,97 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/cashier-go/cashier/lib"
+)
+
+// Paths of the renewal endpoints, relative to the CA's address.
+const (
+	renewPath          = "/renew"
+	renewChallengePath = "/renew/challenge"
+)
+
+// postRenewal sends a renewal request to the CA and decodes the response
+// into v.
+func postRenewal(ctx context.Context, conf *Config, ref string, rr *lib.RenewRequest, v interface{}) error {
+	client, err := newHTTPClient(conf)
+	if err != nil {
+		return err
+	}
+	u, err := resolveURL(conf.CA, ref)
+	if err != nil {
+		return fmt.Errorf("unable to parse renewal url: %w", err)
+	}
+	b, err := json.Marshal(rr)
+	if err != nil {
+		return fmt.Errorf("unable to create renewal request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Add("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		sr := &lib.SignResponse{}
+		json.NewDecoder(resp.Body).Decode(sr)
+		return newSignError(resp, sr)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("unable to decode server response: %w", err)
+	}
+	return nil
+}
+
+// Renew asks the CA for a new certificate for the key of a current
+// certificate, without logging in. The signer proves possession of the
+// certificate's key. The new certificate has the same identity and
+// principals. Errors returned by the CA are a *SignError.
+func Renew(ctx context.Context, cert *ssh.Certificate, signer ssh.Signer, conf *Config) (*ssh.Certificate, error) {
+	validity, err := time.ParseDuration(conf.Validity)
+	if err != nil {
+		return nil, err
+	}
+	rr := &lib.RenewRequest{
+		Cert:       string(lib.GetPublicKey(cert)),
+		ValidUntil: time.Now().Add(validity),
+		Version:    lib.Version,
+	}
+	c := &lib.ChallengeResponse{}
+	if err := postRenewal(ctx, conf, renewChallengePath, rr, c); err != nil {
+		return nil, fmt.Errorf("unable to fetch challenge: %w", err)
+	}
+	if c.Namespace != lib.RenewNamespace {
+		return nil, fmt.Errorf("unexpected challenge namespace %q", c.Namespace)
+	}
+	rr.Challenge = c.Challenge
+	if rr.Signature, err = lib.SignSSHSig(signer, lib.RenewNamespace, []byte(c.Challenge)); err != nil {
+		return nil, fmt.Errorf("unable to sign challenge: %w", err)
+	}
+	sr := &lib.SignResponse{}
+	if err := postRenewal(ctx, conf, renewPath, rr, sr); err != nil {
+		return nil, fmt.Errorf("error sending request to CA: %w", err)
+	}
+	k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(sr.Response))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse response: %w", err)
+	}
+	renewed, ok := k.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("did not receive a valid certificate from server")
+	}
+	return renewed, nil
+}
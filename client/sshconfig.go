@@ -0,0 +1,118 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const sshConfigHeader = `# This file is managed by cashier. Changes will be overwritten.
+# Add "Include %s" to the top of your ssh config to use it.
+`
+
+// StableKeyFilePaths returns the fixed paths at which the most recent key
+// files for a profile can be found. These do not change between logins so
+// may be referenced from an ssh config.
+func StableKeyFilePaths(prefix, profile string) KeyFiles {
+	return KeyFilePaths(prefix, "cashier_"+profile)
+}
+
+// symlink atomically replaces link with a symbolic link to target.
+func symlink(target, link string) error {
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, link)
+}
+
+// LinkKeyFiles points the stable key file paths for a profile at the files
+// saved for the given key ID, and deletes the files they pointed at before.
+// It returns the stable paths.
+func LinkKeyFiles(prefix, profile, keyID string) (KeyFiles, error) {
+	stable := StableKeyFilePaths(prefix, profile)
+	files := KeyFilePaths(prefix, keyID)
+	for _, f := range [][2]string{
+		{files.PrivateKey, stable.PrivateKey},
+		{files.PublicKey, stable.PublicKey},
+		{files.Certificate, stable.Certificate},
+	} {
+		target := filepath.Base(f[0])
+		// Only files saved by a previous login, next to the link, are deleted.
+		previous, err := os.Readlink(f[1])
+		if err != nil || previous == target || previous != filepath.Base(previous) || !strings.HasPrefix(previous, "id_") {
+			previous = ""
+		}
+		if err := symlink(target, f[1]); err != nil {
+			return KeyFiles{}, fmt.Errorf("unable to link key file: %w", err)
+		}
+		if previous != "" {
+			if err := os.Remove(filepath.Join(filepath.Dir(f[1]), previous)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return KeyFiles{}, fmt.Errorf("unable to delete old key file: %w", err)
+			}
+		}
+	}
+	return stable, nil
+}
+
+func sshConfigMarkers(profile string) (string, string) {
+	return "# BEGIN cashier profile " + profile, "# END cashier profile " + profile
+}
+
+// sshConfigBlock returns the managed ssh config block for a profile.
+func sshConfigBlock(profile string, hosts []string, files KeyFiles) string {
+	if len(hosts) == 0 {
+		hosts = []string{"*"}
+	}
+	begin, end := sshConfigMarkers(profile)
+	var b strings.Builder
+	fmt.Fprintln(&b, begin)
+	fmt.Fprintf(&b, "Host %s\n", strings.Join(hosts, " "))
+	fmt.Fprintf(&b, "  IdentityFile %q\n", files.PrivateKey)
+	fmt.Fprintf(&b, "  CertificateFile %q\n", files.Certificate)
+	fmt.Fprintln(&b, end)
+	return b.String()
+}
+
+// WriteSSHConfig adds or replaces the block for a profile in the managed ssh
+// config file at path. Blocks for other profiles are preserved.
+func WriteSSHConfig(path, profile string, hosts []string, files KeyFiles) error {
+	existing, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("unable to read ssh config: %w", err)
+	}
+	begin, end := sshConfigMarkers(profile)
+	var out bytes.Buffer
+	fmt.Fprintf(&out, sshConfigHeader, path)
+	skip, inBlock := false, false
+	scanner := bufio.NewScanner(bytes.NewReader(existing))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == begin:
+			skip = true
+		case skip && line == end:
+			skip = false
+		case skip:
+		case strings.HasPrefix(line, "# BEGIN cashier profile "):
+			inBlock = true
+			fmt.Fprintln(&out, line)
+		case inBlock:
+			fmt.Fprintln(&out, line)
+			inBlock = !strings.HasPrefix(line, "# END cashier profile ")
+		}
+	}
+	out.WriteString(sshConfigBlock(profile, hosts, files))
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, out.Bytes(), 0o600); err != nil {
+		return fmt.Errorf("unable to write ssh config: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinkKeyFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, id := range []string{"key_1", "key_2"} {
+		cert, key := signedCert(t, id, []string{"user"})
+		require.NoError(t, SavePublicFiles(dir, cert, cert.Key))
+		require.NoError(t, SavePrivateFiles(dir, cert, key))
+		stable, err := LinkKeyFiles(dir, "prod", id)
+		require.NoError(t, err)
+		assert.Equal(t, StableKeyFilePaths(dir, "prod"), stable)
+		for _, f := range [][2]string{
+			{stable.PrivateKey, "id_" + id},
+			{stable.PublicKey, "id_" + id + ".pub"},
+			{stable.Certificate, "id_" + id + "-cert.pub"},
+		} {
+			target, err := os.Readlink(f[0])
+			require.NoError(t, err)
+			assert.Equal(t, f[1], target)
+		}
+	}
+	// The files of the first login were deleted when the links moved on.
+	for _, f := range []string{"id_key_1", "id_key_1.pub", "id_key_1-cert.pub"} {
+		_, err := os.Stat(filepath.Join(dir, f))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	}
+	// The files the links point at are kept.
+	_, err := os.Stat(filepath.Join(dir, "id_key_2"))
+	assert.NoError(t, err)
+}
+
+func TestWriteSSHConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cashier_config")
+	prod := StableKeyFilePaths(dir, "prod")
+	staging := StableKeyFilePaths(dir, "staging")
+
+	require.NoError(t, WriteSSHConfig(path, "prod", nil, prod))
+	require.NoError(t, WriteSSHConfig(path, "staging", []string{"*.staging.example.com"}, staging))
+	// Rewriting a profile replaces its block and keeps the others.
+	require.NoError(t, WriteSSHConfig(path, "prod", []string{"*.example.com", "bastion"}, prod))
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	want := "# This file is managed by cashier. Changes will be overwritten.\n" +
+		"# Add \"Include " + path + "\" to the top of your ssh config to use it.\n" +
+		"# BEGIN cashier profile staging\n" +
+		"Host *.staging.example.com\n" +
+		"  IdentityFile \"" + staging.PrivateKey + "\"\n" +
+		"  CertificateFile \"" + staging.Certificate + "\"\n" +
+		"# END cashier profile staging\n" +
+		"# BEGIN cashier profile prod\n" +
+		"Host *.example.com bastion\n" +
+		"  IdentityFile \"" + prod.PrivateKey + "\"\n" +
+		"  CertificateFile \"" + prod.Certificate + "\"\n" +
+		"# END cashier profile prod\n"
+	assert.Equal(t, want, string(b))
+}
@@ -0,0 +1,120 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var errPinMismatch = errors.New("server certificate does not match any pinned fingerprint")
+
+// parseFingerprint decodes a hex-encoded SHA256 fingerprint. Colons and an
+// optional "sha256:" prefix are ignored.
+func parseFingerprint(s string) ([]byte, error) {
+	s = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "sha256:")
+	b, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid fingerprint %q: %w", s, err)
+	}
+	if len(b) != sha256.Size {
+		return nil, fmt.Errorf("invalid fingerprint %q: must be a SHA256 digest", s)
+	}
+	return b, nil
+}
+
+// verifyPins returns a function which checks that the server's leaf
+// certificate matches one of the pinned fingerprints.
+func verifyPins(pins []string) (func(tls.ConnectionState) error, error) {
+	var fingerprints [][]byte
+	for _, p := range pins {
+		fp, err := parseFingerprint(p)
+		if err != nil {
+			return nil, err
+		}
+		fingerprints = append(fingerprints, fp)
+	}
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errPinMismatch
+		}
+		sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+		for _, fp := range fingerprints {
+			if bytes.Equal(sum[:], fp) {
+				return nil
+			}
+		}
+		return errPinMismatch
+	}, nil
+}
+
+// tlsConfig builds the TLS configuration used to talk to the CA.
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	conf := &tls.Config{InsecureSkipVerify: !c.ValidateTLSCertificate}
+	if c.TLSCAFile != "" {
+		b, err := os.ReadFile(c.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", c.TLSCAFile)
+		}
+		conf.RootCAs = pool
+	}
+	if c.TLSClientCert != "" || c.TLSClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSClientCert, c.TLSClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load TLS client certificate: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if len(c.TLSPinnedCerts) > 0 {
+		verify, err := verifyPins(c.TLSPinnedCerts)
+		if err != nil {
+			return nil, err
+		}
+		conf.VerifyConnection = verify
+	}
+	return conf, nil
+}
+
+// proxy returns the proxy function for requests to the CA. An explicitly
+// configured proxy takes precedence over the environment.
+func (c *Config) proxy() (func(*http.Request) (*url.URL, error), error) {
+	if c.Proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := url.Parse(c.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse proxy url: %w", err)
+	}
+	return http.ProxyURL(u), nil
+}
+
+// newHTTPClient returns a http client configured to talk to the CA.
+func newHTTPClient(c *Config) (*http.Client, error) {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := c.proxy()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           proxy,
+			TLSClientConfig: tlsConfig,
+		},
+		Timeout: 30 * time.Second,
+	}, nil
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePEM(t *testing.T, name, blockType string, b []byte) string {
+	t.Helper()
+	f := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(f, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: b}), 0o600))
+	return f
+}
+
+func newTLSServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestParseFingerprint(t *testing.T) {
+	sum := sha256.Sum256([]byte("test"))
+	for _, fp := range []string{
+		hex.EncodeToString(sum[:]),
+		"SHA256:" + hex.EncodeToString(sum[:]),
+	} {
+		b, err := parseFingerprint(fp)
+		require.NoError(t, err)
+		assert.Equal(t, sum[:], b)
+	}
+	_, err := parseFingerprint("abcd")
+	assert.Error(t, err)
+}
+
+func TestTLSCAFile(t *testing.T) {
+	ts := newTLSServer(t)
+	c := &Config{ValidateTLSCertificate: true}
+	client, err := newHTTPClient(c)
+	require.NoError(t, err)
+	_, err = client.Get(ts.URL)
+	assert.Error(t, err, "expected unknown authority error")
+
+	c.TLSCAFile = writePEM(t, "ca.pem", "CERTIFICATE", ts.Certificate().Raw)
+	client, err = newHTTPClient(c)
+	require.NoError(t, err)
+	resp, err := client.Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+}
+
+func TestTLSPinnedCerts(t *testing.T) {
+	ts := newTLSServer(t)
+	sum := sha256.Sum256(ts.Certificate().Raw)
+	other := sha256.Sum256([]byte("other"))
+
+	c := &Config{TLSPinnedCerts: []string{hex.EncodeToString(other[:])}}
+	client, err := newHTTPClient(c)
+	require.NoError(t, err)
+	_, err = client.Get(ts.URL)
+	assert.ErrorIs(t, err, errPinMismatch)
+
+	c.TLSPinnedCerts = append(c.TLSPinnedCerts, hex.EncodeToString(sum[:]))
+	client, err = newHTTPClient(c)
+	require.NoError(t, err)
+	resp, err := client.Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+}
+
+func TestTLSClientCert(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gopher"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	c := &Config{
+		TLSClientCert: writePEM(t, "client.pem", "CERTIFICATE", der),
+		TLSClientKey:  writePEM(t, "client.key", "EC PRIVATE KEY", keyDER),
+	}
+	client, err := newHTTPClient(c)
+	require.NoError(t, err)
+	resp, err := client.Get(ts.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestProxy(t *testing.T) {
+	c := &Config{Proxy: "http://proxy.example.com:3128"}
+	proxy, err := c.proxy()
+	require.NoError(t, err)
+	req, _ := http.NewRequest("GET", "https://sshca.example.com/sign", nil)
+	u, err := proxy(req)
+	require.NoError(t, err)
+	assert.Equal(t, "proxy.example.com:3128", u.Host)
+}
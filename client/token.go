@@ -0,0 +1,277 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/browser"
+	"golang.org/x/oauth2"
+
+	"github.com/cashier-go/cashier/lib"
+)
+
+var errNoToken = errors.New("no token received")
+
+// TokenSource obtains the access token presented to the CA when signing a
+// key.
+type TokenSource interface {
+	Token(ctx context.Context, ca string) (string, error)
+}
+
+// TokenFinisher is implemented by token sources which need to know the
+// outcome of the login the token was used for.
+type TokenFinisher interface {
+	Finish(err error)
+}
+
+// discoveryUser is implemented by token sources which use the CA's
+// discovery document.
+type discoveryUser interface {
+	useDiscovery(conf *Config, d *lib.Discovery)
+}
+
+// TokenSourceFunc adapts a function to a TokenSource.
+type TokenSourceFunc func(ctx context.Context, ca string) (string, error)
+
+// Token calls f.
+func (f TokenSourceFunc) Token(ctx context.Context, ca string) (string, error) {
+	return f(ctx, ca)
+}
+
+// StaticToken is a TokenSource which always returns the same token.
+type StaticToken string
+
+// Token returns the token.
+func (t StaticToken) Token(context.Context, string) (string, error) {
+	return string(t), nil
+}
+
+// IDTokenFile is a TokenSource which reads an OIDC ID token from a file. The
+// file is read for each login, as ID tokens are short lived.
+type IDTokenFile string
+
+// Token returns the token in the file.
+func (f IDTokenFile) Token(context.Context, string) (string, error) {
+	return readTokenFile(string(f), "ID token")
+}
+
+// APIKeyFile is a TokenSource which reads a service account's API key from a
+// file.
+type APIKeyFile string
+
+// Token returns the API key in the file.
+func (f APIKeyFile) Token(context.Context, string) (string, error) {
+	return readTokenFile(string(f), "API key")
+}
+
+// readTokenFile reads a token from a file, ignoring surrounding whitespace.
+func readTokenFile(name, what string) (string, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return "", fmt.Errorf("unable to read %s: %w", what, err)
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("%w: %s is empty", errNoToken, name)
+	}
+	return token, nil
+}
+
+// BrowserTokenSource sends the user to the CA in their browser and receives
+// the token once they have authenticated, either from the browser by way of
+// a server on localhost or pasted by the user.
+// It is not safe for concurrent use.
+type BrowserTokenSource struct {
+	// Input returns the lines entered by the user. A pasted token is
+	// terminated by a '.' on a line of its own. If nil, tokens can only be
+	// received by the local server.
+	Input func() <-chan string
+	// FallbackOnly restricts reading pasted tokens to when the local server
+	// can't be started.
+	FallbackOnly bool
+	// OpenBrowser opens the url. Defaults to the system browser.
+	OpenBrowser func(url string) error
+	// Logf receives progress messages and prompts for the user.
+	Logf func(format string, v ...interface{})
+
+	srv       *localserver
+	conf      *Config
+	discovery *lib.Discovery
+}
+
+// useDiscovery enables the loopback flow if the CA supports it.
+func (s *BrowserTokenSource) useDiscovery(conf *Config, d *lib.Discovery) {
+	s.conf = conf
+	s.discovery = d
+}
+
+// loopback reports whether the CA supports the loopback flow.
+func (s *BrowserTokenSource) loopback() bool {
+	return s.discovery != nil && s.discovery.AuthorizeURL != "" && s.discovery.TokenURL != "" &&
+		slices.Contains(s.discovery.AuthFlows, lib.AuthFlowLoopback)
+}
+
+// clientCert reports whether the client authenticates with a TLS client
+// certificate, which the CA accepts instead of a token.
+func (s *BrowserTokenSource) clientCert() bool {
+	return s.conf != nil && s.conf.TLSClientCert != "" && s.discovery != nil &&
+		slices.Contains(s.discovery.AuthFlows, lib.AuthFlowClientCert)
+}
+
+func (s *BrowserTokenSource) logf(format string, v ...interface{}) {
+	if s.Logf != nil {
+		s.Logf(format, v...)
+	}
+}
+
+// Token returns the token received for the CA. No token is needed if the
+// client has a TLS client certificate the CA accepts.
+func (s *BrowserTokenSource) Token(ctx context.Context, ca string) (string, error) {
+	if s.clientCert() {
+		s.logf("Authenticating with TLS client certificate %s", s.conf.TLSClientCert)
+		return "", nil
+	}
+	srv, err := startServer(ca)
+	if err != nil {
+		s.logf("%v", err)
+	}
+	s.srv = srv
+	url := ca
+	var fromServer, codes <-chan string
+	var verifier string
+	switch {
+	case srv != nil && s.loopback():
+		verifier = oauth2.GenerateVerifier()
+		if url, err = s.authorizeURL(ca, srv, verifier); err != nil {
+			return "", err
+		}
+		codes = srv.code
+	case srv != nil:
+		url = fmt.Sprintf("%s?localserver=%s", ca, srv.url())
+		fromServer = srv.token
+	}
+	open := s.OpenBrowser
+	if open == nil {
+		open = browser.OpenURL
+	}
+	s.logf("Your browser has been opened to visit %s", url)
+	if err := open(url); err != nil {
+		s.logf("Error launching web browser. Go to the link in your web browser")
+	}
+
+	var pasted <-chan string
+	if s.Input != nil && (srv == nil || !s.FallbackOnly) {
+		pasted = s.Input()
+		s.logf("Enter token, followed by a '.' on a new line: ")
+	}
+	if fromServer == nil && codes == nil && pasted == nil {
+		return "", errNoToken
+	}
+
+	var encoded string
+	var buf []byte
+	for encoded == "" {
+		select {
+		case t := <-fromServer:
+			s.logf("Token received")
+			encoded = t
+		case code := <-codes:
+			s.logf("Authorization code received")
+			return s.exchange(ctx, ca, code, verifier)
+		case line, ok := <-pasted:
+			if !ok {
+				return "", errNoToken
+			}
+			if line != "." {
+				buf = append(buf, line...)
+				continue
+			}
+			if len(buf) == 0 {
+				continue
+			}
+			encoded = string(buf)
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	token, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("error decoding token: %w", err)
+	}
+	return string(token), nil
+}
+
+// authorizeURL returns the URL starting the loopback flow, which sends the
+// browser back to the local server with an authorization code.
+func (s *BrowserTokenSource) authorizeURL(ca string, srv *localserver, verifier string) (string, error) {
+	u, err := resolveURL(ca, s.discovery.AuthorizeURL)
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{
+		"redirect_uri":          {srv.redirectURL()},
+		"state":                 {srv.state},
+		"code_challenge":        {oauth2.S256ChallengeFromVerifier(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	return u + "?" + q.Encode(), nil
+}
+
+// exchange exchanges an authorization code for the token.
+func (s *BrowserTokenSource) exchange(ctx context.Context, ca, code, verifier string) (string, error) {
+	u, err := resolveURL(ca, s.discovery.TokenURL)
+	if err != nil {
+		return "", err
+	}
+	client, err := newHTTPClient(s.conf)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{"code": {code}, "code_verifier": {verifier}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error exchanging authorization code: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("%w: unable to exchange authorization code (%d): %s", ErrUnauthorized, resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	tr := &lib.TokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(tr); err != nil {
+		return "", fmt.Errorf("unable to decode token response: %w", err)
+	}
+	return tr.AccessToken, nil
+}
+
+// Finish reports the outcome of the login to the browser and stops the
+// local server.
+func (s *BrowserTokenSource) Finish(err error) {
+	if s.srv == nil {
+		return
+	}
+	resp := srvOK
+	if err != nil {
+		resp = srvError
+	}
+	s.srv.respond(resp)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.srv.stop(ctx)
+	s.srv = nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"github.com/cashier-go/cashier/client"
+)
+
+// execCommand obtains a certificate for each profile, serves them from an
+// in-process agent and runs args with SSH_AUTH_SOCK pointing at it. The agent
+// and its keys are destroyed when the command exits.
+// It returns the exit code of the command, or an error if the command could
+// not be run. The agent is closed before either is returned.
+func execCommand(configs []*client.Config, args []string, input func() <-chan string) (int, error) {
+	a, err := client.NewEphemeralAgent()
+	if err != nil {
+		return 0, err
+	}
+	defer a.Close()
+
+	for _, c := range configs {
+		if err := execLogin(c, a, input); err != nil {
+			return 0, err
+		}
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "SSH_AUTH_SOCK="+a.SocketPath())
+
+	// The child shares our terminal and receives these signals directly.
+	// Ignore them here so that the agent outlives the child.
+	signal.Ignore(syscall.SIGINT, syscall.SIGQUIT)
+	defer signal.Reset(syscall.SIGINT, syscall.SIGQUIT)
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(terminate)
+
+	if err := cmd.Start(); err != nil {
+		log.Println(err)
+		return 127, nil
+	}
+	go func() {
+		for sig := range terminate {
+			cmd.Process.Signal(sig)
+		}
+	}()
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return 0, nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() >= 0:
+		return exitErr.ExitCode(), nil
+	default:
+		return 0, err
+	}
+}
+
+// execLogin obtains a certificate for a profile and adds it to the agent.
+// Pasted tokens are only read if the local server could not be started, as
+// stdin belongs to the command being run.
+func execLogin(c *client.Config, a *client.EphemeralAgent, input func() <-chan string) error {
+	if c.PublicKeyFile != "" {
+		return fmt.Errorf("profile %q: exec needs a new key pair for the temporary agent and can't use public_key", c.Profile)
+	}
+	opts := client.LoginOptions{
+		Config: c,
+		Token: &client.BrowserTokenSource{
+			Input:        input,
+			FallbackOnly: true,
+			Logf:         log.Printf,
+		},
+		Message: *reason,
+		Reason:  promptForReason(input),
+		Agent:   a,
+		Logf:    log.Printf,
+	}
+	if c.IDTokenFile != "" {
+		opts.Token = client.IDTokenFile(c.IDTokenFile)
+	}
+	if c.APIKeyFile != "" {
+		opts.Token = client.APIKeyFile(c.APIKeyFile)
+	}
+	res, err := client.Login(context.Background(), opts)
+	if err != nil {
+		return err
+	}
+	printSummary(res.Info)
+	return nil
+}
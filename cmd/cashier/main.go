@@ -2,118 +2,282 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"context"
-	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"os/user"
 	"path"
+	"strings"
+	"sync"
+	"text/tabwriter"
 	"time"
 
 	"github.com/cashier-go/cashier/client"
 	"github.com/cashier-go/cashier/lib"
-	"github.com/pkg/browser"
 	"github.com/spf13/pflag"
 	"golang.org/x/crypto/ssh/agent"
 )
 
 var (
-	u, _    = user.Current()
-	cfg     = pflag.String("config", path.Join(u.HomeDir, ".cashier.conf"), "Path to config file")
-	_       = pflag.String("ca", "http://localhost:10000", "CA server")
-	_       = pflag.Int("key_size", 0, "Size of key to generate. Ignored for ed25519 keys. (default 2048 for rsa keys, 256 for ecdsa keys)")
-	_       = pflag.Duration("validity", time.Hour*24, "Key lifetime. May be overridden by the CA at signing time")
-	_       = pflag.String("key_type", "", "Type of private key to generate - rsa, ecdsa or ed25519. (default \"rsa\")")
-	_       = pflag.String("key_file_prefix", "", "Prefix for filename for public key and cert (optional, no default)")
-	version = pflag.Bool("version", false, "Print version and exit")
+	u, _     = user.Current()
+	cfg      = pflag.String("config", path.Join(u.HomeDir, ".cashier.conf"), "Path to config file")
+	profiles = pflag.StringSlice("profile", nil, "Configuration profile(s) to use. May be repeated or comma separated. \"all\" selects every profile in the config file")
+	_        = pflag.String("ca", "http://localhost:10000", "CA server")
+	_        = pflag.Int("key_size", 0, "Size of key to generate. Ignored for ed25519 keys. (default 2048 for rsa keys, 256 for ecdsa keys)")
+	_        = pflag.Duration("validity", time.Hour*24, "Key lifetime. May be overridden by the CA at signing time")
+	_        = pflag.String("key_type", "", "Type of private key to generate - rsa, ecdsa or ed25519. (default \"rsa\")")
+	_        = pflag.String("key_file_prefix", "", "Prefix for filename for public key and cert (optional, no default)")
+	_        = pflag.String("public_key", "", "Sign an existing public key, such as a FIDO security key, instead of generating a new key pair")
+	_        = pflag.StringSlice("principal", nil, "Principal(s) to request. May be repeated or comma separated. (default all allowed principals)")
+	reason   = pflag.String("reason", "", "Reason for the signing request, if required by the CA")
+	passFD   = pflag.Int("passphrase_fd", -1, "Read the passphrase used to encrypt saved private keys from this file descriptor")
+	version  = pflag.Bool("version", false, "Print version and exit")
 )
 
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] [login|status|logout]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [flags] exec -- command [args...]\n\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  login   Obtain a new certificate and add it to the ssh agent (default)")
+	fmt.Fprintln(os.Stderr, "  status  List certificates in the ssh agent issued by the CA")
+	fmt.Fprintln(os.Stderr, "  logout  Remove certificates issued by the CA from the ssh agent")
+	fmt.Fprintln(os.Stderr, "  exec    Obtain a certificate and run a command with it in a temporary ssh agent")
+	fmt.Fprintln(os.Stderr, "\nFlags:")
+	pflag.PrintDefaults()
+}
+
 func main() {
+	pflag.Usage = usage
 	pflag.Parse()
 	if *version {
 		fmt.Printf("%s\n", lib.Version)
 		os.Exit(0)
 	}
 	log.SetFlags(0)
-	var err error
 
-	c, err := client.ReadConfig(*cfg)
-	if err != nil {
-		log.Printf("Configuration error: %v\n", err)
-	}
-	log.Println("Generating new key pair")
-	priv, pub, err := client.GenerateKey(client.KeyType(c.Keytype), client.KeySize(c.Keysize))
+	configs, err := client.ReadProfiles(*cfg, *profiles)
 	if err != nil {
-		log.Fatalln("Error generating key pair: ", err)
+		log.Fatalf("Configuration error: %v\n", err)
 	}
 
-	// local server to receive the token
-	ctx := context.Background()
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-	srv := startServer(c.CA)
-	defer srv.stop(ctx)
-
-	url := fmt.Sprintf("%s?localserver=%s", c.CA, srv.url())
+	switch cmd := pflag.Arg(0); cmd {
+	case "", "login":
+		// The passphrase must be read before stdin is handed to the line reader.
+		passphrase, err := readPassphrase(configs)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		input := readLines(os.Stdin)
+		for _, c := range configs {
+			if len(configs) > 1 {
+				log.Printf("Logging in to profile %q (%s)\n", c.Profile, c.CA)
+			}
+			login(c, input, passphrase)
+		}
+	case "exec":
+		args := pflag.Args()[1:]
+		if len(args) == 0 {
+			log.Println("exec requires a command to run")
+			usage()
+			os.Exit(2)
+		}
+		code, err := execCommand(configs, args, readLines(os.Stdin))
+		if err != nil {
+			log.Println(err)
+			code = 1
+		}
+		os.Exit(code)
+	case "status":
+		status(configs)
+	case "logout":
+		for _, c := range configs {
+			logout(c)
+		}
+	default:
+		log.Printf("Unknown command %q\n", cmd)
+		usage()
+		os.Exit(2)
+	}
+}
 
-	log.Println("Your browser has been opened to visit", url)
-	if err = browser.OpenURL(url); err != nil {
-		log.Println("Error launching web browser. Go to the link in your web browser")
+// connectAgent returns a client for the agent listening on $SSH_AUTH_SOCK.
+func connectAgent() (agent.ExtendedAgent, func() error, error) {
+	path := os.Getenv("SSH_AUTH_SOCK")
+	if path == "" {
+		return nil, nil, errors.New("no ssh agent found: SSH_AUTH_SOCK is not set")
+	}
+	sock, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error connecting to agent: %w", err)
 	}
+	return client.NewAgentClient(sock), sock.Close, nil
+}
 
-	var encodedToken string
-	go func() {
-		fmt.Println("Enter token, followed by a '.' on a new line: ")
-		scanner := bufio.NewScanner(os.Stdin)
-		var buffer bytes.Buffer
-		for scanner.Scan(); scanner.Text() != "."; scanner.Scan() {
-			buffer.WriteString(scanner.Text())
+// readPassphrase obtains the passphrase used to encrypt saved private keys, if
+// any of the profiles save an encrypted private key.
+func readPassphrase(configs []*client.Config) ([]byte, error) {
+	if *passFD >= 0 {
+		return client.ReadPassphraseFD(*passFD)
+	}
+	for _, c := range configs {
+		if c.PublicFilePrefix != "" && c.EncryptPrivateKey {
+			return client.PromptPassphrase()
 		}
-		encodedToken = buffer.String()
-		cancel()
-	}()
+	}
+	return nil, nil
+}
 
-	select {
-	case encodedToken = <-srv.token:
-		// got a token on the http listener
-		log.Println("Token received")
-	case <-ctx.Done():
-		// got a pasted token
+// readLines returns a function which starts reading lines from r on its
+// first call. All reads from stdin go through it so that pasted tokens and
+// prompts don't compete for input.
+func readLines(r io.Reader) func() <-chan string {
+	return sync.OnceValue(func() <-chan string {
+		lines := make(chan string)
+		go func() {
+			defer close(lines)
+			scanner := bufio.NewScanner(r)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+		}()
+		return lines
+	})
+}
+
+// promptForReason asks the user for the reason for a signing request.
+func promptForReason(input func() <-chan string) func(context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		fmt.Print("Enter message: ")
+		select {
+		case line, ok := <-input():
+			if !ok {
+				return "", errors.New("no reason entered")
+			}
+			return strings.TrimSpace(line), nil
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
 	}
+}
 
-	token, err := base64.StdEncoding.DecodeString(encodedToken)
+func status(configs []*client.Config) {
+	a, closer, err := connectAgent()
 	if err != nil {
-		log.Fatalln("Error decoding token:", err)
+		log.Fatalln(err)
+	}
+	defer closer()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PROFILE\tKEY ID\tPRINCIPALS\tEXPIRES\tISSUER")
+	found := false
+	listed := map[string]bool{}
+	for _, c := range configs {
+		// Profiles sharing a CA list the same keys.
+		if listed[c.CA] {
+			continue
+		}
+		listed[c.CA] = true
+		keys, err := client.ListKeys(a, c.CA)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		for _, k := range keys {
+			if k.Certificate == nil {
+				continue
+			}
+			found = true
+			expires := k.Expiry.Format(time.RFC1123)
+			if k.Expired() {
+				expires += " (expired)"
+			}
+			profile := k.Profile
+			if profile == "" {
+				profile = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", profile, k.KeyID, strings.Join(k.Principals, ","), expires, k.Issuer)
+		}
 	}
-	log.Println("Sending keys for signing... ")
+	if !found {
+		log.Println("No certificates found in the agent")
+		return
+	}
+	w.Flush()
+}
 
-	cert, err := client.Sign(pub, string(token), c)
+func logout(c *client.Config) {
+	a, closer, err := connectAgent()
 	if err != nil {
-		srv.respond(srvError)
 		log.Fatalln(err)
 	}
-	sock, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+	defer closer()
+	n, err := client.RemoveKeys(a, c.CA)
 	if err != nil {
-		srv.respond(srvError)
-		log.Fatalf("Error connecting to agent: %v\n", err)
-	}
-	defer sock.Close()
-	a := agent.NewClient(sock)
-	if err = client.InstallCert(a, cert, priv, c.CA); err != nil {
-		srv.respond(srvError)
 		log.Fatalln(err)
 	}
-	// If we got this far then the creds are installed and ready to use.
-	log.Println("Credentials added to agent.")
-	srv.respond(srvOK)
+	log.Printf("Removed %d keys issued by %s from the agent\n", n, c.CA)
+}
 
-	if err := client.SavePublicFiles(c.PublicFilePrefix, cert, pub); err != nil {
-		log.Fatalln(err)
+func login(c *client.Config, input func() <-chan string, passphrase []byte) {
+	opts := client.LoginOptions{
+		Config:     c,
+		Token:      &client.BrowserTokenSource{Input: input, Logf: log.Printf},
+		Message:    *reason,
+		Reason:     promptForReason(input),
+		SaveFiles:  true,
+		Passphrase: passphrase,
+		Logf:       log.Printf,
 	}
-	if err := client.SavePrivateFiles(c.PublicFilePrefix, cert, priv); err != nil {
+	if c.IDTokenFile != "" {
+		opts.Token = client.IDTokenFile(c.IDTokenFile)
+	}
+	if c.APIKeyFile != "" {
+		opts.Token = client.APIKeyFile(c.APIKeyFile)
+	}
+	// Certificates for an existing public_key are saved next to it, the
+	// agent isn't needed.
+	if c.PublicKeyFile == "" {
+		a, closer, err := connectAgent()
+		switch {
+		case err != nil && c.PublicFilePrefix == "":
+			log.Fatalf("%v and key_file_prefix is not set\n", err)
+		case err != nil:
+			log.Println(err)
+		default:
+			defer closer()
+			opts.Agent = a
+			if opts.Constraints, err = c.AgentConstraints(); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
+	res, err := client.Login(context.Background(), opts)
+	if err != nil {
 		log.Fatalln(err)
 	}
+	printSummary(res.Info)
+}
+
+// printSummary describes the issued certificate.
+func printSummary(info *lib.CertificateInfo) {
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "Certificate issued:")
+	fmt.Fprintf(w, "  Key ID:\t%s\n", info.KeyID)
+	fmt.Fprintf(w, "  Serial:\t%d\n", info.Serial)
+	fmt.Fprintf(w, "  Principals:\t%s\n", strings.Join(info.Principals, ", "))
+	fmt.Fprintf(w, "  Valid:\t%s to %s\n", info.ValidAfter.Local().Format(time.RFC1123), info.ValidBefore.Local().Format(time.RFC1123))
+	fmt.Fprintf(w, "  Extensions:\t%s\n", strings.Join(info.Extensions, ", "))
+	for opt, v := range info.CriticalOptions {
+		fmt.Fprintf(w, "  Option:\t%s=%s\n", opt, v)
+	}
+	fmt.Fprintf(w, "  CA:\t%s\n", info.CAFingerprint)
+	if info.KRLURL != "" {
+		fmt.Fprintf(w, "  Revocation list:\t%s\n", info.KRLURL)
+	}
+	if info.Reason != "" {
+		fmt.Fprintf(w, "  Reason:\t%s\n", info.Reason)
+	}
+	w.Flush()
 }
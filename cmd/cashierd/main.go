@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"os/signal"
 	"syscall"
 	"time"
@@ -61,6 +62,20 @@ func run(conf *config.Config) error {
 		return fmt.Errorf("failed to start server: %w", err)
 	}
 
+	// reload secrets on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for range hup {
+			if err := s.ReloadSecrets(); err != nil {
+				log.Printf("unable to reload secrets: %v", err)
+				continue
+			}
+			log.Print("reloaded secrets")
+		}
+	}()
+
 	// wait for a signal
 	<-ctx.Done()
 	stop()
@@ -0,0 +1,44 @@
+package lib
+
+import (
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// CertificateInfo describes an issued certificate.
+type CertificateInfo struct {
+	Serial          uint64            `json:"serial"`
+	KeyID           string            `json:"key_id"`
+	Principals      []string          `json:"principals"`
+	ValidAfter      time.Time         `json:"valid_after"`
+	ValidBefore     time.Time         `json:"valid_before"`
+	Extensions      []string          `json:"extensions"`
+	CriticalOptions map[string]string `json:"critical_options,omitempty"`
+	CAFingerprint   string            `json:"ca_fingerprint"`    // SHA256 fingerprint of the CA public key.
+	KRLURL          string            `json:"krl_url,omitempty"` // Relative to the server's address.
+	Reason          string            `json:"reason,omitempty"`
+}
+
+// NewCertificateInfo describes the certificate.
+func NewCertificateInfo(cert *ssh.Certificate) *CertificateInfo {
+	info := &CertificateInfo{
+		Serial:      cert.Serial,
+		KeyID:       cert.KeyId,
+		Principals:  cert.ValidPrincipals,
+		ValidAfter:  time.Unix(int64(cert.ValidAfter), 0).UTC(),
+		ValidBefore: time.Unix(int64(cert.ValidBefore), 0).UTC(),
+	}
+	for ext := range cert.Extensions {
+		info.Extensions = append(info.Extensions, ext)
+	}
+	sort.Strings(info.Extensions)
+	if len(cert.CriticalOptions) > 0 {
+		info.CriticalOptions = cert.CriticalOptions
+	}
+	if cert.SignatureKey != nil {
+		info.CAFingerprint = ssh.FingerprintSHA256(cert.SignatureKey)
+	}
+	return info
+}
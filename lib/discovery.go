@@ -0,0 +1,45 @@
+package lib
+
+// DiscoveryPath is where the server publishes its Discovery document.
+const DiscoveryPath = "/.well-known/cashier"
+
+// AuthFlowBrowser is the flow where the user authenticates in their browser
+// and the token is passed to the client.
+const AuthFlowBrowser = "browser"
+
+// AuthFlowLoopback is the flow where the user authenticates in their browser,
+// which is redirected to the client's loopback address with an authorization
+// code (RFC 8252). The client exchanges the code, bound to it with PKCE, for
+// the token.
+const AuthFlowLoopback = "loopback"
+
+// AuthFlowClientCert is where the client authenticates signing requests with
+// a TLS client certificate instead of a token.
+const AuthFlowClientCert = "client_cert"
+
+// AuthFlowIDToken is where a workload, such as a CI job, presents an OIDC ID
+// token issued by its platform as the bearer token.
+const AuthFlowIDToken = "id_token"
+
+// AuthFlowAPIKey is where automation presents a service account's API key as
+// the bearer token.
+const AuthFlowAPIKey = "api_key"
+
+// Discovery describes the server to clients. It is served without
+// authentication.
+type Discovery struct {
+	Version           string   `json:"version"`
+	MinClientVersion  string   `json:"min_client_version,omitempty"`
+	AuthFlows         []string `json:"auth_flows"`
+	KeyTypes          []string `json:"key_types"`    // Key types which may be signed, e.g. rsa, ecdsa, ed25519 or sk-ed25519.
+	MaxValidity       string   `json:"max_validity"` // The longest validity a certificate is issued with.
+	RequireReason     bool     `json:"require_reason"`
+	RevocationURL     string   `json:"revocation_url"` // URLs are relative to the server's address.
+	CAKeyURL          string   `json:"ca_key_url"`
+	ChallengeURL      string   `json:"challenge_url,omitempty"` // Issues challenges proving possession of a key.
+	RequireKeyProof   bool     `json:"require_key_proof,omitempty"`
+	AuthorizeURL      string   `json:"authorize_url,omitempty"`       // Starts the loopback flow.
+	TokenURL          string   `json:"token_url,omitempty"`           // Exchanges authorization codes for tokens.
+	RenewURL          string   `json:"renew_url,omitempty"`           // Renews certificates, if enabled.
+	RenewChallengeURL string   `json:"renew_challenge_url,omitempty"` // Issues challenges for renewals.
+}
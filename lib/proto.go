@@ -8,11 +8,72 @@ type SignRequest struct {
 	ValidUntil time.Time `json:"valid_until"`
 	Message    string    `json:"message"`
 	Version    string    `json:"version"`
+
+	// Principals, Extensions and SourceAddress narrow the certificate to a
+	// subset of what the user is allowed. If empty the defaults are used.
+	Principals    []string `json:"principals,omitempty"`
+	Extensions    []string `json:"extensions,omitempty"`
+	SourceAddress string   `json:"source_address,omitempty"`
+
+	// Attestation is the FIDO attestation for a security key, as written by
+	// `ssh-keygen -O write-attestation`, and AttestationChallenge the
+	// challenge the key was created with.
+	Attestation          []byte `json:"attestation,omitempty"`
+	AttestationChallenge []byte `json:"attestation_challenge,omitempty"`
+
+	// Challenge is a challenge issued by the CA, and Signature an sshsig
+	// signature of it by the key being signed, proving possession of the
+	// private key.
+	Challenge string `json:"challenge,omitempty"`
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// RenewRequest asks the server to renew a certificate. It is signed by the
+// certificate's key over a challenge issued for the certificate.
+type RenewRequest struct {
+	Cert       string    `json:"cert"` // The certificate in authorized_keys format.
+	ValidUntil time.Time `json:"valid_until"`
+	Version    string    `json:"version"`
+	Challenge  string    `json:"challenge,omitempty"`
+	Signature  []byte    `json:"signature,omitempty"` // sshsig signature of the challenge in RenewNamespace.
 }
 
+// ChallengeResponse is sent by the server with a challenge to be signed by
+// the key in the next signing request.
+type ChallengeResponse struct {
+	Challenge string    `json:"challenge"`
+	Namespace string    `json:"namespace"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// TokenResponse is sent by the server in exchange for an authorization code
+// received by the client on its loopback address.
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"` // Seconds until the token expires.
+}
+
+// ErrorCode identifies why a signing request failed.
+type ErrorCode string
+
+// Error codes returned in a SignResponse.
+const (
+	ErrorUnauthorized ErrorCode = "unauthorized"  // The token is missing, invalid or expired.
+	ErrorNeedsReason  ErrorCode = "needs_reason"  // A reason is required for the request.
+	ErrorKeyRejected  ErrorCode = "key_rejected"  // The public key or request is unacceptable.
+	ErrorPolicyDenied ErrorCode = "policy_denied" // The request asks for more than the user is allowed.
+	ErrorRateLimited  ErrorCode = "rate_limited"  // Too many requests, try again later.
+	ErrorInternal     ErrorCode = "internal"      // The server failed to sign the key.
+)
+
 // SignResponse is sent by the server.
 type SignResponse struct {
-	Status   string `json:"status"`   // Status will be "ok" or "error".
-	Response string `json:"response"` // Response will contain either the signed certificate or the error message.
-	Version  string `json:"version"`
+	Status   string    `json:"status"`          // Status will be "ok" or "error".
+	Response string    `json:"response"`        // Response will contain either the signed certificate or the error message.
+	Error    ErrorCode `json:"error,omitempty"` // Error is set if Status is "error".
+	Version  string    `json:"version"`
+
+	// Certificate describes the issued certificate if Status is "ok".
+	Certificate *CertificateInfo `json:"certificate,omitempty"`
 }
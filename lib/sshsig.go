@@ -0,0 +1,124 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SignNamespace is the sshsig namespace of signatures proving possession of
+// a key in a signing request.
+const SignNamespace = "sign@cashier"
+
+// RenewNamespace is the sshsig namespace of signatures proving possession of
+// the key of a certificate being renewed.
+const RenewNamespace = "renew@cashier"
+
+// sshsigMagic starts signatures in the format of `ssh-keygen -Y sign`, see
+// PROTOCOL.sshsig in OpenSSH.
+const sshsigMagic = "SSHSIG"
+
+type sshsigBlob struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// sshsigSignedData returns the data signed for the message.
+func sshsigSignedData(namespace, hashAlgorithm string, message []byte) ([]byte, error) {
+	var h []byte
+	switch hashAlgorithm {
+	case "sha256":
+		sum := sha256.Sum256(message)
+		h = sum[:]
+	case "sha512":
+		sum := sha512.Sum512(message)
+		h = sum[:]
+	default:
+		return nil, fmt.Errorf("unsupported ssh signature hash %q", hashAlgorithm)
+	}
+	return append([]byte(sshsigMagic), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{namespace, "", hashAlgorithm, h})...), nil
+}
+
+// SignSSHSig signs the message with an sshsig signature, as made by
+// `ssh-keygen -Y sign`. The signature is returned in binary form.
+func SignSSHSig(signer ssh.Signer, namespace string, message []byte) ([]byte, error) {
+	data, err := sshsigSignedData(namespace, "sha512", message)
+	if err != nil {
+		return nil, err
+	}
+	var sig *ssh.Signature
+	if as, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		// sshsig forbids SHA-1 RSA signatures.
+		sig, err = as.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA512)
+	} else {
+		sig, err = signer.Sign(rand.Reader, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(sshsigMagic), ssh.Marshal(sshsigBlob{
+		Version:       1,
+		PublicKey:     signer.PublicKey().Marshal(),
+		Namespace:     namespace,
+		HashAlgorithm: "sha512",
+		Signature:     ssh.Marshal(sig),
+	})...), nil
+}
+
+// ParseArmoredSSHSig returns the binary form of an armored sshsig signature,
+// the output of `ssh-keygen -Y sign`.
+func ParseArmoredSSHSig(b []byte) ([]byte, error) {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "SSH SIGNATURE" {
+		return nil, errors.New("no ssh signature found")
+	}
+	return block.Bytes, nil
+}
+
+// VerifySSHSig checks that sig is an sshsig signature of the message by the
+// public key.
+func VerifySSHSig(pub ssh.PublicKey, namespace string, message, sig []byte) error {
+	if !bytes.HasPrefix(sig, []byte(sshsigMagic)) {
+		return errors.New("not an ssh signature")
+	}
+	var blob sshsigBlob
+	if err := ssh.Unmarshal(sig[len(sshsigMagic):], &blob); err != nil {
+		return fmt.Errorf("unable to parse ssh signature: %w", err)
+	}
+	if blob.Version != 1 {
+		return fmt.Errorf("unsupported ssh signature version %d", blob.Version)
+	}
+	if !bytes.Equal(blob.PublicKey, pub.Marshal()) {
+		return errors.New("ssh signature is for a different key")
+	}
+	if blob.Namespace != namespace {
+		return fmt.Errorf("ssh signature namespace %q, expected %q", blob.Namespace, namespace)
+	}
+	data, err := sshsigSignedData(namespace, blob.HashAlgorithm, message)
+	if err != nil {
+		return err
+	}
+	s := &ssh.Signature{}
+	if err := ssh.Unmarshal(blob.Signature, s); err != nil {
+		return fmt.Errorf("unable to parse ssh signature: %w", err)
+	}
+	if pub.Type() == ssh.KeyAlgoRSA && s.Format == ssh.KeyAlgoRSA {
+		return errors.New("SHA-1 RSA ssh signatures are not accepted")
+	}
+	return pub.Verify(data, s)
+}
@@ -0,0 +1,70 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/cashier-go/cashier/testdata"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHSig(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	edSigner, _ := ssh.NewSignerFromKey(edKey)
+	rsaSigner, _ := ssh.ParsePrivateKey(testdata.Priv)
+	message := []byte("challenge")
+	for _, signer := range []ssh.Signer{edSigner, rsaSigner} {
+		sig, err := SignSSHSig(signer, SignNamespace, message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifySSHSig(signer.PublicKey(), SignNamespace, message, sig); err != nil {
+			t.Errorf("%s: unexpected error: %v", signer.PublicKey().Type(), err)
+		}
+		if err := VerifySSHSig(signer.PublicKey(), SignNamespace, []byte("other"), sig); err == nil {
+			t.Errorf("%s: expected an error for a different message", signer.PublicKey().Type())
+		}
+		if err := VerifySSHSig(signer.PublicKey(), "file", message, sig); err == nil {
+			t.Errorf("%s: expected an error for a different namespace", signer.PublicKey().Type())
+		}
+	}
+	sig, _ := SignSSHSig(edSigner, SignNamespace, message)
+	if err := VerifySSHSig(rsaSigner.PublicKey(), SignNamespace, message, sig); err == nil {
+		t.Error("expected an error for a different key")
+	}
+}
+
+func TestSSHSigKeygen(t *testing.T) {
+	keygen, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skip("ssh-keygen not found")
+	}
+	dir := t.TempDir()
+	key := filepath.Join(dir, "id_ed25519")
+	if out, err := exec.Command(keygen, "-q", "-t", "ed25519", "-N", "", "-f", key).CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	b, _ := os.ReadFile(key + ".pub")
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(keygen, "-Y", "sign", "-f", key, "-n", SignNamespace)
+	cmd.Stdin = bytes.NewReader([]byte("challenge"))
+	armored, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := ParseArmoredSSHSig(armored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySSHSig(pub, SignNamespace, []byte("challenge"), sig); err != nil {
+		t.Errorf("unable to verify ssh-keygen signature: %v", err)
+	}
+}
@@ -14,3 +14,21 @@ func TestGetPublicKey(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestNewCertificateInfo(t *testing.T) {
+	c, _, _, _, _ := ssh.ParseAuthorizedKey(testdata.Cert)
+	cert := c.(*ssh.Certificate)
+	info := NewCertificateInfo(cert)
+	if info.KeyID != cert.KeyId || info.Serial != cert.Serial {
+		t.Errorf("Unexpected info %+v", info)
+	}
+	if !reflect.DeepEqual(info.Principals, cert.ValidPrincipals) {
+		t.Errorf("Expected principals %v, got %v", cert.ValidPrincipals, info.Principals)
+	}
+	if len(info.Extensions) != len(cert.Extensions) {
+		t.Errorf("Expected extensions %v, got %v", cert.Extensions, info.Extensions)
+	}
+	if info.CAFingerprint != ssh.FingerprintSHA256(cert.SignatureKey) {
+		t.Errorf("Unexpected CA fingerprint %s", info.CAFingerprint)
+	}
+}
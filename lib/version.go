@@ -1,4 +1,60 @@
 package lib
 
+import (
+	"strconv"
+	"strings"
+)
+
 // Version string
 var Version = "unknown"
+
+// parseVersion parses a release version such as v1.2.3. Pre-release and
+// build suffixes, as added by `git describe`, are ignored.
+func parseVersion(v string) ([3]int, bool) {
+	var parsed [3]int
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) > 3 {
+		return parsed, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return parsed, false
+		}
+		parsed[i] = n
+	}
+	return parsed, true
+}
+
+// ValidVersion reports whether v is a release version such as v1.2.3.
+func ValidVersion(v string) bool {
+	_, ok := parseVersion(v)
+	return ok
+}
+
+// CompareVersions returns -1, 0 or 1 if version a is older than, the same as
+// or newer than version b. ok is false if either isn't a release version,
+// e.g. a development build.
+func CompareVersions(a, b string) (cmp int, ok bool) {
+	va, ok := parseVersion(a)
+	if !ok {
+		return 0, false
+	}
+	vb, ok := parseVersion(b)
+	if !ok {
+		return 0, false
+	}
+	for i := range va {
+		switch {
+		case va[i] < vb[i]:
+			return -1, true
+		case va[i] > vb[i]:
+			return 1, true
+		}
+	}
+	return 0, true
+}
@@ -0,0 +1,26 @@
+package lib
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		cmp  int
+		ok   bool
+	}{
+		{"v1.2.3", "v1.2.3", 0, true},
+		{"1.2", "v1.2.0", 0, true},
+		{"v1.2.3", "v1.10.0", -1, true},
+		{"v2.0.0", "v1.10.0", 1, true},
+		{"v1.2.3-4-gabcdef-dirty", "v1.2.3", 0, true},
+		{"unknown", "v1.2.3", 0, false},
+		{"v1.2.3", "abcdef", 0, false},
+		{"v1.2.3.4", "v1.2.3", 0, false},
+	}
+	for _, tt := range tests {
+		cmp, ok := CompareVersions(tt.a, tt.b)
+		if cmp != tt.cmp || ok != tt.ok {
+			t.Errorf("CompareVersions(%q, %q) = %d, %t, want %d, %t", tt.a, tt.b, cmp, ok, tt.cmp, tt.ok)
+		}
+	}
+}
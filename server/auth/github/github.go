@@ -97,13 +97,14 @@ func (c *Config) Revoke(ctx context.Context, token *oauth2.Token) error {
 }
 
 // StartSession retrieves an authentication endpoint from Github.
-func (c *Config) StartSession(state string) string {
-	return c.config.AuthCodeURL(state)
+// GitHub isn't an OpenID Connect provider, so only PKCE applies.
+func (c *Config) StartSession(s *auth.Session) string {
+	return c.config.AuthCodeURL(s.State, oauth2.S256ChallengeOption(s.Verifier))
 }
 
 // Exchange authorizes the session and returns an access token.
-func (c *Config) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
-	t, err := c.config.Exchange(ctx, code)
+func (c *Config) Exchange(ctx context.Context, code string, s *auth.Session) (*oauth2.Token, error) {
+	t, err := c.config.Exchange(ctx, code, s.ExchangeOptions()...)
 	if err != nil {
 		return nil, err
 	}
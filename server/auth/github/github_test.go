@@ -6,6 +6,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 
+	"github.com/cashier-go/cashier/server/auth"
 	"github.com/cashier-go/cashier/server/config"
 )
 
@@ -62,9 +63,10 @@ func TestStartSession(t *testing.T) {
 	a := assert.New(t)
 
 	p, _ := newGithub()
-	s := p.StartSession("test_state")
+	s := p.StartSession(&auth.Session{State: "test_state", Verifier: "test_verifier", Nonce: "test_nonce"})
 	a.Contains(s, "github.com/login/oauth/authorize")
 	a.Contains(s, "state=test_state")
+	a.Contains(s, "code_challenge_method=S256")
 	a.Contains(s, fmt.Sprintf("client_id=%s", oauthClientID))
 }
 
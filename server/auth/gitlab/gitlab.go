@@ -13,6 +13,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/cashier-go/cashier/server/auth"
 	"github.com/cashier-go/cashier/server/config"
 	"github.com/cashier-go/cashier/server/metrics"
 
@@ -221,17 +222,22 @@ func (c *Config) Revoke(ctx context.Context, token *oauth2.Token) error {
 }
 
 // StartSession retrieves an authentication endpoint from Gitlab.
-func (c *Config) StartSession(state string) string {
-	return c.config.AuthCodeURL(state)
+func (c *Config) StartSession(s *auth.Session) string {
+	return c.config.AuthCodeURL(s.State, s.AuthCodeOptions()...)
 }
 
 // Exchange authorizes the session and returns an access token.
-func (c *Config) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
-	t, err := c.config.Exchange(ctx, code)
-	if err == nil {
-		metrics.M.AuthExchange.WithLabelValues("gitlab").Inc()
+// GitLab only returns an ID token if the openid scope was granted.
+func (c *Config) Exchange(ctx context.Context, code string, s *auth.Session) (*oauth2.Token, error) {
+	t, err := c.config.Exchange(ctx, code, s.ExchangeOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.CheckNonce(t, false); err != nil {
+		return nil, err
 	}
-	return t, err
+	metrics.M.AuthExchange.WithLabelValues("gitlab").Inc()
+	return t, nil
 }
 
 // Username retrieves the username of the Gitlab user.
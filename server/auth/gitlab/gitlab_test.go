@@ -56,7 +56,7 @@ func TestGoodAllUsers(t *testing.T) {
 	a := assert.New(t)
 
 	p, _ := newGitlab()
-	s := p.StartSession("test_state")
+	s := p.StartSession(&auth.Session{State: "test_state", Verifier: "test_verifier", Nonce: "test_nonce"})
 	a.Contains(s, "exampleorg/oauth/authorize")
 	a.Contains(s, "state=test_state")
 	a.Contains(s, fmt.Sprintf("client_id=%s", oauthClientID))
@@ -78,9 +78,11 @@ func TestStartSession(t *testing.T) {
 	a := assert.New(t)
 
 	p, _ := newGitlab()
-	s := p.StartSession("test_state")
+	s := p.StartSession(&auth.Session{State: "test_state", Verifier: "test_verifier", Nonce: "test_nonce"})
 	a.Contains(s, "exampleorg/oauth/authorize")
 	a.Contains(s, "state=test_state")
+	a.Contains(s, "code_challenge_method=S256")
+	a.Contains(s, "nonce=test_nonce")
 	a.Contains(s, fmt.Sprintf("client_id=%s", oauthClientID))
 }
 
@@ -48,7 +48,7 @@ func New(c *config.Auth) (*Config, error) {
 			ClientSecret: c.OauthClientSecret,
 			RedirectURL:  c.OauthCallbackURL,
 			Endpoint:     google.Endpoint,
-			Scopes:       []string{googleapi.UserinfoEmailScope, googleapi.UserinfoProfileScope},
+			Scopes:       []string{"openid", googleapi.UserinfoEmailScope, googleapi.UserinfoProfileScope},
 		},
 		domain:    c.ProviderOpts["domain"],
 		whitelist: uw,
@@ -114,17 +114,21 @@ func (c *Config) Revoke(ctx context.Context, token *oauth2.Token) error {
 }
 
 // StartSession retrieves an authentication endpoint from Google.
-func (c *Config) StartSession(state string) string {
-	return c.config.AuthCodeURL(state, oauth2.SetAuthURLParam("hd", c.domain))
+func (c *Config) StartSession(s *auth.Session) string {
+	return c.config.AuthCodeURL(s.State, append(s.AuthCodeOptions(), oauth2.SetAuthURLParam("hd", c.domain))...)
 }
 
 // Exchange authorizes the session and returns an access token.
-func (c *Config) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
-	t, err := c.config.Exchange(ctx, code)
-	if err == nil {
-		metrics.M.AuthExchange.WithLabelValues("google").Inc()
+func (c *Config) Exchange(ctx context.Context, code string, s *auth.Session) (*oauth2.Token, error) {
+	t, err := c.config.Exchange(ctx, code, s.ExchangeOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.CheckNonce(t, true); err != nil {
+		return nil, err
 	}
-	return t, err
+	metrics.M.AuthExchange.WithLabelValues("google").Inc()
+	return t, nil
 }
 
 // Email retrieves the email address of the user.
@@ -1,10 +1,16 @@
 package google
 
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/cashier-go/cashier/server/auth"
 	"github.com/cashier-go/cashier/server/config"
+	"github.com/cashier-go/cashier/server/metrics"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -56,13 +62,38 @@ func TestStartSession(t *testing.T) {
 
 	p, err := newGoogle()
 	a.NoError(err)
-	s := p.StartSession("test_state")
+	s := p.StartSession(&auth.Session{State: "test_state", Verifier: "test_verifier", Nonce: "test_nonce"})
 	a.Contains(s, "accounts.google.com/o/oauth2/auth")
 	a.Contains(s, "state=test_state")
+	a.Contains(s, "code_challenge_method=S256")
+	a.Contains(s, "nonce=test_nonce")
 	a.Contains(s, fmt.Sprintf("hd=%s", domain))
 	a.Contains(s, fmt.Sprintf("client_id=%s", oauthClientID))
 }
 
+func TestExchange(t *testing.T) {
+	a := assert.New(t)
+	metrics.Register()
+	s := auth.NewSession()
+	var verifier string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verifier = r.FormValue("code_verifier")
+		claims := base64.RawURLEncoding.EncodeToString([]byte(`{"nonce":"` + r.FormValue("code") + `"}`))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"token","token_type":"Bearer","id_token":"e30.%s.c2ln"}`, claims)
+	}))
+	defer srv.Close()
+
+	p, err := newGoogle()
+	a.NoError(err)
+	p.config.Endpoint.TokenURL = srv.URL
+	_, err = p.Exchange(context.Background(), s.Nonce, s)
+	a.NoError(err)
+	a.Equal(s.Verifier, verifier)
+	_, err = p.Exchange(context.Background(), "other", s)
+	a.Error(err, "a token with another nonce should be rejected")
+}
+
 func newGoogle() (*Config, error) {
 	c := &config.Auth{
 		OauthClientID:     oauthClientID,
@@ -53,7 +53,7 @@ func New(c *config.Auth) (*Config, error) {
 			ClientSecret: c.OauthClientSecret,
 			RedirectURL:  c.OauthCallbackURL,
 			Endpoint:     microsoft.AzureADEndpoint(c.ProviderOpts["tenant"]),
-			Scopes:       []string{"user.Read.All", "Directory.Read.All"},
+			Scopes:       []string{"openid", "user.Read.All", "Directory.Read.All"},
 		},
 		tenant:    c.ProviderOpts["tenant"],
 		whitelist: whitelist,
@@ -183,19 +183,23 @@ func (c *Config) Revoke(ctx context.Context, token *oauth2.Token) error {
 }
 
 // StartSession retrieves an authentication endpoint from Microsoft.
-func (c *Config) StartSession(state string) string {
-	return c.config.AuthCodeURL(state,
+func (c *Config) StartSession(s *auth.Session) string {
+	return c.config.AuthCodeURL(s.State, append(s.AuthCodeOptions(),
 		oauth2.SetAuthURLParam("hd", c.tenant),
-		oauth2.SetAuthURLParam("prompt", "login"))
+		oauth2.SetAuthURLParam("prompt", "login"))...)
 }
 
 // Exchange authorizes the session and returns an access token.
-func (c *Config) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
-	t, err := c.config.Exchange(ctx, code)
-	if err == nil {
-		metrics.M.AuthExchange.WithLabelValues("microsoft").Inc()
+func (c *Config) Exchange(ctx context.Context, code string, s *auth.Session) (*oauth2.Token, error) {
+	t, err := c.config.Exchange(ctx, code, s.ExchangeOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.CheckNonce(t, true); err != nil {
+		return nil, err
 	}
-	return t, err
+	metrics.M.AuthExchange.WithLabelValues("microsoft").Inc()
+	return t, nil
 }
 
 // Email retrieves the email address of the user.
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"testing"
 
+	"github.com/cashier-go/cashier/server/auth"
 	"github.com/cashier-go/cashier/server/config"
 	"github.com/stretchr/testify/assert"
 )
@@ -56,8 +57,10 @@ func TestStartSession(t *testing.T) {
 
 	p, err := newMicrosoft()
 	a.NoError(err)
-	s := p.StartSession("test_state")
+	s := p.StartSession(&auth.Session{State: "test_state", Verifier: "test_verifier", Nonce: "test_nonce"})
 	a.Contains(s, fmt.Sprintf("login.microsoftonline.com/%s/oauth2/v2.0/authorize", tenant))
+	a.Contains(s, "code_challenge_method=S256")
+	a.Contains(s, "nonce=test_nonce")
 }
 
 func newMicrosoft() (*Config, error) {
@@ -9,8 +9,8 @@ import (
 // Provider is an abstraction of different auth methods.
 type Provider interface {
 	Name() string
-	StartSession(string) string
-	Exchange(context.Context, string) (*oauth2.Token, error)
+	StartSession(*Session) string
+	Exchange(context.Context, string, *Session) (*oauth2.Token, error)
 	Username(context.Context, *oauth2.Token) string
 	Valid(context.Context, *oauth2.Token) bool
 	Revoke(context.Context, *oauth2.Token) error
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// Session holds the secrets binding an authorization code to the login which
+// requested it.
+type Session struct {
+	// State protects the callback from cross-site request forgery.
+	State string
+	// Verifier is the PKCE code verifier, sent as an S256 challenge when the
+	// session is started and with the code when it is exchanged.
+	Verifier string
+	// Nonce is sent to OpenID Connect providers and must be returned in the
+	// ID token.
+	Nonce string
+}
+
+// NewSession returns a Session with new random secrets.
+func NewSession() *Session {
+	return &Session{
+		State:    randomString(),
+		Verifier: oauth2.GenerateVerifier(),
+		Nonce:    randomString(),
+	}
+}
+
+func randomString() string {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// AuthCodeOptions returns the options starting the session with the
+// authorization endpoint.
+func (s *Session) AuthCodeOptions() []oauth2.AuthCodeOption {
+	return []oauth2.AuthCodeOption{
+		oauth2.S256ChallengeOption(s.Verifier),
+		oauth2.SetAuthURLParam("nonce", s.Nonce),
+	}
+}
+
+// ExchangeOptions returns the options exchanging the session's authorization
+// code.
+func (s *Session) ExchangeOptions() []oauth2.AuthCodeOption {
+	return []oauth2.AuthCodeOption{oauth2.VerifierOption(s.Verifier)}
+}
+
+// CheckNonce checks that the ID token returned with the token, if any, was
+// issued for the session. If required the token must include an ID token.
+//
+// The ID token's signature isn't checked, as it was received directly from
+// the provider's token endpoint over TLS.
+func (s *Session) CheckNonce(token *oauth2.Token, required bool) error {
+	idToken, _ := token.Extra("id_token").(string)
+	if idToken == "" {
+		if required {
+			return errors.New("no ID token received")
+		}
+		return nil
+	}
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("malformed ID token: %w", err)
+	}
+	var claims struct {
+		Nonce string `json:"nonce"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return fmt.Errorf("malformed ID token: %w", err)
+	}
+	if claims.Nonce != s.Nonce {
+		return errors.New("ID token nonce doesn't match the session")
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func idToken(claims string) string {
+	return "e30." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".c2ln"
+}
+
+func TestCheckNonce(t *testing.T) {
+	s := NewSession()
+	if s.State == "" || s.Verifier == "" || s.Nonce == "" || s.State == s.Nonce {
+		t.Fatalf("Unexpected session: %+v", s)
+	}
+	withID := func(id string) *oauth2.Token {
+		return (&oauth2.Token{AccessToken: "token"}).WithExtra(map[string]interface{}{"id_token": id})
+	}
+	tests := []struct {
+		name     string
+		token    *oauth2.Token
+		required bool
+		ok       bool
+	}{
+		{"matching nonce", withID(idToken(`{"nonce":"` + s.Nonce + `"}`)), true, true},
+		{"other nonce", withID(idToken(`{"nonce":"other"}`)), false, false},
+		{"missing nonce", withID(idToken(`{}`)), false, false},
+		{"malformed", withID("abc"), false, false},
+		{"no id token", &oauth2.Token{AccessToken: "token"}, false, true},
+		{"no id token, required", &oauth2.Token{AccessToken: "token"}, true, false},
+	}
+	for _, test := range tests {
+		if err := s.CheckNonce(test.token, test.required); (err == nil) != test.ok {
+			t.Errorf("%s: unexpected result %v", test.name, err)
+		}
+	}
+}
@@ -39,12 +39,12 @@ func (c *Config) Revoke(ctx context.Context, token *oauth2.Token) error {
 }
 
 // StartSession retrieves an authentication endpoint.
-func (c *Config) StartSession(state string) string {
+func (c *Config) StartSession(s *auth.Session) string {
 	return "https://www.example.com/auth"
 }
 
 // Exchange authorizes the session and returns an access token.
-func (c *Config) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
+func (c *Config) Exchange(ctx context.Context, code string, s *auth.Session) (*oauth2.Token, error) {
 	return &oauth2.Token{
 		AccessToken: "token",
 		Expiry:      time.Now().Add(1 * time.Hour),
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cashier-go/cashier/server/signer"
+	"github.com/cashier-go/cashier/server/store"
+	"github.com/cashier-go/cashier/server/workload"
+)
+
+var errUnauthorized = errors.New("unauthorized")
+
+// signCaller is who a signing request is from.
+type signCaller struct {
+	grant signer.Grant
+	// binding binds challenges proving possession of a key to the caller.
+	binding string
+	// token is the caller's sign token, if they logged in. It's used up when
+	// a certificate is issued.
+	token *store.TokenRecord
+	// claims are the ID token claims of a workload.
+	claims map[string]interface{}
+	// serviceAccount is the service account an API key belongs to.
+	serviceAccount string
+	// provider is the name of the auth provider a user logged in with.
+	provider string
+}
+
+// signCaller authenticates a signing request, by its bearer token, which is
+// a sign token, a service account's API key or a workload's ID token, or
+// else by a verified TLS client certificate.
+func (a *application) signCaller(r *http.Request) (*signCaller, error) {
+	if token := tokenFromRequest(r); token.AccessToken != "" {
+		if strings.HasPrefix(token.AccessToken, apiKeyPrefix) {
+			if !a.serviceAccountsEnabled() {
+				return nil, errUnauthorized
+			}
+			account, err := a.serviceAccount(token.AccessToken)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %w", errUnauthorized, err)
+			}
+			grant, err := a.serviceAccountGrant(account)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %w", errUnauthorized, err)
+			}
+			return &signCaller{
+				grant:          grant,
+				binding:        token.AccessToken,
+				serviceAccount: account.Name,
+			}, nil
+		}
+		if a.workload != nil && workload.IsToken(token.AccessToken) {
+			id, err := a.workload.Verify(r.Context(), token.AccessToken)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %w", errUnauthorized, err)
+			}
+			return &signCaller{
+				grant:   id.Grant,
+				binding: token.AccessToken,
+				claims:  id.Claims,
+			}, nil
+		}
+		rec, err := a.signToken(token.AccessToken)
+		if err != nil {
+			return nil, errUnauthorized
+		}
+		p := a.provider(rec.Provider)
+		if p == nil {
+			return nil, fmt.Errorf("%w: unknown provider %q", errUnauthorized, rec.Provider)
+		}
+		return &signCaller{
+			grant:    p.grant(rec.Username),
+			binding:  token.AccessToken,
+			token:    rec,
+			provider: p.name,
+		}, nil
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		leaf := r.TLS.VerifiedChains[0][0]
+		grant, err := clientCertGrant(a.config.ClientCerts.Identities, leaf)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(leaf.Raw)
+		return &signCaller{
+			grant:   grant,
+			binding: "tls:" + hex.EncodeToString(sum[:]),
+		}, nil
+	}
+	return nil, errUnauthorized
+}
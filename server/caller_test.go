@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/cashier-go/cashier/lib"
+	"github.com/cashier-go/cashier/server/config"
+	"github.com/cashier-go/cashier/server/workload"
+	"github.com/cashier-go/cashier/testdata"
+)
+
+func TestSignIDToken(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: key.Public(), KeyID: "key1"}}})
+	}))
+	defer jwks.Close()
+	a.workload = workload.New(config.WorkloadIdentity{
+		Issuers: []config.WorkloadIssuer{{
+			URL:      "https://ci.example.com",
+			Audience: "cashier",
+			JWKSURL:  jwks.URL,
+			Policies: []config.WorkloadPolicy{{
+				Username:    "deploy",
+				Claims:      map[string]string{"repository": "example/app", "ref": "refs/heads/main"},
+				Principals:  []string{"deploy"},
+				MaxValidity: "15m",
+			}, {
+				Username:   "release",
+				Claims:     map[string]string{"repository": "example/app", "ref": "refs/heads/release"},
+				Principals: []string{"release"},
+			}},
+		}},
+	}, nil)
+	defer func() { a.workload = nil }()
+
+	// A zero validUntil is left out of the request.
+	sign := func(claims map[string]interface{}, validUntil time.Time) (int, *ssh.Certificate) {
+		t.Helper()
+		sig, _ := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, (&jose.SignerOptions{}).WithHeader("kid", "key1"))
+		token, err := jwt.Signed(sig).Claims(jwt.Claims{
+			Issuer:   "https://ci.example.com",
+			Audience: jwt.Audience{"cashier"},
+			Expiry:   jwt.NewNumericDate(time.Now().Add(5 * time.Minute)),
+		}).Claims(claims).Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := map[string]interface{}{"key": string(testdata.Pub)}
+		if !validUntil.IsZero() {
+			body["valid_until"] = validUntil
+		}
+		s, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", "/sign", bytes.NewReader(s))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp := httptest.NewRecorder()
+		a.router.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			return resp.Code, nil
+		}
+		r := &lib.SignResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(r); err != nil {
+			t.Fatal(err)
+		}
+		k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(r.Response))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Code, k.(*ssh.Certificate)
+	}
+
+	code, cert := sign(map[string]interface{}{"repository": "example/app", "ref": "refs/heads/main"}, time.Now().UTC().Add(4*time.Hour))
+	if code != http.StatusOK {
+		t.Fatalf("Unexpected status: %s", http.StatusText(code))
+	}
+	if !reflect.DeepEqual(cert.ValidPrincipals, []string{"deploy"}) {
+		t.Errorf("Unexpected principals %v", cert.ValidPrincipals)
+	}
+	if validUntil := time.Unix(int64(cert.ValidBefore), 0); validUntil.After(time.Now().Add(15 * time.Minute)) {
+		t.Errorf("Expected validity to be capped at 15m, got %s", time.Until(validUntil))
+	}
+	rec, err := a.certstore.Get(cert.KeyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(rec.Claims), &claims); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Username != "deploy" || claims["repository"] != "example/app" || claims["iss"] != "https://ci.example.com" {
+		t.Errorf("Unexpected record: %+v", rec)
+	}
+
+	if code, _ := sign(map[string]interface{}{"repository": "example/app", "ref": "refs/heads/feature"}, time.Now().UTC().Add(4*time.Hour)); code != http.StatusUnauthorized {
+		t.Errorf("Expected a token not matching a policy to be rejected, got %s", http.StatusText(code))
+	}
+
+	// Without valid_until the validity is still capped, by the policy or by
+	// default.
+	for ref, max := range map[string]time.Duration{
+		"refs/heads/main":    15 * time.Minute,
+		"refs/heads/release": workload.DefaultMaxValidity,
+	} {
+		code, cert := sign(map[string]interface{}{"repository": "example/app", "ref": ref}, time.Time{})
+		if code != http.StatusOK {
+			t.Fatalf("Unexpected status: %s", http.StatusText(code))
+		}
+		if limit := uint64(time.Now().Add(max).Unix()); cert.ValidBefore > limit {
+			t.Errorf("Expected validity for %s to be capped at %s without valid_until, got valid before %d", ref, max, cert.ValidBefore)
+		}
+	}
+}
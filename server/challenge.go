@@ -0,0 +1,60 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+// challengeTTL is how long a client has to answer a challenge.
+const challengeTTL = 5 * time.Minute
+
+type challenge struct {
+	token   [sha256.Size]byte
+	expires time.Time
+}
+
+// challengeStore holds the challenges issued to clients to prove possession
+// of their private key. Each challenge is bound to the token it was issued
+// for and may only be used once.
+type challengeStore struct {
+	mu     sync.Mutex
+	issued map[string]challenge
+}
+
+// issue returns a new challenge for the token.
+func (s *challengeStore) issue(token string) (string, time.Time, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	expires := time.Now().Add(challengeTTL)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.issued == nil {
+		s.issued = make(map[string]challenge)
+	}
+	for k, c := range s.issued {
+		if time.Now().After(c.expires) {
+			delete(s.issued, k)
+		}
+	}
+	s.issued[nonce] = challenge{token: sha256.Sum256([]byte(token)), expires: expires}
+	return nonce, expires, nil
+}
+
+// redeem reports whether the challenge was issued for the token and hasn't
+// expired. The challenge can't be redeemed again.
+func (s *challengeStore) redeem(nonce, token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.issued[nonce]
+	if !ok {
+		return false
+	}
+	delete(s.issued, nonce)
+	return c.token == sha256.Sum256([]byte(token)) && time.Now().Before(c.expires)
+}
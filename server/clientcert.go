@@ -0,0 +1,79 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"slices"
+	"time"
+
+	"go4.org/wkfs"
+
+	"github.com/cashier-go/cashier/server/config"
+	"github.com/cashier-go/cashier/server/signer"
+)
+
+// clientCertGrant returns the grant of the first identity matching a client
+// certificate.
+func clientCertGrant(identities []config.ClientCertIdentity, cert *x509.Certificate) (signer.Grant, error) {
+	for _, id := range identities {
+		if id.CommonName != "" && id.CommonName != cert.Subject.CommonName {
+			continue
+		}
+		if id.SAN != "" && !hasSAN(cert, id.SAN) {
+			continue
+		}
+		grant := signer.Grant{
+			Username:   id.Username,
+			Principals: id.Principals,
+		}
+		if id.MaxValidity != "" {
+			d, err := time.ParseDuration(id.MaxValidity)
+			if err != nil {
+				return signer.Grant{}, fmt.Errorf("invalid max_validity for %s: %w", id.Username, err)
+			}
+			grant.MaxValidity = d
+		}
+		return grant, nil
+	}
+	return signer.Grant{}, fmt.Errorf("%w: no identity for client certificate %q", errUnauthorized, cert.Subject)
+}
+
+// hasSAN reports whether a certificate has a DNS, email, IP or URI subject
+// alternative name.
+func hasSAN(cert *x509.Certificate, san string) bool {
+	if slices.Contains(cert.DNSNames, san) || slices.Contains(cert.EmailAddresses, san) {
+		return true
+	}
+	for _, ip := range cert.IPAddresses {
+		if ip.String() == san {
+			return true
+		}
+	}
+	for _, u := range cert.URIs {
+		if u.String() == san {
+			return true
+		}
+	}
+	return false
+}
+
+// clientCertAuth configures a TLS listener to verify client certificates
+// issued by the client_certs CA. Certificates are optional, since browsers
+// and token clients don't have one.
+func clientCertAuth(tlsConfig *tls.Config, conf config.ClientCerts) error {
+	if conf.CAFile == "" {
+		return nil
+	}
+	b, err := wkfs.ReadFile(conf.CAFile)
+	if err != nil {
+		return fmt.Errorf("error reading client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return fmt.Errorf("no certificates found in %s", conf.CAFile)
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
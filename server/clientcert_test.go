@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/cashier-go/cashier/lib"
+	"github.com/cashier-go/cashier/server/config"
+	"github.com/cashier-go/cashier/testdata"
+)
+
+func newClientCert(t *testing.T, cn string, uris ...string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, u := range uris {
+		parsed, _ := url.Parse(u)
+		tmpl.URIs = append(tmpl.URIs, parsed)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestSignClientCert(t *testing.T) {
+	a.config.ClientCerts = config.ClientCerts{
+		CAFile: "client_ca.pem",
+		Identities: []config.ClientCertIdentity{
+			{Username: "deploy", CommonName: "deploy", Principals: []string{"deploy"}, MaxValidity: "1h"},
+			{Username: "ci", SAN: "spiffe://example.com/ci"},
+		},
+	}
+	defer func() { a.config.ClientCerts = config.ClientCerts{} }()
+
+	sign := func(cert *x509.Certificate) (int, *ssh.Certificate) {
+		t.Helper()
+		s, _ := json.Marshal(&lib.SignRequest{
+			Key:        string(testdata.Pub),
+			ValidUntil: time.Now().UTC().Add(4 * time.Hour),
+		})
+		req, _ := http.NewRequest("POST", "/sign", bytes.NewReader(s))
+		if cert != nil {
+			req.TLS = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{cert},
+				VerifiedChains:   [][]*x509.Certificate{{cert}},
+			}
+		}
+		resp := httptest.NewRecorder()
+		a.router.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			return resp.Code, nil
+		}
+		r := &lib.SignResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(r); err != nil {
+			t.Fatal(err)
+		}
+		k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(r.Response))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Code, k.(*ssh.Certificate)
+	}
+
+	code, cert := sign(newClientCert(t, "deploy"))
+	if code != http.StatusOK {
+		t.Fatalf("Unexpected status: %s", http.StatusText(code))
+	}
+	if !reflect.DeepEqual(cert.ValidPrincipals, []string{"deploy"}) {
+		t.Errorf("Unexpected principals %v", cert.ValidPrincipals)
+	}
+	if validUntil := time.Unix(int64(cert.ValidBefore), 0); validUntil.After(time.Now().Add(time.Hour)) {
+		t.Errorf("Expected validity to be capped at 1h, got %s", time.Until(validUntil))
+	}
+	rec, err := a.certstore.Get(cert.KeyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Username != "deploy" {
+		t.Errorf("Expected the cert to be recorded for deploy, got %q", rec.Username)
+	}
+
+	code, cert = sign(newClientCert(t, "runner", "spiffe://example.com/ci"))
+	if code != http.StatusOK {
+		t.Fatalf("Unexpected status: %s", http.StatusText(code))
+	}
+	if cert.ValidPrincipals[0] != "ci" {
+		t.Errorf("Unexpected principals %v", cert.ValidPrincipals)
+	}
+
+	if code, _ := sign(newClientCert(t, "unknown")); code != http.StatusUnauthorized {
+		t.Errorf("Expected an unmapped client cert to be rejected, got %s", http.StatusText(code))
+	}
+	if code, _ := sign(nil); code != http.StatusUnauthorized {
+		t.Errorf("Expected a request without a token or client cert to be rejected, got %s", http.StatusText(code))
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	tlsConfig := &tls.Config{}
+	if err := clientCertAuth(tlsConfig, config.ClientCerts{}); err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.ClientAuth != tls.NoClientCert {
+		t.Error("Expected client certs to be disabled without a CA")
+	}
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: newClientCert(t, "ca").Raw})
+	if err := os.WriteFile(ca, pemBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := clientCertAuth(tlsConfig, config.ClientCerts{CAFile: ca}); err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.ClientAuth != tls.VerifyClientCertIfGiven || tlsConfig.ClientCAs == nil {
+		t.Error("Expected client certs to be verified")
+	}
+}
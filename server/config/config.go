@@ -4,9 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/cashier-go/cashier/lib"
 	"github.com/cashier-go/cashier/server/helpers/vault"
 	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/hcl"
@@ -33,20 +36,53 @@ type Database struct {
 
 // Server holds the configuration specific to the web server and sessions.
 type Server struct {
-	UseTLS                bool     `hcl:"use_tls"`
-	TLSKey                string   `hcl:"tls_key"`
-	TLSCert               string   `hcl:"tls_cert"`
-	LetsEncryptServername string   `hcl:"letsencrypt_servername"`
-	LetsEncryptCache      string   `hcl:"letsencrypt_cachedir"`
-	Addr                  string   `hcl:"address"`
-	Port                  int      `hcl:"port"`
-	User                  string   `hcl:"user"`
-	CookieSecret          string   `hcl:"cookie_secret"`
-	CSRFSecret            string   `hcl:"csrf_secret"`
-	HTTPLogFile           string   `hcl:"http_logfile"`
-	Database              Database `hcl:"database"`
-	RequireReason         bool     `hcl:"require_reason"`
-	ShutdownTimeout       string   `hcl:"shutdown_timeout"`
+	UseTLS                bool             `hcl:"use_tls"`
+	TLSKey                string           `hcl:"tls_key"`
+	TLSCert               string           `hcl:"tls_cert"`
+	LetsEncryptServername string           `hcl:"letsencrypt_servername"`
+	LetsEncryptCache      string           `hcl:"letsencrypt_cachedir"`
+	Addr                  string           `hcl:"address"`
+	Port                  int              `hcl:"port"`
+	User                  string           `hcl:"user"`
+	CookieSecret          string           `hcl:"cookie_secret"`
+	CookieSecrets         []string         `hcl:"cookie_secrets"`
+	CookieEncryptionKeys  []string         `hcl:"cookie_encryption_keys"`
+	CSRFSecret            string           `hcl:"csrf_secret"`
+	CSRFSecrets           []string         `hcl:"csrf_secrets"`
+	SecretsReloadInterval string           `hcl:"secrets_reload_interval"`
+	HTTPLogFile           string           `hcl:"http_logfile"`
+	Database              Database         `hcl:"database"`
+	RequireReason         bool             `hcl:"require_reason"`
+	ShutdownTimeout       string           `hcl:"shutdown_timeout"`
+	MinClientVersion      string           `hcl:"min_client_version"`
+	RequireKeyProof       bool             `hcl:"require_key_proof"`
+	MaxRenewals           int              `hcl:"max_renewals"`
+	RenewalIdentityMaxAge string           `hcl:"renewal_identity_max_age"`
+	ClientCerts           ClientCerts      `hcl:"client_certs"`
+	WorkloadIdentity      WorkloadIdentity `hcl:"workload_identity"`
+	// Admins may use the admin pages. Every user may, unless admins are
+	// configured.
+	Admins []string `hcl:"admins"`
+	// ServiceAccountPrincipals are the principals admins may give service
+	// accounts. Service accounts are disabled unless they're configured.
+	ServiceAccountPrincipals []string `hcl:"service_account_principals"`
+}
+
+// ClientCerts configures authenticating signing requests with TLS client
+// certificates.
+type ClientCerts struct {
+	CAFile     string               `hcl:"ca_file"`
+	Identities []ClientCertIdentity `hcl:"identity"`
+}
+
+// ClientCertIdentity maps client certificates, by subject common name and/or
+// subject alternative name, to the user certificates are issued to.
+type ClientCertIdentity struct {
+	Username    string   `hcl:",key"`
+	CommonName  string   `hcl:"common_name"`
+	SAN         string   `hcl:"san"`
+	Principals  []string `hcl:"principals"`
+	MaxValidity string   `hcl:"max_validity"`
 }
 
 // Auth holds the configuration specific to the OAuth provider.
@@ -57,14 +93,97 @@ type Auth struct {
 	Provider          string            `hcl:"provider"`
 	ProviderOpts      map[string]string `hcl:"provider_opts"`
 	UsersWhitelist    []string          `hcl:"users_whitelist"`
+	// AdditionalPrincipals are allowed to the provider's users as well as
+	// the ssh additional_principals.
+	AdditionalPrincipals []string `hcl:"additional_principals"`
+	// UsernamePrefix is prepended to the provider's usernames, keeping the
+	// users of different providers apart.
+	UsernamePrefix string `hcl:"username_prefix"`
+	// Logins are named providers users choose between, configured instead
+	// of a single provider.
+	Logins []*Login `hcl:"login"`
+}
+
+// Login is a named OAuth provider.
+type Login struct {
+	Name string `hcl:",key"`
+	Auth `hcl:",squash"`
+}
+
+// Providers returns the configured providers. A single provider is named
+// after its type, and login blocks share the oauth_callback_url unless they
+// set their own.
+func (a *Auth) Providers() []*Login {
+	if len(a.Logins) == 0 {
+		return []*Login{{Name: a.Provider, Auth: *a}}
+	}
+	providers := make([]*Login, 0, len(a.Logins))
+	for _, l := range a.Logins {
+		p := *l
+		if p.OauthCallbackURL == "" {
+			p.OauthCallbackURL = a.OauthCallbackURL
+		}
+		providers = append(providers, &p)
+	}
+	return providers
 }
 
 // SSH holds the configuration specific to signing ssh keys.
 type SSH struct {
-	SigningKey           string   `hcl:"signing_key"`
-	AdditionalPrincipals []string `hcl:"additional_principals"`
-	MaxAge               string   `hcl:"max_age"`
-	Permissions          []string `hcl:"permissions"`
+	SigningKey           string       `hcl:"signing_key"`
+	AdditionalPrincipals []string     `hcl:"additional_principals"`
+	MaxAge               string       `hcl:"max_age"`
+	Permissions          []string     `hcl:"permissions"`
+	KeyPolicy            KeyPolicy    `hcl:"key_policy"`
+	SecurityKeys         SecurityKeys `hcl:"security_keys"`
+}
+
+// MinRSABits is the smallest min_rsa_bits allowed, and the default.
+const MinRSABits = 2048
+
+// KeyPolicy restricts the public keys which may be signed.
+type KeyPolicy struct {
+	AllowedKeyTypes []string `hcl:"allowed_key_types"`
+	MinRSABits      int      `hcl:"min_rsa_bits"`
+	MinECDSABits    int      `hcl:"min_ecdsa_bits"`
+	Blocklist       []string `hcl:"blocklist"`
+	BlocklistFile   string   `hcl:"blocklist_file"`
+}
+
+// SecurityKeys holds the options for certificates issued to FIDO security
+// keys (sk-* keys).
+type SecurityKeys struct {
+	NoTouchRequired    bool     `hcl:"no_touch_required"`
+	VerifyRequired     bool     `hcl:"verify_required"`
+	RequireAttestation bool     `hcl:"require_attestation"`
+	AttestationRoots   string   `hcl:"attestation_roots"`
+	AllowedAAGUIDs     []string `hcl:"allowed_aaguids"`
+}
+
+// WorkloadIdentity configures authenticating signing requests with OIDC ID
+// tokens issued to workloads, such as CI jobs.
+type WorkloadIdentity struct {
+	Issuers []WorkloadIssuer `hcl:"issuer"`
+}
+
+// WorkloadIssuer is an OIDC issuer whose ID tokens are trusted, identified
+// by its issuer URL.
+type WorkloadIssuer struct {
+	URL      string `hcl:",key"`
+	Audience string `hcl:"audience"`
+	// JWKSURL is where the issuer's keys are published. If unset it's read
+	// from the issuer's OpenID configuration.
+	JWKSURL  string           `hcl:"jwks_url"`
+	Policies []WorkloadPolicy `hcl:"policy"`
+}
+
+// WorkloadPolicy maps ID tokens, by their claims, to the user certificates
+// are issued to. Claim values may be glob patterns.
+type WorkloadPolicy struct {
+	Username    string            `hcl:",key"`
+	Claims      map[string]string `hcl:"claims"`
+	Principals  []string          `hcl:"principals"`
+	MaxValidity string            `hcl:"max_validity"`
 }
 
 // AWS holds Amazon AWS configuration.
@@ -81,16 +200,115 @@ type Vault struct {
 	Token   string `hcl:"token"`
 }
 
+// CookieKeys returns the authentication keys of the session cookie, current
+// first. cookie_secrets takes precedence over cookie_secret.
+func (s *Server) CookieKeys() []string {
+	if len(s.CookieSecrets) > 0 {
+		return s.CookieSecrets
+	}
+	return []string{s.CookieSecret}
+}
+
+// CSRFKeys returns the authentication keys of CSRF tokens, current first.
+// csrf_secrets takes precedence over csrf_secret.
+func (s *Server) CSRFKeys() []string {
+	if len(s.CSRFSecrets) > 0 {
+		return s.CSRFSecrets
+	}
+	return []string{s.CSRFSecret}
+}
+
 func verifyConfig(c *Config) error {
 	var err error
 	if c.SSH == nil {
 		err = multierror.Append(err, errors.New("missing ssh config section"))
+	} else if bits := c.SSH.KeyPolicy.MinRSABits; bits != 0 && bits < MinRSABits {
+		err = multierror.Append(err, fmt.Errorf("min_rsa_bits must be at least %d", MinRSABits))
 	}
 	if c.Auth == nil {
 		err = multierror.Append(err, errors.New("missing auth config section"))
+	} else if len(c.Auth.Logins) > 0 {
+		if c.Auth.Provider != "" {
+			err = multierror.Append(err, errors.New("auth can't have both a provider and login blocks"))
+		}
+		names := map[string]bool{}
+		for _, l := range c.Auth.Logins {
+			if l.Provider == "" {
+				err = multierror.Append(err, fmt.Errorf("login %q has no provider", l.Name))
+			}
+			if names[l.Name] {
+				err = multierror.Append(err, fmt.Errorf("duplicate login %q", l.Name))
+			}
+			names[l.Name] = true
+			if l.UsernamePrefix == "" {
+				err = multierror.Append(err, fmt.Errorf("login %q has no username_prefix", l.Name))
+			}
+		}
+		for _, l := range c.Auth.Logins {
+			for _, o := range c.Auth.Logins {
+				if l != o && l.UsernamePrefix != "" && strings.HasPrefix(l.UsernamePrefix, o.UsernamePrefix) {
+					err = multierror.Append(err, fmt.Errorf("username_prefix of login %q overlaps login %q", l.Name, o.Name))
+				}
+			}
+		}
 	}
 	if c.Server == nil {
 		err = multierror.Append(err, errors.New("missing server config section"))
+	} else {
+		if c.Server.MinClientVersion != "" && !lib.ValidVersion(c.Server.MinClientVersion) {
+			err = multierror.Append(err, fmt.Errorf("invalid min_client_version %q", c.Server.MinClientVersion))
+		}
+		if len(c.Server.CookieEncryptionKeys) > len(c.Server.CookieKeys()) {
+			err = multierror.Append(err, errors.New("there are more cookie_encryption_keys than cookie secrets"))
+		}
+		if c.Server.SecretsReloadInterval != "" {
+			if _, perr := time.ParseDuration(c.Server.SecretsReloadInterval); perr != nil {
+				err = multierror.Append(err, fmt.Errorf("invalid secrets_reload_interval %q", c.Server.SecretsReloadInterval))
+			}
+		}
+		if c.Server.RenewalIdentityMaxAge != "" {
+			if _, perr := time.ParseDuration(c.Server.RenewalIdentityMaxAge); perr != nil {
+				err = multierror.Append(err, fmt.Errorf("invalid renewal_identity_max_age %q", c.Server.RenewalIdentityMaxAge))
+			}
+		}
+		if cc := c.Server.ClientCerts; cc.CAFile != "" || len(cc.Identities) > 0 {
+			if !c.Server.UseTLS || cc.CAFile == "" {
+				err = multierror.Append(err, errors.New("client_certs requires use_tls and a ca_file"))
+			}
+			for _, id := range cc.Identities {
+				if id.CommonName == "" && id.SAN == "" {
+					err = multierror.Append(err, fmt.Errorf("client_certs identity %q has no common_name or san", id.Username))
+				}
+				if id.MaxValidity != "" {
+					if _, perr := time.ParseDuration(id.MaxValidity); perr != nil {
+						err = multierror.Append(err, fmt.Errorf("invalid max_validity %q for client_certs identity %q", id.MaxValidity, id.Username))
+					}
+				}
+			}
+		}
+		if len(c.Server.ServiceAccountPrincipals) > 0 && len(c.Server.Admins) == 0 {
+			err = multierror.Append(err, errors.New("service_account_principals requires admins"))
+		}
+		for _, iss := range c.Server.WorkloadIdentity.Issuers {
+			if iss.Audience == "" {
+				err = multierror.Append(err, fmt.Errorf("workload_identity issuer %q has no audience", iss.URL))
+			}
+			for _, p := range iss.Policies {
+				if len(p.Claims) == 0 {
+					err = multierror.Append(err, fmt.Errorf("workload_identity policy %q has no claims", p.Username))
+				}
+				for _, pattern := range p.Claims {
+					if _, perr := path.Match(pattern, ""); perr != nil {
+						err = multierror.Append(err, fmt.Errorf("invalid claim pattern %q for workload_identity policy %q", pattern, p.Username))
+					}
+				}
+				if p.MaxValidity != "" {
+					if _, perr := time.ParseDuration(p.MaxValidity); perr != nil {
+						err = multierror.Append(err, fmt.Errorf("invalid max_validity %q for workload_identity policy %q", p.MaxValidity, p.Username))
+					}
+				}
+			}
+		}
 	}
 	return err
 }
@@ -135,6 +353,10 @@ func setFromVault(c *Config) error {
 	}
 	c.Auth.OauthClientID = get(c.Auth.OauthClientID)
 	c.Auth.OauthClientSecret = get(c.Auth.OauthClientSecret)
+	for _, l := range c.Auth.Logins {
+		l.OauthClientID = get(l.OauthClientID)
+		l.OauthClientSecret = get(l.OauthClientSecret)
+	}
 	c.Server.CSRFSecret = get(c.Server.CSRFSecret)
 	c.Server.CookieSecret = get(c.Server.CookieSecret)
 	c.Server.Database.Password = get(c.Server.Database.Password)
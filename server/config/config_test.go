@@ -9,15 +9,44 @@ import (
 var (
 	parsedConfig = &Config{
 		Server: &Server{
-			UseTLS:       true,
-			TLSKey:       "server.key",
-			TLSCert:      "server.crt",
-			Addr:         "127.0.0.1",
-			Port:         443,
-			User:         "nobody",
-			CookieSecret: "supersecret",
-			CSRFSecret:   "supersecret",
-			HTTPLogFile:  "cashierd.log",
+			UseTLS:                   true,
+			TLSKey:                   "server.key",
+			TLSCert:                  "server.crt",
+			Addr:                     "127.0.0.1",
+			Port:                     443,
+			User:                     "nobody",
+			CookieSecret:             "supersecret",
+			CookieSecrets:            []string{"/vault/secret/cashier/cookie_secret", "file:/etc/cashier/old_cookie_secret"},
+			CookieEncryptionKeys:     []string{"0123456789abcdef0123456789abcdef"},
+			CSRFSecret:               "supersecret",
+			CSRFSecrets:              []string{"newsecret", "supersecret"},
+			SecretsReloadInterval:    "1h",
+			HTTPLogFile:              "cashierd.log",
+			MinClientVersion:         "v1.2.0",
+			RequireKeyProof:          true,
+			MaxRenewals:              3,
+			RenewalIdentityMaxAge:    "168h",
+			Admins:                   []string{"alice"},
+			ServiceAccountPrincipals: []string{"deploy", "backup"},
+			ClientCerts: ClientCerts{
+				CAFile: "client_ca.pem",
+				Identities: []ClientCertIdentity{
+					{Username: "deploy", CommonName: "deploy", Principals: []string{"deploy"}, MaxValidity: "1h"},
+					{Username: "ci", SAN: "spiffe://example.com/ci"},
+				},
+			},
+			WorkloadIdentity: WorkloadIdentity{
+				Issuers: []WorkloadIssuer{{
+					URL:      "https://token.actions.githubusercontent.com",
+					Audience: "https://sshca.example.com",
+					Policies: []WorkloadPolicy{{
+						Username:    "deploy",
+						Claims:      map[string]string{"repository": "example/app", "ref": "refs/heads/main", "environment": "production"},
+						Principals:  []string{"deploy"},
+						MaxValidity: "15m",
+					}},
+				}},
+			},
 			Database: Database{
 				Type:     "mysql",
 				Username: "user",
@@ -38,6 +67,17 @@ var (
 			AdditionalPrincipals: []string{"ec2-user", "ubuntu"},
 			MaxAge:               "720h",
 			Permissions:          []string{"permit-pty", "permit-X11-forwarding", "permit-port-forwarding", "permit-user-rc"},
+			KeyPolicy: KeyPolicy{
+				AllowedKeyTypes: []string{"rsa", "ed25519"},
+				MinRSABits:      3072,
+				Blocklist:       []string{"SHA256:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU"},
+			},
+			SecurityKeys: SecurityKeys{
+				VerifyRequired:     true,
+				RequireAttestation: true,
+				AttestationRoots:   "fido_roots.pem",
+				AllowedAAGUIDs:     []string{"cb69481e-8ff7-4039-93ec-0a2729a154a8"},
+			},
 		},
 		AWS: &AWS{
 			Region:    "us-east-1",
@@ -63,3 +103,140 @@ func TestConfigVerify(t *testing.T) {
 	_, err := ReadConfig("testdata/empty.config")
 	assert.Contains(t, err.Error(), "missing ssh config section", "missing server config section", "missing auth config section")
 }
+
+func TestConfigVerifyMinClientVersion(t *testing.T) {
+	err := verifyConfig(&Config{
+		Server: &Server{MinClientVersion: "latest"},
+		Auth:   &Auth{},
+		SSH:    &SSH{},
+	})
+	assert.ErrorContains(t, err, `invalid min_client_version "latest"`)
+}
+
+func TestConfigVerifyDurations(t *testing.T) {
+	err := verifyConfig(&Config{
+		Server: &Server{
+			CookieSecret:          "secret",
+			CookieEncryptionKeys:  []string{"key1", "key2"},
+			SecretsReloadInterval: "hourly",
+			RenewalIdentityMaxAge: "weekly",
+		},
+		Auth: &Auth{},
+		SSH:  &SSH{},
+	})
+	assert.ErrorContains(t, err, "more cookie_encryption_keys than cookie secrets")
+	assert.ErrorContains(t, err, `invalid secrets_reload_interval "hourly"`)
+	assert.ErrorContains(t, err, `invalid renewal_identity_max_age "weekly"`)
+}
+
+func TestConfigVerifyKeyPolicy(t *testing.T) {
+	err := verifyConfig(&Config{
+		Server: &Server{},
+		Auth:   &Auth{},
+		SSH:    &SSH{KeyPolicy: KeyPolicy{MinRSABits: 1024}},
+	})
+	assert.ErrorContains(t, err, "min_rsa_bits must be at least 2048")
+	err = verifyConfig(&Config{
+		Server: &Server{},
+		Auth:   &Auth{},
+		SSH:    &SSH{KeyPolicy: KeyPolicy{MinRSABits: 4096}},
+	})
+	assert.NoError(t, err)
+}
+
+func TestConfigVerifyServiceAccounts(t *testing.T) {
+	err := verifyConfig(&Config{
+		Server: &Server{ServiceAccountPrincipals: []string{"deploy"}},
+		Auth:   &Auth{},
+		SSH:    &SSH{},
+	})
+	assert.ErrorContains(t, err, "service_account_principals requires admins")
+}
+
+func TestConfigVerifyClientCerts(t *testing.T) {
+	err := verifyConfig(&Config{
+		Server: &Server{
+			ClientCerts: ClientCerts{
+				Identities: []ClientCertIdentity{{Username: "deploy", MaxValidity: "forever"}},
+			},
+		},
+		Auth: &Auth{},
+		SSH:  &SSH{},
+	})
+	assert.ErrorContains(t, err, "client_certs requires use_tls and a ca_file")
+	assert.ErrorContains(t, err, `client_certs identity "deploy" has no common_name or san`)
+	assert.ErrorContains(t, err, `invalid max_validity "forever" for client_certs identity "deploy"`)
+}
+
+func TestConfigVerifyWorkloadIdentity(t *testing.T) {
+	err := verifyConfig(&Config{
+		Server: &Server{
+			WorkloadIdentity: WorkloadIdentity{
+				Issuers: []WorkloadIssuer{{
+					URL: "https://token.actions.githubusercontent.com",
+					Policies: []WorkloadPolicy{
+						{Username: "any"},
+						{Username: "deploy", Claims: map[string]string{"ref": "refs/[heads"}, MaxValidity: "forever"},
+					},
+				}},
+			},
+		},
+		Auth: &Auth{},
+		SSH:  &SSH{},
+	})
+	assert.ErrorContains(t, err, `workload_identity issuer "https://token.actions.githubusercontent.com" has no audience`)
+	assert.ErrorContains(t, err, `workload_identity policy "any" has no claims`)
+	assert.ErrorContains(t, err, `invalid claim pattern "refs/[heads" for workload_identity policy "deploy"`)
+	assert.ErrorContains(t, err, `invalid max_validity "forever" for workload_identity policy "deploy"`)
+}
+
+func TestConfigLogins(t *testing.T) {
+	c, err := ReadConfig("testdata/logins.config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	providers := c.Auth.Providers()
+	assert.Len(t, providers, 2)
+	assert.Equal(t, &Login{
+		Name: "contractors",
+		Auth: Auth{
+			OauthClientID:     "github-client",
+			OauthClientSecret: "github-secret",
+			OauthCallbackURL:  "https://sshca.example.com/auth/callback",
+			Provider:          "github",
+			UsersWhitelist:    []string{"alice", "bob"},
+			UsernamePrefix:    "c-",
+		},
+	}, providers[0])
+	assert.Equal(t, "employees", providers[1].Name)
+	assert.Equal(t, map[string]string{"domain": "example.com"}, providers[1].ProviderOpts)
+	assert.Equal(t, []string{"ops"}, providers[1].AdditionalPrincipals)
+
+	single := (&Auth{Provider: "github"}).Providers()
+	assert.Equal(t, "github", single[0].Name)
+
+	err = verifyConfig(&Config{
+		Server: &Server{},
+		Auth: &Auth{
+			Provider: "github",
+			Logins:   []*Login{{Name: "a", Auth: Auth{Provider: "github"}}, {Name: "a"}},
+		},
+		SSH: &SSH{},
+	})
+	assert.ErrorContains(t, err, "auth can't have both a provider and login blocks")
+	assert.ErrorContains(t, err, `login "a" has no provider`)
+	assert.ErrorContains(t, err, `duplicate login "a"`)
+	assert.ErrorContains(t, err, `login "a" has no username_prefix`)
+
+	err = verifyConfig(&Config{
+		Server: &Server{},
+		Auth: &Auth{
+			Logins: []*Login{
+				{Name: "a", Auth: Auth{Provider: "github", UsernamePrefix: "gh-"}},
+				{Name: "b", Auth: Auth{Provider: "google", UsernamePrefix: "g"}},
+			},
+		},
+		SSH: &SSH{},
+	})
+	assert.ErrorContains(t, err, `username_prefix of login "a" overlaps login "b"`)
+}
@@ -1,22 +1,22 @@
 package server
 
 import (
-	"crypto/rand"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
-	"io"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
 
 	"github.com/gorilla/csrf"
+	"golang.org/x/crypto/ssh"
 	"golang.org/x/oauth2"
 
 	"github.com/cashier-go/cashier/lib"
+	"github.com/cashier-go/cashier/server/auth"
+	"github.com/cashier-go/cashier/server/signer"
 	"github.com/cashier-go/cashier/server/store"
 	"github.com/cashier-go/cashier/server/templates"
 )
@@ -31,75 +31,213 @@ func tokenFromRequest(r *http.Request) *oauth2.Token {
 	return token
 }
 
+// writeSignError sends a failed SignResponse.
+func writeSignError(w http.ResponseWriter, code int, errCode lib.ErrorCode, err error) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&lib.SignResponse{
+		Status:   "error",
+		Response: fmt.Sprintf("%s: %s", http.StatusText(code), err),
+		Error:    errCode,
+		Version:  lib.Version,
+	})
+}
+
 func (a *application) sign(w http.ResponseWriter, r *http.Request) {
 	var (
-		errNeedsReason  = errors.New("signing request needs a reason")
-		errUnauthorized = errors.New("unauthorized")
-		errSigningKey   = errors.New("error signing key")
+		errNeedsReason = errors.New("signing request needs a reason")
+		errSigningKey  = errors.New("error signing key")
 	)
 
-	fail := func(w http.ResponseWriter, code int, err error) {
-		w.WriteHeader(code)
-		json.NewEncoder(w).Encode(&lib.SignResponse{
-			Status:   "error",
-			Response: fmt.Sprintf("%s: %s", http.StatusText(code), err),
-		})
-	}
+	fail := writeSignError
 
-	ctx := r.Context()
-	token := tokenFromRequest(r)
-	if !a.authprovider.Valid(ctx, token) {
-		fail(w, http.StatusUnauthorized, errUnauthorized)
+	caller, err := a.signCaller(r)
+	if err != nil {
+		fail(w, http.StatusUnauthorized, lib.ErrorUnauthorized, err)
 		return
 	}
 
 	// Attempt to sign the pubkey and return a SignResponse.
 	req := lib.SignRequest{}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		fail(w, http.StatusBadRequest, err)
+		fail(w, http.StatusBadRequest, lib.ErrorKeyRejected, err)
 		return
 	}
 
+	if minVersion := a.config.MinClientVersion; minVersion != "" {
+		if cmp, ok := lib.CompareVersions(req.Version, minVersion); ok && cmp < 0 {
+			fail(w, http.StatusUpgradeRequired, lib.ErrorPolicyDenied, fmt.Errorf("client version %s is older than the minimum supported version %s", req.Version, minVersion))
+			return
+		}
+	}
+
 	if a.requireReason && req.Message == "" {
+		// X-Need-Reason is kept for clients which predate error codes.
 		w.Header().Add("X-Need-Reason", "required")
-		fail(w, http.StatusForbidden, errNeedsReason)
+		fail(w, http.StatusForbidden, lib.ErrorNeedsReason, errNeedsReason)
 		return
 	}
 
-	username := a.authprovider.Username(ctx, token)
-	a.authprovider.Revoke(ctx, token) // We don't need this anymore.
-	cert, err := a.keysigner.SignUserKey(&req, username)
-	if err != nil {
-		fail(w, http.StatusInternalServerError, fmt.Errorf("%w: %w", errSigningKey, err))
+	if req.Challenge != "" || a.config.RequireKeyProof {
+		if err := a.verifyKeyProof(&req, caller.binding); err != nil {
+			fail(w, http.StatusBadRequest, lib.ErrorKeyRejected, err)
+			return
+		}
+	}
+
+	cert, err := a.keysigner.SignUserKeyFor(&req, caller.grant)
+	switch {
+	case errors.Is(err, signer.ErrInvalidKey), errors.Is(err, signer.ErrKeyRejected), errors.Is(err, signer.ErrInvalidRequest):
+		fail(w, http.StatusBadRequest, lib.ErrorKeyRejected, err)
+		return
+	case errors.Is(err, signer.ErrNotPermitted):
+		fail(w, http.StatusForbidden, lib.ErrorPolicyDenied, err)
+		return
+	case err != nil:
+		fail(w, http.StatusInternalServerError, lib.ErrorInternal, fmt.Errorf("%w: %w", errSigningKey, err))
 		return
 	}
 
+	// The token is only used up once a cert can be issued, so that a
+	// rejected request can be corrected and retried.
+	if caller.token != nil {
+		if err := a.certstore.UseToken(caller.token.Hash); err != nil {
+			fail(w, http.StatusUnauthorized, lib.ErrorUnauthorized, errUnauthorized)
+			return
+		}
+	}
+
 	rec := store.MakeRecord(cert)
 	rec.Message = req.Message
+	rec.Username = caller.grant.Username
+	rec.ServiceAccount = caller.serviceAccount
+	rec.Provider = caller.provider
+	if caller.claims != nil {
+		b, err := json.Marshal(caller.claims)
+		if err != nil {
+			log.Printf("Error encoding claims: %v", err)
+		}
+		rec.Claims = string(b)
+	}
 	if err := a.certstore.SetRecord(rec); err != nil {
 		log.Printf("Error recording cert: %v", err)
 	}
+	info := lib.NewCertificateInfo(cert)
+	info.KRLURL = "/revoked"
+	info.Reason = req.Message
 	if err := json.NewEncoder(w).Encode(&lib.SignResponse{
-		Status:   "ok",
-		Response: string(lib.GetPublicKey(cert)),
+		Status:      "ok",
+		Response:    string(lib.GetPublicKey(cert)),
+		Version:     lib.Version,
+		Certificate: info,
 	}); err != nil {
-		fail(w, http.StatusInternalServerError, fmt.Errorf("%w: %w", errSigningKey, err))
+		fail(w, http.StatusInternalServerError, lib.ErrorInternal, fmt.Errorf("%w: %w", errSigningKey, err))
 		return
 	}
 }
 
+// verifyKeyProof checks that the request is signed by the key being signed,
+// over a challenge issued to the caller.
+func (a *application) verifyKeyProof(req *lib.SignRequest, binding string) error {
+	if req.Challenge == "" || len(req.Signature) == 0 {
+		return errors.New("a signed challenge is required to prove possession of the key")
+	}
+	if !a.challenges.redeem(req.Challenge, binding) {
+		return errors.New("unknown or expired challenge")
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.Key))
+	if err != nil {
+		return fmt.Errorf("%w: %w", signer.ErrInvalidKey, err)
+	}
+	if err := lib.VerifySSHSig(pub, lib.SignNamespace, []byte(req.Challenge), req.Signature); err != nil {
+		return fmt.Errorf("invalid challenge signature: %w", err)
+	}
+	return nil
+}
+
+// signChallenge issues a challenge to be signed by the key in the next
+// signing request.
+func (a *application) signChallenge(w http.ResponseWriter, r *http.Request) {
+	caller, err := a.signCaller(r)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	challenge, expires, err := a.challenges.issue(caller.binding)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&lib.ChallengeResponse{
+		Challenge: challenge,
+		Namespace: lib.SignNamespace,
+		ExpiresAt: expires,
+	})
+}
+
+func (a *application) discovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	d := &lib.Discovery{
+		Version:          lib.Version,
+		MinClientVersion: a.config.MinClientVersion,
+		AuthFlows:        []string{lib.AuthFlowBrowser, lib.AuthFlowLoopback},
+		KeyTypes:         a.keysigner.KeyTypes(),
+		MaxValidity:      a.keysigner.MaxValidity().String(),
+		RequireReason:    a.requireReason,
+		RevocationURL:    "/revoked",
+		CAKeyURL:         "/ca.pub",
+		ChallengeURL:     "/sign/challenge",
+		RequireKeyProof:  a.config.RequireKeyProof,
+		AuthorizeURL:     "/auth/authorize",
+		TokenURL:         "/auth/token",
+	}
+	if a.serviceAccountsEnabled() {
+		d.AuthFlows = append(d.AuthFlows, lib.AuthFlowAPIKey)
+	}
+	if a.config.ClientCerts.CAFile != "" {
+		d.AuthFlows = append(d.AuthFlows, lib.AuthFlowClientCert)
+	}
+	if a.workload != nil {
+		d.AuthFlows = append(d.AuthFlows, lib.AuthFlowIDToken)
+	}
+	if a.config.MaxRenewals > 0 {
+		d.RenewURL = "/renew"
+		d.RenewChallengeURL = "/renew/challenge"
+	}
+	json.NewEncoder(w).Encode(d)
+}
+
+func (a *application) caPublicKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(ssh.MarshalAuthorizedKey(a.keysigner.PublicKey()))
+}
+
 func (a *application) auth(w http.ResponseWriter, r *http.Request) {
 	switch r.URL.EscapedPath() {
 	case "/auth/login":
-		buf := make([]byte, 32)
-		io.ReadFull(rand.Reader, buf)
-		state := hex.EncodeToString(buf)
-		a.setSessionVariable(w, r, "state", state)
-		http.Redirect(w, r, a.authprovider.StartSession(state), http.StatusFound)
+		name := r.FormValue("provider")
+		if name == "" && len(a.authproviders) > 1 {
+			tmpl := template.Must(template.New("login.html").Parse(templates.Login))
+			tmpl.Execute(w, map[string]interface{}{
+				"Providers": a.providerNames(),
+			})
+			return
+		}
+		p := a.requestProvider(r)
+		if p == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Unknown provider %q", name)
+			return
+		}
+		s := auth.NewSession()
+		a.setSessionVariable(w, r, "provider", p.name)
+		a.setAuthSession(w, r, s)
+		http.Redirect(w, r, p.StartSession(s), http.StatusFound)
 	case "/auth/callback":
 		ctx := r.Context()
-		state := a.getSessionVariable(r, "state")
-		if r.FormValue("state") != state {
+		s := a.getAuthSession(r)
+		p := a.sessionProvider(r)
+		if s.State == "" || r.FormValue("state") != s.State || p == nil {
 			log.Printf("Not authorized on /auth/callback")
 			w.WriteHeader(http.StatusUnauthorized)
 			fmt.Fprint(w, http.StatusText(http.StatusUnauthorized))
@@ -110,7 +248,9 @@ func (a *application) auth(w http.ResponseWriter, r *http.Request) {
 			originURL = "/"
 		}
 		code := r.FormValue("code")
-		token, err := a.authprovider.Exchange(r.Context(), code)
+		// The session's secrets can only be used once.
+		a.setAuthSession(w, r, &auth.Session{})
+		token, err := p.Exchange(r.Context(), code, s)
 		if err != nil {
 			log.Printf("Error on /auth/callback: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -121,18 +261,143 @@ func (a *application) auth(w http.ResponseWriter, r *http.Request) {
 		a.setAuthToken(w, r, token)
 
 		// if we don't check the token here, it gets into an auth loop
-		if !a.authprovider.Valid(ctx, token) {
+		if !p.Valid(ctx, token) {
 			log.Printf("Not authorized")
 			w.WriteHeader(http.StatusUnauthorized)
 			fmt.Fprint(w, http.StatusText(http.StatusUnauthorized))
 			return
 		}
+		// A session ID planted before the login mustn't be logged in.
+		if err := a.renewSessionID(w, r); err != nil {
+			log.Printf("Error on /auth/callback: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		// The username and provider identify the user's sessions.
+		username := p.username(ctx, token)
+		a.setSessionVariable(w, r, "username", username)
+		if err := a.cacheIdentity(username, p.name, token); err != nil {
+			log.Printf("Error caching identity of %s: %v", username, err)
+		}
 		http.Redirect(w, r, originURL, http.StatusFound)
 	default:
 		w.WriteHeader(http.StatusInternalServerError)
 	}
 }
 
+// logoutPage asks the user to confirm logging out, as logout only accepts
+// POST requests with a CSRF token.
+func (a *application) logoutPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-CSRF-Token", csrf.Token(r))
+	tmpl := template.Must(template.New("logout.html").Parse(templates.Logout))
+	tmpl.Execute(w, map[string]interface{}{
+		csrf.TemplateTag: csrf.TemplateField(r),
+	})
+}
+
+// logout deletes the user's session and cached identity, and revokes their
+// upstream token.
+func (a *application) logout(w http.ResponseWriter, r *http.Request) {
+	if username, p := a.getSessionVariable(r, "username"), a.sessionProvider(r); username != "" && p != nil {
+		if err := a.certstore.DeleteIdentity(p.name, username); err != nil {
+			log.Printf("Error on /auth/logout: %v", err)
+		}
+	}
+	if token, p := a.getAuthToken(r), a.sessionProvider(r); token.AccessToken != "" && p != nil {
+		if err := p.Revoke(r.Context(), token); err != nil {
+			log.Printf("Error revoking token on /auth/logout: %v", err)
+		}
+	}
+	if err := a.destroySession(w, r); err != nil {
+		log.Printf("Error on /auth/logout: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	fmt.Fprint(w, "You have been logged out")
+}
+
+// authorize asks the user to confirm that the client on their computer may
+// log in. Codes are only issued once the user confirms, by confirmAuthorize.
+func (a *application) authorize(w http.ResponseWriter, r *http.Request) {
+	redirect, challenge, err := authorizeRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	// The confirmation mustn't be framed by another site.
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("X-CSRF-Token", csrf.Token(r))
+	tmpl := template.Must(template.New("authorize.html").Parse(templates.Authorize))
+	tmpl.Execute(w, map[string]interface{}{
+		csrf.TemplateTag: csrf.TemplateField(r),
+		"Redirect":       redirect.Scheme + "://" + redirect.Host,
+		"Username":       a.getSessionVariable(r, "username"),
+		"Params": map[string]string{
+			"redirect_uri":          r.FormValue("redirect_uri"),
+			"state":                 r.FormValue("state"),
+			"code_challenge":        challenge,
+			"code_challenge_method": "S256",
+		},
+	})
+}
+
+// confirmAuthorize sends the user's browser to the client's loopback address
+// with an authorization code, which the client exchanges for a sign token.
+// The code is bound to the client with PKCE.
+func (a *application) confirmAuthorize(w http.ResponseWriter, r *http.Request) {
+	redirect, challenge, err := authorizeRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	p := a.sessionProvider(r)
+	username := p.username(r.Context(), a.getAuthToken(r))
+	code, err := a.mintToken(username, p.name, codeAudience, challenge, codeTTL)
+	if err != nil {
+		log.Printf("Error issuing authorization code: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	q := redirect.Query()
+	q.Set("code", code)
+	q.Set("state", r.FormValue("state"))
+	redirect.RawQuery = q.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// exchangeCode exchanges an authorization code for a sign token.
+func (a *application) exchangeCode(w http.ResponseWriter, r *http.Request) {
+	rec, err := a.lookupToken(r.FormValue("code"), codeAudience)
+	if err == nil && rec.CodeChallenge != oauth2.S256ChallengeFromVerifier(r.FormValue("code_verifier")) {
+		err = errors.New("code_verifier doesn't match the code_challenge")
+	}
+	if err == nil {
+		err = a.certstore.UseToken(rec.Hash)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s: %v", http.StatusText(http.StatusBadRequest), err), http.StatusBadRequest)
+		return
+	}
+	token, err := a.mintSignToken(rec.Username, rec.Provider)
+	if err != nil {
+		log.Printf("Error issuing sign token: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(&lib.TokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(signTokenTTL.Seconds()),
+	})
+}
+
 func (a *application) index(w http.ResponseWriter, r *http.Request) {
 	localserver := r.FormValue("localserver")
 	tok := a.getAuthToken(r)
@@ -141,12 +406,24 @@ func (a *application) index(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, http.StatusText(400))
 		return
 	}
+	p := a.sessionProvider(r)
+	signToken, err := a.mintSignToken(p.username(r.Context(), tok), p.name)
+	if err != nil {
+		log.Printf("Error issuing sign token: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, http.StatusText(http.StatusInternalServerError))
+		return
+	}
 	page := struct {
 		Token       string
 		Localserver string
+		Expiry      string
+		CSRFField   template.HTML
 	}{
-		Token:       encodeToken(tok.AccessToken),
+		Token:       encodeToken(signToken),
 		Localserver: localserver,
+		Expiry:      fmt.Sprintf("%d minutes", int(signTokenTTL.Minutes())),
+		CSRFField:   csrf.TemplateField(r),
 	}
 	tmpl := template.Must(template.New("token.html").Parse(templates.Token))
 	tmpl.Execute(w, page)
@@ -174,6 +451,7 @@ func (a *application) getAllCerts(w http.ResponseWriter, r *http.Request) {
 	tmpl := template.Must(template.New("certs.html").Parse(templates.Certs))
 	tmpl.Execute(w, map[string]interface{}{
 		csrf.TemplateTag: csrf.TemplateField(r),
+		"Providers":      a.providerNames(),
 	})
 }
 
@@ -192,6 +470,49 @@ func (a *application) getCertsJSON(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// revokeSessions logs a provider's user out of all their sessions, revoking
+// the upstream tokens held by the sessions.
+func (a *application) revokeSessions(w http.ResponseWriter, r *http.Request) {
+	username := r.FormValue("username")
+	if username == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "A username is required")
+		return
+	}
+	p := a.requestProvider(r)
+	if p == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unknown provider %q", r.FormValue("provider"))
+		return
+	}
+	sessions, err := a.certstore.UserSessions(p.name, username)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Unable to revoke sessions")
+		return
+	}
+	for _, s := range sessions {
+		values, _ := decodeSessionData(s.Data)
+		token := &oauth2.Token{}
+		if json.Unmarshal([]byte(values["token"]), token) == nil && token.AccessToken != "" {
+			p.Revoke(r.Context(), token)
+		}
+		if err := a.certstore.DeleteSession(s.ID); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, "Unable to revoke sessions")
+			return
+		}
+	}
+	// Certificates can't be renewed without logging in again.
+	if err := a.certstore.DeleteIdentity(p.name, username); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Unable to revoke sessions")
+		return
+	}
+	log.Printf("Revoked %d sessions of %s of %s", len(sessions), username, p.name)
+	http.Redirect(w, r, "/admin/certs", http.StatusSeeOther)
+}
+
 func (a *application) revoke(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	if err := a.certstore.Revoke(r.Form["cert_id"]); err != nil {
@@ -2,12 +2,16 @@ package server
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
@@ -16,10 +20,10 @@ import (
 	"golang.org/x/oauth2"
 
 	"github.com/gorilla/mux"
-	"github.com/gorilla/sessions"
 	"github.com/stripe/krl"
 
 	"github.com/cashier-go/cashier/lib"
+	"github.com/cashier-go/cashier/server/auth"
 	"github.com/cashier-go/cashier/server/auth/testprovider"
 	"github.com/cashier-go/cashier/server/config"
 	"github.com/cashier-go/cashier/server/signer"
@@ -40,16 +44,26 @@ func init() {
 	})
 	certstore, _ := store.New(config.Database{Type: "mem"})
 	a = &application{
-		cookiestore:  sessions.NewCookieStore([]byte("secret")),
-		authprovider: testprovider.New(),
-		keysigner:    keysigner,
-		certstore:    certstore,
-		router:       mux.NewRouter(),
-		config:       &config.Server{CSRFSecret: "0123456789abcdef"},
+		sessionstore:  newSessionStore(certstore, []byte("secret")),
+		csrf:          newCSRFProtect(false, []byte("0123456789abcdef")),
+		authproviders: []*authProvider{{Provider: testprovider.New(), name: "testprovider"}},
+		keysigner:     keysigner,
+		certstore:     certstore,
+		router:        mux.NewRouter(),
+		config:        &config.Server{CookieSecret: "secret", CSRFSecret: "0123456789abcdef"},
 	}
 	a.setupRoutes()
 }
 
+func newSignToken(t *testing.T) string {
+	t.Helper()
+	token, err := a.mintSignToken("test", "testprovider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
 func TestLoginHandler(t *testing.T) {
 	req, _ := http.NewRequest("GET", "/auth/login", nil)
 	resp := httptest.NewRecorder()
@@ -59,11 +73,39 @@ func TestLoginHandler(t *testing.T) {
 	}
 }
 
+func TestCallbackRenewsSessionID(t *testing.T) {
+	// The session an attacker planted in the victim's browser.
+	req, _ := http.NewRequest("GET", "/auth/callback?state=state&code=abcdef", nil)
+	resp := httptest.NewRecorder()
+	a.setSessionVariable(resp, req, "provider", "testprovider")
+	a.setAuthSession(resp, req, &auth.Session{State: "state"})
+	planted := resp.Result().Cookies()[0]
+	req.AddCookie(planted)
+
+	resp = httptest.NewRecorder()
+	a.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusFound {
+		t.Fatalf("Unexpected status: %s", http.StatusText(resp.Code))
+	}
+	cookies := resp.Result().Cookies()
+	if last := cookies[len(cookies)-1]; last.Value == planted.Value {
+		t.Error("Expected a new session cookie")
+	}
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(planted)
+	resp = httptest.NewRecorder()
+	a.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusSeeOther {
+		t.Errorf("Expected the planted session not to be logged in, got %s", http.StatusText(resp.Code))
+	}
+}
+
 func TestCallbackHandler(t *testing.T) {
 	req, _ := http.NewRequest("GET", "/auth/callback", nil)
 	req.Form = url.Values{"state": []string{"state"}, "code": []string{"abcdef"}}
 	resp := httptest.NewRecorder()
 	a.setSessionVariable(resp, req, "state", "state")
+	a.setSessionVariable(resp, req, "provider", "testprovider")
 	for _, cookie := range resp.Result().Cookies() {
 		req.AddCookie(cookie)
 	}
@@ -81,12 +123,32 @@ func TestRootHandler(t *testing.T) {
 		Expiry:      time.Now().Add(1 * time.Hour),
 	}
 	a.setAuthToken(resp, req, tok)
+	a.setSessionVariable(resp, req, "provider", "testprovider")
 	for _, cookie := range resp.Result().Cookies() {
 		req.AddCookie(cookie)
 	}
 	a.router.ServeHTTP(resp, req)
-	if resp.Code != http.StatusOK && !strings.Contains(resp.Body.String(), "XXX_TEST_TOKEN_STRING_XXX") {
-		t.Error("Unable to find token in response")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Unexpected status: %s", http.StatusText(resp.Code))
+	}
+	body := resp.Body.String()
+	if strings.Contains(body, "XXX_TEST_TOKEN_STRING_XXX") || strings.Contains(body, base64.StdEncoding.EncodeToString([]byte("XXX_TEST_TOKEN_STRING_XXX"))) {
+		t.Error("The upstream token was shown to the user")
+	}
+	m := regexp.MustCompile(`>([A-Za-z0-9+/=\n]+)\.</textarea>`).FindStringSubmatch(body)
+	if m == nil {
+		t.Fatal("Unable to find token in response")
+	}
+	token, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(m[1], "\n", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := a.signToken(string(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Username != "test" {
+		t.Errorf("Unexpected username %q", rec.Username)
 	}
 }
 
@@ -99,6 +161,245 @@ func TestRootHandlerNoSession(t *testing.T) {
 	}
 }
 
+func TestSessionCookie(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	resp := httptest.NewRecorder()
+	a.setAuthToken(resp, req, &oauth2.Token{AccessToken: "XXX_TEST_TOKEN_STRING_XXX"})
+	cookies := resp.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected a single cookie, got %d", len(cookies))
+	}
+	if strings.Contains(cookies[0].Value, "XXX_TEST_TOKEN_STRING_XXX") {
+		t.Error("The upstream token was stored in the cookie")
+	}
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	if tok := a.getAuthToken(req); tok.AccessToken != "XXX_TEST_TOKEN_STRING_XXX" {
+		t.Errorf("Unexpected token %q", tok.AccessToken)
+	}
+
+	// A forged session ID is ignored.
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "session", Value: "forged"})
+	if tok := a.getAuthToken(req); tok.AccessToken != "" {
+		t.Errorf("Unexpected token %q", tok.AccessToken)
+	}
+}
+
+// loggedIn returns the cookie of a new session for the user.
+func loggedIn(t *testing.T, username string) *http.Cookie {
+	t.Helper()
+	return loggedInWith(t, "testprovider", username)
+}
+
+// loggedInWith returns the cookie of a session logged in with the provider.
+func loggedInWith(t *testing.T, provider, username string) *http.Cookie {
+	t.Helper()
+	req, _ := http.NewRequest("GET", "/", nil)
+	resp := httptest.NewRecorder()
+	a.setAuthToken(resp, req, &oauth2.Token{AccessToken: "token", Expiry: time.Now().Add(time.Hour)})
+	a.setSessionVariable(resp, req, "provider", provider)
+	a.setSessionVariable(resp, req, "username", username)
+	return resp.Result().Cookies()[0]
+}
+
+// logout logs the session out from the logout page.
+func logout(t *testing.T, cookie *http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	req, _ := http.NewRequest("GET", "/auth/logout", nil)
+	req.AddCookie(cookie)
+	resp := httptest.NewRecorder()
+	a.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Unexpected status: %s", http.StatusText(resp.Code))
+	}
+	req, _ = http.NewRequest("POST", "/auth/logout", nil)
+	req.Header.Set("X-CSRF-Token", resp.Result().Header.Get("X-CSRF-Token"))
+	req.AddCookie(cookie)
+	for _, c := range resp.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	resp = httptest.NewRecorder()
+	a.router.ServeHTTP(resp, req)
+	return resp
+}
+
+func TestLogout(t *testing.T) {
+	cookie := loggedIn(t, "test")
+	req, _ := http.NewRequest("POST", "/auth/logout", nil)
+	req.AddCookie(cookie)
+	resp := httptest.NewRecorder()
+	a.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusForbidden {
+		t.Errorf("Expected a logout without a CSRF token to be rejected, got %s", http.StatusText(resp.Code))
+	}
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	resp = httptest.NewRecorder()
+	a.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Errorf("Expected the session to still be logged in, got %s", http.StatusText(resp.Code))
+	}
+
+	if resp := logout(t, cookie); resp.Code != http.StatusOK {
+		t.Fatalf("Unexpected status: %s", http.StatusText(resp.Code))
+	}
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	resp = httptest.NewRecorder()
+	a.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusSeeOther {
+		t.Errorf("Expected the session to be logged out, got %s", http.StatusText(resp.Code))
+	}
+}
+
+func TestRevokeSessions(t *testing.T) {
+	victim := []*http.Cookie{loggedIn(t, "victim"), loggedIn(t, "victim")}
+	admin := loggedIn(t, "admin")
+
+	req, _ := http.NewRequest("GET", "/admin/certs", nil)
+	req.AddCookie(admin)
+	resp := httptest.NewRecorder()
+	a.router.ServeHTTP(resp, req)
+	csrfToken := resp.Result().Header.Get("X-CSRF-Token")
+
+	req, _ = http.NewRequest("POST", "/admin/sessions/revoke", strings.NewReader(url.Values{"username": []string{"victim"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-CSRF-Token", csrfToken)
+	req.AddCookie(admin)
+	for _, cookie := range resp.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	resp = httptest.NewRecorder()
+	a.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusSeeOther {
+		t.Fatalf("Unexpected status: %s", http.StatusText(resp.Code))
+	}
+
+	for _, cookie := range victim {
+		req, _ = http.NewRequest("GET", "/", nil)
+		req.AddCookie(cookie)
+		resp = httptest.NewRecorder()
+		a.router.ServeHTTP(resp, req)
+		if resp.Code != http.StatusSeeOther {
+			t.Errorf("Expected the session to be logged out, got %s", http.StatusText(resp.Code))
+		}
+	}
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(admin)
+	resp = httptest.NewRecorder()
+	a.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Errorf("Expected the admin to still be logged in, got %s", http.StatusText(resp.Code))
+	}
+}
+
+func TestCallbackNoState(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/auth/callback?code=abcdef", nil)
+	resp := httptest.NewRecorder()
+	a.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a callback without a login to be rejected, got %s", http.StatusText(resp.Code))
+	}
+}
+
+func TestLoopbackFlow(t *testing.T) {
+	cookie := loggedIn(t, "test")
+	verifier := oauth2.GenerateVerifier()
+	query := func(redirect, challenge string) url.Values {
+		return url.Values{
+			"redirect_uri":          []string{redirect},
+			"state":                 []string{"client_state"},
+			"code_challenge":        []string{challenge},
+			"code_challenge_method": []string{"S256"},
+		}
+	}
+	// authorize shows the confirmation page, and confirms if it's shown.
+	authorize := func(redirect, challenge string) *httptest.ResponseRecorder {
+		q := query(redirect, challenge)
+		req, _ := http.NewRequest("GET", "/auth/authorize?"+q.Encode(), nil)
+		req.AddCookie(cookie)
+		resp := httptest.NewRecorder()
+		a.router.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			return resp
+		}
+		if !strings.Contains(resp.Body.String(), `action="/auth/authorize" method="post"`) {
+			t.Fatal("Expected a confirmation form")
+		}
+		req, _ = http.NewRequest("POST", "/auth/authorize", strings.NewReader(q.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-CSRF-Token", resp.Result().Header.Get("X-CSRF-Token"))
+		req.AddCookie(cookie)
+		for _, c := range resp.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		resp = httptest.NewRecorder()
+		a.router.ServeHTTP(resp, req)
+		return resp
+	}
+	exchange := func(code, verifier string) *httptest.ResponseRecorder {
+		form := url.Values{"code": []string{code}, "code_verifier": []string{verifier}}
+		req, _ := http.NewRequest("POST", "/auth/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp := httptest.NewRecorder()
+		a.router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	for _, redirect := range []string{"https://127.0.0.1:1234/cb", "http://example.com:1234/cb", "http://127.0.0.1/cb"} {
+		if resp := authorize(redirect, oauth2.S256ChallengeFromVerifier(verifier)); resp.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected the redirect to be rejected, got %s", redirect, http.StatusText(resp.Code))
+		}
+	}
+	if resp := authorize("http://127.0.0.1:1234/cb", ""); resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected a request without a code challenge to be rejected, got %s", http.StatusText(resp.Code))
+	}
+	// Codes are only issued by a confirmation from the page.
+	req, _ := http.NewRequest("POST", "/auth/authorize", strings.NewReader(query("http://127.0.0.1:1234/cb", oauth2.S256ChallengeFromVerifier(verifier)).Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookie)
+	forged := httptest.NewRecorder()
+	a.router.ServeHTTP(forged, req)
+	if forged.Code != http.StatusForbidden {
+		t.Errorf("Expected a confirmation without a CSRF token to be rejected, got %s", http.StatusText(forged.Code))
+	}
+
+	resp := authorize("http://127.0.0.1:1234/cb", oauth2.S256ChallengeFromVerifier(verifier))
+	if resp.Code != http.StatusFound {
+		t.Fatalf("Unexpected status: %s", http.StatusText(resp.Code))
+	}
+	loc, _ := url.Parse(resp.Header().Get("Location"))
+	if loc.Host != "127.0.0.1:1234" || loc.Path != "/cb" || loc.Query().Get("state") != "client_state" {
+		t.Fatalf("Unexpected redirect %s", loc)
+	}
+	code := loc.Query().Get("code")
+	if resp := exchange(code, "wrong"); resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected the wrong verifier to be rejected, got %s", http.StatusText(resp.Code))
+	}
+	resp = exchange(code, verifier)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Unexpected status: %s", http.StatusText(resp.Code))
+	}
+	tr := &lib.TokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(tr); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := a.signToken(tr.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Username != "test" {
+		t.Errorf("Unexpected username %q", rec.Username)
+	}
+	if resp := exchange(code, verifier); resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected a replayed code to be rejected, got %s", http.StatusText(resp.Code))
+	}
+	if resp := exchange(tr.AccessToken, verifier); resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected a sign token to be rejected as a code, got %s", http.StatusText(resp.Code))
+	}
+}
+
 func TestSignRevoke(t *testing.T) {
 	var resp *httptest.ResponseRecorder
 	var req *http.Request
@@ -110,7 +411,7 @@ func TestSignRevoke(t *testing.T) {
 	})
 	req, _ = http.NewRequest("POST", "/sign", bytes.NewReader(s))
 	resp = httptest.NewRecorder()
-	req.Header.Set("Authorization", "Bearer abcdef")
+	req.Header.Set("Authorization", "Bearer "+newSignToken(t))
 	a.router.ServeHTTP(resp, req)
 	if resp.Code != http.StatusOK {
 		t.Fatal("Unexpected response")
@@ -139,6 +440,7 @@ func TestSignRevoke(t *testing.T) {
 		Expiry:      time.Now().Add(1 * time.Hour),
 	}
 	a.setAuthToken(resp, req, tok)
+	a.setSessionVariable(resp, req, "provider", "testprovider")
 	a.router.ServeHTTP(resp, req)
 	csrfToken := resp.Result().Header.Get("X-CSRF-Token")
 
@@ -172,6 +474,257 @@ func TestSignRevoke(t *testing.T) {
 	}
 }
 
+func TestSignNarrowed(t *testing.T) {
+	tests := []struct {
+		name       string
+		principals []string
+		code       int
+	}{
+		{"allowed", []string{"test"}, http.StatusOK},
+		{"not allowed", []string{"root"}, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _ := json.Marshal(&lib.SignRequest{
+				Key:        string(testdata.Pub),
+				ValidUntil: time.Now().UTC().Add(1 * time.Hour),
+				Principals: test.principals,
+				Extensions: []string{"permit-pty"},
+			})
+			req, _ := http.NewRequest("POST", "/sign", bytes.NewReader(s))
+			req.Header.Set("Authorization", "Bearer "+newSignToken(t))
+			resp := httptest.NewRecorder()
+			a.router.ServeHTTP(resp, req)
+			if resp.Code != test.code {
+				t.Fatalf("Unexpected status: %s, wanted %s", http.StatusText(resp.Code), http.StatusText(test.code))
+			}
+			if test.code != http.StatusOK {
+				return
+			}
+			r := &lib.SignResponse{}
+			if err := json.NewDecoder(resp.Body).Decode(r); err != nil {
+				t.Fatal(err)
+			}
+			k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(r.Response))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert := k.(*ssh.Certificate)
+			if len(cert.Extensions) != 1 {
+				t.Errorf("Expected only permit-pty, got %v", cert.Extensions)
+			}
+			info := r.Certificate
+			if info == nil {
+				t.Fatal("Response is missing certificate info")
+			}
+			if info.KeyID != cert.KeyId || info.Serial != cert.Serial || info.KRLURL != "/revoked" {
+				t.Errorf("Certificate info doesn't match cert: %+v", info)
+			}
+			if info.CAFingerprint != ssh.FingerprintSHA256(a.keysigner.PublicKey()) {
+				t.Errorf("Unexpected CA fingerprint %s", info.CAFingerprint)
+			}
+		})
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	a.config.MinClientVersion = "v1.2.0"
+	defer func() { a.config.MinClientVersion = "" }()
+	req, _ := http.NewRequest("GET", lib.DiscoveryPath, nil)
+	resp := httptest.NewRecorder()
+	a.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Unexpected status: %s", http.StatusText(resp.Code))
+	}
+	d := &lib.Discovery{}
+	if err := json.NewDecoder(resp.Body).Decode(d); err != nil {
+		t.Fatal(err)
+	}
+	if d.MinClientVersion != "v1.2.0" || d.MaxValidity != "4h0m0s" || d.RevocationURL != "/revoked" || d.ChallengeURL != "/sign/challenge" {
+		t.Errorf("Unexpected discovery document: %+v", d)
+	}
+
+	req, _ = http.NewRequest("GET", d.CAKeyURL, nil)
+	resp = httptest.NewRecorder()
+	a.router.ServeHTTP(resp, req)
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(resp.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pub.Marshal(), a.keysigner.PublicKey().Marshal()) {
+		t.Error("CA public key doesn't match the signing key")
+	}
+}
+
+func TestSignMinClientVersion(t *testing.T) {
+	a.config.MinClientVersion = "v1.2.0"
+	defer func() { a.config.MinClientVersion = "" }()
+	tests := []struct {
+		version string
+		code    int
+	}{
+		{"v1.1.9", http.StatusUpgradeRequired},
+		{"v1.2.0", http.StatusOK},
+		{"unknown", http.StatusOK},
+	}
+	for _, test := range tests {
+		s, _ := json.Marshal(&lib.SignRequest{
+			Key:        string(testdata.Pub),
+			ValidUntil: time.Now().UTC().Add(1 * time.Hour),
+			Version:    test.version,
+		})
+		req, _ := http.NewRequest("POST", "/sign", bytes.NewReader(s))
+		req.Header.Set("Authorization", "Bearer "+newSignToken(t))
+		resp := httptest.NewRecorder()
+		a.router.ServeHTTP(resp, req)
+		if resp.Code != test.code {
+			t.Errorf("version %s: unexpected status: %s, wanted %s", test.version, http.StatusText(resp.Code), http.StatusText(test.code))
+		}
+	}
+}
+
+func TestSignErrorCodes(t *testing.T) {
+	a.requireReason = true
+	defer func() { a.requireReason = false }()
+	tests := []struct {
+		name    string
+		req     *lib.SignRequest
+		code    int
+		errCode lib.ErrorCode
+	}{
+		{"needs reason", &lib.SignRequest{Key: string(testdata.Pub)}, http.StatusForbidden, lib.ErrorNeedsReason},
+		{"invalid key", &lib.SignRequest{Key: "ssh-rsa AAAA", Message: "test"}, http.StatusBadRequest, lib.ErrorKeyRejected},
+		{"certificate", &lib.SignRequest{Key: string(testdata.Cert), Message: "test"}, http.StatusBadRequest, lib.ErrorKeyRejected},
+		{"invalid source address", &lib.SignRequest{Key: string(testdata.Pub), Message: "test", SourceAddress: "nowhere"}, http.StatusBadRequest, lib.ErrorKeyRejected},
+		{"policy denied", &lib.SignRequest{Key: string(testdata.Pub), Message: "test", Principals: []string{"root"}}, http.StatusForbidden, lib.ErrorPolicyDenied},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _ := json.Marshal(test.req)
+			req, _ := http.NewRequest("POST", "/sign", bytes.NewReader(s))
+			req.Header.Set("Authorization", "Bearer "+newSignToken(t))
+			resp := httptest.NewRecorder()
+			a.router.ServeHTTP(resp, req)
+			if resp.Code != test.code {
+				t.Errorf("Unexpected status: %s, wanted %s", http.StatusText(resp.Code), http.StatusText(test.code))
+			}
+			r := &lib.SignResponse{}
+			if err := json.NewDecoder(resp.Body).Decode(r); err != nil {
+				t.Fatal(err)
+			}
+			if r.Status != "error" || r.Error != test.errCode {
+				t.Errorf("Unexpected error code %q, wanted %q", r.Error, test.errCode)
+			}
+		})
+	}
+}
+
+func TestSignKeyProof(t *testing.T) {
+	a.config.RequireKeyProof = true
+	defer func() { a.config.RequireKeyProof = false }()
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(priv)
+	other, _ := ssh.ParsePrivateKey(testdata.Priv)
+
+	challenge := func(token string) string {
+		req, _ := http.NewRequest("GET", "/sign/challenge", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp := httptest.NewRecorder()
+		a.router.ServeHTTP(resp, req)
+		c := &lib.ChallengeResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(c); err != nil {
+			t.Fatal(err)
+		}
+		if c.Namespace != lib.SignNamespace {
+			t.Fatalf("Unexpected namespace %q", c.Namespace)
+		}
+		return c.Challenge
+	}
+	sign := func(req *lib.SignRequest, token string) int {
+		s, _ := json.Marshal(req)
+		r, _ := http.NewRequest("POST", "/sign", bytes.NewReader(s))
+		r.Header.Set("Authorization", "Bearer "+token)
+		resp := httptest.NewRecorder()
+		a.router.ServeHTTP(resp, r)
+		return resp.Code
+	}
+	request := func(nonce string, by ssh.Signer) *lib.SignRequest {
+		sig, err := lib.SignSSHSig(by, lib.SignNamespace, []byte(nonce))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &lib.SignRequest{
+			Key:        string(ssh.MarshalAuthorizedKey(signer.PublicKey())),
+			ValidUntil: time.Now().UTC().Add(1 * time.Hour),
+			Challenge:  nonce,
+			Signature:  sig,
+		}
+	}
+
+	token := newSignToken(t)
+	if code := sign(&lib.SignRequest{Key: string(ssh.MarshalAuthorizedKey(signer.PublicKey()))}, token); code != http.StatusBadRequest {
+		t.Errorf("Expected a request without proof to be rejected, got %s", http.StatusText(code))
+	}
+	nonce := challenge(token)
+	if code := sign(request(nonce, other), token); code != http.StatusBadRequest {
+		t.Errorf("Expected a challenge signed by another key to be rejected, got %s", http.StatusText(code))
+	}
+	nonce = challenge(token)
+	if code := sign(request(nonce, signer), newSignToken(t)); code != http.StatusBadRequest {
+		t.Errorf("Expected a challenge issued for another token to be rejected, got %s", http.StatusText(code))
+	}
+	nonce = challenge(token)
+	req := request(nonce, signer)
+	if code := sign(req, token); code != http.StatusOK {
+		t.Errorf("Unexpected status: %s", http.StatusText(code))
+	}
+	if code := sign(req, newSignToken(t)); code != http.StatusBadRequest {
+		t.Errorf("Expected a replayed challenge to be rejected, got %s", http.StatusText(code))
+	}
+}
+
+func TestSignTokenSingleUse(t *testing.T) {
+	token := newSignToken(t)
+	sign := func(token string) int {
+		s, _ := json.Marshal(&lib.SignRequest{
+			Key:        string(testdata.Pub),
+			ValidUntil: time.Now().UTC().Add(1 * time.Hour),
+		})
+		req, _ := http.NewRequest("POST", "/sign", bytes.NewReader(s))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp := httptest.NewRecorder()
+		a.router.ServeHTTP(resp, req)
+		return resp.Code
+	}
+	if code := sign(token); code != http.StatusOK {
+		t.Fatalf("Unexpected status: %s", http.StatusText(code))
+	}
+	if code := sign(token); code != http.StatusUnauthorized {
+		t.Errorf("Expected a used token to be rejected, got %s", http.StatusText(code))
+	}
+	if code := sign("abcdef"); code != http.StatusUnauthorized {
+		t.Errorf("Expected an unknown token to be rejected, got %s", http.StatusText(code))
+	}
+
+	// An expired token is rejected.
+	expired := newSignToken(t)
+	rec, _ := a.certstore.GetToken(hashToken(expired))
+	rec.Expires = time.Now().UTC().Add(-time.Minute)
+	a.certstore.SetToken(rec)
+	if code := sign(expired); code != http.StatusUnauthorized {
+		t.Errorf("Expected an expired token to be rejected, got %s", http.StatusText(code))
+	}
+
+	// A token issued for another audience is rejected.
+	other := newSignToken(t)
+	rec, _ = a.certstore.GetToken(hashToken(other))
+	rec.Audience = "other"
+	a.certstore.SetToken(rec)
+	if code := sign(other); code != http.StatusUnauthorized {
+		t.Errorf("Expected a token for another audience to be rejected, got %s", http.StatusText(code))
+	}
+}
+
 func TestTokenFromRequest(t *testing.T) {
 	tests := []struct {
 		name string
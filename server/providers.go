@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/oauth2"
+
+	"github.com/cashier-go/cashier/server/auth"
+	"github.com/cashier-go/cashier/server/auth/github"
+	"github.com/cashier-go/cashier/server/auth/gitlab"
+	"github.com/cashier-go/cashier/server/auth/google"
+	"github.com/cashier-go/cashier/server/auth/microsoft"
+	"github.com/cashier-go/cashier/server/config"
+	"github.com/cashier-go/cashier/server/signer"
+)
+
+// authProvider is an auth provider configured under a name.
+type authProvider struct {
+	auth.Provider
+	name string
+	// additionalPrincipals are allowed to the provider's users.
+	additionalPrincipals []string
+	// usernamePrefix namespaces the provider's usernames.
+	usernamePrefix string
+}
+
+// username returns the namespaced username of the token's user, which is
+// their principal and identifies them across providers.
+func (p *authProvider) username(ctx context.Context, token *oauth2.Token) string {
+	return p.usernamePrefix + p.Username(ctx, token)
+}
+
+// grant returns what a user of the provider may be issued.
+func (p *authProvider) grant(username string) signer.Grant {
+	return signer.Grant{
+		Username:             username,
+		AdditionalPrincipals: p.additionalPrincipals,
+	}
+}
+
+// newAuthProviders configures the auth providers.
+func newAuthProviders(conf *config.Auth) ([]*authProvider, error) {
+	var providers []*authProvider
+	for _, l := range conf.Providers() {
+		var (
+			p   auth.Provider
+			err error
+		)
+		switch l.Provider {
+		case "github":
+			p, err = github.New(&l.Auth)
+		case "gitlab":
+			p, err = gitlab.New(&l.Auth)
+		case "google":
+			p, err = google.New(&l.Auth)
+		case "microsoft":
+			p, err = microsoft.New(&l.Auth)
+		default:
+			return nil, fmt.Errorf("unknown provider %q", l.Provider)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to configure provider %q: %w", l.Name, err)
+		}
+		providers = append(providers, &authProvider{
+			Provider:             p,
+			name:                 l.Name,
+			additionalPrincipals: l.AdditionalPrincipals,
+			usernamePrefix:       l.UsernamePrefix,
+		})
+	}
+	return providers, nil
+}
+
+// provider returns the named provider, or nil if there's no such provider.
+func (a *application) provider(name string) *authProvider {
+	for _, p := range a.authproviders {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// requestProvider returns the provider named by a request's "provider"
+// parameter, which may be left out if there's only one provider.
+func (a *application) requestProvider(r *http.Request) *authProvider {
+	name := r.FormValue("provider")
+	if name == "" && len(a.authproviders) == 1 {
+		return a.authproviders[0]
+	}
+	return a.provider(name)
+}
+
+// providerNames returns the names of the providers users can log in with.
+func (a *application) providerNames() []string {
+	names := make([]string, 0, len(a.authproviders))
+	for _, p := range a.authproviders {
+		names = append(names, p.name)
+	}
+	return names
+}
+
+// sessionProvider returns the provider the user is logging in, or logged
+// in, with.
+func (a *application) sessionProvider(r *http.Request) *authProvider {
+	return a.provider(a.getSessionVariable(r, "provider"))
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/cashier-go/cashier/lib"
+	"github.com/cashier-go/cashier/server/auth"
+	"github.com/cashier-go/cashier/server/auth/testprovider"
+	"github.com/cashier-go/cashier/testdata"
+)
+
+// withProviders configures the application with a contractors and an
+// employees provider for the duration of a test.
+func withProviders(t *testing.T) {
+	t.Helper()
+	providers := a.authproviders
+	a.authproviders = []*authProvider{
+		{Provider: testprovider.New(), name: "contractors", usernamePrefix: "c-"},
+		{Provider: testprovider.New(), name: "employees", additionalPrincipals: []string{"ops"}, usernamePrefix: "e-"},
+	}
+	t.Cleanup(func() { a.authproviders = providers })
+}
+
+func TestLoginChooser(t *testing.T) {
+	withProviders(t)
+
+	req, _ := http.NewRequest("GET", "/auth/login", nil)
+	resp := httptest.NewRecorder()
+	a.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Unexpected status: %s", http.StatusText(resp.Code))
+	}
+	for _, name := range []string{"contractors", "employees"} {
+		if !strings.Contains(resp.Body.String(), "/auth/login?provider="+name) {
+			t.Errorf("Expected a link to log in with %s", name)
+		}
+	}
+
+	req, _ = http.NewRequest("GET", "/auth/login?provider=employees", nil)
+	resp = httptest.NewRecorder()
+	a.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusFound {
+		t.Fatalf("Unexpected status: %s", http.StatusText(resp.Code))
+	}
+	req, _ = http.NewRequest("GET", "/", nil)
+	for _, cookie := range resp.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	if p := a.sessionProvider(req); p == nil || p.name != "employees" {
+		t.Errorf("Expected the session to log in with employees, got %+v", p)
+	}
+
+	req, _ = http.NewRequest("GET", "/auth/login?provider=unknown", nil)
+	resp = httptest.NewRecorder()
+	a.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown provider to be rejected, got %s", http.StatusText(resp.Code))
+	}
+}
+
+func TestSignProviderPrincipals(t *testing.T) {
+	withProviders(t)
+
+	sign := func(provider string) (int, *ssh.Certificate) {
+		t.Helper()
+		token, err := a.mintSignToken("test", provider)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, _ := json.Marshal(&lib.SignRequest{
+			Key:        string(testdata.Pub),
+			Principals: []string{"ops"},
+			ValidUntil: time.Now().UTC().Add(1 * time.Hour),
+		})
+		req, _ := http.NewRequest("POST", "/sign", bytes.NewReader(s))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp := httptest.NewRecorder()
+		a.router.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			return resp.Code, nil
+		}
+		r := &lib.SignResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(r); err != nil {
+			t.Fatal(err)
+		}
+		k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(r.Response))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Code, k.(*ssh.Certificate)
+	}
+
+	code, cert := sign("employees")
+	if code != http.StatusOK {
+		t.Fatalf("Unexpected status: %s", http.StatusText(code))
+	}
+	rec, err := a.certstore.Get(cert.KeyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Provider != "employees" {
+		t.Errorf("Expected the cert to be recorded for employees, got %q", rec.Provider)
+	}
+	if code, _ := sign("contractors"); code != http.StatusForbidden {
+		t.Errorf("Expected another provider's principal to be denied, got %s", http.StatusText(code))
+	}
+	if code, _ := sign(""); code != http.StatusUnauthorized {
+		t.Errorf("Expected a token without a provider to be rejected, got %s", http.StatusText(code))
+	}
+}
+
+func TestProviderUsernames(t *testing.T) {
+	withProviders(t)
+
+	login := func(provider string) []*http.Cookie {
+		t.Helper()
+		req, _ := http.NewRequest("GET", "/auth/callback?state=state&code=abcdef", nil)
+		resp := httptest.NewRecorder()
+		a.setSessionVariable(resp, req, "provider", provider)
+		a.setAuthSession(resp, req, &auth.Session{State: "state"})
+		for _, cookie := range resp.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		resp = httptest.NewRecorder()
+		a.router.ServeHTTP(resp, req)
+		if resp.Code != http.StatusFound {
+			t.Fatalf("Unexpected status: %s", http.StatusText(resp.Code))
+		}
+		// The session ID is renewed, so only the last cookie is current.
+		cookies := resp.Result().Cookies()
+		return cookies[len(cookies)-1:]
+	}
+	for provider, username := range map[string]string{"contractors": "c-test", "employees": "e-test"} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		for _, cookie := range login(provider) {
+			req.AddCookie(cookie)
+		}
+		if got := a.getSessionVariable(req, "username"); got != username {
+			t.Errorf("Expected %s to log in as %s, got %s", provider, username, got)
+		}
+		sessions, err := a.certstore.UserSessions(provider, username)
+		if err != nil || len(sessions) != 1 {
+			t.Errorf("Expected a session of %s of %s, got %d (%v)", username, provider, len(sessions), err)
+		}
+	}
+	if sessions, _ := a.certstore.UserSessions("employees", "c-test"); len(sessions) != 0 {
+		t.Errorf("Expected no sessions of c-test of employees, got %d", len(sessions))
+	}
+	if a.provider("") != nil {
+		t.Error("Expected no provider without a name")
+	}
+}
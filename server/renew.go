@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/oauth2"
+
+	"github.com/cashier-go/cashier/lib"
+	"github.com/cashier-go/cashier/server/signer"
+	"github.com/cashier-go/cashier/server/store"
+)
+
+// defaultRenewalIdentityMaxAge is how long after a login the user's
+// certificates can be renewed, unless configured.
+const defaultRenewalIdentityMaxAge = 24 * time.Hour
+
+var errRenewalDisabled = errors.New("certificate renewal is not enabled")
+
+// renewBinding binds a renewal challenge to the certificate being renewed.
+// Key IDs aren't unique, so the certificate's fingerprint is used.
+func renewBinding(cert *ssh.Certificate) string {
+	return "renew:" + ssh.FingerprintSHA256(cert)
+}
+
+// cacheIdentity records the identity of a user who logged in with the
+// provider, so that their certificates can be renewed.
+func (a *application) cacheIdentity(username, provider string, token *oauth2.Token) error {
+	if a.config.MaxRenewals <= 0 {
+		return nil
+	}
+	b, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return a.certstore.SetIdentity(&store.IdentityRecord{
+		Username:   username,
+		Token:      string(b),
+		VerifiedAt: time.Now().UTC(),
+		Provider:   provider,
+	})
+}
+
+// checkIdentity checks that the provider's user is still authorized, using
+// the identity cached at their last login, and returns the provider.
+// The upstream token is checked again while it is valid; after that the
+// cached identity is trusted until it's too old.
+func (a *application) checkIdentity(ctx context.Context, provider, username string) (*authProvider, error) {
+	maxAge := defaultRenewalIdentityMaxAge
+	if a.config.RenewalIdentityMaxAge != "" {
+		d, err := time.ParseDuration(a.config.RenewalIdentityMaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("invalid renewal_identity_max_age: %w", err)
+		}
+		maxAge = d
+	}
+	p := a.provider(provider)
+	if p == nil {
+		return nil, fmt.Errorf("%s logged in with unknown provider %q, log in again", username, provider)
+	}
+	identity, err := a.certstore.GetIdentity(p.name, username)
+	if err != nil {
+		return nil, fmt.Errorf("no identity is cached for %s, log in again", username)
+	}
+	if time.Since(identity.VerifiedAt) > maxAge {
+		return nil, fmt.Errorf("%s last logged in more than %s ago, log in again", username, maxAge)
+	}
+	token := &oauth2.Token{}
+	if err := json.Unmarshal([]byte(identity.Token), token); err != nil {
+		return nil, fmt.Errorf("unable to decode cached identity: %w", err)
+	}
+	if token.Valid() && !p.Valid(ctx, token) {
+		a.certstore.DeleteIdentity(p.name, username)
+		return nil, fmt.Errorf("%s is no longer authorized", username)
+	}
+	return p, nil
+}
+
+// renewableCert parses a certificate and returns it along with its record,
+// if it's a current, unrevoked certificate issued by the CA which hasn't been
+// renewed yet and may be renewed again.
+func (a *application) renewableCert(s string) (*ssh.Certificate, *store.CertRecord, error) {
+	k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse certificate: %w", err)
+	}
+	cert, ok := k.(*ssh.Certificate)
+	if !ok {
+		return nil, nil, errors.New("not a certificate")
+	}
+	if err := a.keysigner.CheckCert(cert); err != nil {
+		return nil, nil, err
+	}
+	rec, err := a.certstore.Get(cert.KeyId)
+	if err != nil || strings.TrimSpace(rec.Raw) != strings.TrimSpace(string(lib.GetPublicKey(cert))) {
+		return nil, nil, fmt.Errorf("unknown certificate %s", cert.KeyId)
+	}
+	switch {
+	case rec.Revoked:
+		return nil, nil, fmt.Errorf("certificate %s has been revoked", cert.KeyId)
+	case rec.Renewed:
+		return nil, nil, fmt.Errorf("certificate %s has already been renewed", cert.KeyId)
+	case rec.Username == "", rec.Fingerprint != ssh.FingerprintSHA256(cert):
+		return nil, nil, fmt.Errorf("certificate %s can't be renewed, log in again", cert.KeyId)
+	case rec.Renewals >= a.config.MaxRenewals:
+		return nil, nil, fmt.Errorf("certificate %s has been renewed %d times, log in again", cert.KeyId, rec.Renewals)
+	}
+	return cert, rec, nil
+}
+
+// renewChallenge issues a challenge to be signed by the key of a certificate
+// in the next renewal request.
+func (a *application) renewChallenge(w http.ResponseWriter, r *http.Request) {
+	if a.config.MaxRenewals <= 0 {
+		http.Error(w, errRenewalDisabled.Error(), http.StatusNotFound)
+		return
+	}
+	req := lib.RenewRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	cert, _, err := a.renewableCert(req.Cert)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	challenge, expires, err := a.challenges.issue(renewBinding(cert))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&lib.ChallengeResponse{
+		Challenge: challenge,
+		Namespace: lib.RenewNamespace,
+		ExpiresAt: expires,
+	})
+}
+
+// renew issues a new certificate for the key of a current certificate, with
+// the same identity and principals. The client proves possession of the key
+// by signing a challenge. Each certificate can only be renewed once.
+func (a *application) renew(w http.ResponseWriter, r *http.Request) {
+	fail := writeSignError
+	if a.config.MaxRenewals <= 0 {
+		fail(w, http.StatusNotFound, lib.ErrorPolicyDenied, errRenewalDisabled)
+		return
+	}
+	req := lib.RenewRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		fail(w, http.StatusBadRequest, lib.ErrorKeyRejected, err)
+		return
+	}
+	if minVersion := a.config.MinClientVersion; minVersion != "" {
+		if cmp, ok := lib.CompareVersions(req.Version, minVersion); ok && cmp < 0 {
+			fail(w, http.StatusUpgradeRequired, lib.ErrorPolicyDenied, fmt.Errorf("client version %s is older than the minimum supported version %s", req.Version, minVersion))
+			return
+		}
+	}
+	cert, rec, err := a.renewableCert(req.Cert)
+	if err != nil {
+		fail(w, http.StatusUnauthorized, lib.ErrorUnauthorized, err)
+		return
+	}
+	if req.Challenge == "" || !a.challenges.redeem(req.Challenge, renewBinding(cert)) {
+		fail(w, http.StatusUnauthorized, lib.ErrorUnauthorized, errors.New("unknown or expired challenge"))
+		return
+	}
+	if err := lib.VerifySSHSig(cert.Key, lib.RenewNamespace, []byte(req.Challenge), req.Signature); err != nil {
+		fail(w, http.StatusUnauthorized, lib.ErrorUnauthorized, fmt.Errorf("invalid challenge signature: %w", err))
+		return
+	}
+	p, err := a.checkIdentity(r.Context(), rec.Provider, rec.Username)
+	if err != nil {
+		fail(w, http.StatusUnauthorized, lib.ErrorUnauthorized, err)
+		return
+	}
+	validUntil := req.ValidUntil
+	if validUntil.IsZero() {
+		validUntil = time.Now().Add(a.keysigner.MaxValidity())
+	}
+	renewed, err := a.keysigner.RenewUserCertFor(cert, p.grant(rec.Username), validUntil)
+	switch {
+	case errors.Is(err, signer.ErrInvalidKey), errors.Is(err, signer.ErrKeyRejected), errors.Is(err, signer.ErrInvalidRequest):
+		fail(w, http.StatusBadRequest, lib.ErrorKeyRejected, err)
+		return
+	case errors.Is(err, signer.ErrNotPermitted):
+		fail(w, http.StatusForbidden, lib.ErrorPolicyDenied, err)
+		return
+	case err != nil:
+		fail(w, http.StatusInternalServerError, lib.ErrorInternal, fmt.Errorf("error renewing certificate: %w", err))
+		return
+	}
+
+	newRec := store.MakeRecord(renewed)
+	newRec.Message = rec.Message
+	newRec.Username = rec.Username
+	newRec.Provider = p.name
+	newRec.Renewals = rec.Renewals + 1
+	// The certificate is only used up once it has been renewed. Concurrent
+	// renewals of it race to record theirs.
+	switch err := a.certstore.RecordRenewal(ssh.FingerprintSHA256(cert), newRec); {
+	case errors.Is(err, store.ErrCertRenewed):
+		fail(w, http.StatusUnauthorized, lib.ErrorUnauthorized, fmt.Errorf("certificate %s: %w", cert.KeyId, err))
+		return
+	case err != nil:
+		fail(w, http.StatusInternalServerError, lib.ErrorInternal, fmt.Errorf("error recording certificate: %w", err))
+		return
+	}
+	log.Printf("Renewed cert id: %s as %s", cert.KeyId, renewed.KeyId)
+	info := lib.NewCertificateInfo(renewed)
+	info.KRLURL = "/revoked"
+	info.Reason = rec.Message
+	json.NewEncoder(w).Encode(&lib.SignResponse{
+		Status:      "ok",
+		Response:    string(lib.GetPublicKey(renewed)),
+		Version:     lib.Version,
+		Certificate: info,
+	})
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/oauth2"
+
+	"github.com/cashier-go/cashier/lib"
+	"github.com/cashier-go/cashier/server/config"
+	keysigner "github.com/cashier-go/cashier/server/signer"
+	"github.com/cashier-go/cashier/server/store"
+	"github.com/cashier-go/cashier/testdata"
+)
+
+func TestRenew(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(priv)
+	_, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+	other, _ := ssh.NewSignerFromKey(otherPriv)
+	ca, _ := ssh.ParsePrivateKey(testdata.Priv)
+
+	renew := func(cert *ssh.Certificate, by ssh.Signer) (int, *ssh.Certificate) {
+		t.Helper()
+		body, _ := json.Marshal(&lib.RenewRequest{Cert: string(lib.GetPublicKey(cert))})
+		req, _ := http.NewRequest("POST", "/renew/challenge", bytes.NewReader(body))
+		resp := httptest.NewRecorder()
+		a.router.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			return resp.Code, nil
+		}
+		c := &lib.ChallengeResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(c); err != nil {
+			t.Fatal(err)
+		}
+		if c.Namespace != lib.RenewNamespace {
+			t.Fatalf("Unexpected namespace %q", c.Namespace)
+		}
+		sig, err := lib.SignSSHSig(by, lib.RenewNamespace, []byte(c.Challenge))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ = json.Marshal(&lib.RenewRequest{
+			Cert:       string(lib.GetPublicKey(cert)),
+			ValidUntil: time.Now().Add(time.Hour),
+			Challenge:  c.Challenge,
+			Signature:  sig,
+		})
+		req, _ = http.NewRequest("POST", "/renew", bytes.NewReader(body))
+		resp = httptest.NewRecorder()
+		a.router.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK {
+			return resp.Code, nil
+		}
+		r := &lib.SignResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(r); err != nil {
+			t.Fatal(err)
+		}
+		k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(r.Response))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Code, k.(*ssh.Certificate)
+	}
+	issue := func() *ssh.Certificate {
+		t.Helper()
+		cert, err := a.keysigner.SignUserKey(&lib.SignRequest{
+			Key:        string(ssh.MarshalAuthorizedKey(signer.PublicKey())),
+			ValidUntil: time.Now().Add(time.Hour),
+		}, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Key IDs only change every second.
+		cert.KeyId += "_" + hashToken(string(cert.Signature.Blob))[:8]
+		cert.SignCert(rand.Reader, ca)
+		rec := store.MakeRecord(cert)
+		rec.Username = "test"
+		rec.Provider = "testprovider"
+		a.certstore.SetRecord(rec)
+		return cert
+	}
+
+	cert := issue()
+	if code, _ := renew(cert, signer); code != http.StatusNotFound {
+		t.Errorf("Expected renewals to be disabled by default, got %s", http.StatusText(code))
+	}
+
+	a.config.MaxRenewals = 2
+	defer func() { a.config.MaxRenewals = 0 }()
+	if code, _ := renew(cert, signer); code != http.StatusUnauthorized {
+		t.Errorf("Expected a renewal without a cached identity to be rejected, got %s", http.StatusText(code))
+	}
+	a.cacheIdentity("test", "testprovider", &oauth2.Token{AccessToken: "token", Expiry: time.Now().Add(time.Hour)})
+	defer a.certstore.DeleteIdentity("testprovider", "test")
+
+	if code, _ := renew(cert, other); code != http.StatusUnauthorized {
+		t.Errorf("Expected a challenge signed by another key to be rejected, got %s", http.StatusText(code))
+	}
+
+	// A failed renewal doesn't use up the cert.
+	keyFile := filepath.Join(t.TempDir(), "signing_key")
+	if err := os.WriteFile(keyFile, testdata.Priv, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ecdsaOnly, err := keysigner.New(&config.SSH{
+		SigningKey: keyFile,
+		MaxAge:     "4h",
+		KeyPolicy:  config.KeyPolicy{AllowedKeyTypes: []string{"ecdsa"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.keysigner, ecdsaOnly = ecdsaOnly, a.keysigner
+	code, _ := renew(cert, signer)
+	a.keysigner = ecdsaOnly
+	if code != http.StatusBadRequest {
+		t.Errorf("Expected a key rejected by the key policy to be rejected, got %s", http.StatusText(code))
+	}
+
+	code, renewed := renew(cert, signer)
+	if code != http.StatusOK {
+		t.Fatalf("Unexpected status: %s", http.StatusText(code))
+	}
+	if !reflect.DeepEqual(renewed.ValidPrincipals, cert.ValidPrincipals) {
+		t.Errorf("Expected principals %v, got %v", cert.ValidPrincipals, renewed.ValidPrincipals)
+	}
+	if !bytes.Equal(renewed.Key.Marshal(), cert.Key.Marshal()) {
+		t.Error("Renewed cert key doesn't match the cert key")
+	}
+	rec, err := a.certstore.Get(renewed.KeyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Username != "test" || rec.Renewals != 1 {
+		t.Errorf("Unexpected record: %+v", rec)
+	}
+	if code, _ := renew(cert, signer); code != http.StatusUnauthorized {
+		t.Errorf("Expected a cert to only be renewed once, got %s", http.StatusText(code))
+	}
+
+	// Renew the renewed cert until the limit is reached.
+	renewed.KeyId += "_renewed"
+	renewed.SignCert(rand.Reader, ca)
+	rec.KeyID = renewed.KeyId
+	rec.Raw = string(lib.GetPublicKey(renewed))
+	rec.Fingerprint = ssh.FingerprintSHA256(renewed)
+	a.certstore.SetRecord(rec)
+	if code, _ := renew(renewed, signer); code != http.StatusOK {
+		t.Errorf("Unexpected status: %s", http.StatusText(code))
+	}
+	rec.Renewed = false
+	rec.Renewals = 2
+	a.certstore.SetRecord(rec)
+	if code, _ := renew(renewed, signer); code != http.StatusUnauthorized {
+		t.Errorf("Expected a renewal beyond max_renewals to be rejected, got %s", http.StatusText(code))
+	}
+
+	revoked := issue()
+	a.certstore.Revoke([]string{revoked.KeyId})
+	if code, _ := renew(revoked, signer); code != http.StatusUnauthorized {
+		t.Errorf("Expected a revoked cert to be rejected, got %s", http.StatusText(code))
+	}
+
+	a.config.RenewalIdentityMaxAge = "1ns"
+	defer func() { a.config.RenewalIdentityMaxAge = "" }()
+	if code, _ := renew(issue(), signer); code != http.StatusUnauthorized {
+		t.Errorf("Expected a renewal with a stale identity to be rejected, got %s", http.StatusText(code))
+	}
+}
+
+func TestLogoutForgetsIdentity(t *testing.T) {
+	a.config.MaxRenewals = 1
+	defer func() { a.config.MaxRenewals = 0 }()
+	cookie := loggedIn(t, "test")
+	a.cacheIdentity("test", "testprovider", &oauth2.Token{AccessToken: "token", Expiry: time.Now().Add(time.Hour)})
+	logout(t, cookie)
+	if _, err := a.certstore.GetIdentity("testprovider", "test"); err == nil {
+		t.Error("Expected the cached identity to be removed on logout")
+	}
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/csrf"
+	"go4.org/wkfs"
+
+	"github.com/cashier-go/cashier/server/config"
+)
+
+// secrets holds the keys of the session cookie and CSRF tokens. The first key
+// of each is current and is used for new cookies and tokens; the others are
+// previous keys which are still accepted, so that keys can be rotated without
+// logging everyone out.
+type secrets struct {
+	cookieKeyPairs [][]byte
+	csrfKeys       [][]byte
+}
+
+// readSecret returns the value of a secret. Values starting with `/vault/`
+// are read from vault and values starting with `file:` are read from the
+// named file. Other values are used as-is.
+func readSecret(value string) ([]byte, error) {
+	name := ""
+	switch {
+	case strings.HasPrefix(value, "/vault/"):
+		name = value
+	case strings.HasPrefix(value, "file:"):
+		name = strings.TrimPrefix(value, "file:")
+	default:
+		return []byte(value), nil
+	}
+	b, err := wkfs.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read secret %s: %w", name, err)
+	}
+	return bytes.TrimSpace(b), nil
+}
+
+// loadSecrets reads the cookie and CSRF keys of the configuration.
+func loadSecrets(conf *config.Server) (*secrets, error) {
+	s := &secrets{}
+	cookieKeys := conf.CookieKeys()
+	if len(conf.CookieEncryptionKeys) > len(cookieKeys) {
+		return nil, fmt.Errorf("there are more cookie_encryption_keys than cookie secrets")
+	}
+	for i, v := range cookieKeys {
+		hashKey, err := readSecret(v)
+		if err != nil {
+			return nil, err
+		}
+		var blockKey []byte
+		if i < len(conf.CookieEncryptionKeys) {
+			if blockKey, err = readSecret(conf.CookieEncryptionKeys[i]); err != nil {
+				return nil, err
+			}
+			if _, err := aes.NewCipher(blockKey); err != nil {
+				return nil, fmt.Errorf("invalid cookie encryption key %d: %w", i+1, err)
+			}
+		}
+		s.cookieKeyPairs = append(s.cookieKeyPairs, hashKey, blockKey)
+	}
+	for _, v := range conf.CSRFKeys() {
+		key, err := readSecret(v)
+		if err != nil {
+			return nil, err
+		}
+		s.csrfKeys = append(s.csrfKeys, key)
+	}
+	return s, nil
+}
+
+// reloadSecrets reads the cookie and CSRF keys again and starts using them.
+func (a *application) reloadSecrets() error {
+	s, err := loadSecrets(a.config)
+	if err != nil {
+		return err
+	}
+	a.sessionstore.setKeyPairs(s.cookieKeyPairs...)
+	a.csrf.setKeys(s.csrfKeys...)
+	return nil
+}
+
+// reloadSecretsEvery reloads the secrets at each interval. Errors are logged
+// and the previous secrets are kept.
+func (a *application) reloadSecretsEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := a.reloadSecrets(); err != nil {
+			log.Printf("unable to reload secrets: %v", err)
+		}
+	}
+}
+
+// csrfProtect is csrf.Protect with several keys. csrf.Protect only accepts
+// one key, so each protected handler is built once for each key, and built
+// again when the keys change. Requests are checked with the current key
+// first, and then with the previous keys. Checking with the current key
+// issues a token and cookie made with it, which a request accepted with a
+// previous key is served with, so browsers move to the current key.
+type csrfProtect struct {
+	mu     sync.RWMutex
+	keys   [][]byte
+	routes []*csrfRoute
+	secure bool
+}
+
+// csrfRoute is a handler protected with the current keys.
+type csrfRoute struct {
+	next    http.Handler
+	handler http.Handler
+}
+
+// csrfCurrentKey is the context key of the request and response checked
+// with the current key, while a previous key is tried.
+type csrfCurrentKey struct{}
+
+type csrfCurrent struct {
+	w http.ResponseWriter
+	r *http.Request
+}
+
+// csrfPreviousWriter drops the headers set by the handlers of previous keys,
+// which would replace the cookie made with the current key.
+type csrfPreviousWriter struct {
+	http.ResponseWriter
+	header http.Header
+}
+
+func (w *csrfPreviousWriter) Header() http.Header {
+	return w.header
+}
+
+func newCSRFProtect(secure bool, keys ...[]byte) *csrfProtect {
+	c := &csrfProtect{secure: secure}
+	c.setKeys(keys...)
+	return c
+}
+
+// setKeys replaces the keys, current first, and rebuilds the protected
+// handlers.
+func (c *csrfProtect) setKeys(keys ...[]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys = keys
+	for _, route := range c.routes {
+		route.handler = c.build(route.next)
+	}
+}
+
+// build protects next with the keys.
+func (c *csrfProtect) build(next http.Handler) http.Handler {
+	// Handlers after the first are passed the current request in the context.
+	current := func(r *http.Request) *csrfCurrent {
+		return r.Context().Value(csrfCurrentKey{}).(*csrfCurrent)
+	}
+	serve := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cur := current(r)
+		next.ServeHTTP(cur.w, cur.r)
+	})
+	var fallback http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cur := current(r)
+		http.Error(cur.w, fmt.Sprintf("%s - %s", http.StatusText(http.StatusForbidden), csrf.FailureReason(cur.r)), http.StatusForbidden)
+	})
+	for i := len(c.keys) - 1; i > 0; i-- {
+		fallback = csrf.Protect(c.keys[i], csrf.Secure(c.secure), csrf.ErrorHandler(fallback))(serve)
+	}
+	opts := []csrf.Option{csrf.Secure(c.secure)}
+	if len(c.keys) > 1 {
+		previous := fallback
+		opts = append(opts, csrf.ErrorHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), csrfCurrentKey{}, &csrfCurrent{w: w, r: r})
+			previous.ServeHTTP(&csrfPreviousWriter{ResponseWriter: w, header: http.Header{}}, r.WithContext(ctx))
+		})))
+	}
+	return csrf.Protect(c.keys[0], opts...)(next)
+}
+
+// protect is middleware requiring a CSRF token on unsafe requests.
+func (c *csrfProtect) protect(next http.Handler) http.Handler {
+	route := &csrfRoute{next: next}
+	c.mu.Lock()
+	route.handler = c.build(next)
+	c.routes = append(c.routes, route)
+	c.mu.Unlock()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.RLock()
+		h := route.handler
+		c.mu.RUnlock()
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+
+	"github.com/cashier-go/cashier/server/config"
+)
+
+func TestLoadSecrets(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cookie_secret")
+	if err := os.WriteFile(file, []byte("from-a-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := loadSecrets(&config.Server{
+		CookieSecret:         "ignored",
+		CookieSecrets:        []string{"file:" + file, "previous"},
+		CookieEncryptionKeys: []string{"0123456789abcdef"},
+		CSRFSecret:           "csrf",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"from-a-file", "0123456789abcdef", "previous", ""}
+	if len(s.cookieKeyPairs) != len(want) {
+		t.Fatalf("got %d cookie keys, expected %d", len(s.cookieKeyPairs), len(want))
+	}
+	for i, key := range want {
+		if string(s.cookieKeyPairs[i]) != key {
+			t.Errorf("cookie key %d: got %q, expected %q", i, s.cookieKeyPairs[i], key)
+		}
+	}
+	if len(s.csrfKeys) != 1 || string(s.csrfKeys[0]) != "csrf" {
+		t.Errorf("unexpected csrf keys %q", s.csrfKeys)
+	}
+
+	if _, err := loadSecrets(&config.Server{CookieSecret: "secret", CookieEncryptionKeys: []string{"short"}}); err == nil {
+		t.Error("expected an error for an invalid encryption key")
+	}
+	if _, err := loadSecrets(&config.Server{CookieSecret: "file:" + file + ".missing"}); err == nil {
+		t.Error("expected an error for a missing secret file")
+	}
+}
+
+func TestCookieSecretRotation(t *testing.T) {
+	defer func(c *config.Server) {
+		a.config = c
+		a.reloadSecrets()
+	}(a.config)
+	a.config = &config.Server{CookieSecret: "old", CSRFSecret: "old"}
+	if err := a.reloadSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	cookie := loggedIn(t, "test")
+
+	a.config = &config.Server{
+		CookieSecrets:        []string{"new", "old"},
+		CookieEncryptionKeys: []string{"0123456789abcdef0123456789abcdef"},
+		CSRFSecret:           "old",
+	}
+	if err := a.reloadSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	resp := httptest.NewRecorder()
+	a.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Errorf("Expected a cookie made with the previous secret to be accepted, got %s", http.StatusText(resp.Code))
+	}
+	var id string
+	rotated := loggedIn(t, "test")
+	if securecookie.DecodeMulti(rotated.Name, rotated.Value, &id, securecookie.CodecsFromPairs([]byte("old"))...) == nil {
+		t.Error("Expected new cookies to be made with the current secret")
+	}
+
+	a.config = &config.Server{CookieSecret: "new", CSRFSecret: "old"}
+	if err := a.reloadSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	resp = httptest.NewRecorder()
+	a.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusSeeOther {
+		t.Errorf("Expected a cookie made with a removed secret to be rejected, got %s", http.StatusText(resp.Code))
+	}
+}
+
+func TestCSRFSecretRotation(t *testing.T) {
+	defer func(c *config.Server) {
+		a.config = c
+		a.reloadSecrets()
+	}(a.config)
+	a.config = &config.Server{CookieSecret: "secret", CSRFSecret: "old"}
+	if err := a.reloadSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	session := loggedIn(t, "test")
+	req, _ := http.NewRequest("GET", "/admin/certs", nil)
+	req.AddCookie(session)
+	resp := httptest.NewRecorder()
+	a.router.ServeHTTP(resp, req)
+	csrfToken := resp.Result().Header.Get("X-CSRF-Token")
+	cookies := resp.Result().Cookies()
+
+	post := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/admin/sessions/revoke", strings.NewReader(url.Values{"username": []string{"nobody"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-CSRF-Token", csrfToken)
+		req.AddCookie(session)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		resp := httptest.NewRecorder()
+		a.router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	a.config = &config.Server{CookieSecret: "secret", CSRFSecrets: []string{"new", "old"}}
+	if err := a.reloadSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	resp = post()
+	if resp.Code != http.StatusSeeOther {
+		t.Fatalf("Expected a CSRF token made with the previous secret to be accepted, got %s", http.StatusText(resp.Code))
+	}
+	upgraded := resp.Result().Cookies()
+	if len(upgraded) != 1 {
+		t.Fatalf("Expected the CSRF cookie to be made again with the current secret, got %v", upgraded)
+	}
+
+	a.config = &config.Server{CookieSecret: "secret", CSRFSecret: "new"}
+	if err := a.reloadSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	if resp := post(); resp.Code != http.StatusForbidden {
+		t.Errorf("Expected a CSRF token made with a removed secret to be rejected, got %s", http.StatusText(resp.Code))
+	}
+	req, _ = http.NewRequest("GET", "/admin/certs", nil)
+	req.AddCookie(session)
+	req.AddCookie(upgraded[0])
+	resp = httptest.NewRecorder()
+	a.router.ServeHTTP(resp, req)
+	if len(resp.Result().Cookies()) != 0 {
+		t.Error("Expected the CSRF cookie made with the current secret to be kept")
+	}
+	csrfToken, cookies = resp.Result().Header.Get("X-CSRF-Token"), upgraded
+	if resp := post(); resp.Code != http.StatusSeeOther {
+		t.Errorf("Expected a CSRF cookie made with the current secret to be accepted, got %s", http.StatusText(resp.Code))
+	}
+}
@@ -13,9 +13,9 @@ import (
 	"net/http"
 	"os"
 	"runtime"
+	"slices"
 	"time"
 
-	"github.com/gorilla/csrf"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
@@ -28,20 +28,24 @@ import (
 
 	"github.com/cashier-go/cashier/lib"
 	"github.com/cashier-go/cashier/server/auth"
-	"github.com/cashier-go/cashier/server/auth/github"
-	"github.com/cashier-go/cashier/server/auth/gitlab"
-	"github.com/cashier-go/cashier/server/auth/google"
-	"github.com/cashier-go/cashier/server/auth/microsoft"
 	"github.com/cashier-go/cashier/server/config"
 	"github.com/cashier-go/cashier/server/metrics"
 	"github.com/cashier-go/cashier/server/signer"
 	"github.com/cashier-go/cashier/server/store"
+	"github.com/cashier-go/cashier/server/workload"
 )
 
 // Server is a convenience wrapper around a *httpServer
 type Server struct {
 	httpServer *http.Server
 	logfile    *os.File
+	app        *application
+}
+
+// ReloadSecrets reads the cookie and CSRF secrets again, e.g. after they were
+// rotated.
+func (s *Server) ReloadSecrets() error {
+	return s.app.reloadSecrets()
 }
 
 // Shutdown the server and perform any cleanup
@@ -72,7 +76,11 @@ func setupTLS(l net.Listener, conf *config.Server) (net.Listener, error) {
 		if conf.LetsEncryptCache != "" {
 			m.Cache = wkfscache.Cache(conf.LetsEncryptCache)
 		}
-		return tls.NewListener(l, m.TLSConfig()), nil
+		tlsConfig := m.TLSConfig()
+		if err := clientCertAuth(tlsConfig, conf.ClientCerts); err != nil {
+			return nil, err
+		}
+		return tls.NewListener(l, tlsConfig), nil
 	}
 	if conf.TLSCert == "" || conf.TLSKey == "" {
 		return nil, fmt.Errorf("TLS cert or key not specified in config")
@@ -83,6 +91,9 @@ func setupTLS(l net.Listener, conf *config.Server) (net.Listener, error) {
 	if err != nil {
 		return nil, fmt.Errorf("unable to create TLS listener: %w", err)
 	}
+	if err := clientCertAuth(tlsConfig, conf.ClientCerts); err != nil {
+		return nil, err
+	}
 	return tls.NewListener(l, tlsConfig), nil
 }
 
@@ -116,21 +127,9 @@ func Run(conf *config.Config) (*Server, error) {
 	// Unprivileged section
 	metrics.Register()
 
-	var authprovider auth.Provider
-	switch conf.Auth.Provider {
-	case "github":
-		authprovider, err = github.New(conf.Auth)
-	case "gitlab":
-		authprovider, err = gitlab.New(conf.Auth)
-	case "google":
-		authprovider, err = google.New(conf.Auth)
-	case "microsoft":
-		authprovider, err = microsoft.New(conf.Auth)
-	default:
-		return nil, fmt.Errorf("unknown provider %q", conf.Auth.Provider)
-	}
+	authproviders, err := newAuthProviders(conf.Auth)
 	if err != nil {
-		return nil, fmt.Errorf("unable to configure provider %q: %w", conf.Auth.Provider, err)
+		return nil, err
 	}
 
 	keysigner, err := signer.New(conf.SSH)
@@ -143,16 +142,25 @@ func Run(conf *config.Config) (*Server, error) {
 		return nil, fmt.Errorf("unable to configure datastore: %w", err)
 	}
 
+	keys, err := loadSecrets(conf.Server)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load secrets: %w", err)
+	}
+
 	app := &application{
-		cookiestore:   sessions.NewCookieStore([]byte(conf.Server.CookieSecret)),
+		sessionstore:  newSessionStore(certstore, keys.cookieKeyPairs...),
+		csrf:          newCSRFProtect(conf.Server.UseTLS, keys.csrfKeys...),
 		requireReason: conf.Server.RequireReason,
 		keysigner:     keysigner,
 		certstore:     certstore,
-		authprovider:  authprovider,
+		authproviders: authproviders,
 		config:        conf.Server,
 		router:        mux.NewRouter(),
 	}
-	app.cookiestore.Options = &sessions.Options{
+	if len(conf.Server.WorkloadIdentity.Issuers) > 0 {
+		app.workload = workload.New(conf.Server.WorkloadIdentity, &http.Client{Timeout: 10 * time.Second})
+	}
+	app.sessionstore.Options = &sessions.Options{
 		MaxAge:   900,
 		Path:     "/",
 		Secure:   conf.Server.UseTLS,
@@ -167,6 +175,14 @@ func Run(conf *config.Config) (*Server, error) {
 		}
 	}
 
+	if conf.Server.SecretsReloadInterval != "" {
+		interval, err := time.ParseDuration(conf.Server.SecretsReloadInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secrets_reload_interval: %w", err)
+		}
+		go app.reloadSecretsEvery(interval)
+	}
+
 	app.setupRoutes()
 	r := handlers.LoggingHandler(logfile, app.router)
 	s := &http.Server{
@@ -181,6 +197,7 @@ func Run(conf *config.Config) (*Server, error) {
 	return &Server{
 		httpServer: s,
 		logfile:    logfile,
+		app:        app,
 	}, nil
 }
 
@@ -211,30 +228,49 @@ func encodeToken(s string) string {
 //go:embed static
 var static embed.FS
 
-// application contains local context - cookiestore, authsession etc.
+// application contains local context - sessionstore, authsession etc.
 type application struct {
-	cookiestore   *sessions.CookieStore
-	authprovider  auth.Provider
+	sessionstore  *sessionStore
+	csrf          *csrfProtect
+	authproviders []*authProvider
 	certstore     store.CertStorer
 	keysigner     *signer.KeySigner
 	router        *mux.Router
 	config        *config.Server
 	requireReason bool
+	challenges    challengeStore
+	workload      *workload.Verifier
 }
 
 func (a *application) setupRoutes() {
 	// login required
-	csrfHandler := csrf.Protect([]byte(a.config.CSRFSecret), csrf.Secure(a.config.UseTLS))
-	a.router.Methods("GET").Path("/").Handler(a.authed(http.HandlerFunc(a.index)))
-	a.router.Methods("POST").Path("/admin/revoke").Handler(a.authed(csrfHandler(http.HandlerFunc(a.revoke))))
-	a.router.Methods("GET").Path("/admin/certs").Handler(a.authed(csrfHandler(http.HandlerFunc(a.getAllCerts))))
-	a.router.Methods("GET").Path("/admin/certs.json").Handler(a.authed(http.HandlerFunc(a.getCertsJSON)))
+	csrfHandler := a.csrf.protect
+	a.router.Methods("GET").Path("/").Handler(a.authed(csrfHandler(http.HandlerFunc(a.index))))
+	a.router.Methods("POST").Path("/admin/revoke").Handler(a.admin(csrfHandler(http.HandlerFunc(a.revoke))))
+	a.router.Methods("GET").Path("/admin/certs").Handler(a.admin(csrfHandler(http.HandlerFunc(a.getAllCerts))))
+	a.router.Methods("GET").Path("/admin/certs.json").Handler(a.admin(http.HandlerFunc(a.getCertsJSON)))
+	a.router.Methods("GET").Path("/auth/authorize").Handler(a.authed(csrfHandler(http.HandlerFunc(a.authorize))))
+	a.router.Methods("POST").Path("/auth/authorize").Handler(a.authed(csrfHandler(http.HandlerFunc(a.confirmAuthorize))))
+	a.router.Methods("POST").Path("/admin/sessions/revoke").Handler(a.admin(csrfHandler(http.HandlerFunc(a.revokeSessions))))
+	a.router.Methods("GET").Path("/admin/service-accounts").Handler(a.admin(a.requireServiceAccounts(csrfHandler(http.HandlerFunc(a.listServiceAccounts)))))
+	a.router.Methods("POST").Path("/admin/service-accounts").Handler(a.admin(a.requireServiceAccounts(csrfHandler(http.HandlerFunc(a.setServiceAccount)))))
+	a.router.Methods("POST").Path("/admin/service-accounts/delete").Handler(a.admin(a.requireServiceAccounts(csrfHandler(http.HandlerFunc(a.deleteServiceAccount)))))
+	a.router.Methods("POST").Path("/admin/service-accounts/keys").Handler(a.admin(a.requireServiceAccounts(csrfHandler(http.HandlerFunc(a.createAPIKey)))))
+	a.router.Methods("POST").Path("/admin/service-accounts/keys/delete").Handler(a.admin(a.requireServiceAccounts(csrfHandler(http.HandlerFunc(a.deleteAPIKey)))))
 
 	// no login required
 	a.router.Methods("GET").Path("/auth/login").HandlerFunc(a.auth)
 	a.router.Methods("GET").Path("/auth/callback").HandlerFunc(a.auth)
+	a.router.Methods("GET").Path("/auth/logout").Handler(csrfHandler(http.HandlerFunc(a.logoutPage)))
+	a.router.Methods("POST").Path("/auth/logout").Handler(csrfHandler(http.HandlerFunc(a.logout)))
+	a.router.Methods("POST").Path("/auth/token").HandlerFunc(a.exchangeCode)
 	a.router.Methods("GET").Path("/revoked").HandlerFunc(a.revoked)
 	a.router.Methods("POST").Path("/sign").HandlerFunc(a.sign)
+	a.router.Methods("GET").Path("/sign/challenge").HandlerFunc(a.signChallenge)
+	a.router.Methods("POST").Path("/renew").HandlerFunc(a.renew)
+	a.router.Methods("POST").Path("/renew/challenge").HandlerFunc(a.renewChallenge)
+	a.router.Methods("GET").Path(lib.DiscoveryPath).HandlerFunc(a.discovery)
+	a.router.Methods("GET").Path("/ca.pub").HandlerFunc(a.caPublicKey)
 
 	a.router.Methods("GET").Path("/healthcheck").HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -263,8 +299,25 @@ func (a *application) setAuthToken(w http.ResponseWriter, r *http.Request, token
 	a.setSessionVariable(w, r, "token", string(v))
 }
 
+// getAuthSession returns the secrets of the login in progress.
+func (a *application) getAuthSession(r *http.Request) *auth.Session {
+	return &auth.Session{
+		State:    a.getSessionVariable(r, "state"),
+		Verifier: a.getSessionVariable(r, "pkce_verifier"),
+		Nonce:    a.getSessionVariable(r, "nonce"),
+	}
+}
+
+func (a *application) setAuthSession(w http.ResponseWriter, r *http.Request, s *auth.Session) {
+	session, _ := a.sessionstore.Get(r, "session")
+	session.Values["state"] = s.State
+	session.Values["pkce_verifier"] = s.Verifier
+	session.Values["nonce"] = s.Nonce
+	session.Save(r, w)
+}
+
 func (a *application) getSessionVariable(r *http.Request, key string) string {
-	session, _ := a.cookiestore.Get(r, "session")
+	session, _ := a.sessionstore.Get(r, "session")
 	v, ok := session.Values[key].(string)
 	if !ok {
 		v = ""
@@ -273,16 +326,41 @@ func (a *application) getSessionVariable(r *http.Request, key string) string {
 }
 
 func (a *application) setSessionVariable(w http.ResponseWriter, r *http.Request, key, value string) {
-	session, _ := a.cookiestore.Get(r, "session")
+	session, _ := a.sessionstore.Get(r, "session")
 	session.Values[key] = value
 	session.Save(r, w)
 }
 
+// renewSessionID gives the session a new ID, deleting it under the old one.
+func (a *application) renewSessionID(w http.ResponseWriter, r *http.Request) error {
+	session, _ := a.sessionstore.Get(r, "session")
+	return a.sessionstore.renewID(r, w, session)
+}
+
+// destroySession removes the session from the store and the browser.
+func (a *application) destroySession(w http.ResponseWriter, r *http.Request) error {
+	session, _ := a.sessionstore.Get(r, "session")
+	session.Options.MaxAge = -1
+	return session.Save(r, w)
+}
+
+// admin restricts a handler to logged in admins.
+func (a *application) admin(next http.Handler) http.Handler {
+	return a.authed(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if admins := a.config.Admins; len(admins) > 0 && !slices.Contains(admins, a.getSessionVariable(r, "username")) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, http.StatusText(http.StatusForbidden))
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
 func (a *application) authed(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		t := a.getAuthToken(r)
 		ctx := r.Context()
-		if !t.Valid() || !a.authprovider.Valid(ctx, t) {
+		if p := a.sessionProvider(r); p == nil || !t.Valid() || !p.Valid(ctx, t) {
 			a.setSessionVariable(w, r, "origin_url", r.URL.RequestURI())
 			http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
 			return
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/csrf"
+
+	"github.com/cashier-go/cashier/server/signer"
+	"github.com/cashier-go/cashier/server/store"
+	"github.com/cashier-go/cashier/server/templates"
+)
+
+// apiKeyPrefix marks a bearer token as a service account's API key.
+const apiKeyPrefix = "cashier_sa_"
+
+var serviceAccountName = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// newAPIKey generates an API key. Only its hash is stored.
+func newAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// serviceAccount returns the unexpired service account an API key belongs to.
+func (a *application) serviceAccount(key string) (*store.ServiceAccountRecord, error) {
+	rec, err := a.certstore.GetAPIKey(hashToken(key))
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	account, err := a.certstore.GetServiceAccount(rec.Account)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	if time.Now().After(account.Expires) {
+		return nil, fmt.Errorf("service account %s has expired", account.Name)
+	}
+	return account, nil
+}
+
+// serviceAccountsEnabled reports whether service accounts are configured.
+func (a *application) serviceAccountsEnabled() bool {
+	return len(a.config.Admins) > 0 && len(a.config.ServiceAccountPrincipals) > 0
+}
+
+// serviceAccountGrant returns what a service account may be issued. Its
+// principals are limited to those currently allowed to service accounts.
+func (a *application) serviceAccountGrant(account *store.ServiceAccountRecord) (signer.Grant, error) {
+	var principals []string
+	for _, p := range account.Principals {
+		if slices.Contains(a.config.ServiceAccountPrincipals, p) {
+			principals = append(principals, p)
+		}
+	}
+	// An empty grant would allow the username and additional principals.
+	if len(principals) == 0 {
+		return signer.Grant{}, fmt.Errorf("service account %s has no allowed principals", account.Name)
+	}
+	return signer.Grant{
+		Username:    account.Name,
+		Principals:  principals,
+		MaxValidity: account.MaxValidity,
+	}, nil
+}
+
+// requireServiceAccounts fails requests to the service account pages unless
+// service accounts are configured.
+func (a *application) requireServiceAccounts(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.serviceAccountsEnabled() {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "Service accounts are not enabled")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type serviceAccountView struct {
+	*store.ServiceAccountRecord
+	Keys    []*store.APIKeyRecord
+	Expired bool
+}
+
+// renderServiceAccounts shows the service accounts, and a newly created API
+// key if there is one.
+func (a *application) renderServiceAccounts(w http.ResponseWriter, r *http.Request, newKey, newKeyAccount string) {
+	accounts, err := a.certstore.ListServiceAccounts()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	views := make([]*serviceAccountView, 0, len(accounts))
+	for _, account := range accounts {
+		keys, err := a.certstore.ListAPIKeys(account.Name)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		views = append(views, &serviceAccountView{
+			ServiceAccountRecord: account,
+			Keys:                 keys,
+			Expired:              time.Now().After(account.Expires),
+		})
+	}
+	w.Header().Set("X-CSRF-Token", csrf.Token(r))
+	tmpl := template.Must(template.New("service_accounts.html").Parse(templates.ServiceAccounts))
+	tmpl.Execute(w, map[string]interface{}{
+		csrf.TemplateTag: csrf.TemplateField(r),
+		"Accounts":       views,
+		"NewKey":         newKey,
+		"NewKeyAccount":  newKeyAccount,
+	})
+}
+
+func (a *application) listServiceAccounts(w http.ResponseWriter, r *http.Request) {
+	a.renderServiceAccounts(w, r, "", "")
+}
+
+// setServiceAccount creates or updates a service account.
+func (a *application) setServiceAccount(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if !serviceAccountName.MatchString(name) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "A name of letters, digits, '.', '_' or '-' is required")
+		return
+	}
+	var principals store.StringSlice
+	for _, p := range strings.Split(r.FormValue("principals"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			principals = append(principals, p)
+		}
+	}
+	if len(principals) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "At least one principal is required")
+		return
+	}
+	for _, p := range principals {
+		if !slices.Contains(a.config.ServiceAccountPrincipals, p) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Principal %q isn't allowed for service accounts", p)
+			return
+		}
+	}
+	var maxValidity time.Duration
+	if v := r.FormValue("max_validity"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Invalid max validity %q", v)
+			return
+		}
+		maxValidity = d
+	}
+	expires, err := time.Parse("2006-01-02", r.FormValue("expires"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "An expiry date is required")
+		return
+	}
+	account := &store.ServiceAccountRecord{
+		Name:        name,
+		Principals:  principals,
+		MaxValidity: maxValidity,
+		CreatedBy:   a.getSessionVariable(r, "username"),
+		CreatedAt:   time.Now().UTC(),
+		Expires:     expires,
+	}
+	if existing, err := a.certstore.GetServiceAccount(name); err == nil {
+		account.CreatedBy = existing.CreatedBy
+		account.CreatedAt = existing.CreatedAt
+	}
+	if err := a.certstore.SetServiceAccount(account); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Unable to save service account")
+		return
+	}
+	log.Printf("Service account %s saved by %s", name, a.getSessionVariable(r, "username"))
+	http.Redirect(w, r, "/admin/service-accounts", http.StatusSeeOther)
+}
+
+func (a *application) deleteServiceAccount(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if err := a.certstore.DeleteServiceAccount(name); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Unable to delete service account")
+		return
+	}
+	log.Printf("Service account %s deleted by %s", name, a.getSessionVariable(r, "username"))
+	http.Redirect(w, r, "/admin/service-accounts", http.StatusSeeOther)
+}
+
+// createAPIKey creates an API key for a service account. The key is only
+// shown in the response.
+func (a *application) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if _, err := a.certstore.GetServiceAccount(name); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No service account %q", name)
+		return
+	}
+	key, err := newAPIKey()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Unable to create API key")
+		return
+	}
+	if err := a.certstore.SetAPIKey(&store.APIKeyRecord{
+		Hash:      hashToken(key),
+		Account:   name,
+		CreatedAt: time.Now().UTC(),
+	}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Unable to create API key")
+		return
+	}
+	log.Printf("API key created for service account %s by %s", name, a.getSessionVariable(r, "username"))
+	a.renderServiceAccounts(w, r, key, name)
+}
+
+func (a *application) deleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	if err := a.certstore.DeleteAPIKey(r.FormValue("key_hash")); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Unable to delete API key")
+		return
+	}
+	http.Redirect(w, r, "/admin/service-accounts", http.StatusSeeOther)
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/cashier-go/cashier/lib"
+	"github.com/cashier-go/cashier/server/store"
+	"github.com/cashier-go/cashier/testdata"
+)
+
+// signWithAPIKey signs testdata.Pub with an API key.
+func signWithAPIKey(t *testing.T, key string) (int, *ssh.Certificate) {
+	t.Helper()
+	return signWithAPIKeyUntil(t, key, time.Now().UTC().Add(4*time.Hour))
+}
+
+// signWithAPIKeyUntil signs testdata.Pub with an API key, asking for a
+// certificate valid until validUntil. A zero validUntil is left out.
+func signWithAPIKeyUntil(t *testing.T, key string, validUntil time.Time) (int, *ssh.Certificate) {
+	t.Helper()
+	body := map[string]interface{}{"key": string(testdata.Pub)}
+	if !validUntil.IsZero() {
+		body["valid_until"] = validUntil
+	}
+	s, _ := json.Marshal(body)
+	req, _ := http.NewRequest("POST", "/sign", bytes.NewReader(s))
+	req.Header.Set("Authorization", "Bearer "+key)
+	resp := httptest.NewRecorder()
+	a.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		return resp.Code, nil
+	}
+	r := &lib.SignResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(r); err != nil {
+		t.Fatal(err)
+	}
+	k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(r.Response))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Code, k.(*ssh.Certificate)
+}
+
+// withServiceAccounts enables service accounts, managed by "admin", for the
+// duration of a test.
+func withServiceAccounts(t *testing.T) {
+	t.Helper()
+	admins, principals := a.config.Admins, a.config.ServiceAccountPrincipals
+	a.config.Admins = []string{"admin"}
+	a.config.ServiceAccountPrincipals = []string{"deploy", "www", "backup"}
+	t.Cleanup(func() {
+		a.config.Admins, a.config.ServiceAccountPrincipals = admins, principals
+	})
+}
+
+func TestSignAPIKey(t *testing.T) {
+	withServiceAccounts(t)
+	now := time.Now().UTC()
+	for _, account := range []*store.ServiceAccountRecord{
+		{Name: "deploy", Principals: store.StringSlice{"deploy", "www"}, MaxValidity: 30 * time.Minute, Expires: now.Add(time.Hour)},
+		{Name: "old", Principals: store.StringSlice{"deploy"}, Expires: now.Add(-time.Hour)},
+		{Name: "root", Principals: store.StringSlice{"root"}, Expires: now.Add(time.Hour)},
+	} {
+		if err := a.certstore.SetServiceAccount(account); err != nil {
+			t.Fatal(err)
+		}
+		defer a.certstore.DeleteServiceAccount(account.Name)
+	}
+	keys := map[string]string{}
+	for _, name := range []string{"deploy", "old", "root"} {
+		key, _ := newAPIKey()
+		if err := a.certstore.SetAPIKey(&store.APIKeyRecord{Hash: hashToken(key), Account: name, CreatedAt: now}); err != nil {
+			t.Fatal(err)
+		}
+		keys[name] = key
+	}
+
+	code, cert := signWithAPIKey(t, keys["deploy"])
+	if code != http.StatusOK {
+		t.Fatalf("Unexpected status: %s", http.StatusText(code))
+	}
+	if !reflect.DeepEqual(cert.ValidPrincipals, []string{"deploy", "www"}) {
+		t.Errorf("Unexpected principals %v", cert.ValidPrincipals)
+	}
+	if validUntil := time.Unix(int64(cert.ValidBefore), 0); validUntil.After(time.Now().Add(30 * time.Minute)) {
+		t.Errorf("Expected validity to be capped at 30m, got %s", time.Until(validUntil))
+	}
+	rec, err := a.certstore.Get(cert.KeyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Username != "deploy" || rec.ServiceAccount != "deploy" {
+		t.Errorf("Unexpected record: %+v", rec)
+	}
+
+	code, cert = signWithAPIKeyUntil(t, keys["deploy"], time.Time{})
+	if code != http.StatusOK {
+		t.Fatalf("Unexpected status: %s", http.StatusText(code))
+	}
+	if max := uint64(time.Now().Add(30 * time.Minute).Unix()); cert.ValidBefore > max {
+		t.Errorf("Expected validity to be capped at 30m without valid_until, got valid before %d", cert.ValidBefore)
+	}
+
+	// API keys aren't used up.
+	if code, _ := signWithAPIKey(t, keys["deploy"]); code != http.StatusOK {
+		t.Errorf("Expected an API key to be reusable, got %s", http.StatusText(code))
+	}
+	if code, _ := signWithAPIKey(t, keys["old"]); code != http.StatusUnauthorized {
+		t.Errorf("Expected an expired service account to be rejected, got %s", http.StatusText(code))
+	}
+	if code, _ := signWithAPIKey(t, apiKeyPrefix+"unknown"); code != http.StatusUnauthorized {
+		t.Errorf("Expected an unknown API key to be rejected, got %s", http.StatusText(code))
+	}
+	if code, _ := signWithAPIKey(t, keys["root"]); code != http.StatusUnauthorized {
+		t.Errorf("Expected a service account without allowed principals to be rejected, got %s", http.StatusText(code))
+	}
+
+	a.config.ServiceAccountPrincipals = nil
+	if code, _ := signWithAPIKey(t, keys["deploy"]); code != http.StatusUnauthorized {
+		t.Errorf("Expected API keys to be rejected when service accounts are disabled, got %s", http.StatusText(code))
+	}
+}
+
+func TestServiceAccountAdmin(t *testing.T) {
+	withServiceAccounts(t)
+	req, _ := http.NewRequest("GET", "/admin/service-accounts", nil)
+	req.AddCookie(loggedIn(t, "mallory"))
+	resp := httptest.NewRecorder()
+	a.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusForbidden {
+		t.Errorf("Expected a user who isn't an admin to be forbidden, got %s", http.StatusText(resp.Code))
+	}
+
+	admin := loggedIn(t, "admin")
+	req, _ = http.NewRequest("GET", "/admin/service-accounts", nil)
+	req.AddCookie(admin)
+	resp = httptest.NewRecorder()
+	a.router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Unexpected status: %s", http.StatusText(resp.Code))
+	}
+	csrfToken := resp.Result().Header.Get("X-CSRF-Token")
+	csrfCookies := resp.Result().Cookies()
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		t.Helper()
+		req, _ := http.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-CSRF-Token", csrfToken)
+		req.AddCookie(admin)
+		for _, cookie := range csrfCookies {
+			req.AddCookie(cookie)
+		}
+		resp := httptest.NewRecorder()
+		a.router.ServeHTTP(resp, req)
+		return resp
+	}
+
+	expires := time.Now().UTC().AddDate(0, 0, 30).Format("2006-01-02")
+	resp = post("/admin/service-accounts", url.Values{"name": {"backup"}, "principals": {"backup, www"}, "max_validity": {"1h"}, "expires": {expires}})
+	if resp.Code != http.StatusSeeOther {
+		t.Fatalf("Unexpected status: %s", http.StatusText(resp.Code))
+	}
+	defer a.certstore.DeleteServiceAccount("backup")
+	account, err := a.certstore.GetServiceAccount("backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]string(account.Principals), []string{"backup", "www"}) || account.MaxValidity != time.Hour || account.CreatedBy != "admin" {
+		t.Errorf("Unexpected service account: %+v", account)
+	}
+	if resp := post("/admin/service-accounts", url.Values{"name": {"no principals"}, "expires": {expires}}); resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid service account to be rejected, got %s", http.StatusText(resp.Code))
+	}
+	if resp := post("/admin/service-accounts", url.Values{"name": {"escalate"}, "principals": {"backup,root"}, "expires": {expires}}); resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected a principal outside service_account_principals to be rejected, got %s", http.StatusText(resp.Code))
+	}
+
+	resp = post("/admin/service-accounts/keys", url.Values{"name": {"backup"}})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Unexpected status: %s", http.StatusText(resp.Code))
+	}
+	key := regexp.MustCompile(apiKeyPrefix + `[A-Za-z0-9_-]+`).FindString(resp.Body.String())
+	if key == "" {
+		t.Fatal("Expected the new API key to be shown")
+	}
+	if code, _ := signWithAPIKey(t, key); code != http.StatusOK {
+		t.Errorf("Unexpected status: %s", http.StatusText(code))
+	}
+
+	if resp := post("/admin/service-accounts/keys/delete", url.Values{"key_hash": {hashToken(key)}}); resp.Code != http.StatusSeeOther {
+		t.Fatalf("Unexpected status: %s", http.StatusText(resp.Code))
+	}
+	if code, _ := signWithAPIKey(t, key); code != http.StatusUnauthorized {
+		t.Errorf("Expected a deleted API key to be rejected, got %s", http.StatusText(code))
+	}
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+
+	"github.com/cashier-go/cashier/server/store"
+)
+
+// sessionStore is a sessions.Store which keeps session values on the server.
+// The cookie only holds an opaque, signed session ID, and the ID is stored by
+// its hash.
+type sessionStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+	db      store.SessionStorer
+	mu      sync.RWMutex
+}
+
+var _ sessions.Store = (*sessionStore)(nil)
+
+// newSessionStore returns a sessionStore saving sessions in db. The key pairs
+// sign and optionally encrypt the session cookie, as for
+// sessions.NewCookieStore.
+func newSessionStore(db store.SessionStorer, keyPairs ...[]byte) *sessionStore {
+	return &sessionStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 900,
+		},
+		db: db,
+	}
+}
+
+// setKeyPairs replaces the key pairs of the session cookie. The first pair
+// is used for new cookies, and cookies made with any of the pairs are
+// accepted.
+func (s *sessionStore) setKeyPairs(keyPairs ...[]byte) {
+	codecs := securecookie.CodecsFromPairs(keyPairs...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Codecs = codecs
+}
+
+func (s *sessionStore) codecs() []securecookie.Codec {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Codecs
+}
+
+// Get returns a session for the given name after adding it to the registry.
+func (s *sessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the
+// registry.
+func (s *sessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	if err := securecookie.DecodeMulti(name, c.Value, &session.ID, s.codecs()...); err != nil {
+		session.ID = ""
+		return session, err
+	}
+	if err := s.load(session); err != nil {
+		// Unknown or expired sessions are replaced by a new session.
+		session.ID = ""
+		return session, nil
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+// Save stores the session and sets the session cookie. A session with a
+// MaxAge <= 0 is deleted.
+func (s *sessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge <= 0 {
+		if session.ID != "" {
+			if err := s.db.DeleteSession(hashToken(session.ID)); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+	if session.ID == "" {
+		session.ID = base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+	}
+	if err := s.save(session); err != nil {
+		return err
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs()...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// renewID saves the session under a new ID and deletes it under the old one,
+// so that an ID known before a login can't be used after it.
+func (s *sessionStore) renewID(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.ID != "" {
+		if err := s.db.DeleteSession(hashToken(session.ID)); err != nil {
+			return err
+		}
+	}
+	session.ID = ""
+	return s.Save(r, w, session)
+}
+
+// save writes the string values of the session to the database.
+func (s *sessionStore) save(session *sessions.Session) error {
+	values := make(map[string]string, len(session.Values))
+	for k, v := range session.Values {
+		key, ok := k.(string)
+		value, ok2 := v.(string)
+		if ok && ok2 {
+			values[key] = value
+		}
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	return s.db.SetSession(&store.SessionRecord{
+		ID:       hashToken(session.ID),
+		Username: values["username"],
+		Data:     string(data),
+		Expires:  time.Now().UTC().Add(time.Duration(session.Options.MaxAge) * time.Second),
+		Provider: values["provider"],
+	})
+}
+
+// load reads the values of the session from the database.
+func (s *sessionStore) load(session *sessions.Session) error {
+	rec, err := s.db.GetSession(hashToken(session.ID))
+	if err != nil {
+		return err
+	}
+	values, err := decodeSessionData(rec.Data)
+	if err != nil {
+		return err
+	}
+	for k, v := range values {
+		session.Values[k] = v
+	}
+	return nil
+}
+
+func decodeSessionData(data string) (map[string]string, error) {
+	values := map[string]string{}
+	err := json.Unmarshal([]byte(data), &values)
+	return values, err
+}
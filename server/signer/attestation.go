@@ -0,0 +1,268 @@
+package signer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/google/uuid"
+	"go4.org/wkfs"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/cashier-go/cashier/server/config"
+)
+
+// attestationV01 identifies the attestation format written by
+// `ssh-keygen -O write-attestation`.
+const attestationV01 = "ssh-sk-attest-v01"
+
+// flagAttestedCredentialData is set in authenticator data which includes the
+// credential public key.
+const flagAttestedCredentialData = 0x40
+
+// oidFIDOAAGUID is the attestation certificate extension holding the
+// authenticator's AAGUID.
+var oidFIDOAAGUID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+// isSecurityKey reports whether the key is held by a FIDO security key.
+func isSecurityKey(pub ssh.PublicKey) bool {
+	switch pub.Type() {
+	case ssh.KeyAlgoSKECDSA256, ssh.KeyAlgoSKED25519:
+		return true
+	}
+	return false
+}
+
+// securityKeyApplication returns the FIDO application (relying party) a
+// security key was created for, e.g. "ssh:".
+func securityKeyApplication(pub ssh.PublicKey) (string, error) {
+	var err error
+	switch pub.Type() {
+	case ssh.KeyAlgoSKECDSA256:
+		var k struct {
+			Name        string
+			Curve       string
+			KeyBytes    []byte
+			Application string
+		}
+		if err = ssh.Unmarshal(pub.Marshal(), &k); err == nil {
+			return k.Application, nil
+		}
+	case ssh.KeyAlgoSKED25519:
+		var k struct {
+			Name        string
+			KeyBytes    []byte
+			Application string
+		}
+		if err = ssh.Unmarshal(pub.Marshal(), &k); err == nil {
+			return k.Application, nil
+		}
+	default:
+		err = fmt.Errorf("%s is not a security key", pub.Type())
+	}
+	return "", err
+}
+
+// attestation is a parsed FIDO attestation.
+type attestation struct {
+	cert      *x509.Certificate
+	signature []byte
+	authData  []byte
+}
+
+func parseAttestation(b []byte) (*attestation, error) {
+	var blob struct {
+		Magic     string
+		Cert      []byte
+		Signature []byte
+		AuthData  []byte
+		Flags     uint32
+		Reserved  []byte
+	}
+	if err := ssh.Unmarshal(b, &blob); err != nil {
+		return nil, fmt.Errorf("unable to parse attestation: %w", err)
+	}
+	if blob.Magic != attestationV01 {
+		return nil, fmt.Errorf("unsupported attestation format %q", blob.Magic)
+	}
+	cert, err := x509.ParseCertificate(blob.Cert)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse attestation certificate: %w", err)
+	}
+	return &attestation{
+		cert:      cert,
+		signature: blob.Signature,
+		authData:  unwrapCBORBytes(blob.AuthData),
+	}, nil
+}
+
+// authenticatorData is the part of the FIDO authenticator data needed to
+// check an attestation.
+type authenticatorData struct {
+	rpIDHash      []byte
+	aaguid        []byte
+	credentialKey crypto.PublicKey
+}
+
+func parseAuthenticatorData(b []byte) (*authenticatorData, error) {
+	// rpIdHash (32) | flags (1) | signCount (4) | aaguid (16) | credentialIdLength (2) | credentialId | credentialPublicKey
+	if len(b) < 37 || b[32]&flagAttestedCredentialData == 0 {
+		return nil, errors.New("authenticator data has no attested credential")
+	}
+	ad := &authenticatorData{rpIDHash: b[:32]}
+	b = b[37:]
+	if len(b) < 18 {
+		return nil, errors.New("authenticator data is truncated")
+	}
+	ad.aaguid = b[:16]
+	n := int(binary.BigEndian.Uint16(b[16:18]))
+	if b = b[18:]; len(b) < n {
+		return nil, errors.New("authenticator data is truncated")
+	}
+	key, _, err := parseCOSEKey(b[n:])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse credential public key: %w", err)
+	}
+	ad.credentialKey = key
+	return ad, nil
+}
+
+// certificateAAGUID returns the AAGUID in the attestation certificate, if any.
+func certificateAAGUID(cert *x509.Certificate) ([]byte, error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidFIDOAAGUID) {
+			continue
+		}
+		var aaguid []byte
+		if _, err := asn1.Unmarshal(ext.Value, &aaguid); err != nil || len(aaguid) != 16 {
+			return nil, errors.New("invalid AAGUID extension in attestation certificate")
+		}
+		return aaguid, nil
+	}
+	return nil, nil
+}
+
+// attestationVerifier checks that security keys live on approved
+// authenticators.
+type attestationVerifier struct {
+	required bool
+	roots    *x509.CertPool
+	aaguids  []string
+}
+
+// verify checks the attestation for a security key. Other keys aren't
+// attested.
+func (v *attestationVerifier) verify(pub ssh.PublicKey, att, challenge []byte) error {
+	if v == nil || !isSecurityKey(pub) {
+		return nil
+	}
+	if len(att) == 0 {
+		if v.required {
+			return fmt.Errorf("%w: security keys must be sent with their attestation", ErrKeyRejected)
+		}
+		return nil
+	}
+	if err := v.check(pub, att, challenge); err != nil {
+		return fmt.Errorf("%w: attestation: %w", ErrKeyRejected, err)
+	}
+	return nil
+}
+
+func (v *attestationVerifier) check(pub ssh.PublicKey, b, challenge []byte) error {
+	att, err := parseAttestation(b)
+	if err != nil {
+		return err
+	}
+	if _, err := att.cert.Verify(x509.VerifyOptions{
+		Roots:     v.roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return fmt.Errorf("untrusted attestation certificate: %w", err)
+	}
+
+	// The signature covers the authenticator data and the hash of the
+	// challenge the key was created with.
+	clientDataHash := sha256.Sum256(challenge)
+	signed := append(slices.Clip(att.authData), clientDataHash[:]...)
+	var alg x509.SignatureAlgorithm
+	switch att.cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		alg = x509.ECDSAWithSHA256
+	case ed25519.PublicKey:
+		alg = x509.PureEd25519
+	default:
+		return errors.New("unsupported attestation certificate key")
+	}
+	if err := att.cert.CheckSignature(alg, signed, att.signature); err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+
+	ad, err := parseAuthenticatorData(att.authData)
+	if err != nil {
+		return err
+	}
+	application, err := securityKeyApplication(pub)
+	if err != nil {
+		return err
+	}
+	if rpIDHash := sha256.Sum256([]byte(application)); !bytes.Equal(ad.rpIDHash, rpIDHash[:]) {
+		return errors.New("application doesn't match the key")
+	}
+	key, ok := ad.credentialKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !key.Equal(pub.(ssh.CryptoPublicKey).CryptoPublicKey()) {
+		return errors.New("attested key doesn't match the key")
+	}
+
+	certAAGUID, err := certificateAAGUID(att.cert)
+	if err != nil {
+		return err
+	}
+	if certAAGUID != nil && !bytes.Equal(certAAGUID, ad.aaguid) {
+		return errors.New("AAGUID doesn't match the attestation certificate")
+	}
+	if len(v.aaguids) > 0 {
+		id, _ := uuid.FromBytes(ad.aaguid)
+		if !slices.Contains(v.aaguids, id.String()) {
+			return fmt.Errorf("authenticator %s is not allowed", id)
+		}
+	}
+	return nil
+}
+
+// newAttestationVerifier creates an attestationVerifier from the supplied
+// configuration. It returns nil if attestation isn't configured.
+func newAttestationVerifier(conf config.SecurityKeys) (*attestationVerifier, error) {
+	if conf.AttestationRoots == "" {
+		if conf.RequireAttestation || len(conf.AllowedAAGUIDs) > 0 {
+			return nil, errors.New("attestation_roots must be set to verify attestations")
+		}
+		return nil, nil
+	}
+	data, err := wkfs.ReadFile(conf.AttestationRoots)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read attestation roots %s: %w", conf.AttestationRoots, err)
+	}
+	v := &attestationVerifier{
+		required: conf.RequireAttestation,
+		roots:    x509.NewCertPool(),
+	}
+	if !v.roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in attestation roots %s", conf.AttestationRoots)
+	}
+	for _, s := range conf.AllowedAAGUIDs {
+		id, err := uuid.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AAGUID %q: %w", s, err)
+		}
+		v.aaguids = append(v.aaguids, id.String())
+	}
+	return v, nil
+}
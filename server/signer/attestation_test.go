@@ -0,0 +1,247 @@
+package signer
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/cashier-go/cashier/server/config"
+	"github.com/cashier-go/cashier/testdata"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const testAAGUID = "cb69481e-8ff7-4039-93ec-0a2729a154a8"
+
+// testAuthenticator creates attestations as a FIDO authenticator would.
+type testAuthenticator struct {
+	cert    []byte
+	key     *ecdsa.PrivateKey
+	aaguid  []byte
+	rootPEM []byte
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	t.Helper()
+	rootKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test FIDO Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := x509.ParseCertificate(rootDER)
+
+	a := &testAuthenticator{rootPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootDER})}
+	a.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	aaguid := uuid.MustParse(testAAGUID)
+	a.aaguid = aaguid[:]
+	ext, _ := asn1.Marshal(a.aaguid)
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		Subject:         pkix.Name{CommonName: "Test Authenticator"},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: oidFIDOAAGUID, Value: ext}},
+	}
+	if a.cert, err = x509.CreateCertificate(rand.Reader, template, root, &a.key.PublicKey, rootKey); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// cborBytes encodes b as a CBOR byte string.
+func cborBytes(b []byte) []byte {
+	if len(b) < 24 {
+		return append([]byte{0x40 | byte(len(b))}, b...)
+	}
+	return append([]byte{0x58, byte(len(b))}, b...)
+}
+
+// enroll creates a security key for the application and its attestation.
+func (a *testAuthenticator) enroll(t *testing.T, keyType, application string, challenge []byte) (ssh.PublicKey, []byte) {
+	t.Helper()
+	var wire, cose []byte
+	switch keyType {
+	case ssh.KeyAlgoSKED25519:
+		pub, _, _ := ed25519.GenerateKey(rand.Reader)
+		wire = ssh.Marshal(struct {
+			Name        string
+			KeyBytes    []byte
+			Application string
+		}{keyType, pub, application})
+		cose = append([]byte{0xa4, 0x01, 0x01, 0x03, 0x27, 0x20, 0x06, 0x21}, cborBytes(pub)...)
+	case ssh.KeyAlgoSKECDSA256:
+		k, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		wire = ssh.Marshal(struct {
+			Name        string
+			Curve       string
+			KeyBytes    []byte
+			Application string
+		}{keyType, "nistp256", elliptic.Marshal(elliptic.P256(), k.X, k.Y), application})
+		x, y := make([]byte, 32), make([]byte, 32)
+		k.X.FillBytes(x)
+		k.Y.FillBytes(y)
+		cose = append([]byte{0xa5, 0x01, 0x02, 0x03, 0x26, 0x20, 0x01, 0x21}, cborBytes(x)...)
+		cose = append(append(cose, 0x22), cborBytes(y)...)
+	}
+	pub, err := ssh.ParsePublicKey(wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rpIDHash := sha256.Sum256([]byte(application))
+	authData := append(rpIDHash[:], 0x41, 0, 0, 0, 1)
+	authData = append(authData, a.aaguid...)
+	authData = append(authData, 0, 4, 1, 2, 3, 4)
+	authData = append(authData, cose...)
+	clientDataHash := sha256.Sum256(challenge)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, ssh.Marshal(struct {
+		Magic     string
+		Cert      []byte
+		Signature []byte
+		AuthData  []byte
+		Flags     uint32
+		Reserved  []byte
+	}{attestationV01, a.cert, sig, cborBytes(authData), 0, nil})
+}
+
+func TestAttestation(t *testing.T) {
+	a := newTestAuthenticator(t)
+	roots := filepath.Join(t.TempDir(), "roots.pem")
+	if err := os.WriteFile(roots, a.rootPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	v, err := newAttestationVerifier(config.SecurityKeys{
+		RequireAttestation: true,
+		AttestationRoots:   roots,
+		AllowedAAGUIDs:     []string{testAAGUID},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := []byte("0123456789abcdef0123456789abcdef")
+
+	for _, keyType := range []string{ssh.KeyAlgoSKED25519, ssh.KeyAlgoSKECDSA256} {
+		pub, att := a.enroll(t, keyType, "ssh:", challenge)
+		if err := v.verify(pub, att, challenge); err != nil {
+			t.Errorf("%s: unexpected error: %v", keyType, err)
+		}
+	}
+
+	pub, att := a.enroll(t, ssh.KeyAlgoSKED25519, "ssh:", challenge)
+	other, _ := a.enroll(t, ssh.KeyAlgoSKED25519, "ssh:", challenge)
+	otherApp, otherAppAtt := a.enroll(t, ssh.KeyAlgoSKED25519, "ssh:other", challenge)
+	untrusted, untrustedAtt := newTestAuthenticator(t).enroll(t, ssh.KeyAlgoSKED25519, "ssh:", challenge)
+	rsaKey, _, _, _, _ := ssh.ParseAuthorizedKey(testdata.Pub)
+	tests := []struct {
+		name      string
+		pub       ssh.PublicKey
+		att       []byte
+		challenge []byte
+	}{
+		{"missing attestation", pub, nil, nil},
+		{"wrong challenge", pub, att, []byte("challenge")},
+		{"different key", other, att, challenge},
+		{"untrusted root", untrusted, untrustedAtt, challenge},
+		{"corrupt attestation", pub, att[:len(att)-20], challenge},
+	}
+	for _, test := range tests {
+		if err := v.verify(test.pub, test.att, test.challenge); !errors.Is(err, ErrKeyRejected) {
+			t.Errorf("%s: expected ErrKeyRejected, got %v", test.name, err)
+		}
+	}
+	if err := v.verify(otherApp, otherAppAtt, challenge); err != nil {
+		t.Errorf("unexpected error for another application: %v", err)
+	}
+	if err := v.verify(rsaKey, nil, nil); err != nil {
+		t.Errorf("unexpected error for a key which isn't a security key: %v", err)
+	}
+
+	v.aaguids = []string{"00000000-0000-0000-0000-000000000000"}
+	if err := v.verify(pub, att, challenge); !errors.Is(err, ErrKeyRejected) {
+		t.Errorf("expected ErrKeyRejected for a disallowed AAGUID, got %v", err)
+	}
+	v.required = false
+	if err := v.verify(pub, nil, nil); err != nil {
+		t.Errorf("unexpected error for an optional attestation: %v", err)
+	}
+
+	if _, err := newAttestationVerifier(config.SecurityKeys{RequireAttestation: true}); err == nil {
+		t.Error("expected an error when require_attestation is set without attestation_roots")
+	}
+}
+
+func TestCBORMapKeys(t *testing.T) {
+	cert := newTestAuthenticator(t).cert
+	for _, b := range [][]byte{
+		{0xa1, 0x80, 0x00},       // array key
+		{0xa1, 0xa0, 0x00},       // map key
+		{0xa1, 0x41, 0x00, 0x00}, // byte string key
+	} {
+		d := &cborDecoder{r: bytes.NewReader(b)}
+		if _, err := d.value(); !errors.Is(err, errCBOR) {
+			t.Errorf("%x: expected errCBOR, got %v", b, err)
+		}
+		if _, _, err := parseCOSEKey(b); err == nil {
+			t.Errorf("%x: expected an error", b)
+		}
+		// Authenticator data which isn't a CBOR byte string is used as is.
+		att, err := parseAttestation(ssh.Marshal(struct {
+			Magic     string
+			Cert      []byte
+			Signature []byte
+			AuthData  []byte
+			Flags     uint32
+			Reserved  []byte
+		}{attestationV01, cert, nil, b, 0, nil}))
+		if err != nil {
+			t.Fatalf("%x: %v", b, err)
+		}
+		if !bytes.Equal(att.authData, b) {
+			t.Errorf("%x: expected the authenticator data to be unchanged, got %x", b, att.authData)
+		}
+	}
+}
+
+func TestCBORTruncated(t *testing.T) {
+	for _, b := range [][]byte{
+		{0x19, 0x01},             // uint16 missing a byte
+		{0x1b, 0x00, 0x00, 0x00}, // uint64 missing bytes
+		{0x59, 0x00},             // byte string length missing a byte
+		{0x43, 0x00, 0x00},       // byte string missing a byte
+		{0x63, 0x61, 0x62},       // text string missing a byte
+	} {
+		d := &cborDecoder{r: bytes.NewReader(b)}
+		if _, err := d.value(); !errors.Is(err, errCBOR) {
+			t.Errorf("%x: expected errCBOR, got %v", b, err)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package signer
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// COSE key parameters used by security keys, see RFC 8152.
+const (
+	coseKty = 1
+	coseCrv = -1
+	coseX   = -2
+	coseY   = -3
+
+	coseKtyOKP = 1
+	coseKtyEC2 = 2
+
+	coseCrvP256    = 1
+	coseCrvEd25519 = 6
+)
+
+var errCBOR = errors.New("invalid CBOR")
+
+// cborDecoder decodes the subset of CBOR needed for authenticator data:
+// integers, byte and text strings, arrays and maps of definite length.
+type cborDecoder struct {
+	r *bytes.Reader
+}
+
+// head reads the major type and argument of the next item.
+func (d *cborDecoder) head() (byte, uint64, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, 0, errCBOR
+	}
+	major, info := b>>5, b&0x1f
+	var n int
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info == 24:
+		n = 1
+	case info == 25:
+		n = 2
+	case info == 26:
+		n = 4
+	case info == 27:
+		n = 8
+	default:
+		return 0, 0, fmt.Errorf("%w: unsupported additional information %d", errCBOR, info)
+	}
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(d.r, buf[8-n:]); err != nil {
+		return 0, 0, errCBOR
+	}
+	return major, binary.BigEndian.Uint64(buf), nil
+}
+
+// value decodes the next item as an int64, []byte, string, []interface{} or
+// map[interface{}]interface{}.
+func (d *cborDecoder) value() (interface{}, error) {
+	major, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case 0:
+		return int64(arg), nil
+	case 1:
+		return -1 - int64(arg), nil
+	case 2, 3:
+		if arg > uint64(d.r.Len()) {
+			return nil, errCBOR
+		}
+		b := make([]byte, arg)
+		if _, err := io.ReadFull(d.r, b); err != nil {
+			return nil, errCBOR
+		}
+		if major == 3 {
+			return string(b), nil
+		}
+		return b, nil
+	case 4:
+		if arg > uint64(d.r.Len()) {
+			return nil, errCBOR
+		}
+		a := make([]interface{}, arg)
+		for i := range a {
+			if a[i], err = d.value(); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	case 5:
+		if arg > uint64(d.r.Len()) {
+			return nil, errCBOR
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			k, err := d.value()
+			if err != nil {
+				return nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, fmt.Errorf("%w: unsupported map key type %T", errCBOR, k)
+			}
+			if m[k], err = d.value(); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported major type %d", errCBOR, major)
+	}
+}
+
+// parseCOSEKey decodes a COSE public key from the start of b and returns it
+// with the remaining bytes.
+func parseCOSEKey(b []byte) (interface{}, []byte, error) {
+	d := &cborDecoder{r: bytes.NewReader(b)}
+	v, err := d.value()
+	if err != nil {
+		return nil, nil, err
+	}
+	rest := b[len(b)-d.r.Len():]
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: COSE key is not a map", errCBOR)
+	}
+	param := func(k int64) []byte {
+		b, _ := m[k].([]byte)
+		return b
+	}
+	kty, _ := m[int64(coseKty)].(int64)
+	crv, _ := m[int64(coseCrv)].(int64)
+	switch {
+	case kty == coseKtyEC2 && crv == coseCrvP256:
+		x, y := param(coseX), param(coseY)
+		if len(x) != 32 || len(y) != 32 {
+			return nil, nil, errors.New("invalid P-256 COSE key")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, rest, nil
+	case kty == coseKtyOKP && crv == coseCrvEd25519:
+		x := param(coseX)
+		if len(x) != ed25519.PublicKeySize {
+			return nil, nil, errors.New("invalid Ed25519 COSE key")
+		}
+		return ed25519.PublicKey(x), rest, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported COSE key type %d curve %d", kty, crv)
+	}
+}
+
+// unwrapCBORBytes returns the contents of b if it is a single CBOR byte
+// string, as written by OpenSSH, otherwise b.
+func unwrapCBORBytes(b []byte) []byte {
+	d := &cborDecoder{r: bytes.NewReader(b)}
+	if v, err := d.value(); err == nil && d.r.Len() == 0 {
+		if inner, ok := v.([]byte); ok {
+			return inner
+		}
+	}
+	return b
+}
@@ -0,0 +1,140 @@
+package signer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"go4.org/wkfs"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/cashier-go/cashier/server/config"
+)
+
+// ErrKeyRejected is returned when a public key doesn't meet the key policy.
+var ErrKeyRejected = errors.New("public key rejected")
+
+// keyTypes maps ssh key algorithms to the names used in configuration.
+var keyTypes = map[string]string{
+	ssh.KeyAlgoRSA:        "rsa",
+	ssh.KeyAlgoDSA:        "dsa",
+	ssh.KeyAlgoECDSA256:   "ecdsa",
+	ssh.KeyAlgoECDSA384:   "ecdsa",
+	ssh.KeyAlgoECDSA521:   "ecdsa",
+	ssh.KeyAlgoED25519:    "ed25519",
+	ssh.KeyAlgoSKECDSA256: "sk-ecdsa",
+	ssh.KeyAlgoSKED25519:  "sk-ed25519",
+}
+
+// defaultKeyTypes are allowed if the policy doesn't list any.
+var defaultKeyTypes = []string{"rsa", "ecdsa", "ed25519", "sk-ecdsa", "sk-ed25519"}
+
+// keyPolicy decides which public keys may be signed.
+type keyPolicy struct {
+	types        []string
+	minRSABits   int
+	minECDSABits int
+	blocked      map[string]bool
+}
+
+// allowedTypes returns the key types which may be signed.
+func (p *keyPolicy) allowedTypes() []string {
+	if len(p.types) == 0 {
+		return defaultKeyTypes
+	}
+	return p.types
+}
+
+// check returns an error if the key may not be signed.
+func (p *keyPolicy) check(pub ssh.PublicKey) error {
+	if _, ok := pub.(*ssh.Certificate); ok {
+		return fmt.Errorf("%w: certificates can't be signed, send the public key instead", ErrKeyRejected)
+	}
+	keyType, ok := keyTypes[pub.Type()]
+	if !ok || !slices.Contains(p.allowedTypes(), keyType) {
+		return fmt.Errorf("%w: %s keys are not allowed, use one of: %s", ErrKeyRejected, pub.Type(), strings.Join(p.allowedTypes(), ", "))
+	}
+	if cpk, ok := pub.(ssh.CryptoPublicKey); ok {
+		switch k := cpk.CryptoPublicKey().(type) {
+		case *rsa.PublicKey:
+			if bits := k.N.BitLen(); bits < p.minRSABits {
+				return fmt.Errorf("%w: rsa keys must be at least %d bits, got %d", ErrKeyRejected, p.minRSABits, bits)
+			}
+		case *ecdsa.PublicKey:
+			if bits := k.Curve.Params().BitSize; bits < p.minECDSABits {
+				return fmt.Errorf("%w: ecdsa keys must be at least %d bits, got %d", ErrKeyRejected, p.minECDSABits, bits)
+			}
+		}
+	}
+	if fp := ssh.FingerprintSHA256(pub); p.blocked[fp] {
+		return fmt.Errorf("%w: key %s is blocklisted", ErrKeyRejected, fp)
+	}
+	return nil
+}
+
+// parseBlocklist reads fingerprints from a blocklist file. Each line holds
+// either a SHA256 fingerprint or an authorized_keys style public key. Blank
+// lines and lines starting with # are ignored.
+func parseBlocklist(data []byte, blocked map[string]bool) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "SHA256:"):
+			blocked[line] = true
+		default:
+			pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err != nil {
+				return fmt.Errorf("line %d: %w", n, err)
+			}
+			blocked[ssh.FingerprintSHA256(pub)] = true
+		}
+	}
+	return scanner.Err()
+}
+
+// newKeyPolicy creates a keyPolicy from the supplied configuration.
+func newKeyPolicy(conf config.KeyPolicy) (keyPolicy, error) {
+	p := keyPolicy{
+		minRSABits:   conf.MinRSABits,
+		minECDSABits: conf.MinECDSABits,
+		blocked:      make(map[string]bool),
+	}
+	if p.minRSABits == 0 {
+		p.minRSABits = config.MinRSABits
+	}
+	for _, t := range conf.AllowedKeyTypes {
+		known := false
+		for _, v := range keyTypes {
+			known = known || v == t
+		}
+		if !known {
+			return p, fmt.Errorf("unknown key type %q in allowed_key_types", t)
+		}
+		if !slices.Contains(p.types, t) {
+			p.types = append(p.types, t)
+		}
+	}
+	for _, fp := range conf.Blocklist {
+		if !strings.HasPrefix(fp, "SHA256:") {
+			return p, fmt.Errorf("invalid blocklist fingerprint %q, expected a SHA256 fingerprint", fp)
+		}
+		p.blocked[fp] = true
+	}
+	if conf.BlocklistFile != "" {
+		data, err := wkfs.ReadFile(conf.BlocklistFile)
+		if err != nil {
+			return p, fmt.Errorf("unable to read blocklist %s: %w", conf.BlocklistFile, err)
+		}
+		if err := parseBlocklist(data, p.blocked); err != nil {
+			return p, fmt.Errorf("unable to parse blocklist %s: %w", conf.BlocklistFile, err)
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,115 @@
+package signer
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cashier-go/cashier/lib"
+	"github.com/cashier-go/cashier/server/config"
+	"github.com/cashier-go/cashier/testdata"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func publicKey(t *testing.T, k interface{}) ssh.PublicKey {
+	t.Helper()
+	pub, err := ssh.NewPublicKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+func TestKeyPolicy(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	edPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	blocked, _, _ := ed25519.GenerateKey(rand.Reader)
+	cert, _, _, _, _ := ssh.ParseAuthorizedKey(testdata.Cert)
+
+	dir := t.TempDir()
+	blocklist := filepath.Join(dir, "blocklist")
+	data := "# weak keys\n\n" + string(ssh.MarshalAuthorizedKey(publicKey(t, blocked)))
+	if err := os.WriteFile(blocklist, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := newKeyPolicy(config.KeyPolicy{
+		AllowedKeyTypes: []string{"rsa", "ecdsa", "ed25519"},
+		MinRSABits:      2048,
+		MinECDSABits:    384,
+		Blocklist:       []string{ssh.FingerprintSHA256(publicKey(t, &p384.PublicKey))},
+		BlocklistFile:   blocklist,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		key     ssh.PublicKey
+		allowed bool
+	}{
+		{"ed25519", publicKey(t, edPub), true},
+		{"small rsa", publicKey(t, &rsaKey.PublicKey), false},
+		{"small ecdsa", publicKey(t, &p256.PublicKey), false},
+		{"blocklisted fingerprint", publicKey(t, &p384.PublicKey), false},
+		{"blocklisted key", publicKey(t, blocked), false},
+		{"certificate", cert, false},
+	}
+	for _, test := range tests {
+		err := p.check(test.key)
+		if test.allowed && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.allowed && !errors.Is(err, ErrKeyRejected) {
+			t.Errorf("%s: expected ErrKeyRejected, got %v", test.name, err)
+		}
+	}
+
+	// RSA keys smaller than 2048 bits are rejected by default.
+	p, _ = newKeyPolicy(config.KeyPolicy{})
+	if err := p.check(publicKey(t, &rsaKey.PublicKey)); !errors.Is(err, ErrKeyRejected) {
+		t.Errorf("expected ErrKeyRejected for a small rsa key by default, got %v", err)
+	}
+
+	p, _ = newKeyPolicy(config.KeyPolicy{AllowedKeyTypes: []string{"ecdsa"}})
+	if err := p.check(publicKey(t, edPub)); !errors.Is(err, ErrKeyRejected) {
+		t.Errorf("expected ErrKeyRejected for a disallowed key type, got %v", err)
+	}
+	for _, conf := range []config.KeyPolicy{
+		{AllowedKeyTypes: []string{"rsa1"}},
+		{Blocklist: []string{"MD5:00:11"}},
+		{BlocklistFile: filepath.Join(dir, "missing")},
+	} {
+		if _, err := newKeyPolicy(conf); err == nil {
+			t.Errorf("expected an error for %+v", conf)
+		}
+	}
+}
+
+func TestSignRejectedKey(t *testing.T) {
+	s := &KeySigner{
+		ca:       key,
+		validity: 12 * time.Hour,
+		policy:   keyPolicy{minRSABits: 4096},
+	}
+	r := &lib.SignRequest{
+		Key:        string(testdata.Pub),
+		ValidUntil: time.Now().Add(1 * time.Hour),
+	}
+	if _, err := s.SignUserKey(r, "gopher1"); !errors.Is(err, ErrKeyRejected) {
+		t.Errorf("expected ErrKeyRejected, got %v", err)
+	}
+	if want := []string{"rsa", "ecdsa", "ed25519", "sk-ecdsa", "sk-ed25519"}; !reflect.DeepEqual(s.KeyTypes(), want) {
+		t.Errorf("Wrong key types: wanted: %v got: %v", want, s.KeyTypes())
+	}
+}
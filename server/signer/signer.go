@@ -1,9 +1,15 @@
 package signer
 
 import (
+	"bytes"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
+	"net"
+	"slices"
 	"strings"
 	"time"
 
@@ -26,12 +32,28 @@ var defaultPermissions = map[string]string{
 	"permit-user-rc":          "",
 }
 
+// ErrInvalidKey is returned when the public key can't be parsed.
+var ErrInvalidKey = errors.New("invalid public key")
+
+// ErrInvalidRequest is returned when the signing request is malformed.
+var ErrInvalidRequest = errors.New("invalid request")
+
+// ErrNotPermitted is returned when a signing request asks for more than the
+// user is allowed.
+var ErrNotPermitted = errors.New("request not permitted")
+
 // KeySigner does the work of signing a ssh public key with the CA key.
 type KeySigner struct {
 	ca          ssh.Signer
 	validity    time.Duration
 	principals  []string
 	permissions []string
+	policy      keyPolicy
+
+	// Options for certificates issued to security keys.
+	noTouchRequired bool
+	verifyRequired  bool
+	attestation     *attestationVerifier
 }
 
 func (s *KeySigner) setPermissions(cert *ssh.Certificate) {
@@ -46,37 +68,265 @@ func (s *KeySigner) setPermissions(cert *ssh.Certificate) {
 		}
 	}
 	if len(cert.Extensions) == 0 {
-		cert.Extensions = defaultPermissions
+		for k, v := range defaultPermissions {
+			cert.Extensions[k] = v
+		}
 	}
 }
 
+// setSecurityKeyOptions sets the FIDO options on certificates for security
+// keys. Other keys are left alone.
+func (s *KeySigner) setSecurityKeyOptions(cert *ssh.Certificate) {
+	if !isSecurityKey(cert.Key) {
+		return
+	}
+	if s.noTouchRequired {
+		cert.Extensions["no-touch-required"] = ""
+	}
+	if s.verifyRequired {
+		cert.CriticalOptions["verify-required"] = ""
+	}
+}
+
+// narrowPrincipals returns the requested principals which are allowed. It is
+// an error if none are.
+func narrowPrincipals(allowed, requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return allowed, nil
+	}
+	var principals []string
+	for _, p := range requested {
+		if slices.Contains(allowed, p) && !slices.Contains(principals, p) {
+			principals = append(principals, p)
+		}
+	}
+	if len(principals) == 0 {
+		return nil, fmt.Errorf("%w: none of the principals %q are allowed", ErrNotPermitted, requested)
+	}
+	return principals, nil
+}
+
+// narrowExtensions removes the extensions that weren't requested.
+func narrowExtensions(cert *ssh.Certificate, requested []string) {
+	for ext := range cert.Extensions {
+		if !slices.Contains(requested, ext) {
+			delete(cert.Extensions, ext)
+		}
+	}
+}
+
+// parseAddresses parses a source-address list of addresses and CIDR blocks.
+func parseAddresses(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, addr := range strings.Split(s, ",") {
+		addr = strings.TrimSpace(addr)
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid source address %q", addr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source address %q", addr)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// narrowSourceAddress restricts the certificate to the requested source
+// addresses, which must fall within any source-address already set.
+func narrowSourceAddress(cert *ssh.Certificate, requested string) error {
+	if requested == "" {
+		return nil
+	}
+	nets, err := parseAddresses(requested)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidRequest, err)
+	}
+	if allowed, ok := cert.CriticalOptions["source-address"]; ok {
+		allowedNets, err := parseAddresses(allowed)
+		if err != nil {
+			return err
+		}
+		for _, n := range nets {
+			ones, bits := n.Mask.Size()
+			if !slices.ContainsFunc(allowedNets, func(a *net.IPNet) bool {
+				aOnes, aBits := a.Mask.Size()
+				return a.Contains(n.IP) && bits == aBits && ones >= aOnes
+			}) {
+				return fmt.Errorf("%w: source address %s", ErrNotPermitted, n)
+			}
+		}
+	}
+	addrs := make([]string, len(nets))
+	for i, n := range nets {
+		addrs[i] = n.String()
+	}
+	cert.CriticalOptions["source-address"] = strings.Join(addrs, ",")
+	return nil
+}
+
+// issueOptions change how a request is issued.
+type issueOptions struct {
+	// keepParent issues the principals and extensions of the request,
+	// taken from the certificate being renewed, rather than treating empty
+	// lists as a request for everything allowed.
+	keepParent bool
+}
+
+// Grant is what a caller may be issued.
+type Grant struct {
+	Username string
+	// Principals are the principals the caller is allowed. If empty, the
+	// username and the configured additional principals are allowed.
+	Principals []string
+	// AdditionalPrincipals are allowed as well as the username and the
+	// configured additional principals, if Principals is empty.
+	AdditionalPrincipals []string
+	// MaxValidity, if set, further limits the validity of certificates.
+	MaxValidity time.Duration
+}
+
 // SignUserKey returns a signed ssh certificate.
 func (s *KeySigner) SignUserKey(req *lib.SignRequest, username string) (*ssh.Certificate, error) {
+	return s.SignUserKeyFor(req, Grant{Username: username})
+}
+
+// SignUserKeyFor returns a signed ssh certificate for the caller of the grant.
+func (s *KeySigner) SignUserKeyFor(req *lib.SignRequest, grant Grant) (*ssh.Certificate, error) {
 	pubkey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.Key))
 	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+	}
+	if err := s.policy.check(pubkey); err != nil {
 		return nil, err
 	}
-	expires := time.Now().UTC().Add(s.validity)
-	if req.ValidUntil.After(expires) {
+	if err := s.attestation.verify(pubkey, req.Attestation, req.AttestationChallenge); err != nil {
+		return nil, err
+	}
+	return s.issue(pubkey, req, grant, issueOptions{})
+}
+
+// CheckCert checks that the certificate is a user certificate issued by the
+// CA which hasn't expired.
+func (s *KeySigner) CheckCert(cert *ssh.Certificate) error {
+	if cert.CertType != ssh.UserCert {
+		return fmt.Errorf("%w: not a user certificate", ErrInvalidRequest)
+	}
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), s.ca.PublicKey().Marshal())
+		},
+		SupportedCriticalOptions: slices.Collect(maps.Keys(cert.CriticalOptions)),
+	}
+	if !checker.IsUserAuthority(cert.SignatureKey) {
+		return fmt.Errorf("%w: certificate was not issued by this CA", ErrInvalidRequest)
+	}
+	var principal string
+	if len(cert.ValidPrincipals) > 0 {
+		principal = cert.ValidPrincipals[0]
+	}
+	if err := checker.CheckCert(principal, cert); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidRequest, err)
+	}
+	return nil
+}
+
+// RenewUserCert returns a new certificate for the key of a certificate issued
+// by the CA, with the same principals, extensions and source address. The key
+// must still be allowed by the key policy, but attestations were checked when
+// the first certificate was issued and aren't required again.
+func (s *KeySigner) RenewUserCert(cert *ssh.Certificate, username string, validUntil time.Time) (*ssh.Certificate, error) {
+	return s.RenewUserCertFor(cert, Grant{Username: username}, validUntil)
+}
+
+// RenewUserCertFor renews a certificate for the caller of the grant.
+func (s *KeySigner) RenewUserCertFor(cert *ssh.Certificate, grant Grant, validUntil time.Time) (*ssh.Certificate, error) {
+	if err := s.policy.check(cert.Key); err != nil {
+		return nil, err
+	}
+	req := &lib.SignRequest{
+		ValidUntil:    validUntil,
+		Principals:    cert.ValidPrincipals,
+		Extensions:    slices.Collect(maps.Keys(cert.Extensions)),
+		SourceAddress: cert.CriticalOptions["source-address"],
+	}
+	return s.issue(cert.Key, req, grant, issueOptions{keepParent: true})
+}
+
+// issue signs a certificate for the key.
+func (s *KeySigner) issue(pubkey ssh.PublicKey, req *lib.SignRequest, grant Grant, opts issueOptions) (*ssh.Certificate, error) {
+	validity := s.validity
+	if grant.MaxValidity > 0 && grant.MaxValidity < validity {
+		validity = grant.MaxValidity
+	}
+	expires := time.Now().UTC().Add(validity)
+	if req.ValidUntil.IsZero() || req.ValidUntil.After(expires) {
 		req.ValidUntil = expires
 	}
+	allowed := grant.Principals
+	if len(allowed) == 0 {
+		allowed = append([]string{grant.Username}, s.principals...)
+		allowed = append(allowed, grant.AdditionalPrincipals...)
+	}
+	if opts.keepParent && len(req.Principals) == 0 {
+		return nil, fmt.Errorf("%w: certificate has no principals", ErrInvalidRequest)
+	}
+	principals, err := narrowPrincipals(allowed, req.Principals)
+	if err != nil {
+		return nil, err
+	}
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
 	cert := &ssh.Certificate{
+		Serial:          binary.BigEndian.Uint64(serial[:]),
 		CertType:        ssh.UserCert,
 		Key:             pubkey,
-		KeyId:           fmt.Sprintf("%s_%d", username, time.Now().UTC().Unix()),
+		KeyId:           fmt.Sprintf("%s_%d", grant.Username, time.Now().UTC().Unix()),
 		ValidAfter:      uint64(time.Now().UTC().Add(-5 * time.Minute).Unix()),
 		ValidBefore:     uint64(req.ValidUntil.Unix()),
-		ValidPrincipals: []string{username},
+		ValidPrincipals: principals,
 	}
-	cert.ValidPrincipals = append(cert.ValidPrincipals, s.principals...)
 	s.setPermissions(cert)
+	s.setSecurityKeyOptions(cert)
+	if len(req.Extensions) > 0 || opts.keepParent {
+		narrowExtensions(cert, req.Extensions)
+	}
+	if err := narrowSourceAddress(cert, req.SourceAddress); err != nil {
+		return nil, err
+	}
 	if err := cert.SignCert(rand.Reader, s.ca); err != nil {
 		return nil, err
 	}
-	log.Printf("Issued cert id: %s principals: %s fp: %s valid until: %s\n", cert.KeyId, cert.ValidPrincipals, ssh.FingerprintSHA256(pubkey), time.Unix(int64(cert.ValidBefore), 0).UTC())
+	log.Printf("Issued cert id: %s serial: %d principals: %s fp: %s valid until: %s\n", cert.KeyId, cert.Serial, cert.ValidPrincipals, ssh.FingerprintSHA256(pubkey), time.Unix(int64(cert.ValidBefore), 0).UTC())
 	return cert, nil
 }
 
+// PublicKey returns the CA public key.
+func (s *KeySigner) PublicKey() ssh.PublicKey {
+	return s.ca.PublicKey()
+}
+
+// MaxValidity returns the longest validity a certificate is issued with.
+func (s *KeySigner) MaxValidity() time.Duration {
+	return s.validity
+}
+
+// KeyTypes returns the key types which may be signed.
+func (s *KeySigner) KeyTypes() []string {
+	return s.policy.allowedTypes()
+}
+
 // GenerateRevocationList returns an SSH key revocation list (KRL).
 func (s *KeySigner) GenerateRevocationList(certs []*store.CertRecord) ([]byte, error) {
 	revoked := &krl.KRLCertificateSection{
@@ -107,10 +357,23 @@ func New(conf *config.SSH) (*KeySigner, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error parsing duration '%s': %w", conf.MaxAge, err)
 	}
+	policy, err := newKeyPolicy(conf.KeyPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key policy: %w", err)
+	}
+	attestation, err := newAttestationVerifier(conf.SecurityKeys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid security key config: %w", err)
+	}
 	return &KeySigner{
 		ca:          key,
 		validity:    validity,
 		principals:  conf.AdditionalPrincipals,
 		permissions: conf.Permissions,
+		policy:      policy,
+
+		noTouchRequired: conf.SecurityKeys.NoTouchRequired,
+		verifyRequired:  conf.SecurityKeys.VerifyRequired,
+		attestation:     attestation,
 	}, nil
 }
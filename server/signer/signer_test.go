@@ -2,6 +2,9 @@ package signer
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
 	"reflect"
 	"testing"
 	"time"
@@ -106,3 +109,205 @@ func TestPermissions(t *testing.T) {
 		t.Errorf("Wrong options: wanted: %v got :%v", cert.CriticalOptions, want.options)
 	}
 }
+
+func TestNarrowRequest(t *testing.T) {
+	s := &KeySigner{
+		ca:          key,
+		validity:    12 * time.Hour,
+		principals:  []string{"ec2-user", "deploy"},
+		permissions: []string{"source-address=10.0.0.0/8,192.168.1.1"},
+	}
+	r := &lib.SignRequest{
+		Key:           string(testdata.Pub),
+		ValidUntil:    time.Now().Add(1 * time.Hour),
+		Principals:    []string{"deploy", "root", "deploy"},
+		Extensions:    []string{"permit-pty", "permit-user-rc", "permit-everything"},
+		SourceAddress: "10.1.0.0/16, 192.168.1.1",
+	}
+	cert, err := s.SignUserKey(r, "gopher1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"deploy"}; !reflect.DeepEqual(cert.ValidPrincipals, want) {
+		t.Errorf("Wrong principals: wanted: %v got: %v", want, cert.ValidPrincipals)
+	}
+	if want := map[string]string{"permit-pty": "", "permit-user-rc": ""}; !reflect.DeepEqual(cert.Extensions, want) {
+		t.Errorf("Wrong extensions: wanted: %v got: %v", want, cert.Extensions)
+	}
+	if want := "10.1.0.0/16,192.168.1.1/32"; cert.CriticalOptions["source-address"] != want {
+		t.Errorf("Wrong source-address: wanted: %s got: %s", want, cert.CriticalOptions["source-address"])
+	}
+	if len(defaultPermissions) != 5 {
+		t.Error("default permissions were modified")
+	}
+
+	for _, r := range []*lib.SignRequest{
+		{Key: string(testdata.Pub), Principals: []string{"root"}},
+		{Key: string(testdata.Pub), SourceAddress: "0.0.0.0/0"},
+		{Key: string(testdata.Pub), SourceAddress: "192.168.1.0/24"},
+	} {
+		if _, err := s.SignUserKey(r, "gopher1"); !errors.Is(err, ErrNotPermitted) {
+			t.Errorf("Expected ErrNotPermitted for %+v, got %v", r, err)
+		}
+	}
+	if _, err := s.SignUserKey(&lib.SignRequest{Key: string(testdata.Pub), SourceAddress: "nonsense"}, "gopher1"); err == nil {
+		t.Error("Expected an error for an invalid source address")
+	}
+}
+
+func TestSignUserKeyFor(t *testing.T) {
+	r := &lib.SignRequest{
+		Key:        string(testdata.Pub),
+		ValidUntil: time.Now().Add(4 * time.Hour),
+	}
+	grant := Grant{Username: "deploy", Principals: []string{"deploy", "www"}, MaxValidity: time.Hour}
+	cert, err := signer.SignUserKeyFor(r, grant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cert.ValidPrincipals, grant.Principals) {
+		t.Errorf("Wrong principals: wanted: %v got: %v", grant.Principals, cert.ValidPrincipals)
+	}
+	if validBefore := time.Unix(int64(cert.ValidBefore), 0); validBefore.After(time.Now().Add(time.Hour)) {
+		t.Errorf("Expected validity to be limited to %s, got %s", grant.MaxValidity, time.Until(validBefore))
+	}
+	// A request without valid_until gets the longest validity allowed.
+	cert, err = signer.SignUserKeyFor(&lib.SignRequest{Key: string(testdata.Pub)}, grant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if max := uint64(time.Now().Add(time.Hour).Unix()); cert.ValidBefore > max {
+		t.Errorf("Expected validity to be limited to %s without valid_until, got valid before %d", grant.MaxValidity, cert.ValidBefore)
+	}
+	r = &lib.SignRequest{Key: string(testdata.Pub), Principals: []string{"ec2-user"}}
+	if _, err := signer.SignUserKeyFor(r, grant); !errors.Is(err, ErrNotPermitted) {
+		t.Errorf("Expected ErrNotPermitted for a principal outside the grant, got %v", err)
+	}
+	r = &lib.SignRequest{Key: string(testdata.Pub), Principals: []string{"ops"}}
+	cert, err = signer.SignUserKeyFor(r, Grant{Username: "gopher1", AdditionalPrincipals: []string{"ops"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cert.ValidPrincipals, []string{"ops"}) {
+		t.Errorf("Wrong principals: wanted: [ops] got: %v", cert.ValidPrincipals)
+	}
+}
+
+func TestSecurityKeyOptions(t *testing.T) {
+	s := &KeySigner{
+		ca:              key,
+		validity:        12 * time.Hour,
+		noTouchRequired: true,
+		verifyRequired:  true,
+	}
+	cert, err := s.SignUserKey(&lib.SignRequest{Key: string(testdata.SKPub), ValidUntil: time.Now().Add(1 * time.Hour)}, "gopher1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cert.Extensions["no-touch-required"]; !ok {
+		t.Errorf("Expected no-touch-required, got extensions: %v", cert.Extensions)
+	}
+	if _, ok := cert.CriticalOptions["verify-required"]; !ok {
+		t.Errorf("Expected verify-required, got options: %v", cert.CriticalOptions)
+	}
+
+	cert, err = s.SignUserKey(&lib.SignRequest{Key: string(testdata.Pub), ValidUntil: time.Now().Add(1 * time.Hour)}, "gopher1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cert.Extensions["no-touch-required"]; ok {
+		t.Error("Unexpected no-touch-required for a non security key")
+	}
+	if _, ok := cert.CriticalOptions["verify-required"]; ok {
+		t.Error("Unexpected verify-required for a non security key")
+	}
+}
+
+func TestRenewUserCert(t *testing.T) {
+	s := &KeySigner{
+		ca:          key,
+		validity:    12 * time.Hour,
+		principals:  []string{"ec2-user", "deploy"},
+		permissions: []string{"permit-pty", "permit-user-rc", "force-command=/bin/ls"},
+	}
+	cert, err := s.SignUserKey(&lib.SignRequest{
+		Key:           string(testdata.Pub),
+		ValidUntil:    time.Now().Add(1 * time.Hour),
+		Principals:    []string{"gopher1", "deploy"},
+		Extensions:    []string{"permit-pty"},
+		SourceAddress: "10.0.0.0/8",
+	}, "gopher1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CheckCert(cert); err != nil {
+		t.Fatalf("unexpected error checking cert: %v", err)
+	}
+	renewed, err := s.RenewUserCert(cert, "gopher1", time.Now().Add(48*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(renewed.ValidPrincipals, cert.ValidPrincipals) {
+		t.Errorf("Wrong principals: wanted: %v got: %v", cert.ValidPrincipals, renewed.ValidPrincipals)
+	}
+	if !reflect.DeepEqual(renewed.Extensions, cert.Extensions) {
+		t.Errorf("Wrong extensions: wanted: %v got: %v", cert.Extensions, renewed.Extensions)
+	}
+	if !reflect.DeepEqual(renewed.CriticalOptions, cert.CriticalOptions) {
+		t.Errorf("Wrong options: wanted: %v got: %v", cert.CriticalOptions, renewed.CriticalOptions)
+	}
+	if !bytes.Equal(renewed.Key.Marshal(), cert.Key.Marshal()) {
+		t.Error("Renewed cert key doesn't match the cert key")
+	}
+	if max := uint64(time.Now().Add(s.validity).Unix()); renewed.ValidBefore > max {
+		t.Errorf("Renewed cert is valid for longer than %s", s.validity)
+	}
+
+	s.principals = []string{"ec2-user"}
+	renewed, err = s.RenewUserCert(cert, "gopher1", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"gopher1"}; !reflect.DeepEqual(renewed.ValidPrincipals, want) {
+		t.Errorf("Expected principals which are no longer allowed to be dropped, got %v", renewed.ValidPrincipals)
+	}
+
+	bare := *cert
+	bare.Extensions = map[string]string{}
+	renewed, err = s.RenewUserCert(&bare, "gopher1", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(renewed.Extensions) != 0 {
+		t.Errorf("Expected a cert without extensions to be renewed without extensions, got %v", renewed.Extensions)
+	}
+	bare.ValidPrincipals = nil
+	if _, err := s.RenewUserCert(&bare, "gopher1", time.Now().Add(time.Hour)); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("Expected ErrInvalidRequest for a cert without principals, got %v", err)
+	}
+
+	other := &KeySigner{ca: testCA(t), validity: time.Hour}
+	if err := other.CheckCert(cert); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("Expected ErrInvalidRequest for a cert issued by another CA, got %v", err)
+	}
+	cert.ValidBefore = uint64(time.Now().Add(-time.Minute).Unix())
+	if err := cert.SignCert(rand.Reader, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CheckCert(cert); !errors.Is(err, ErrInvalidRequest) {
+		t.Errorf("Expected ErrInvalidRequest for an expired cert, got %v", err)
+	}
+}
+
+func testCA(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
@@ -2,16 +2,27 @@ package store
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 )
 
 var _ CertStorer = (*memoryStore)(nil)
 
+// identityKey identifies a user of an auth provider.
+type identityKey struct {
+	provider, username string
+}
+
 // memoryStore is an in-memory CertStorer
 type memoryStore struct {
 	sync.Mutex
-	certs map[string]*CertRecord
+	certs      map[string]*CertRecord
+	tokens     map[string]*TokenRecord
+	sessions   map[string]*SessionRecord
+	identities map[identityKey]*IdentityRecord
+	accounts   map[string]*ServiceAccountRecord
+	apiKeys    map[string]*APIKeyRecord
 }
 
 // Get a single *CertRecord
@@ -59,6 +70,22 @@ func (ms *memoryStore) Revoke(ids []string) error {
 	return nil
 }
 
+// RecordRenewal marks the unrevoked cert with the fingerprint as renewed and
+// records the cert it was renewed as. It returns ErrCertRenewed if there's no
+// such cert, or it was already renewed.
+func (ms *memoryStore) RecordRenewal(fingerprint string, renewed *CertRecord) error {
+	ms.Lock()
+	defer ms.Unlock()
+	for _, r := range ms.certs {
+		if r.Fingerprint == fingerprint && !r.Renewed && !r.Revoked {
+			r.Renewed = true
+			ms.certs[renewed.KeyID] = renewed
+			return nil
+		}
+	}
+	return ErrCertRenewed
+}
+
 // GetRevoked returns all revoked certs
 func (ms *memoryStore) GetRevoked() ([]*CertRecord, error) {
 	var revoked []*CertRecord
@@ -76,12 +103,231 @@ func (ms *memoryStore) Close() error {
 	ms.Lock()
 	defer ms.Unlock()
 	ms.certs = nil
+	ms.tokens = nil
+	ms.sessions = nil
+	ms.identities = nil
+	ms.accounts = nil
+	ms.apiKeys = nil
+	return nil
+}
+
+// SetToken records a *TokenRecord. Expired tokens are removed.
+func (ms *memoryStore) SetToken(token *TokenRecord) error {
+	ms.Lock()
+	defer ms.Unlock()
+	for k, t := range ms.tokens {
+		if t.Expires.Before(time.Now().UTC()) {
+			delete(ms.tokens, k)
+		}
+	}
+	ms.tokens[token.Hash] = token
+	return nil
+}
+
+// GetToken returns a single *TokenRecord
+func (ms *memoryStore) GetToken(hash string) (*TokenRecord, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	t, ok := ms.tokens[hash]
+	if !ok {
+		return nil, fmt.Errorf("unknown token %s", hash)
+	}
+	r := *t
+	return &r, nil
+}
+
+// UseToken marks a token as used. It fails if the token has already been
+// used or has expired.
+func (ms *memoryStore) UseToken(hash string) error {
+	ms.Lock()
+	defer ms.Unlock()
+	t, ok := ms.tokens[hash]
+	if !ok || t.Used || t.Expires.Before(time.Now().UTC()) {
+		return ErrTokenUsed
+	}
+	t.Used = true
+	return nil
+}
+
+// SetSession records a *SessionRecord, replacing any previous version of
+// the session. Expired sessions are removed.
+func (ms *memoryStore) SetSession(session *SessionRecord) error {
+	ms.Lock()
+	defer ms.Unlock()
+	for k, s := range ms.sessions {
+		if s.Expires.Before(time.Now().UTC()) {
+			delete(ms.sessions, k)
+		}
+	}
+	r := *session
+	ms.sessions[session.ID] = &r
+	return nil
+}
+
+// GetSession returns a single unexpired *SessionRecord
+func (ms *memoryStore) GetSession(id string) (*SessionRecord, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	s, ok := ms.sessions[id]
+	if !ok || s.Expires.Before(time.Now().UTC()) {
+		return nil, fmt.Errorf("unknown session %s", id)
+	}
+	r := *s
+	return &r, nil
+}
+
+// DeleteSession removes a session.
+func (ms *memoryStore) DeleteSession(id string) error {
+	ms.Lock()
+	defer ms.Unlock()
+	delete(ms.sessions, id)
+	return nil
+}
+
+// UserSessions returns the unexpired sessions of a provider's user.
+func (ms *memoryStore) UserSessions(provider, username string) ([]*SessionRecord, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	var sessions []*SessionRecord
+	for _, s := range ms.sessions {
+		if s.Provider == provider && s.Username == username && !s.Expires.Before(time.Now().UTC()) {
+			r := *s
+			sessions = append(sessions, &r)
+		}
+	}
+	return sessions, nil
+}
+
+// SetIdentity records a *IdentityRecord, replacing any previous identity of
+// the user.
+func (ms *memoryStore) SetIdentity(identity *IdentityRecord) error {
+	ms.Lock()
+	defer ms.Unlock()
+	r := *identity
+	ms.identities[identityKey{identity.Provider, identity.Username}] = &r
+	return nil
+}
+
+// GetIdentity returns the *IdentityRecord of a provider's user.
+func (ms *memoryStore) GetIdentity(provider, username string) (*IdentityRecord, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	i, ok := ms.identities[identityKey{provider, username}]
+	if !ok {
+		return nil, fmt.Errorf("unknown identity %s of %s", username, provider)
+	}
+	r := *i
+	return &r, nil
+}
+
+// DeleteIdentity removes the identity of a provider's user.
+func (ms *memoryStore) DeleteIdentity(provider, username string) error {
+	ms.Lock()
+	defer ms.Unlock()
+	delete(ms.identities, identityKey{provider, username})
+	return nil
+}
+
+// SetServiceAccount records a *ServiceAccountRecord, replacing any previous
+// version of the account.
+func (ms *memoryStore) SetServiceAccount(account *ServiceAccountRecord) error {
+	ms.Lock()
+	defer ms.Unlock()
+	r := *account
+	ms.accounts[account.Name] = &r
+	return nil
+}
+
+// GetServiceAccount returns a single *ServiceAccountRecord
+func (ms *memoryStore) GetServiceAccount(name string) (*ServiceAccountRecord, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	a, ok := ms.accounts[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown service account %s", name)
+	}
+	r := *a
+	return &r, nil
+}
+
+// ListServiceAccounts returns all service accounts, by name.
+func (ms *memoryStore) ListServiceAccounts() ([]*ServiceAccountRecord, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	accounts := make([]*ServiceAccountRecord, 0, len(ms.accounts))
+	for _, a := range ms.accounts {
+		r := *a
+		accounts = append(accounts, &r)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Name < accounts[j].Name })
+	return accounts, nil
+}
+
+// DeleteServiceAccount removes a service account and its API keys.
+func (ms *memoryStore) DeleteServiceAccount(name string) error {
+	ms.Lock()
+	defer ms.Unlock()
+	delete(ms.accounts, name)
+	for k, key := range ms.apiKeys {
+		if key.Account == name {
+			delete(ms.apiKeys, k)
+		}
+	}
+	return nil
+}
+
+// SetAPIKey records a *APIKeyRecord
+func (ms *memoryStore) SetAPIKey(key *APIKeyRecord) error {
+	ms.Lock()
+	defer ms.Unlock()
+	r := *key
+	ms.apiKeys[key.Hash] = &r
+	return nil
+}
+
+// GetAPIKey returns a single *APIKeyRecord
+func (ms *memoryStore) GetAPIKey(hash string) (*APIKeyRecord, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	k, ok := ms.apiKeys[hash]
+	if !ok {
+		return nil, fmt.Errorf("unknown api key %s", hash)
+	}
+	r := *k
+	return &r, nil
+}
+
+// ListAPIKeys returns the API keys of a service account.
+func (ms *memoryStore) ListAPIKeys(account string) ([]*APIKeyRecord, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	var keys []*APIKeyRecord
+	for _, k := range ms.apiKeys {
+		if k.Account == account {
+			r := *k
+			keys = append(keys, &r)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+// DeleteAPIKey removes an API key.
+func (ms *memoryStore) DeleteAPIKey(hash string) error {
+	ms.Lock()
+	defer ms.Unlock()
+	delete(ms.apiKeys, hash)
 	return nil
 }
 
 // newMemoryStore returns an in-memory CertStorer.
 func newMemoryStore() *memoryStore {
 	return &memoryStore{
-		certs: make(map[string]*CertRecord),
+		certs:      make(map[string]*CertRecord),
+		tokens:     make(map[string]*TokenRecord),
+		sessions:   make(map[string]*SessionRecord),
+		identities: make(map[identityKey]*IdentityRecord),
+		accounts:   make(map[string]*ServiceAccountRecord),
+		apiKeys:    make(map[string]*APIKeyRecord),
 	}
 }
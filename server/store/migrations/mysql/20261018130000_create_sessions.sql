@@ -0,0 +1,13 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS `sessions` (
+  `id` varchar(64) NOT NULL,
+  `username` varchar(255) NOT NULL DEFAULT '',
+  `data` text NOT NULL,
+  `expires_at` datetime DEFAULT '1970-01-01 00:00:01',
+  PRIMARY KEY (`id`)
+);
+CREATE INDEX `idx_sessions_username` ON `sessions` (`username`);
+CREATE INDEX `idx_sessions_expires_at` ON `sessions` (`expires_at`);
+
+-- +migrate Down
+DROP TABLE `sessions`;
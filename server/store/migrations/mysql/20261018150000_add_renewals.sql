@@ -0,0 +1,14 @@
+-- +migrate Up
+ALTER TABLE `issued_certs` ADD COLUMN `username` varchar(255) NOT NULL DEFAULT '';
+ALTER TABLE `issued_certs` ADD COLUMN `renewals` int NOT NULL DEFAULT 0;
+CREATE TABLE IF NOT EXISTS `identities` (
+  `username` varchar(255) NOT NULL,
+  `token` text NOT NULL,
+  `verified_at` datetime DEFAULT '1970-01-01 00:00:01',
+  PRIMARY KEY (`username`)
+);
+
+-- +migrate Down
+DROP TABLE `identities`;
+ALTER TABLE `issued_certs` DROP COLUMN `renewals`;
+ALTER TABLE `issued_certs` DROP COLUMN `username`;
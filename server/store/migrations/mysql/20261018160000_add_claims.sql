@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE `issued_certs` ADD COLUMN `claims` TEXT NOT NULL;
+
+-- +migrate Down
+ALTER TABLE `issued_certs` DROP COLUMN `claims`;
@@ -0,0 +1,23 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS `service_accounts` (
+  `name` varchar(255) NOT NULL,
+  `principals` varchar(255) DEFAULT '[]',
+  `max_validity` bigint NOT NULL DEFAULT 0,
+  `created_by` varchar(255) NOT NULL DEFAULT '',
+  `created_at` datetime DEFAULT '1970-01-01 00:00:01',
+  `expires_at` datetime DEFAULT '1970-01-01 00:00:01',
+  PRIMARY KEY (`name`)
+);
+CREATE TABLE IF NOT EXISTS `api_keys` (
+  `key_hash` varchar(64) NOT NULL,
+  `account` varchar(255) NOT NULL,
+  `created_at` datetime DEFAULT '1970-01-01 00:00:01',
+  PRIMARY KEY (`key_hash`)
+);
+CREATE INDEX `idx_api_keys_account` ON `api_keys` (`account`);
+ALTER TABLE `issued_certs` ADD COLUMN `service_account` varchar(255) NOT NULL DEFAULT '';
+
+-- +migrate Down
+ALTER TABLE `issued_certs` DROP COLUMN `service_account`;
+DROP TABLE `api_keys`;
+DROP TABLE `service_accounts`;
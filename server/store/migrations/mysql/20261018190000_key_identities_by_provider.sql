@@ -0,0 +1,14 @@
+-- +migrate Up
+ALTER TABLE `identities`
+  DROP PRIMARY KEY,
+  ADD PRIMARY KEY (`provider`, `username`);
+ALTER TABLE `sessions` ADD COLUMN `provider` varchar(255) NOT NULL DEFAULT '';
+CREATE INDEX `idx_sessions_provider_username` ON `sessions` (`provider`, `username`);
+
+-- +migrate Down
+DROP INDEX `idx_sessions_provider_username` ON `sessions`;
+ALTER TABLE `sessions` DROP COLUMN `provider`;
+DELETE FROM `identities`;
+ALTER TABLE `identities`
+  DROP PRIMARY KEY,
+  ADD PRIMARY KEY (`username`);
@@ -0,0 +1,14 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS `sign_tokens` (
+  `token_hash` varchar(64) NOT NULL,
+  `username` varchar(255) NOT NULL,
+  `audience` varchar(255) NOT NULL,
+  `created_at` datetime DEFAULT '1970-01-01 00:00:01',
+  `expires_at` datetime DEFAULT '1970-01-01 00:00:01',
+  `used` tinyint(1) DEFAULT 0,
+  PRIMARY KEY (`token_hash`)
+);
+CREATE INDEX `idx_sign_tokens_expires_at` ON `sign_tokens` (`expires_at`);
+
+-- +migrate Down
+DROP TABLE `sign_tokens`;
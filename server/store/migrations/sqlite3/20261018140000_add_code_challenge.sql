@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE `sign_tokens` ADD COLUMN `code_challenge` varchar(64) NOT NULL DEFAULT '';
+
+-- +migrate Down
+ALTER TABLE `sign_tokens` DROP COLUMN `code_challenge`;
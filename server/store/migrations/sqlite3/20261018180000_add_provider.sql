@@ -0,0 +1,9 @@
+-- +migrate Up
+ALTER TABLE `issued_certs` ADD COLUMN `provider` varchar(255) NOT NULL DEFAULT '';
+ALTER TABLE `sign_tokens` ADD COLUMN `provider` varchar(255) NOT NULL DEFAULT '';
+ALTER TABLE `identities` ADD COLUMN `provider` varchar(255) NOT NULL DEFAULT '';
+
+-- +migrate Down
+ALTER TABLE `identities` DROP COLUMN `provider`;
+ALTER TABLE `sign_tokens` DROP COLUMN `provider`;
+ALTER TABLE `issued_certs` DROP COLUMN `provider`;
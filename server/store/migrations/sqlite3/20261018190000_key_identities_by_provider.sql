@@ -0,0 +1,29 @@
+-- +migrate Up
+CREATE TABLE `identities_new` (
+  `provider` varchar(255) NOT NULL DEFAULT '',
+  `username` varchar(255) NOT NULL,
+  `token` text NOT NULL,
+  `verified_at` datetime DEFAULT '1970-01-01 00:00:01',
+  PRIMARY KEY (`provider`, `username`)
+);
+INSERT INTO `identities_new` (provider, username, token, verified_at)
+  SELECT provider, username, token, verified_at FROM `identities`;
+DROP TABLE `identities`;
+ALTER TABLE `identities_new` RENAME TO `identities`;
+ALTER TABLE `sessions` ADD COLUMN `provider` varchar(255) NOT NULL DEFAULT '';
+CREATE INDEX `idx_sessions_provider_username` ON `sessions` (`provider`, `username`);
+
+-- +migrate Down
+DROP INDEX `idx_sessions_provider_username`;
+ALTER TABLE `sessions` DROP COLUMN `provider`;
+CREATE TABLE `identities_old` (
+  `username` varchar(255) NOT NULL,
+  `token` text NOT NULL,
+  `verified_at` datetime DEFAULT '1970-01-01 00:00:01',
+  `provider` varchar(255) NOT NULL DEFAULT '',
+  PRIMARY KEY (`username`)
+);
+INSERT OR REPLACE INTO `identities_old` (username, token, verified_at, provider)
+  SELECT username, token, verified_at, provider FROM `identities`;
+DROP TABLE `identities`;
+ALTER TABLE `identities_old` RENAME TO `identities`;
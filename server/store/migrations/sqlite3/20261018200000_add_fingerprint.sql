@@ -0,0 +1,9 @@
+-- +migrate Up
+ALTER TABLE `issued_certs` ADD COLUMN `fingerprint` varchar(255) NOT NULL DEFAULT '';
+ALTER TABLE `issued_certs` ADD COLUMN `renewed` tinyint(1) NOT NULL DEFAULT 0;
+CREATE INDEX `idx_fingerprint` ON `issued_certs` (`fingerprint`);
+
+-- +migrate Down
+DROP INDEX `idx_fingerprint`;
+ALTER TABLE `issued_certs` DROP COLUMN `renewed`;
+ALTER TABLE `issued_certs` DROP COLUMN `fingerprint`;
@@ -33,6 +33,32 @@ type sqlStore struct {
 	listAll     *sqlx.Stmt
 	listCurrent *sqlx.Stmt
 	revoked     *sqlx.Stmt
+	markRenewed *sqlx.Stmt
+
+	setToken     *sqlx.Stmt
+	getToken     *sqlx.Stmt
+	useToken     *sqlx.Stmt
+	expireTokens *sqlx.Stmt
+
+	setSession     *sqlx.Stmt
+	getSession     *sqlx.Stmt
+	deleteSession  *sqlx.Stmt
+	userSessions   *sqlx.Stmt
+	expireSessions *sqlx.Stmt
+
+	setIdentity    *sqlx.Stmt
+	getIdentity    *sqlx.Stmt
+	deleteIdentity *sqlx.Stmt
+
+	setAccount    *sqlx.Stmt
+	getAccount    *sqlx.Stmt
+	listAccounts  *sqlx.Stmt
+	deleteAccount *sqlx.Stmt
+	setAPIKey     *sqlx.Stmt
+	getAPIKey     *sqlx.Stmt
+	listAPIKeys   *sqlx.Stmt
+	deleteAPIKey  *sqlx.Stmt
+	deleteAPIKeys *sqlx.Stmt
 }
 
 // newSQLStore returns a *sql.DB CertStorer.
@@ -75,7 +101,7 @@ func newSQLStore(c config.Database) (*sqlStore, error) {
 		conn: conn,
 	}
 
-	if db.set, err = conn.Preparex("INSERT INTO issued_certs (key_id, principals, created_at, expires_at, raw_key, message) VALUES (?, ?, ?, ?, ?, ?)"); err != nil {
+	if db.set, err = conn.Preparex("INSERT INTO issued_certs (key_id, principals, created_at, expires_at, raw_key, message, username, renewals, claims, service_account, provider, fingerprint, renewed) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"); err != nil {
 		return nil, fmt.Errorf("sqlStore: prepare set: %w", err)
 	}
 	if db.get, err = conn.Preparex("SELECT * FROM issued_certs WHERE key_id = ?"); err != nil {
@@ -90,6 +116,72 @@ func newSQLStore(c config.Database) (*sqlStore, error) {
 	if db.revoked, err = conn.Preparex("SELECT * FROM issued_certs WHERE revoked = 1 AND ? <= expires_at"); err != nil {
 		return nil, fmt.Errorf("sqlStore: prepare revoked: %w", err)
 	}
+	if db.markRenewed, err = conn.Preparex("UPDATE issued_certs SET renewed = 1 WHERE fingerprint = ? AND renewed = 0 AND revoked = 0"); err != nil {
+		return nil, fmt.Errorf("sqlStore: prepare markRenewed: %w", err)
+	}
+	if db.setToken, err = conn.Preparex("INSERT INTO sign_tokens (token_hash, username, audience, code_challenge, created_at, expires_at, provider) VALUES (?, ?, ?, ?, ?, ?, ?)"); err != nil {
+		return nil, fmt.Errorf("sqlStore: prepare setToken: %w", err)
+	}
+	if db.getToken, err = conn.Preparex("SELECT * FROM sign_tokens WHERE token_hash = ?"); err != nil {
+		return nil, fmt.Errorf("sqlStore: prepare getToken: %w", err)
+	}
+	if db.useToken, err = conn.Preparex("UPDATE sign_tokens SET used = 1 WHERE token_hash = ? AND used = 0 AND expires_at >= ?"); err != nil {
+		return nil, fmt.Errorf("sqlStore: prepare useToken: %w", err)
+	}
+	if db.expireTokens, err = conn.Preparex("DELETE FROM sign_tokens WHERE expires_at < ?"); err != nil {
+		return nil, fmt.Errorf("sqlStore: prepare expireTokens: %w", err)
+	}
+	if db.setSession, err = conn.Preparex("REPLACE INTO sessions (id, username, data, expires_at, provider) VALUES (?, ?, ?, ?, ?)"); err != nil {
+		return nil, fmt.Errorf("sqlStore: prepare setSession: %w", err)
+	}
+	if db.getSession, err = conn.Preparex("SELECT * FROM sessions WHERE id = ? AND expires_at >= ?"); err != nil {
+		return nil, fmt.Errorf("sqlStore: prepare getSession: %w", err)
+	}
+	if db.deleteSession, err = conn.Preparex("DELETE FROM sessions WHERE id = ?"); err != nil {
+		return nil, fmt.Errorf("sqlStore: prepare deleteSession: %w", err)
+	}
+	if db.userSessions, err = conn.Preparex("SELECT * FROM sessions WHERE provider = ? AND username = ? AND expires_at >= ?"); err != nil {
+		return nil, fmt.Errorf("sqlStore: prepare userSessions: %w", err)
+	}
+	if db.expireSessions, err = conn.Preparex("DELETE FROM sessions WHERE expires_at < ?"); err != nil {
+		return nil, fmt.Errorf("sqlStore: prepare expireSessions: %w", err)
+	}
+	if db.setIdentity, err = conn.Preparex("REPLACE INTO identities (username, token, verified_at, provider) VALUES (?, ?, ?, ?)"); err != nil {
+		return nil, fmt.Errorf("sqlStore: prepare setIdentity: %w", err)
+	}
+	if db.getIdentity, err = conn.Preparex("SELECT * FROM identities WHERE provider = ? AND username = ?"); err != nil {
+		return nil, fmt.Errorf("sqlStore: prepare getIdentity: %w", err)
+	}
+	if db.deleteIdentity, err = conn.Preparex("DELETE FROM identities WHERE provider = ? AND username = ?"); err != nil {
+		return nil, fmt.Errorf("sqlStore: prepare deleteIdentity: %w", err)
+	}
+	if db.setAccount, err = conn.Preparex("REPLACE INTO service_accounts (name, principals, max_validity, created_by, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)"); err != nil {
+		return nil, fmt.Errorf("sqlStore: prepare setAccount: %w", err)
+	}
+	if db.getAccount, err = conn.Preparex("SELECT * FROM service_accounts WHERE name = ?"); err != nil {
+		return nil, fmt.Errorf("sqlStore: prepare getAccount: %w", err)
+	}
+	if db.listAccounts, err = conn.Preparex("SELECT * FROM service_accounts ORDER BY name"); err != nil {
+		return nil, fmt.Errorf("sqlStore: prepare listAccounts: %w", err)
+	}
+	if db.deleteAccount, err = conn.Preparex("DELETE FROM service_accounts WHERE name = ?"); err != nil {
+		return nil, fmt.Errorf("sqlStore: prepare deleteAccount: %w", err)
+	}
+	if db.setAPIKey, err = conn.Preparex("INSERT INTO api_keys (key_hash, account, created_at) VALUES (?, ?, ?)"); err != nil {
+		return nil, fmt.Errorf("sqlStore: prepare setAPIKey: %w", err)
+	}
+	if db.getAPIKey, err = conn.Preparex("SELECT * FROM api_keys WHERE key_hash = ?"); err != nil {
+		return nil, fmt.Errorf("sqlStore: prepare getAPIKey: %w", err)
+	}
+	if db.listAPIKeys, err = conn.Preparex("SELECT * FROM api_keys WHERE account = ? ORDER BY created_at"); err != nil {
+		return nil, fmt.Errorf("sqlStore: prepare listAPIKeys: %w", err)
+	}
+	if db.deleteAPIKey, err = conn.Preparex("DELETE FROM api_keys WHERE key_hash = ?"); err != nil {
+		return nil, fmt.Errorf("sqlStore: prepare deleteAPIKey: %w", err)
+	}
+	if db.deleteAPIKeys, err = conn.Preparex("DELETE FROM api_keys WHERE account = ?"); err != nil {
+		return nil, fmt.Errorf("sqlStore: prepare deleteAPIKeys: %w", err)
+	}
 	return db, nil
 }
 
@@ -123,7 +215,7 @@ func (db *sqlStore) SetRecord(rec *CertRecord) error {
 	if err := db.conn.Ping(); err != nil {
 		return connError(err)
 	}
-	_, err := db.set.Exec(rec.KeyID, rec.Principals, rec.CreatedAt, rec.Expires, rec.Raw, rec.Message)
+	_, err := db.set.Exec(rec.KeyID, rec.Principals, rec.CreatedAt, rec.Expires, rec.Raw, rec.Message, rec.Username, rec.Renewals, rec.Claims, rec.ServiceAccount, rec.Provider, rec.Fingerprint, rec.Renewed)
 	return err
 }
 
@@ -161,6 +253,32 @@ func (db *sqlStore) Revoke(ids []string) error {
 	return err
 }
 
+// RecordRenewal marks the unrevoked cert with the fingerprint as renewed and
+// records the cert it was renewed as, in one transaction. It returns
+// ErrCertRenewed if there's no such cert, or it was already renewed.
+func (db *sqlStore) RecordRenewal(fingerprint string, renewed *CertRecord) error {
+	if err := db.conn.Ping(); err != nil {
+		return connError(err)
+	}
+	tx, err := db.conn.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Stmtx(db.markRenewed).Exec(fingerprint)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return ErrCertRenewed
+	}
+	r := renewed
+	if _, err := tx.Stmtx(db.set).Exec(r.KeyID, r.Principals, r.CreatedAt, r.Expires, r.Raw, r.Message, r.Username, r.Renewals, r.Claims, r.ServiceAccount, r.Provider, r.Fingerprint, r.Renewed); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 // GetRevoked returns all revoked certs
 func (db *sqlStore) GetRevoked() ([]*CertRecord, error) {
 	if err := db.conn.Ping(); err != nil {
@@ -173,6 +291,196 @@ func (db *sqlStore) GetRevoked() ([]*CertRecord, error) {
 	return recs, nil
 }
 
+// SetToken records a *TokenRecord. Expired tokens are removed.
+func (db *sqlStore) SetToken(token *TokenRecord) error {
+	if err := db.conn.Ping(); err != nil {
+		return connError(err)
+	}
+	if _, err := db.expireTokens.Exec(time.Now().UTC()); err != nil {
+		return err
+	}
+	_, err := db.setToken.Exec(token.Hash, token.Username, token.Audience, token.CodeChallenge, token.CreatedAt, token.Expires, token.Provider)
+	return err
+}
+
+// GetToken returns a single *TokenRecord
+func (db *sqlStore) GetToken(hash string) (*TokenRecord, error) {
+	if err := db.conn.Ping(); err != nil {
+		return nil, connError(err)
+	}
+	t := &TokenRecord{}
+	return t, db.getToken.Get(t, hash)
+}
+
+// UseToken marks a token as used. It fails if the token has already been
+// used or has expired.
+func (db *sqlStore) UseToken(hash string) error {
+	if err := db.conn.Ping(); err != nil {
+		return connError(err)
+	}
+	res, err := db.useToken.Exec(hash, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return ErrTokenUsed
+	}
+	return nil
+}
+
+// SetSession records a *SessionRecord, replacing any previous version of
+// the session. Expired sessions are removed.
+func (db *sqlStore) SetSession(session *SessionRecord) error {
+	if err := db.conn.Ping(); err != nil {
+		return connError(err)
+	}
+	if _, err := db.expireSessions.Exec(time.Now().UTC()); err != nil {
+		return err
+	}
+	_, err := db.setSession.Exec(session.ID, session.Username, session.Data, session.Expires, session.Provider)
+	return err
+}
+
+// GetSession returns a single unexpired *SessionRecord
+func (db *sqlStore) GetSession(id string) (*SessionRecord, error) {
+	if err := db.conn.Ping(); err != nil {
+		return nil, connError(err)
+	}
+	s := &SessionRecord{}
+	return s, db.getSession.Get(s, id, time.Now().UTC())
+}
+
+// DeleteSession removes a session.
+func (db *sqlStore) DeleteSession(id string) error {
+	if err := db.conn.Ping(); err != nil {
+		return connError(err)
+	}
+	_, err := db.deleteSession.Exec(id)
+	return err
+}
+
+// UserSessions returns the unexpired sessions of a provider's user.
+func (db *sqlStore) UserSessions(provider, username string) ([]*SessionRecord, error) {
+	if err := db.conn.Ping(); err != nil {
+		return nil, connError(err)
+	}
+	var sessions []*SessionRecord
+	if err := db.userSessions.Select(&sessions, provider, username, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// SetIdentity records a *IdentityRecord, replacing any previous identity of
+// the user.
+func (db *sqlStore) SetIdentity(identity *IdentityRecord) error {
+	if err := db.conn.Ping(); err != nil {
+		return connError(err)
+	}
+	_, err := db.setIdentity.Exec(identity.Username, identity.Token, identity.VerifiedAt, identity.Provider)
+	return err
+}
+
+// GetIdentity returns the *IdentityRecord of a provider's user.
+func (db *sqlStore) GetIdentity(provider, username string) (*IdentityRecord, error) {
+	if err := db.conn.Ping(); err != nil {
+		return nil, connError(err)
+	}
+	i := &IdentityRecord{}
+	return i, db.getIdentity.Get(i, provider, username)
+}
+
+// DeleteIdentity removes the identity of a provider's user.
+func (db *sqlStore) DeleteIdentity(provider, username string) error {
+	if err := db.conn.Ping(); err != nil {
+		return connError(err)
+	}
+	_, err := db.deleteIdentity.Exec(provider, username)
+	return err
+}
+
+// SetServiceAccount records a *ServiceAccountRecord, replacing any previous
+// version of the account.
+func (db *sqlStore) SetServiceAccount(account *ServiceAccountRecord) error {
+	if err := db.conn.Ping(); err != nil {
+		return connError(err)
+	}
+	_, err := db.setAccount.Exec(account.Name, account.Principals, account.MaxValidity, account.CreatedBy, account.CreatedAt, account.Expires)
+	return err
+}
+
+// GetServiceAccount returns a single *ServiceAccountRecord
+func (db *sqlStore) GetServiceAccount(name string) (*ServiceAccountRecord, error) {
+	if err := db.conn.Ping(); err != nil {
+		return nil, connError(err)
+	}
+	a := &ServiceAccountRecord{}
+	return a, db.getAccount.Get(a, name)
+}
+
+// ListServiceAccounts returns all service accounts, by name.
+func (db *sqlStore) ListServiceAccounts() ([]*ServiceAccountRecord, error) {
+	if err := db.conn.Ping(); err != nil {
+		return nil, connError(err)
+	}
+	accounts := []*ServiceAccountRecord{}
+	if err := db.listAccounts.Select(&accounts); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// DeleteServiceAccount removes a service account and its API keys.
+func (db *sqlStore) DeleteServiceAccount(name string) error {
+	if err := db.conn.Ping(); err != nil {
+		return connError(err)
+	}
+	if _, err := db.deleteAPIKeys.Exec(name); err != nil {
+		return err
+	}
+	_, err := db.deleteAccount.Exec(name)
+	return err
+}
+
+// SetAPIKey records a *APIKeyRecord
+func (db *sqlStore) SetAPIKey(key *APIKeyRecord) error {
+	if err := db.conn.Ping(); err != nil {
+		return connError(err)
+	}
+	_, err := db.setAPIKey.Exec(key.Hash, key.Account, key.CreatedAt)
+	return err
+}
+
+// GetAPIKey returns a single *APIKeyRecord
+func (db *sqlStore) GetAPIKey(hash string) (*APIKeyRecord, error) {
+	if err := db.conn.Ping(); err != nil {
+		return nil, connError(err)
+	}
+	k := &APIKeyRecord{}
+	return k, db.getAPIKey.Get(k, hash)
+}
+
+// ListAPIKeys returns the API keys of a service account.
+func (db *sqlStore) ListAPIKeys(account string) ([]*APIKeyRecord, error) {
+	if err := db.conn.Ping(); err != nil {
+		return nil, connError(err)
+	}
+	var keys []*APIKeyRecord
+	if err := db.listAPIKeys.Select(&keys, account); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// DeleteAPIKey removes an API key.
+func (db *sqlStore) DeleteAPIKey(hash string) error {
+	if err := db.conn.Ping(); err != nil {
+		return connError(err)
+	}
+	_, err := db.deleteAPIKey.Exec(hash)
+	return err
+}
+
 // Close the connection to the database
 func (db *sqlStore) Close() error {
 	return db.conn.Close()
@@ -2,6 +2,7 @@ package store
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -24,14 +25,121 @@ func New(c config.Database) (CertStorer, error) {
 // CertStorer records issued certs in a persistent store for audit and
 // revocation purposes.
 type CertStorer interface {
+	TokenStorer
+	SessionStorer
+	IdentityStorer
+	ServiceAccountStorer
 	Get(id string) (*CertRecord, error)
 	SetRecord(record *CertRecord) error
 	List(includeExpired bool) ([]*CertRecord, error)
 	Revoke(id []string) error
 	GetRevoked() ([]*CertRecord, error)
+	RecordRenewal(fingerprint string, renewed *CertRecord) error
 	Close() error
 }
 
+// ErrCertRenewed is returned when renewing a certificate which has already
+// been renewed or revoked.
+var ErrCertRenewed = errors.New("certificate has already been renewed")
+
+// ErrTokenUsed is returned when using a token which has already been used or
+// has expired.
+var ErrTokenUsed = errors.New("token has already been used or has expired")
+
+// TokenStorer holds the tokens issued to users for signing requests. Tokens
+// are stored by their hash and may only be used once.
+type TokenStorer interface {
+	SetToken(token *TokenRecord) error
+	GetToken(hash string) (*TokenRecord, error)
+	UseToken(hash string) error
+}
+
+// SessionStorer holds the server-side sessions of logged in users. Sessions
+// are stored by the hash of their ID, and belong to a username of an auth
+// provider.
+type SessionStorer interface {
+	SetSession(session *SessionRecord) error
+	GetSession(id string) (*SessionRecord, error)
+	DeleteSession(id string) error
+	UserSessions(provider, username string) ([]*SessionRecord, error)
+}
+
+// IdentityStorer caches the identities of users who logged in, so that their
+// certificates can be renewed without logging in again. Identities are keyed
+// by auth provider and username.
+type IdentityStorer interface {
+	SetIdentity(identity *IdentityRecord) error
+	GetIdentity(provider, username string) (*IdentityRecord, error)
+	DeleteIdentity(provider, username string) error
+}
+
+// ServiceAccountStorer holds the service accounts managed by admins and
+// their API keys. API keys are stored by their hash.
+type ServiceAccountStorer interface {
+	SetServiceAccount(account *ServiceAccountRecord) error
+	GetServiceAccount(name string) (*ServiceAccountRecord, error)
+	ListServiceAccounts() ([]*ServiceAccountRecord, error)
+	// DeleteServiceAccount removes a service account and its API keys.
+	DeleteServiceAccount(name string) error
+	SetAPIKey(key *APIKeyRecord) error
+	GetAPIKey(hash string) (*APIKeyRecord, error)
+	ListAPIKeys(account string) ([]*APIKeyRecord, error)
+	DeleteAPIKey(hash string) error
+}
+
+// A ServiceAccountRecord is an account used by automation to sign keys.
+type ServiceAccountRecord struct {
+	Name       string      `db:"name"`
+	Principals StringSlice `db:"principals"`
+	// MaxValidity limits the validity of certificates issued to the account.
+	MaxValidity time.Duration `db:"max_validity"`
+	CreatedBy   string        `db:"created_by"`
+	CreatedAt   time.Time     `db:"created_at"`
+	Expires     time.Time     `db:"expires_at"`
+}
+
+// An APIKeyRecord is an API key of a service account.
+type APIKeyRecord struct {
+	Hash      string    `db:"key_hash"`
+	Account   string    `db:"account"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// An IdentityRecord is the identity of a user as of their last login.
+type IdentityRecord struct {
+	Username string `db:"username"`
+	// Token is the user's OAuth token, encoded as JSON.
+	Token      string    `db:"token"`
+	VerifiedAt time.Time `db:"verified_at"`
+	// Provider is the name of the auth provider the user logged in with.
+	Provider string `db:"provider"`
+}
+
+// A SessionRecord is the server-side state of a user's session.
+type SessionRecord struct {
+	ID       string    `db:"id"`
+	Username string    `db:"username"`
+	Data     string    `db:"data"`
+	Expires  time.Time `db:"expires_at"`
+	// Provider is the name of the auth provider the user logged in with.
+	Provider string `db:"provider"`
+}
+
+// A TokenRecord is a token issued to a user.
+type TokenRecord struct {
+	Hash     string `db:"token_hash"`
+	Username string `db:"username"`
+	Audience string `db:"audience"`
+	// CodeChallenge is the PKCE challenge an authorization code was issued
+	// for.
+	CodeChallenge string    `db:"code_challenge"`
+	CreatedAt     time.Time `db:"created_at"`
+	Expires       time.Time `db:"expires_at"`
+	Used          bool      `db:"used"`
+	// Provider is the name of the auth provider the user logged in with.
+	Provider string `db:"provider"`
+}
+
 // A CertRecord is a representation of a ssh certificate used by a CertStorer.
 type CertRecord struct {
 	ID         int         `json:"-" db:"id"`
@@ -42,6 +150,22 @@ type CertRecord struct {
 	Revoked    bool        `json:"revoked" db:"revoked"`
 	Raw        string      `json:"-" db:"raw_key"`
 	Message    string      `json:"message" db:"message"`
+	Username   string      `json:"username,omitempty" db:"username"`
+	// Renewals is the number of times the certificate's first ancestor was
+	// renewed to issue it.
+	Renewals int `json:"renewals,omitempty" db:"renewals"`
+	// Claims are the JSON encoded claims of the ID token a workload
+	// authenticated with.
+	Claims string `json:"claims,omitempty" db:"claims"`
+	// ServiceAccount is the service account the certificate was issued to.
+	ServiceAccount string `json:"service_account,omitempty" db:"service_account"`
+	// Provider is the name of the auth provider the user logged in with.
+	Provider string `json:"provider,omitempty" db:"provider"`
+	// Fingerprint is the SHA256 fingerprint of the certificate itself,
+	// unlike the KeyID which isn't unique.
+	Fingerprint string `json:"fingerprint,omitempty" db:"fingerprint"`
+	// Renewed is set once the certificate has been renewed.
+	Renewed bool `json:"renewed,omitempty" db:"renewed"`
 }
 
 // MarshalJSON implements the json.Marshaler interface for the CreatedAt and
@@ -68,10 +192,11 @@ func parseTime(t uint64) time.Time {
 // MakeRecord converts a Certificate to a CertRecord
 func MakeRecord(cert *ssh.Certificate) *CertRecord {
 	return &CertRecord{
-		KeyID:      cert.KeyId,
-		Principals: StringSlice(cert.ValidPrincipals),
-		CreatedAt:  parseTime(cert.ValidAfter),
-		Expires:    parseTime(cert.ValidBefore),
-		Raw:        string(lib.GetPublicKey(cert)),
+		KeyID:       cert.KeyId,
+		Principals:  StringSlice(cert.ValidPrincipals),
+		CreatedAt:   parseTime(cert.ValidAfter),
+		Expires:     parseTime(cert.ValidBefore),
+		Raw:         string(lib.GetPublicKey(cert)),
+		Fingerprint: ssh.FingerprintSHA256(cert),
 	}
 }
@@ -74,6 +74,11 @@ func testStore(t *testing.T, db CertStorer) {
 	cert.ValidBefore = uint64(time.Now().Add(1 * time.Hour).UTC().Unix())
 	cert.ValidAfter = uint64(time.Now().Add(-5 * time.Minute).UTC().Unix())
 	rec := MakeRecord(cert)
+	rec.Username = "user"
+	rec.Renewals = 2
+	rec.Claims = `{"repository":"example/app"}`
+	rec.ServiceAccount = "deploy"
+	rec.Provider = "employees"
 	if err = db.SetRecord(rec); err != nil {
 		t.Error(err)
 	}
@@ -85,6 +90,30 @@ func testStore(t *testing.T, db CertStorer) {
 	if ret.KeyID != cert.KeyId {
 		t.Error("key mismatch")
 	}
+	if ret.Username != "user" || ret.Renewals != 2 || ret.Claims != rec.Claims || ret.ServiceAccount != "deploy" || ret.Provider != "employees" {
+		t.Errorf("Unexpected record: %+v", ret)
+	}
+	renewed := &CertRecord{KeyID: "renewed", Principals: StringSlice{"user"}, CreatedAt: time.Now().UTC(), Expires: time.Now().UTC().Add(time.Hour), Fingerprint: "SHA256:renewed"}
+	if err = db.RecordRenewal(ssh.FingerprintSHA256(cert), renewed); err != nil {
+		t.Error(err)
+	}
+	if err = db.RecordRenewal(ssh.FingerprintSHA256(cert), &CertRecord{KeyID: "again"}); err != ErrCertRenewed {
+		t.Errorf("Expected ErrCertRenewed for a renewed cert, got %v", err)
+	}
+	if err = db.RecordRenewal("SHA256:unknown", &CertRecord{KeyID: "unknown"}); err != ErrCertRenewed {
+		t.Errorf("Expected ErrCertRenewed for an unknown cert, got %v", err)
+	}
+	if ret, err = db.Get("key"); err != nil || !ret.Renewed {
+		t.Errorf("Expected the cert to be marked renewed, got %+v (%v)", ret, err)
+	}
+	if ret, err = db.Get("renewed"); err != nil || ret.Fingerprint != "SHA256:renewed" {
+		t.Errorf("Expected the renewed cert to be recorded, got %+v (%v)", ret, err)
+	}
+	for _, id := range []string{"again", "unknown"} {
+		if _, err = db.Get(id); err == nil {
+			t.Errorf("Expected cert %s not to be recorded", id)
+		}
+	}
 	if err = db.Revoke([]string{"key"}); err != nil {
 		t.Error(err)
 	}
@@ -101,6 +130,191 @@ func testStore(t *testing.T, db CertStorer) {
 			t.Errorf("Unexpected key: %s", k.KeyID)
 		}
 	}
+
+	tok := &TokenRecord{
+		Hash:      "hash",
+		Username:  "user",
+		Audience:  "sign",
+		CreatedAt: time.Now().UTC(),
+		Expires:   time.Now().UTC().Add(time.Minute),
+		Provider:  "employees",
+	}
+	if err = db.SetToken(tok); err != nil {
+		t.Error(err)
+	}
+	expired := &TokenRecord{
+		Hash:      "expired",
+		Username:  "user",
+		Audience:  "sign",
+		CreatedAt: time.Now().UTC().Add(-time.Hour),
+		Expires:   time.Now().UTC().Add(-time.Minute),
+	}
+	if err = db.SetToken(expired); err != nil {
+		t.Error(err)
+	}
+	got, err := db.GetToken("hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Username != "user" || got.Audience != "sign" || got.Provider != "employees" || got.Used {
+		t.Errorf("Unexpected token: %+v", got)
+	}
+	if err = db.UseToken("hash"); err != nil {
+		t.Error(err)
+	}
+	if err = db.UseToken("hash"); err != ErrTokenUsed {
+		t.Errorf("Expected ErrTokenUsed for a used token, got %v", err)
+	}
+	if got, _ = db.GetToken("hash"); got == nil || !got.Used {
+		t.Error("Expected the token to be marked as used")
+	}
+	if err = db.UseToken("expired"); err != ErrTokenUsed {
+		t.Errorf("Expected ErrTokenUsed for an expired token, got %v", err)
+	}
+	if err = db.UseToken("unknown"); err != ErrTokenUsed {
+		t.Errorf("Expected ErrTokenUsed for an unknown token, got %v", err)
+	}
+
+	sess := &SessionRecord{
+		ID:       "session",
+		Username: "user",
+		Data:     "{}",
+		Expires:  time.Now().UTC().Add(time.Minute),
+		Provider: "employees",
+	}
+	if err = db.SetSession(sess); err != nil {
+		t.Error(err)
+	}
+	sess.Data = `{"a":"b"}`
+	if err = db.SetSession(sess); err != nil {
+		t.Error(err)
+	}
+	if err = db.SetSession(&SessionRecord{ID: "other", Username: "user", Data: "{}", Expires: time.Now().UTC().Add(time.Minute), Provider: "employees"}); err != nil {
+		t.Error(err)
+	}
+	if err = db.SetSession(&SessionRecord{ID: "expired", Username: "user", Data: "{}", Expires: time.Now().UTC().Add(-time.Minute), Provider: "employees"}); err != nil {
+		t.Error(err)
+	}
+	if err = db.SetSession(&SessionRecord{ID: "contractor", Username: "user", Data: "{}", Expires: time.Now().UTC().Add(time.Minute), Provider: "contractors"}); err != nil {
+		t.Error(err)
+	}
+	gotSession, err := db.GetSession("session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotSession.Username != "user" || gotSession.Provider != "employees" || gotSession.Data != `{"a":"b"}` {
+		t.Errorf("Unexpected session: %+v", gotSession)
+	}
+	if _, err = db.GetSession("expired"); err == nil {
+		t.Error("Expected an error for an expired session")
+	}
+	sessions, err := db.UserSessions("employees", "user")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(sessions) != 2 {
+		t.Errorf("Expected 2 sessions, got %d", len(sessions))
+	}
+	if err = db.DeleteSession("session"); err != nil {
+		t.Error(err)
+	}
+	if _, err = db.GetSession("session"); err == nil {
+		t.Error("Expected an error for a deleted session")
+	}
+
+	verified := time.Now().UTC().Truncate(time.Second)
+	if err = db.SetIdentity(&IdentityRecord{Username: "user", Token: "{}", VerifiedAt: verified.Add(-time.Hour), Provider: "employees"}); err != nil {
+		t.Error(err)
+	}
+	if err = db.SetIdentity(&IdentityRecord{Username: "user", Token: `{"a":"b"}`, VerifiedAt: verified, Provider: "employees"}); err != nil {
+		t.Error(err)
+	}
+	if err = db.SetIdentity(&IdentityRecord{Username: "user", Token: "{}", VerifiedAt: verified, Provider: "contractors"}); err != nil {
+		t.Error(err)
+	}
+	identity, err := db.GetIdentity("employees", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Token != `{"a":"b"}` || identity.Provider != "employees" || !identity.VerifiedAt.Equal(verified) {
+		t.Errorf("Unexpected identity: %+v", identity)
+	}
+	if err = db.DeleteIdentity("employees", "user"); err != nil {
+		t.Error(err)
+	}
+	if _, err = db.GetIdentity("employees", "user"); err == nil {
+		t.Error("Expected an error for a deleted identity")
+	}
+	if _, err = db.GetIdentity("contractors", "user"); err != nil {
+		t.Errorf("Expected another provider's identity to be kept, got %v", err)
+	}
+
+	account := &ServiceAccountRecord{
+		Name:        "deploy",
+		Principals:  StringSlice{"deploy"},
+		MaxValidity: time.Hour,
+		CreatedBy:   "admin",
+		CreatedAt:   verified,
+		Expires:     verified.Add(90 * 24 * time.Hour),
+	}
+	if err = db.SetServiceAccount(account); err != nil {
+		t.Error(err)
+	}
+	if err = db.SetServiceAccount(&ServiceAccountRecord{Name: "backup", Principals: StringSlice{"backup"}}); err != nil {
+		t.Error(err)
+	}
+	gotAccount, err := db.GetServiceAccount("deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotAccount.MaxValidity != time.Hour || gotAccount.CreatedBy != "admin" || !gotAccount.Expires.Equal(account.Expires) || len(gotAccount.Principals) != 1 {
+		t.Errorf("Unexpected service account: %+v", gotAccount)
+	}
+	accounts, err := db.ListServiceAccounts()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(accounts) != 2 || accounts[0].Name != "backup" {
+		t.Errorf("Unexpected service accounts: %+v", accounts)
+	}
+	for _, k := range []*APIKeyRecord{
+		{Hash: "key1", Account: "deploy", CreatedAt: verified},
+		{Hash: "key2", Account: "deploy", CreatedAt: verified.Add(time.Second)},
+		{Hash: "key3", Account: "backup", CreatedAt: verified},
+	} {
+		if err = db.SetAPIKey(k); err != nil {
+			t.Error(err)
+		}
+	}
+	key, err := db.GetAPIKey("key2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Account != "deploy" {
+		t.Errorf("Unexpected API key: %+v", key)
+	}
+	if err = db.DeleteAPIKey("key1"); err != nil {
+		t.Error(err)
+	}
+	keys, err := db.ListAPIKeys("deploy")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(keys) != 1 || keys[0].Hash != "key2" {
+		t.Errorf("Unexpected API keys: %+v", keys)
+	}
+	if err = db.DeleteServiceAccount("deploy"); err != nil {
+		t.Error(err)
+	}
+	if _, err = db.GetServiceAccount("deploy"); err == nil {
+		t.Error("Expected an error for a deleted service account")
+	}
+	if _, err = db.GetAPIKey("key2"); err == nil {
+		t.Error("Expected the API keys of a deleted service account to be removed")
+	}
+	if _, err = db.GetAPIKey("key3"); err != nil {
+		t.Error("Expected the API keys of other service accounts to be kept")
+	}
 }
 
 func TestMemoryStore(t *testing.T) {
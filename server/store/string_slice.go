@@ -29,8 +29,11 @@ func (s *StringSlice) Scan(value interface{}) error {
 	var err error
 	v, err := driver.String.ConvertValue(value)
 	if err == nil {
-		if v, ok := v.([]byte); ok {
+		switch v := v.(type) {
+		case []byte:
 			err = json.Unmarshal(v, s)
+		case string:
+			err = json.Unmarshal([]byte(v), s)
 		}
 	}
 	return err
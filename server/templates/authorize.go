@@ -0,0 +1,35 @@
+package templates
+
+// Authorize asks users to confirm a login from the client on their computer.
+const Authorize = `
+<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>Authorize</title>
+
+	<link rel="stylesheet" href="/static/css/normalize.css">
+	<link rel="stylesheet" href="/static/css/skeleton.css">
+	<link href="https://fonts.googleapis.com/css?family=Source+Sans+Pro" rel="stylesheet">
+</head>
+<body>
+	<div class="container">
+		<div class="page-header">
+			<h2>Authorize the cashier client</h2>
+		</div>
+
+		<p>The cashier client listening at <code>{{ .Redirect }}</code> on this computer is asking to get certificates as <strong>{{ .Username }}</strong>.</p>
+		<p>Only continue if you just ran cashier.</p>
+
+		<form action="/auth/authorize" method="post">
+			{{ .csrfField }}
+			{{ range $name, $value := .Params }}
+			<input type="hidden" name="{{ $name }}" value="{{ $value }}" />
+			{{ end }}
+			<button class="button-primary" type="submit" value="Authorize">Authorize</button>
+		</form>
+	</div>
+</body>
+</html>
+`
@@ -51,6 +51,22 @@ const Certs = `
 			</form>
 			<button class="button-primary" type="submit" form="form_revoke" value="Revoke">Revoke</button>
 		</div>
+
+		<div id="sessions">
+			<h4>Log out a user</h4>
+			<form action="/admin/sessions/revoke" method="post" id="form_revoke_sessions">
+			{{ .csrfField }}
+			<input type="text" name="username" placeholder="Username" />
+			{{ if gt (len .Providers) 1 }}
+			<select name="provider">
+				{{ range .Providers }}<option>{{ . }}</option>{{ end }}
+			</select>
+			{{ end }}
+			<button class="button-primary" type="submit" value="Log out">Log out</button>
+			</form>
+		</div>
+
+		<p><a href="/admin/service-accounts">Service accounts</a></p>
 	</div>
 </body>
 <script src="/static/js/list.min.js"></script>
@@ -0,0 +1,30 @@
+package templates
+
+// Login lets users choose which provider to log in with.
+const Login = `
+<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>Log in</title>
+
+	<link rel="stylesheet" href="/static/css/normalize.css">
+	<link rel="stylesheet" href="/static/css/skeleton.css">
+	<link href="https://fonts.googleapis.com/css?family=Source+Sans+Pro" rel="stylesheet">
+</head>
+<body>
+	<div class="container">
+		<div class="page-header">
+			<h2>Log in with</h2>
+		</div>
+
+		<div id="providers">
+			{{ range .Providers }}
+			<a class="button button-primary u-full-width" href="/auth/login?provider={{ . }}">{{ . }}</a>
+			{{ end }}
+		</div>
+	</div>
+</body>
+</html>
+`
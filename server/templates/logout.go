@@ -0,0 +1,29 @@
+package templates
+
+// Logout asks users to confirm logging out.
+const Logout = `
+<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>Log out</title>
+
+	<link rel="stylesheet" href="/static/css/normalize.css">
+	<link rel="stylesheet" href="/static/css/skeleton.css">
+	<link href="https://fonts.googleapis.com/css?family=Source+Sans+Pro" rel="stylesheet">
+</head>
+<body>
+	<div class="container">
+		<div class="page-header">
+			<h2>Log out</h2>
+		</div>
+
+		<form action="/auth/logout" method="post">
+			{{ .csrfField }}
+			<button class="button-primary" type="submit" value="Log out">Log out</button>
+		</form>
+	</div>
+</body>
+</html>
+`
@@ -0,0 +1,91 @@
+package templates
+
+// ServiceAccounts lists the service accounts and their API keys.
+const ServiceAccounts = `
+<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>Service Accounts</title>
+
+	<link rel="stylesheet" href="/static/css/normalize.css">
+	<link rel="stylesheet" href="/static/css/skeleton.css">
+	<link href="https://fonts.googleapis.com/css?family=Source+Sans+Pro" rel="stylesheet">
+</head>
+<body>
+	<div class="container">
+		<div class="page-header">
+			<h2>Service Accounts</h2>
+		</div>
+
+		{{ if .NewKey }}
+		<div id="new-key">
+			<h4>New API key for {{ .NewKeyAccount }}</h4>
+			<p>Copy the key now, it won't be shown again.</p>
+			<pre><code>{{ .NewKey }}</code></pre>
+		</div>
+		{{ end }}
+
+		<table class="u-full-width" id="accounts">
+			<thead>
+			<tr>
+				<th>Name</th>
+				<th>Principals</th>
+				<th>Max validity</th>
+				<th>Expires</th>
+				<th>Created by</th>
+				<th>API keys</th>
+				<th></th>
+			</tr>
+			</thead>
+			<tbody>
+			{{ range .Accounts }}
+			<tr>
+				<td>{{ .Name }}</td>
+				<td>{{ range $i, $p := .Principals }}{{ if $i }}, {{ end }}{{ $p }}{{ end }}</td>
+				<td>{{ if .MaxValidity }}{{ .MaxValidity }}{{ end }}</td>
+				<td>{{ .Expires.Format "2006-01-02" }}{{ if .Expired }} (expired){{ end }}</td>
+				<td>{{ .CreatedBy }}</td>
+				<td>
+					{{ range .Keys }}
+					<form action="/admin/service-accounts/keys/delete" method="post">
+					{{ $.csrfField }}
+					<input type="hidden" name="key_hash" value="{{ .Hash }}" />
+					<code>{{ slice .Hash 0 12 }}</code> created {{ .CreatedAt.Format "2006-01-02" }}
+					<button type="submit">Delete</button>
+					</form>
+					{{ end }}
+					<form action="/admin/service-accounts/keys" method="post">
+					{{ $.csrfField }}
+					<input type="hidden" name="name" value="{{ .Name }}" />
+					<button type="submit">New key</button>
+					</form>
+				</td>
+				<td>
+					<form action="/admin/service-accounts/delete" method="post">
+					{{ $.csrfField }}
+					<input type="hidden" name="name" value="{{ .Name }}" />
+					<button type="submit">Delete</button>
+					</form>
+				</td>
+			</tr>
+			{{ end }}
+			</tbody>
+		</table>
+
+		<div id="create">
+			<h4>Create or update a service account</h4>
+			<form action="/admin/service-accounts" method="post">
+			{{ .csrfField }}
+			<input type="text" name="name" placeholder="Name" />
+			<input type="text" name="principals" placeholder="Principals, comma separated" />
+			<input type="text" name="max_validity" placeholder="Max validity, e.g. 1h" />
+			<input type="date" name="expires" />
+			<button class="button-primary" type="submit" value="Save">Save</button>
+			</form>
+		</div>
+	</div>
+</body>
+</html>
+`
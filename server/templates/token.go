@@ -58,13 +58,17 @@ const Token = `
 		<div>
 			<textarea style="font-size: 12pt" class="u-full-width token-display" readonly spellcheck="false" onclick="this.focus();this.select();">{{.Token}}.</textarea>
 			<h3>
-				The token will expire in &lt; 1 hour.
+				The token can be used once and will expire in {{.Expiry}}.
 			</h3>
 		</div>
 		<div>
 			<h4>
 				<a href="/admin/certs">Previously Issued Certificates</a>
 			</h4>
+			<form action="/auth/logout" method="post">
+				{{.CSRFField}}
+				<button type="submit" value="Log out">Log out</button>
+			</form>
 		</div>
 	</div>
 	{{ if .Localserver }}
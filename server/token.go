@@ -0,0 +1,114 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cashier-go/cashier/server/store"
+)
+
+const (
+	// signTokenTTL is how long a sign token can be used after it was issued.
+	signTokenTTL = 10 * time.Minute
+	// codeTTL is how long an authorization code can be exchanged for a sign
+	// token.
+	codeTTL = time.Minute
+)
+
+// Token audiences restrict tokens to the requests they were issued for.
+const (
+	signAudience = "sign"
+	codeAudience = "code"
+)
+
+var errInvalidToken = errors.New("invalid or expired token")
+
+// hashToken returns the hash a token is stored by.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// mintToken issues a single-use token for the user of the provider,
+// restricted to the audience.
+func (a *application) mintToken(username, provider, audience, codeChallenge string, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now().UTC()
+	err := a.certstore.SetToken(&store.TokenRecord{
+		Hash:          hashToken(token),
+		Username:      username,
+		Provider:      provider,
+		Audience:      audience,
+		CodeChallenge: codeChallenge,
+		CreatedAt:     now,
+		Expires:       now.Add(ttl),
+	})
+	return token, err
+}
+
+// mintSignToken issues a single-use token allowing the user to sign a key.
+// The upstream OAuth token is never shown to the user.
+func (a *application) mintSignToken(username, provider string) (string, error) {
+	return a.mintToken(username, provider, signAudience, "", signTokenTTL)
+}
+
+// lookupToken returns the record of an unused token for the audience.
+func (a *application) lookupToken(token, audience string) (*store.TokenRecord, error) {
+	if token == "" {
+		return nil, errInvalidToken
+	}
+	rec, err := a.certstore.GetToken(hashToken(token))
+	if err != nil || rec.Used || rec.Audience != audience || time.Now().After(rec.Expires) {
+		return nil, errInvalidToken
+	}
+	return rec, nil
+}
+
+// signToken returns the record of an unused sign token.
+func (a *application) signToken(token string) (*store.TokenRecord, error) {
+	return a.lookupToken(token, signAudience)
+}
+
+// loopbackRedirect parses a redirect URI, which must be a loopback address
+// as described in RFC 8252.
+func loopbackRedirect(uri string) (*url.URL, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" || u.Port() == "" || u.Fragment != "" || u.User != nil {
+		return nil, fmt.Errorf("redirect_uri %q is not a loopback address", uri)
+	}
+	if host := u.Hostname(); host != "localhost" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return nil, fmt.Errorf("redirect_uri %q is not a loopback address", uri)
+		}
+	}
+	return u, nil
+}
+
+// authorizeRequest returns the client's loopback address and PKCE challenge
+// from an authorization request.
+func authorizeRequest(r *http.Request) (*url.URL, string, error) {
+	redirect, err := loopbackRedirect(r.FormValue("redirect_uri"))
+	if err != nil {
+		return nil, "", err
+	}
+	challenge := r.FormValue("code_challenge")
+	if r.FormValue("code_challenge_method") != "S256" || challenge == "" {
+		return nil, "", errors.New("an S256 code_challenge is required")
+	}
+	return redirect, challenge, nil
+}
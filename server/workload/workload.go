@@ -0,0 +1,249 @@
+// Package workload authenticates workloads, such as CI jobs, by the OIDC ID
+// tokens their platform issues them.
+package workload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+
+	"github.com/cashier-go/cashier/server/config"
+	"github.com/cashier-go/cashier/server/signer"
+)
+
+// DefaultMaxValidity limits the validity of certificates issued to workloads,
+// unless a policy sets its own.
+const DefaultMaxValidity = time.Hour
+
+const (
+	// keysTTL is how long an issuer's keys are used before they're fetched
+	// again.
+	keysTTL = time.Hour
+	// refreshInterval limits how often keys are fetched for tokens signed by
+	// an unknown key.
+	refreshInterval = time.Minute
+	// leeway allows for clock skew when checking token times.
+	leeway = time.Minute
+)
+
+// ErrNotPermitted is returned for valid tokens which don't match a policy.
+var ErrNotPermitted = errors.New("no workload policy matches the token")
+
+var algorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// Identity is an authenticated workload.
+type Identity struct {
+	Grant signer.Grant
+	// Claims are the token's claims.
+	Claims map[string]interface{}
+}
+
+// Verifier verifies ID tokens from the configured issuers.
+type Verifier struct {
+	client  *http.Client
+	issuers map[string]*issuer
+}
+
+type issuer struct {
+	conf config.WorkloadIssuer
+
+	mu      sync.Mutex
+	keys    *jose.JSONWebKeySet
+	fetched time.Time
+}
+
+// New returns a Verifier for the configured issuers, fetching their keys with
+// client.
+func New(conf config.WorkloadIdentity, client *http.Client) *Verifier {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	v := &Verifier{
+		client:  client,
+		issuers: make(map[string]*issuer),
+	}
+	for _, iss := range conf.Issuers {
+		v.issuers[iss.URL] = &issuer{conf: iss}
+	}
+	return v
+}
+
+// IsToken reports whether s looks like a JWT rather than a sign token.
+func IsToken(s string) bool {
+	return strings.Count(s, ".") == 2
+}
+
+// Verify verifies an ID token, and returns the identity granted by the first
+// policy of its issuer which matches its claims.
+func (v *Verifier) Verify(ctx context.Context, token string) (*Identity, error) {
+	tok, err := jwt.ParseSigned(token, algorithms)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse token: %w", err)
+	}
+	unverified := jwt.Claims{}
+	if err := tok.UnsafeClaimsWithoutVerification(&unverified); err != nil {
+		return nil, fmt.Errorf("unable to parse token: %w", err)
+	}
+	iss, ok := v.issuers[unverified.Issuer]
+	if !ok {
+		return nil, fmt.Errorf("untrusted issuer %q", unverified.Issuer)
+	}
+	keys, err := iss.keysFor(ctx, v.client, tok.Headers[0].KeyID)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		std    jwt.Claims
+		claims map[string]interface{}
+	)
+	for _, key := range keys {
+		if err = tok.Claims(key, &std, &claims); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid token signature: %w", err)
+	}
+	if std.Expiry == nil {
+		return nil, errors.New("token has no expiry")
+	}
+	if err := std.ValidateWithLeeway(jwt.Expected{
+		Issuer:      iss.conf.URL,
+		AnyAudience: jwt.Audience{iss.conf.Audience},
+	}, leeway); err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	for _, p := range iss.conf.Policies {
+		if !matches(p.Claims, claims) {
+			continue
+		}
+		grant := signer.Grant{
+			Username:    p.Username,
+			Principals:  p.Principals,
+			MaxValidity: DefaultMaxValidity,
+		}
+		if p.MaxValidity != "" {
+			if grant.MaxValidity, err = time.ParseDuration(p.MaxValidity); err != nil {
+				return nil, fmt.Errorf("invalid max_validity for %s: %w", p.Username, err)
+			}
+		}
+		return &Identity{Grant: grant, Claims: claims}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNotPermitted, std.Subject)
+}
+
+// matches reports whether every claim of a policy matches the token's claim.
+func matches(policy map[string]string, claims map[string]interface{}) bool {
+	if len(policy) == 0 {
+		return false
+	}
+	for name, pattern := range policy {
+		v, ok := claims[name]
+		if !ok {
+			return false
+		}
+		var s string
+		switch v := v.(type) {
+		case string:
+			s = v
+		case bool, float64:
+			s = fmt.Sprint(v)
+		default:
+			return false
+		}
+		if ok, _ := path.Match(pattern, s); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// keysFor returns the issuer's keys which may have signed a token with the
+// key ID. The keys are fetched again if they're stale, or if none match and
+// they weren't just fetched.
+func (i *issuer) keysFor(ctx context.Context, client *http.Client, kid string) ([]jose.JSONWebKey, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	find := func() []jose.JSONWebKey {
+		if i.keys == nil {
+			return nil
+		}
+		if kid == "" {
+			return i.keys.Keys
+		}
+		return i.keys.Key(kid)
+	}
+	keys := find()
+	age := time.Since(i.fetched)
+	if age > keysTTL || (len(keys) == 0 && age > refreshInterval) {
+		set, err := fetchKeys(ctx, client, i.conf)
+		if err != nil {
+			if len(keys) > 0 {
+				return keys, nil
+			}
+			return nil, err
+		}
+		i.keys = set
+		i.fetched = time.Now()
+		keys = find()
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return keys, nil
+}
+
+// fetchKeys fetches an issuer's key set, from jwks_url or else the jwks_uri
+// of its OpenID configuration.
+func fetchKeys(ctx context.Context, client *http.Client, conf config.WorkloadIssuer) (*jose.JSONWebKeySet, error) {
+	jwksURL := conf.JWKSURL
+	if jwksURL == "" {
+		discovery := struct {
+			JWKSURI string `json:"jwks_uri"`
+		}{}
+		u := strings.TrimSuffix(conf.URL, "/") + "/.well-known/openid-configuration"
+		if err := getJSON(ctx, client, u, &discovery); err != nil {
+			return nil, fmt.Errorf("unable to read OpenID configuration of %s: %w", conf.URL, err)
+		}
+		if discovery.JWKSURI == "" {
+			return nil, fmt.Errorf("OpenID configuration of %s has no jwks_uri", conf.URL)
+		}
+		jwksURL = discovery.JWKSURI
+	}
+	set := &jose.JSONWebKeySet{}
+	if err := getJSON(ctx, client, jwksURL, set); err != nil {
+		return nil, fmt.Errorf("unable to fetch keys of %s: %w", conf.URL, err)
+	}
+	return set, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,173 @@
+package workload
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+
+	"github.com/cashier-go/cashier/server/config"
+)
+
+type testIssuer struct {
+	*httptest.Server
+	key     *ecdsa.PrivateKey
+	kid     string
+	fetches int
+}
+
+// newTestIssuer serves an OpenID configuration and key set.
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss := &testIssuer{key: key, kid: "key1"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": iss.URL, "jwks_uri": iss.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		iss.fetches++
+		json.NewEncoder(w).Encode(&jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: iss.key.Public(), KeyID: iss.kid, Algorithm: string(jose.ES256), Use: "sig"},
+		}})
+	})
+	iss.Server = httptest.NewServer(mux)
+	t.Cleanup(iss.Close)
+	return iss
+}
+
+func (iss *testIssuer) token(t *testing.T, key *ecdsa.PrivateKey, claims map[string]interface{}) string {
+	t.Helper()
+	sig, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", iss.kid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	std := jwt.Claims{
+		Issuer:   iss.URL,
+		Subject:  "repo:example/app:ref:refs/heads/main",
+		Audience: jwt.Audience{"cashier"},
+		IssuedAt: jwt.NewNumericDate(time.Now()),
+		Expiry:   jwt.NewNumericDate(time.Now().Add(5 * time.Minute)),
+	}
+	token, err := jwt.Signed(sig).Claims(std).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestVerify(t *testing.T) {
+	iss := newTestIssuer(t)
+	v := New(config.WorkloadIdentity{
+		Issuers: []config.WorkloadIssuer{{
+			URL:      iss.URL,
+			Audience: "cashier",
+			Policies: []config.WorkloadPolicy{
+				{
+					Username:    "deploy",
+					Claims:      map[string]string{"repository": "example/app", "ref": "refs/heads/main", "environment": "production"},
+					Principals:  []string{"deploy"},
+					MaxValidity: "15m",
+				},
+				{
+					Username: "ci",
+					Claims:   map[string]string{"repository": "example/*"},
+				},
+			},
+		}},
+	}, nil)
+	ctx := context.Background()
+
+	claims := map[string]interface{}{"repository": "example/app", "ref": "refs/heads/main", "environment": "production"}
+	id, err := v.Verify(ctx, iss.token(t, iss.key, claims))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Grant.Username != "deploy" || !reflect.DeepEqual(id.Grant.Principals, []string{"deploy"}) || id.Grant.MaxValidity != 15*time.Minute {
+		t.Errorf("Unexpected grant %+v", id.Grant)
+	}
+	if id.Claims["environment"] != "production" || id.Claims["sub"] != "repo:example/app:ref:refs/heads/main" {
+		t.Errorf("Unexpected claims %v", id.Claims)
+	}
+
+	claims = map[string]interface{}{"repository": "example/lib", "ref": "refs/heads/main"}
+	id, err = v.Verify(ctx, iss.token(t, iss.key, claims))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Grant.Username != "ci" || id.Grant.MaxValidity != DefaultMaxValidity {
+		t.Errorf("Unexpected grant %+v", id.Grant)
+	}
+
+	claims = map[string]interface{}{"repository": "other/app"}
+	if _, err := v.Verify(ctx, iss.token(t, iss.key, claims)); !errors.Is(err, ErrNotPermitted) {
+		t.Errorf("Expected ErrNotPermitted, got %v", err)
+	}
+	if iss.fetches != 1 {
+		t.Errorf("Expected the keys to be fetched once, got %d", iss.fetches)
+	}
+
+	forged, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if _, err := v.Verify(ctx, iss.token(t, forged, map[string]interface{}{"repository": "example/app"})); err == nil {
+		t.Error("Expected a token signed by another key to be rejected")
+	}
+	if _, err := v.Verify(ctx, "not.a.token"); err == nil {
+		t.Error("Expected an invalid token to be rejected")
+	}
+}
+
+func TestVerifyClaims(t *testing.T) {
+	iss := newTestIssuer(t)
+	v := New(config.WorkloadIdentity{
+		Issuers: []config.WorkloadIssuer{{
+			URL:      iss.URL,
+			Audience: "other",
+			JWKSURL:  iss.URL + "/keys",
+			Policies: []config.WorkloadPolicy{{Username: "ci", Claims: map[string]string{"repository": "example/*"}}},
+		}},
+	}, nil)
+	claims := map[string]interface{}{"repository": "example/app"}
+	if _, err := v.Verify(context.Background(), iss.token(t, iss.key, claims)); !errors.Is(err, jwt.ErrInvalidAudience) {
+		t.Errorf("Expected the wrong audience to be rejected, got %v", err)
+	}
+
+	other := newTestIssuer(t)
+	if _, err := v.Verify(context.Background(), other.token(t, other.key, claims)); err == nil {
+		t.Error("Expected a token from an untrusted issuer to be rejected")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	iss := newTestIssuer(t)
+	v := New(config.WorkloadIdentity{
+		Issuers: []config.WorkloadIssuer{{
+			URL:      iss.URL,
+			Audience: "cashier",
+			Policies: []config.WorkloadPolicy{{Username: "ci", Claims: map[string]string{"repository": "example/*"}}},
+		}},
+	}, nil)
+	claims := map[string]interface{}{"repository": "example/app"}
+	if _, err := v.Verify(context.Background(), iss.token(t, iss.key, claims)); err != nil {
+		t.Fatal(err)
+	}
+	iss.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	iss.kid = "key2"
+	v.issuers[iss.URL].fetched = time.Now().Add(-2 * refreshInterval)
+	if _, err := v.Verify(context.Background(), iss.token(t, iss.key, claims)); err != nil {
+		t.Errorf("Expected the keys to be fetched again for a new key: %v", err)
+	}
+}